@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Policy announcements ---
+// When the verification requirements change, /announce posts one of the prepared
+// announcements, optionally DMing it to the verified members it concerns too. The texts
+// are filled in from the current config when the command runs, so an announcement never
+// quotes an outdated domain list or limit. config.json can replace a text or add new
+// ones under "announcements".
+//
+// Texts may use {school}, {domain}, {allowed_domains}, {code_ttl}, {max_attempts},
+// {max_resends}, {school_count}, {welcome_channel} and {note}.
+
+const (
+	announceReverify = "reverify_required"
+	announceDomain   = "domain_added"
+	announcePolicy   = "policy_changed"
+
+	// Spaces out the DMs so a large guild doesn't run into Discord's DM rate limits
+	announceDMInterval = time.Second
+)
+
+var defaultAnnouncements = map[string]string{
+	announceReverify: "📢 **再認証のお願い**\n認証の要件が変わったため、{school}のメンバーの皆さんにもう一度認証をお願いしています. {welcome_channel} のボタンから、{allowed_domains} のメールアドレスで認証してください.{note}",
+	announceDomain:   "📢 **対応ドメインの追加**\n{school} (`{domain}`) のメールアドレスで認証できるようになりました. {welcome_channel} のボタンから認証してください.{note}",
+	announcePolicy:   "📢 **認証ルールの変更**\n認証に使えるメールアドレス: {allowed_domains}\n認証コードの有効期限: {code_ttl}\nコードの入力は{max_attempts}、メールの再送は{max_resends}です.{note}",
+}
+
+// Returns the announcement texts, config.json's over the defaults
+func announcementTemplates() map[string]string {
+	templates := make(map[string]string, len(defaultAnnouncements)+len(config.Announcements))
+	for name, text := range defaultAnnouncements {
+		templates[name] = text
+	}
+	for name, text := range config.Announcements {
+		templates[name] = text
+	}
+	return templates
+}
+
+func validateAnnouncements(announcements map[string]string) error {
+	for name, text := range announcements {
+		if strings.TrimSpace(text) == "" {
+			return fmt.Errorf("%s: text must not be empty", name)
+		}
+	}
+	return nil
+}
+
+func announceCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "announce",
+		Description:              "Post a prepared announcement about changed verification requirements (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "template", Description: "Which announcement", Required: true, Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionChannel, Name: "channel", Description: "Where to post it; the welcome channel if omitted", ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "The school it concerns; also limits the DMs", Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "note", Description: "Extra text added at the end"},
+			{Type: discordgo.ApplicationCommandOptionBoolean, Name: "dm", Description: "Also DM the verified members it concerns"},
+			{Type: discordgo.ApplicationCommandOptionBoolean, Name: "preview", Description: "Only show the text, without posting it"},
+		},
+	}
+}
+
+func handleAnnounceAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	opt := focusedOption(i)
+	if opt != nil && opt.Name == "school" {
+		handleSchoolAutocomplete(s, i)
+		return
+	}
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if isAdmin(i.Member) && opt != nil {
+		var names []string
+		for name := range announcementTemplates() {
+			if strings.Contains(name, strings.ToLower(opt.StringValue())) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if len(choices) == maxAutocompleteChoices {
+				break
+			}
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: name})
+		}
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		log.Printf("Failed to answer announcement autocomplete: %v", err)
+	}
+}
+
+func handleAnnounce(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	name := optionString(i, "template")
+	template, ok := announcementTemplates()[name]
+	if !ok {
+		respondError(s, i, "エラー: お知らせのテンプレートが見つかりません. 候補から選んでください.")
+		return
+	}
+	domain := ""
+	if school := optionString(i, "school"); school != "" {
+		if domain, ok = resolveSchool(school); !ok {
+			respondError(s, i, "エラー: 学校が見つかりません. 候補から選んでください.")
+			return
+		}
+	}
+	channelID := config.welcomeChannelFor(i.GuildID)
+	dm, preview := false, false
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "channel":
+			channelID = opt.ChannelValue(nil).ID
+		case "dm":
+			dm = opt.BoolValue()
+		case "preview":
+			preview = opt.BoolValue()
+		}
+	}
+	text := expandAnnouncement(template, i.GuildID, domain, optionString(i, "note"))
+	if preview {
+		respondEphemeral(s, i, "👀 プレビュー (投稿されていません)\n\n"+text)
+		return
+	}
+
+	if _, err := sendText(s, channelID, text); err != nil {
+		respondWithErrorRef(s, i, "エラー: お知らせを投稿できませんでした. チャンネルの権限を確認してください.", "Failed to post announcement", err)
+		return
+	}
+	userID := interactionUser(i).ID
+	log.Printf("Announcement %s posted in %s by %s", name, channelID, userID)
+	message := fmt.Sprintf("📢 <#%s> にお知らせを投稿しました.", channelID)
+	if dm {
+		members := store.verifiedMembersOf(i.GuildID, domain)
+		go sendAnnouncementDMs(s, name, text, members)
+		message += fmt.Sprintf(" 対象の認証済みメンバー%d人に順にDMを送信します.", len(members))
+	}
+	respondEphemeral(s, i, message)
+}
+
+// Fills in an announcement from the guild's current config
+func expandAnnouncement(template, guild, domain, note string) string {
+	policy := config.policyFor(guild)
+	school := "全校"
+	if domain != "" {
+		school = schoolName(domain)
+	}
+	codeTTL := "次に /verify を実行するまで"
+	if policy.CodeTTL.Duration > 0 {
+		codeTTL = policy.CodeTTL.Duration.String()
+	}
+	if note != "" {
+		note = "\n" + note
+	}
+	return strings.NewReplacer(
+		"{school}", school,
+		"{domain}", domain,
+		"{allowed_domains}", config.emailRulesFor(guild).describe(),
+		"{code_ttl}", codeTTL,
+		"{max_attempts}", limitText(policy.MaxAttempts),
+		"{max_resends}", limitText(policy.MaxResends),
+		"{school_count}", fmt.Sprint(len(schools)),
+		"{welcome_channel}", "<#"+config.welcomeChannelFor(guild)+">",
+		"{note}", note,
+	).Replace(template)
+}
+
+func limitText(n int) string {
+	if n <= 0 {
+		return "無制限"
+	}
+	return fmt.Sprintf("%d回まで", n)
+}
+
+func sendAnnouncementDMs(s *discordgo.Session, name, text string, members []verifiedMember) {
+	sent, failed, unreachable := 0, 0, 0
+	for _, member := range members {
+		err := sendDirectMessage(s, member.UserID, text)
+		switch {
+		case errors.Is(err, errDMUnreachable):
+			unreachable++
+		case err != nil:
+			debugf("Failed to DM announcement to %s: %v", member.UserID, err)
+			failed++
+		default:
+			sent++
+		}
+		time.Sleep(announceDMInterval)
+	}
+	log.Printf("Announcement %s sent by DM to %d members (%d failed, %d not accepting DMs).", name, sent, failed, unreachable)
+	alertAdmins(s, fmt.Sprintf("📢 お知らせ `%s` をDMで%d人に送信しました (失敗 %d人、DMを受け付けていない %d人).", name, sent, failed, unreachable))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Domain anomaly alerts ---
+// Every hour the verifications per email domain in the last window are compared with the
+// same domain's average over the preceding baseline_days. A domain far above its usual
+// volume is reported to the moderators: a sudden burst from one school is what leaked
+// addresses or a script working through a list look like.
+
+type DomainAnomalyConfig struct {
+	// Period the current volume is counted over
+	Window Duration `json:"window"`
+	// Days before the window the baseline is averaged over
+	BaselineDays int `json:"baseline_days"`
+	// How many times the baseline counts as a spike
+	Factor float64 `json:"factor"`
+	// Fewest verifications in the window worth an alert; 0 turns the alerts off
+	MinCount int `json:"min_count"`
+}
+
+func defaultDomainAnomalyConfig() DomainAnomalyConfig {
+	return DomainAnomalyConfig{
+		Window:       Duration{24 * time.Hour},
+		BaselineDays: 14,
+		Factor:       4,
+		MinCount:     10,
+	}
+}
+
+func (c DomainAnomalyConfig) validate() error {
+	if c.MinCount < 0 {
+		return fmt.Errorf("min_count must not be negative")
+	}
+	if c.MinCount > 0 && (c.Window.Duration <= 0 || c.BaselineDays <= 0 || c.Factor <= 1) {
+		return fmt.Errorf("window and baseline_days must be positive and factor greater than 1")
+	}
+	return nil
+}
+
+var domainAnomalyCounter = newCounter("kosen_verify_domain_anomalies_total", "Verification spikes reported per email domain.", "domain")
+
+var (
+	// When each domain was last reported, so a spike is reported once per window
+	lastDomainAlert      = make(map[string]time.Time)
+	lastDomainAlertMutex = &sync.Mutex{}
+)
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:        "domain_anomalies",
+		Description: "Alerts moderators when one domain verifies far more than usual",
+		DefaultCron: "0 * * * *",
+		Run:         runDomainAnomalyCheck,
+	})
+}
+
+type domainAnomaly struct {
+	Domain   string
+	Count    int
+	Baseline float64
+}
+
+// Returns the domains whose volume in the window ending at now is a spike
+func findDomainAnomalies(cfg DomainAnomalyConfig, now time.Time) []domainAnomaly {
+	windowStart := now.Add(-cfg.Window.Duration)
+	baselineStart := windowStart.AddDate(0, 0, -cfg.BaselineDays)
+	current := store.verifiedByDomain(windowStart, now)
+	past := store.verifiedByDomain(baselineStart, windowStart)
+	windows := float64(windowStart.Sub(baselineStart)) / float64(cfg.Window.Duration)
+
+	var anomalies []domainAnomaly
+	for domain, n := range current {
+		if n < cfg.MinCount {
+			continue
+		}
+		baseline := float64(past[domain]) / windows
+		if float64(n) >= cfg.Factor*baseline {
+			anomalies = append(anomalies, domainAnomaly{Domain: domain, Count: n, Baseline: baseline})
+		}
+	}
+	return anomalies
+}
+
+func runDomainAnomalyCheck(s *discordgo.Session) error {
+	cfg := config.DomainAnomaly
+	if cfg.MinCount <= 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, a := range findDomainAnomalies(cfg, now) {
+		lastDomainAlertMutex.Lock()
+		recent := now.Sub(lastDomainAlert[a.Domain]) < cfg.Window.Duration
+		if !recent {
+			lastDomainAlert[a.Domain] = now
+		}
+		lastDomainAlertMutex.Unlock()
+		if recent {
+			continue
+		}
+
+		domainAnomalyCounter.inc(a.Domain)
+		log.Printf("Verification spike for %s: %d in %s, baseline %.1f", a.Domain, a.Count, cfg.Window.Duration, a.Baseline)
+		alertModerators(s, fmt.Sprintf("📈 %s (`%s`) の認証が直近%.0f時間で%d件あり、通常 (平均%.1f件) を大きく上回っています. アドレスの流出や自動化された不正の可能性があるため、最近の認証を確認してください.",
+			schoolName(a.Domain), a.Domain, cfg.Window.Hours(), a.Count, a.Baseline))
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Partner API ---
+// A small read-only REST API on WEB_ADDR for community tools (e.g. a club bot checking
+// whether a member is verified). Every request needs an API key issued with /apikey.
+// Keys carry scopes and a per-minute rate limit; only a hash of the secret is stored,
+// so a key that is lost has to be revoked and issued again.
+
+const (
+	apiKeyPrefix = "kvb"
+
+	scopeMembersRead = "members:read"
+	scopeStatsRead   = "stats:read"
+
+	defaultAPIRateLimit = 60 // requests per minute
+
+	// How often the usage counted in memory is written to the store
+	apiUsageFlushInterval = 5 * time.Minute
+)
+
+var knownAPIScopes = []string{scopeMembersRead, scopeStatsRead}
+
+type apiKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+	// Requests per minute
+	RateLimit  int       `json:"rate_limit"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	Uses       int       `json:"uses"`
+}
+
+func (k *apiKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var apiRequestsCounter = newCounter("kosen_verify_api_requests_total", "Partner API requests by key and status code.", "key", "status")
+
+// Issues a key and returns its secret, which is shown once and never stored.
+// Keys look like "kvb.<id>.<secret>" so the ID can be looked up without scanning every hash.
+func createAPIKey(name string, scopes []string, rateLimit int, createdBy string) (key apiKey, secret string, err error) {
+	id := make([]byte, 4)
+	raw := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return key, "", err
+	}
+	if _, err := rand.Read(raw); err != nil {
+		return key, "", err
+	}
+	key = apiKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Hash:      hashAPISecret(hex.EncodeToString(raw)),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+	if err := store.putAPIKey(key); err != nil {
+		return key, "", err
+	}
+	return key, apiKeyPrefix + "." + key.ID + "." + hex.EncodeToString(raw), nil
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Looks up the key in an "Authorization: Bearer kvb.<id>.<secret>" header
+func authenticateAPIKey(header string) (apiKey, bool) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return apiKey{}, false
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return apiKey{}, false
+	}
+	key, ok := store.apiKey(parts[1])
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPISecret(parts[2]))) != 1 {
+		return apiKey{}, false
+	}
+	return key, true
+}
+
+// Fixed one-minute windows per key
+var (
+	apiWindows     = make(map[string]apiWindow)
+	apiWindowMutex = &sync.Mutex{}
+)
+
+type apiWindow struct {
+	Start time.Time
+	Count int
+}
+
+// Usage of each key since the last flush; writing the store on every request would let
+// anyone holding a key force a rewrite of the state file at the rate limit
+var (
+	apiUsage      = make(map[string]apiKeyUsage)
+	apiUsageMutex = &sync.Mutex{}
+)
+
+type apiKeyUsage struct {
+	Uses     int
+	LastUsed time.Time
+}
+
+func countAPIKeyUse(id string, at time.Time) {
+	apiUsageMutex.Lock()
+	defer apiUsageMutex.Unlock()
+	u := apiUsage[id]
+	u.Uses++
+	u.LastUsed = at
+	apiUsage[id] = u
+}
+
+// Adds the usage counted since the last flush to the stored keys
+func flushAPIKeyUsage() {
+	apiUsageMutex.Lock()
+	usage := apiUsage
+	apiUsage = make(map[string]apiKeyUsage)
+	apiUsageMutex.Unlock()
+	if len(usage) == 0 {
+		return
+	}
+	if err := store.addAPIKeyUsage(usage); err != nil {
+		log.Printf("Failed to record API key use: %v", err)
+	}
+}
+
+func runAPIUsageFlusher() {
+	for range time.Tick(apiUsageFlushInterval) {
+		flushAPIKeyUsage()
+	}
+}
+
+func allowAPIRequest(key apiKey, now time.Time) bool {
+	apiWindowMutex.Lock()
+	defer apiWindowMutex.Unlock()
+	w := apiWindows[key.ID]
+	if now.Sub(w.Start) >= time.Minute {
+		w = apiWindow{Start: now}
+	}
+	if w.Count >= key.RateLimit {
+		return false
+	}
+	w.Count++
+	apiWindows[key.ID] = w
+	return true
+}
+
+// Wraps an API handler with authentication, the scope check, rate limiting and usage logging
+func apiHandler(scope string, next func(w http.ResponseWriter, r *http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		key, ok := authenticateAPIKey(r.Header.Get("Authorization"))
+		if !ok {
+			apiRequestsCounter.inc("", strconv.Itoa(http.StatusUnauthorized))
+			writeAPIError(w, http.StatusUnauthorized, "invalid or missing API key")
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case !key.allows(scope):
+			status = http.StatusForbidden
+			writeAPIError(w, status, "this key lacks the "+scope+" scope")
+		case !allowAPIRequest(key, time.Now()):
+			status = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", "60")
+			writeAPIError(w, status, "rate limit exceeded")
+		default:
+			status = next(w, r)
+			// Rejected requests aren't uses of the key
+			countAPIKeyUse(key.ID, time.Now())
+		}
+
+		apiRequestsCounter.inc(key.ID, strconv.Itoa(status))
+		log.Printf("API %s %s by key %s (%s): %d", r.Method, r.URL.Path, key.ID, key.Name, status)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func registerAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/members/{id}", apiHandler(scopeMembersRead, handleAPIMember))
+	mux.HandleFunc("GET /api/v1/stats", apiHandler(scopeStatsRead, handleAPIStats))
+}
+
+// Whether a Discord user is verified, and with which school. Emails are never exposed.
+func handleAPIMember(w http.ResponseWriter, r *http.Request) int {
+	member, ok := store.isVerified(r.PathValue("id"))
+	if !ok {
+		_, waitlisted := store.verifiedMember(r.PathValue("id"))
+		json.NewEncoder(w).Encode(map[string]any{"user_id": r.PathValue("id"), "verified": false, "waitlisted": waitlisted})
+		return http.StatusOK
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"user_id":     member.UserID,
+		"verified":    true,
+		"guild_id":    member.GuildID,
+		"domain":      member.Domain,
+		"school":      schoolName(member.Domain),
+		"verified_at": member.VerifiedAt,
+	})
+	return http.StatusOK
+}
+
+// Funnel totals for the last ?days= days (default 7)
+func handleAPIStats(w http.ResponseWriter, r *http.Request) int {
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxExportDays {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxExportDays))
+			return http.StatusBadRequest
+		}
+		days = n
+	}
+	since := localNow().AddDate(0, 0, -days+1).Format(statsDateFormat)
+	json.NewEncoder(w).Encode(map[string]any{"days": days, "since": since, "counts": store.funnelTotals(since)})
+	return http.StatusOK
+}
+
+func apiKeyCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minRate := 1.0
+	return &discordgo.ApplicationCommand{
+		Name:                     "apikey",
+		Description:              "Manage API keys for partner integrations (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "action", Description: "What to do", Required: true, Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "create", Value: "create"},
+				{Name: "revoke", Value: "revoke"},
+				{Name: "list", Value: "list"},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "name", Description: "Who the key is for (create)"},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "scopes", Description: "Comma-separated: " + strings.Join(knownAPIScopes, ", ") + " (create)"},
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "rate_limit", Description: "Requests per minute, default 60 (create)", MinValue: &minRate, MaxValue: 6000},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "id", Description: "Key ID (revoke)"},
+		},
+	}
+}
+
+func handleAPIKey(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	switch optionString(i, "action") {
+	case "create":
+		name := strings.TrimSpace(optionString(i, "name"))
+		if name == "" {
+			respondError(s, i, "エラー: name を指定してください.")
+			return
+		}
+		scopes, err := parseAPIScopes(optionString(i, "scopes"))
+		if err != nil {
+			respondError(s, i, "エラー: "+err.Error())
+			return
+		}
+		rateLimit := defaultAPIRateLimit
+		for _, opt := range i.ApplicationCommandData().Options {
+			if opt.Name == "rate_limit" {
+				rateLimit = int(opt.IntValue())
+			}
+		}
+		key, secret, err := createAPIKey(name, scopes, rateLimit, interactionUser(i).ID)
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: APIキーの作成に失敗しました.", "Failed to create API key", err)
+			return
+		}
+		log.Printf("API key %s (%s) created by %s with scopes %v", key.ID, key.Name, key.CreatedBy, key.Scopes)
+		message := fmt.Sprintf("APIキー `%s` を作成しました. このキーは二度と表示されないので、安全な場所に保存してください.\n```\n%s\n```", key.ID, secret)
+		if webAddr == "" {
+			message += "\n⚠️ WEB_ADDR が未設定のため、APIはまだ利用できません."
+		}
+		respondEphemeral(s, i, message)
+	case "revoke":
+		id := strings.TrimSpace(optionString(i, "id"))
+		revoked, err := store.revokeAPIKey(id)
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: APIキーの削除に失敗しました.", "Failed to revoke API key", err)
+			return
+		}
+		if !revoked {
+			respondError(s, i, fmt.Sprintf("エラー: APIキー `%s` は見つかりませんでした.", id))
+			return
+		}
+		log.Printf("API key %s revoked by %s", id, interactionUser(i).ID)
+		respondEphemeral(s, i, fmt.Sprintf("APIキー `%s` を無効にしました.", id))
+	default:
+		flushAPIKeyUsage()
+		keys := store.apiKeys()
+		if len(keys) == 0 {
+			respondEphemeral(s, i, "APIキーはありません.")
+			return
+		}
+		var lines []string
+		for _, key := range keys {
+			lastUsed := "未使用"
+			if !key.LastUsedAt.IsZero() {
+				lastUsed = fmt.Sprintf("<t:%d:R>", key.LastUsedAt.Unix())
+			}
+			lines = append(lines, fmt.Sprintf("`%s` %s — %s, %d回/分, %d回使用, 最終使用 %s",
+				key.ID, key.Name, strings.Join(key.Scopes, ", "), key.RateLimit, key.Uses, lastUsed))
+		}
+		respondEphemeral(s, i, strings.Join(lines, "\n"))
+	}
+}
+
+func parseAPIScopes(value string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		known := false
+		for _, k := range knownAPIScopes {
+			known = known || k == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("不明なスコープ %q です. 使用できるのは %s です.", scope, strings.Join(knownAPIScopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("scopes を1つ以上指定してください (%s).", strings.Join(knownAPIScopes, ", "))
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Appeals ---
+
+const (
+	appealModalID        = "appeal_modal"
+	appealReasonInputID  = "appeal_reason"
+	appealApprovePrefix  = "appeal_approve:"
+	appealDenyPrefix     = "appeal_deny:"
+	appealReasonMaxChars = 1000
+)
+
+var (
+	// Users with an appeal that has not been decided yet
+	pendingAppeals = make(map[string]bool)
+	appealMutex    = &sync.Mutex{}
+)
+
+func handleAppeal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if modChannelID == "" || !featureEnabled(guildOrDefault(i), featureAppeals) {
+		respondError(s, i, "エラー: 現在このサーバーでは申し立てを受け付けていません.")
+		return
+	}
+
+	appealMutex.Lock()
+	alreadyPending := pendingAppeals[interactionUser(i).ID]
+	appealMutex.Unlock()
+	if alreadyPending {
+		respondEphemeral(s, i, "既に申し立てを受け付けています. 管理者の判断をお待ちください.")
+		return
+	}
+
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: appealModalID,
+			Title:    "認証に関する申し立て",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:    appealReasonInputID,
+						Label:       "申し立ての理由",
+						Style:       discordgo.TextInputParagraph,
+						Placeholder: "例: 学校のメールアドレスがまだ発行されていません.",
+						Required:    true,
+						MaxLength:   appealReasonMaxChars,
+					},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to open appeal modal: %v", err)
+	}
+}
+
+func handleAppealSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	user := interactionUser(i)
+	reason := modalValue(i.ModalSubmitData(), appealReasonInputID)
+
+	appealMutex.Lock()
+	if pendingAppeals[user.ID] {
+		appealMutex.Unlock()
+		respondEphemeral(s, i, "既に申し立てを受け付けています. 管理者の判断をお待ちください.")
+		return
+	}
+	pendingAppeals[user.ID] = true
+	appealMutex.Unlock()
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "認証の申し立て",
+		Description: reason,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "ユーザー", Value: fmt.Sprintf("<@%s> (%s)", user.ID, user.Username)},
+		},
+		Color: 0xFEE75C,
+	}
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "承認", Style: discordgo.SuccessButton, CustomID: appealApprovePrefix + user.ID},
+			discordgo.Button{Label: "却下", Style: discordgo.DangerButton, CustomID: appealDenyPrefix + user.ID},
+		}},
+	}
+
+	_, err := sendMessage(s, modChannelID, &discordgo.MessageSend{Embed: embed, Components: components})
+	if err != nil {
+		appealMutex.Lock()
+		delete(pendingAppeals, user.ID)
+		appealMutex.Unlock()
+		respondWithErrorRef(s, i, "エラー: 申し立ての送信に失敗しました. 時間をおいてお試しください.", "Failed to post appeal to mod channel", err)
+		return
+	}
+
+	respondEphemeral(s, i, "申し立てを受け付けました. 管理者が確認し次第、DMで結果をお知らせします.")
+}
+
+// Handles the Approve/Deny buttons on an appeal ticket in the mod channel
+func handleAppealDecision(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !hasManageRoles(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	customID := i.MessageComponentData().CustomID
+	approved := strings.HasPrefix(customID, appealApprovePrefix)
+	targetID := strings.TrimPrefix(strings.TrimPrefix(customID, appealApprovePrefix), appealDenyPrefix)
+
+	var outcome, dm string
+	if approved {
+		domain, ok := attemptedDomain(targetID)
+		if !ok {
+			respondError(s, i, fmt.Sprintf("エラー: <@%s> がどの学校の生徒か分かりません. `/approve` で学校を指定して承認してください.", targetID))
+			return
+		}
+		member, err := s.GuildMember(i.GuildID, targetID)
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: メンバー情報を取得できませんでした. ユーザーがサーバーを退出している可能性があります.", "Failed to fetch member for approved appeal", err)
+			return
+		}
+		// The school's cap and probation apply as they do to email verification. Nothing is
+		// recorded if the roles can't be granted, and the ticket stays open to be decided again.
+		result, err := admitMember(s, member, verifiedMember{UserID: targetID, GuildID: i.GuildID, Domain: domain, Method: verifiedByAppeal})
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: ロールの付与に失敗しました. ユーザーがサーバーを退出している可能性があります.", "Failed to add roles for approved appeal", err)
+			return
+		}
+		outcome = fmt.Sprintf("✅ <@%s> により承認されました.", interactionUser(i).ID)
+		switch {
+		case result.Waitlisted:
+			outcome += fmt.Sprintf(" %sの参加枠が埋まっているため、順番待ちに登録しました.", schoolName(domain))
+			dm = "あなたの申し立ては承認されましたが、学校の参加枠が埋まっているため順番待ちに登録されました. 参加できるようになり次第お知らせします."
+		case result.Probation > 0:
+			dm = "あなたの申し立ては承認されました. 試用期間が終わると、すべてのロールが付与されます."
+		default:
+			dm = "あなたの申し立ては承認され、学生ロールが付与されました."
+		}
+	} else {
+		outcome = fmt.Sprintf("❌ <@%s> により却下されました.", interactionUser(i).ID)
+		dm = "申し立てを確認しましたが、今回は承認されませんでした. ご不明な点は管理者までお問い合わせください."
+	}
+
+	appealMutex.Lock()
+	delete(pendingAppeals, targetID)
+	appealMutex.Unlock()
+
+	// Replace the buttons with the decision so the ticket can't be decided twice
+	var embeds []*discordgo.MessageEmbed
+	if len(i.Message.Embeds) > 0 {
+		embed := i.Message.Embeds[0]
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "結果", Value: outcome})
+		if approved {
+			embed.Color = 0x57F287
+		} else {
+			embed.Color = 0xED4245
+		}
+		embeds = []*discordgo.MessageEmbed{embed}
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Embeds: embeds, Components: []discordgo.MessageComponent{}},
+	})
+	if err != nil {
+		log.Printf("Failed to update appeal ticket: %v", err)
+	}
+
+	if err := notifyUser(s, targetID, dm); err != nil {
+		log.Printf("Failed to notify user %s of appeal outcome: %v", targetID, err)
+	}
+}
+
+// Returns the school a user was trying to verify for: the domain of the address they
+// entered, or of the school they are waitlisted at
+func attemptedDomain(userID string) (string, bool) {
+	verificationMutex.Lock()
+	data, ok := pendingVerifications[userID]
+	verificationMutex.Unlock()
+	if ok && data.Email != "" {
+		return emailDomain(data.Email), true
+	}
+	if record, ok := store.verifiedMember(userID); ok && record.Domain != "" {
+		return record.Domain, true
+	}
+	return "", false
+}
+
+// Returns the value of the text input with the given custom ID in a submitted modal
+func modalValue(data discordgo.ModalSubmitInteractionData, customID string) string {
+	for _, row := range data.Components {
+		actionsRow, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, component := range actionsRow.Components {
+			if input, ok := component.(*discordgo.TextInput); ok && input.CustomID == customID {
+				return input.Value
+			}
+		}
+	}
+	return ""
+}
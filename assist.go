@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- /assist ---
+// Lets an admin open a member's verification channel to a moderator role while helping
+// them, without editing channel permissions by hand. The access is revoked with
+// /assist state:off or automatically once the member is verified.
+
+func assistCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "assist",
+		Description:              "Give a moderator role access to a member's verification channel (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "Member being verified", Required: true},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "state", Description: "Grant or revoke access (default on)", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: featureStateOn, Value: featureStateOn},
+				{Name: featureStateOff, Value: featureStateOff},
+			}},
+			{Type: discordgo.ApplicationCommandOptionRole, Name: "role", Description: "Role to give access (default DISCORD_MODERATOR_ROLE_ID)"},
+		},
+	}
+}
+
+func handleAssist(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	var userID string
+	roleID := moderatorRoleID
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "user":
+			userID = opt.UserValue(nil).ID
+		case "role":
+			roleID = opt.RoleValue(nil, "").ID
+		}
+	}
+	if roleID == "" {
+		respondError(s, i, "エラー: DISCORD_MODERATOR_ROLE_ID が未設定のため、role を指定してください.")
+		return
+	}
+	channels := store.verificationChannelsOf(userID)
+	if len(channels) == 0 {
+		respondError(s, i, fmt.Sprintf("エラー: <@%s> の認証チャンネルはありません.", userID))
+		return
+	}
+
+	on := optionString(i, "state") != featureStateOff
+	var failed []string
+	for _, channelID := range channels {
+		if err := setAssistAccess(s, channelID, roleID, on); err != nil {
+			log.Printf("Failed to change assist access to %s for role %s: %v", channelID, roleID, err)
+			failed = append(failed, "<#"+channelID+">")
+		}
+	}
+	log.Printf("Assist access for role %s to %s's channels set to %v by %s", roleID, userID, on, interactionUser(i).ID)
+
+	if len(failed) > 0 {
+		respondError(s, i, "エラー: 次のチャンネルの権限を変更できませんでした: "+strings.Join(failed, ", "))
+		return
+	}
+	if on {
+		respondEphemeral(s, i, fmt.Sprintf("<@&%s> が <@%s> の認証チャンネルを閲覧できるようにしました. 認証が完了すると自動的に解除されます.", roleID, userID))
+	} else {
+		respondEphemeral(s, i, fmt.Sprintf("<@&%s> の <@%s> の認証チャンネルへのアクセスを解除しました.", roleID, userID))
+	}
+}
+
+func setAssistAccess(s *discordgo.Session, channelID, roleID string, on bool) error {
+	var err error
+	if on {
+		err = s.ChannelPermissionSet(channelID, roleID, discordgo.PermissionOverwriteTypeRole,
+			discordgo.PermissionViewChannel|discordgo.PermissionSendMessages|discordgo.PermissionReadMessageHistory, 0)
+	} else {
+		err = s.ChannelPermissionDelete(channelID, roleID)
+	}
+	if err != nil {
+		return err
+	}
+	return store.setChannelAssist(channelID, roleID, on)
+}
+
+// Revokes every /assist access to a member's verification channels, once they no longer need help
+func revokeAssistAccess(s *discordgo.Session, userID string) {
+	for _, channelID := range store.verificationChannelsOf(userID) {
+		for _, roleID := range store.channelAssistRoles(channelID) {
+			if err := setAssistAccess(s, channelID, roleID, false); err != nil {
+				log.Printf("Failed to revoke assist access to %s for role %s: %v", channelID, roleID, err)
+			}
+		}
+	}
+}
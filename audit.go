@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Interaction audit log ---
+// Every routed interaction is logged as one JSON record. With AUDIT_LOG_FILE set the
+// records are also appended to that file (JSON Lines), which /audit searches so admins
+// can see who did what without digging through the process log. Option values are left
+// out on purpose: they contain email addresses and codes.
+
+const (
+	outcomeOK    = "ok"
+	outcomeError = "error"
+	outcomePanic = "panic"
+
+	auditDefaultLimit = 20
+)
+
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Interaction string    `json:"interaction"`
+	Kind        string    `json:"kind"`
+	// Command name, or the registered custom ID prefix for components and modals
+	Name      string `json:"name"`
+	CustomID  string `json:"custom_id,omitempty"`
+	UserID    string `json:"user_id"`
+	GuildID   string `json:"guild_id,omitempty"`
+	ChannelID string `json:"channel_id"`
+	LatencyMS int64  `json:"latency_ms"`
+	Outcome   string `json:"outcome"`
+}
+
+var (
+	// Outcome of interactions that did not go well, keyed by interaction ID
+	failedInteractions sync.Map
+
+	auditFileMutex = &sync.Mutex{}
+)
+
+// Notes that the user was shown an error, so the audit record says so
+func markInteractionFailed(i *discordgo.InteractionCreate) {
+	failedInteractions.LoadOrStore(i.ID, outcomeError)
+}
+
+func newAuditRecord(rt route, i *discordgo.InteractionCreate, start time.Time) auditRecord {
+	rec := auditRecord{
+		Time:        start,
+		Interaction: i.ID,
+		Kind:        string(rt.kind),
+		Name:        rt.name,
+		UserID:      interactionUser(i).ID,
+		GuildID:     i.GuildID,
+		ChannelID:   i.ChannelID,
+		LatencyMS:   time.Since(start).Milliseconds(),
+		Outcome:     outcomeOK,
+	}
+	switch i.Type {
+	case discordgo.InteractionMessageComponent:
+		rec.CustomID = i.MessageComponentData().CustomID
+	case discordgo.InteractionModalSubmit:
+		rec.CustomID = i.ModalSubmitData().CustomID
+	}
+	if outcome, failed := failedInteractions.LoadAndDelete(i.ID); failed {
+		rec.Outcome = outcome.(string)
+	}
+	return rec
+}
+
+func writeAuditRecord(rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	log.Printf("AUDIT %s", line)
+	if auditLogFile == "" {
+		return
+	}
+	auditFileMutex.Lock()
+	defer auditFileMutex.Unlock()
+	f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// Returns the newest records matching the filters, newest first
+func searchAuditLog(userID, name string, limit int) ([]auditRecord, error) {
+	auditFileMutex.Lock()
+	defer auditFileMutex.Unlock()
+	f, err := os.Open(auditLogFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matches []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if (userID != "" && rec.UserID != userID) || (name != "" && rec.Name != name) {
+			continue
+		}
+		matches = append(matches, rec)
+		if len(matches) > limit {
+			matches = matches[1:]
+		}
+	}
+	for a, b := 0, len(matches)-1; a < b; a, b = a+1, b-1 {
+		matches[a], matches[b] = matches[b], matches[a]
+	}
+	return matches, scanner.Err()
+}
+
+func auditCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minLimit := 1.0
+	return &discordgo.ApplicationCommand{
+		Name:                     "audit",
+		Description:              "Search the interaction audit log (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "Only interactions by this user"},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "name", Description: "Only this command or custom ID prefix"},
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "limit", Description: "Number of records (default 20)", MinValue: &minLimit, MaxValue: 50},
+		},
+	}
+}
+
+func handleAudit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	if auditLogFile == "" {
+		respondError(s, i, "エラー: AUDIT_LOG_FILE が未設定のため、監査ログは保存されていません.")
+		return
+	}
+
+	var userID string
+	limit := auditDefaultLimit
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "user":
+			userID = opt.UserValue(nil).ID
+		case "limit":
+			limit = int(opt.IntValue())
+		}
+	}
+	records, err := searchAuditLog(userID, optionString(i, "name"), limit)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 監査ログを読み込めませんでした.", "Failed to search audit log", err)
+		return
+	}
+	if len(records) == 0 {
+		respondEphemeral(s, i, "該当する記録はありません.")
+		return
+	}
+
+	var lines []string
+	for _, rec := range records {
+		name := rec.Kind + ":" + rec.Name
+		if rec.CustomID != "" && rec.CustomID != rec.Name {
+			name += " (" + rec.CustomID + ")"
+		}
+		line := fmt.Sprintf("<t:%d:f> <@%s> `%s` %dms %s", rec.Time.Unix(), rec.UserID, name, rec.LatencyMS, rec.Outcome)
+		if rec.ChannelID != "" {
+			line += " <#" + rec.ChannelID + ">"
+		}
+		lines = append(lines, line)
+	}
+	// Stay within Discord's 2000 character limit
+	content := ""
+	for _, line := range lines {
+		if len(content)+len(line)+1 > 1900 {
+			content += "…"
+			break
+		}
+		content += line + "\n"
+	}
+	respondEphemeral(s, i, strings.TrimSpace(content))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Membership callbacks ---
+// Student councils keep their own membership lists, so every change of a member's
+// verification status can be POSTed to a configured URL. Events are written to an outbox
+// in the state file in the same save as the change itself, then delivered in order per
+// user and retried with a growing delay, so a restart or an outage of the receiving
+// system doesn't lose them. The receiver should treat the event ID as an idempotency key,
+// since an event may be delivered more than once.
+//
+// The body is signed with HMAC-SHA256 over "<timestamp>.<body>" using the secret in
+// MEMBERSHIP_CALLBACK_SECRET, which is required when a URL is set, sent as X-Kosen-Signature: sha256=<hex> along with the
+// timestamp in X-Kosen-Timestamp.
+//
+// Webhook success actions share the outbox: their events carry their own URL and are
+// otherwise signed, ordered and retried like the membership callbacks.
+
+const (
+	callbackVerified   = "verified"
+	callbackUnverified = "unverified"
+
+	callbackPollInterval = 30 * time.Second
+	maxCallbackDelay     = time.Hour
+)
+
+type CallbackConfig struct {
+	// Endpoint receiving the events; empty disables callbacks
+	URL string `json:"url"`
+	// Send the verified address too; off by default because the receiver rarely needs it
+	IncludeEmail bool `json:"include_email"`
+	// Attempts before an event is dropped and reported
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry, doubled on every further attempt up to an hour
+	RetryDelay Duration `json:"retry_delay"`
+}
+
+func defaultCallbackConfig() CallbackConfig {
+	return CallbackConfig{MaxAttempts: 10, RetryDelay: Duration{time.Minute}}
+}
+
+func (c CallbackConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	// An unsigned callback would let anyone who finds the URL forge membership changes
+	if membershipCallbackSecret == "" {
+		return fmt.Errorf("url is set but MEMBERSHIP_CALLBACK_SECRET is not")
+	}
+	if c.MaxAttempts <= 0 {
+		return fmt.Errorf("max_attempts must be positive")
+	}
+	if c.RetryDelay.Duration <= 0 {
+		return fmt.Errorf("retry_delay must be positive")
+	}
+	return nil
+}
+
+type callbackPayload struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	GuildID    string    `json:"guild_id"`
+	UserID     string    `json:"user_id"`
+	Domain     string    `json:"domain,omitempty"`
+	School     string    `json:"school,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Email      string    `json:"email,omitempty"`
+}
+
+type callbackEvent struct {
+	// Endpoint of a webhook success action; empty for the membership callback URL
+	URL         string          `json:"url,omitempty"`
+	Payload     callbackPayload `json:"payload"`
+	Attempts    int             `json:"attempts,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+var (
+	callbackKick = make(chan struct{}, 1)
+
+	callbacksCounter = newCounter("kosen_verify_membership_callbacks_total", "Membership callback deliveries, by result.", "result")
+)
+
+// Adds an event to the outbox; called from inside a store update so it is saved with the change
+func queueMembershipCallback(d *storeData, event string, member verifiedMember) {
+	if config.Callback.URL == "" {
+		return
+	}
+	payload, err := newCallbackPayload(event, member)
+	if err != nil {
+		log.Printf("Failed to generate callback event ID: %v", err)
+		return
+	}
+	if config.Callback.IncludeEmail {
+		payload.Email = member.Email
+	}
+	queueCallbackEvent(d, &callbackEvent{Payload: payload, NextAttempt: payload.OccurredAt})
+}
+
+func newCallbackPayload(event string, member verifiedMember) (callbackPayload, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return callbackPayload{}, err
+	}
+	payload := callbackPayload{
+		ID:         hex.EncodeToString(id),
+		Event:      event,
+		OccurredAt: time.Now(),
+		GuildID:    member.GuildID,
+		UserID:     member.UserID,
+		Domain:     member.Domain,
+		Method:     member.Method,
+	}
+	if member.Domain != "" {
+		payload.School = schoolName(member.Domain)
+	}
+	return payload, nil
+}
+
+func queueCallbackEvent(d *storeData, ev *callbackEvent) {
+	d.CallbackOutbox = append(d.CallbackOutbox, ev)
+	select {
+	case callbackKick <- struct{}{}:
+	default:
+	}
+}
+
+// Returns where the event is delivered
+func (ev callbackEvent) endpoint() string {
+	if ev.URL != "" {
+		return ev.URL
+	}
+	return config.Callback.URL
+}
+
+// Delivers outbox events as they are queued and retries the failed ones
+func runCallbackOutbox(s *discordgo.Session) {
+	ticker := time.NewTicker(callbackPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-callbackKick:
+		case <-ticker.C:
+		}
+		deliverCallbacks(s)
+	}
+}
+
+func deliverCallbacks(s *discordgo.Session) {
+	now := time.Now()
+	// A user's later events wait for their earlier ones, so each receiver sees them in order
+	blocked := make(map[string]bool)
+	for _, ev := range store.callbackOutbox() {
+		userID := ev.Payload.UserID
+		endpoint := ev.endpoint()
+		key := endpoint + " " + userID
+		if blocked[key] {
+			continue
+		}
+		// Membership events wait while the callback URL is unset
+		if endpoint == "" || ev.NextAttempt.After(now) {
+			blocked[key] = true
+			continue
+		}
+
+		err := postCallback(endpoint, ev.Payload)
+		if err == nil {
+			callbacksCounter.inc("delivered")
+			if err := store.removeCallback(ev.Payload.ID); err != nil {
+				log.Printf("Failed to remove delivered callback: %v", err)
+			}
+			continue
+		}
+
+		ev.Attempts++
+		ev.LastError = err.Error()
+		log.Printf("Failed to deliver %s callback for user %s (attempt %d): %v", ev.Payload.Event, userID, ev.Attempts, err)
+		if ev.Attempts >= config.Callback.MaxAttempts {
+			callbacksCounter.inc("dropped")
+			alertAdmins(s, fmt.Sprintf("⚠️ <@%s> の会員連携通知 (`%s`) を%d回送信できなかったため、破棄しました. 連携先で手動で反映してください: `%v`",
+				userID, ev.Payload.Event, ev.Attempts, err))
+			if err := store.removeCallback(ev.Payload.ID); err != nil {
+				log.Printf("Failed to remove dropped callback: %v", err)
+			}
+			continue
+		}
+		callbacksCounter.inc("failed")
+		delay := config.Callback.RetryDelay.Duration << (ev.Attempts - 1)
+		if delay <= 0 || delay > maxCallbackDelay {
+			delay = maxCallbackDelay
+		}
+		ev.NextAttempt = now.Add(delay)
+		if err := store.putCallback(ev); err != nil {
+			log.Printf("Failed to reschedule callback: %v", err)
+		}
+		blocked[key] = true
+	}
+}
+
+func postCallback(endpoint string, payload callbackPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Kosen-Event-ID", payload.ID)
+	req.Header.Set("X-Kosen-Timestamp", timestamp)
+	req.Header.Set("X-Kosen-Signature", "sha256="+signCallback(timestamp, body))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func signCallback(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(membershipCallbackSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Capacity limits ---
+// Upper bounds on pending verifications and open verification channels, so a spike can't
+// grow memory without limit or run the guild into Discord's 500 channel cap. New starts
+// beyond a limit are turned away with a "try again in a few minutes"; users already in
+// the middle of verifying are not affected.
+
+type CapacityConfig struct {
+	// Users waiting to enter a code; 0 means unlimited
+	MaxPending int `json:"max_pending"`
+	// Verification channels open at the same time; 0 means unlimited
+	MaxChannels int `json:"max_channels"`
+}
+
+func (c CapacityConfig) validate() error {
+	if c.MaxPending < 0 || c.MaxChannels < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+const (
+	capacityPending  = "pending"
+	capacityChannels = "channels"
+)
+
+var capacityRejections = newCounter("kosen_verify_capacity_rejections_total", "Verification starts turned away because a capacity limit was reached.", "limit")
+
+// Formats a count with its limit, if there is one
+func capacityUsage(n, limit int, unit string) string {
+	if limit <= 0 {
+		return fmt.Sprintf("%d%s", n, unit)
+	}
+	return fmt.Sprintf("%d%s (上限 %d%s)", n, unit, limit, unit)
+}
+
+// Turns the user away if another verification channel would exceed max_channels
+func respondIfChannelsFull(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	limit := config.Capacity.MaxChannels
+	if limit <= 0 || store.verificationChannelCount() < limit {
+		return false
+	}
+	capacityRejections.inc(capacityChannels)
+	respondEphemeral(s, i, localized(i, msgBusy))
+	return true
+}
+
+// Turns the user away if a new pending verification would exceed max_pending.
+// Someone who already has a code pending only replaces it, so they always get through.
+func respondIfPendingFull(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	limit := config.Capacity.MaxPending
+	if limit <= 0 {
+		return false
+	}
+	verificationMutex.Lock()
+	_, replacing := pendingVerifications[interactionUser(i).ID]
+	full := !replacing && len(pendingVerifications) >= limit
+	verificationMutex.Unlock()
+	if !full {
+		return false
+	}
+	capacityRejections.inc(capacityPending)
+	respondEphemeral(s, i, localized(i, msgBusy))
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification channel categories ---
+// Discord allows at most 50 channels per category. New verification channels go into the
+// first category with room, starting with DISCORD_PRIVATE_CATEGORY_ID, and are moved to
+// their school's category (category_id in roles.json) once the student enters an address.
+// If no configured category exists, channels are created at the top of the guild; their
+// overwrites keep them private either way, and the admins are told to fix the setting.
+
+const maxChannelsPerCategory = 50
+
+// How often admins are reminded that the category is missing
+const missingCategoryAlertInterval = time.Hour
+
+// Unix time of the last missing category alert
+var lastMissingCategoryAlert atomic.Int64
+
+// Reports whether the category exists
+func categoryExists(s *discordgo.Session, categoryID string) bool {
+	channel, err := cachedChannel(s, categoryID)
+	return err == nil && channel.Type == discordgo.ChannelTypeGuildCategory
+}
+
+func alertMissingCategory(s *discordgo.Session, reason string) {
+	now := time.Now()
+	last := lastMissingCategoryAlert.Load()
+	if now.Sub(time.Unix(last, 0)) < missingCategoryAlertInterval || !lastMissingCategoryAlert.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	log.Printf("Creating verification channels at the guild root: %s", reason)
+	alertAdmins(s, fmt.Sprintf("⚠️ %s. 認証チャンネルをカテゴリの外に作成しています. `DISCORD_PRIVATE_CATEGORY_ID` と `overflow_categories` を確認してください.", reason))
+}
+
+// Reports whether creating a channel failed because its parent category is gone or
+// invalid, as opposed to rate limits, missing permissions and the like
+func isMissingCategoryError(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Message == nil {
+		return false
+	}
+	switch restErr.Message.Code {
+	case discordgo.ErrCodeUnknownChannel:
+		return true
+	case discordgo.ErrCodeInvalidFormBody:
+		return bytes.Contains(restErr.ResponseBody, []byte(`"parent_id"`))
+	}
+	return false
+}
+
+// Counts the channels in a category
+func categoryChannelCount(s *discordgo.Session, categoryID string) int {
+	channels, err := cachedGuildChannels(s, guildID)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, channel := range channels {
+		if channel.ParentID == categoryID {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the category a new verification channel should be created in, or "" for the guild root
+func verificationCategory(s *discordgo.Session) string {
+	candidates := append([]string{privateCategoryID}, config.OverflowCategories...)
+	var existing []string
+	for _, categoryID := range candidates {
+		if categoryID == "" || !categoryExists(s, categoryID) {
+			continue
+		}
+		if categoryChannelCount(s, categoryID) < maxChannelsPerCategory {
+			return categoryID
+		}
+		existing = append(existing, categoryID)
+	}
+	if len(existing) == 0 {
+		if privateCategoryID == "" {
+			alertMissingCategory(s, "DISCORD_PRIVATE_CATEGORY_ID が設定されていません")
+		} else {
+			alertMissingCategory(s, fmt.Sprintf("認証チャンネル用のカテゴリ `%s` が見つかりません", privateCategoryID))
+		}
+		return ""
+	}
+	log.Printf("All verification categories are full, creating the channel in %s anyway.", existing[0])
+	return existing[0]
+}
+
+// Moves a verification channel into the school's category, if it has one with room left
+func moveToSchoolCategory(s *discordgo.Session, channelID, domain string) {
+	school, ok := schools[domain]
+	if !ok || school.CategoryID == "" {
+		return
+	}
+	if channel, err := cachedChannel(s, channelID); err == nil && channel.ParentID == school.CategoryID {
+		return
+	}
+	if categoryChannelCount(s, school.CategoryID) >= maxChannelsPerCategory {
+		log.Printf("Category %s for %s is full, leaving verification channel %s where it is.", school.CategoryID, schoolName(domain), channelID)
+		return
+	}
+	if _, err := s.ChannelEdit(channelID, &discordgo.ChannelEdit{ParentID: school.CategoryID}); err != nil {
+		log.Printf("Failed to move verification channel %s to the %s category: %v", channelID, schoolName(domain), err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Scheduled channel deletion ---
+// Verification channels are deleted a little while after the user is done, so they can
+// read the result. The deletion is written to the store first and carried out by a timer,
+// with the channel_deletions job picking up anything a restart or a failed call left
+// behind. Failures are retried with a growing delay and reported once they run out.
+
+const (
+	maxChannelDeletionAttempts = 10
+	channelDeletionRetryDelay  = time.Minute
+)
+
+type channelDeletion struct {
+	ChannelID string    `json:"channel_id"`
+	At        time.Time `json:"at"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	// The transcript has been posted, so retries don't post it again
+	Archived bool `json:"archived,omitempty"`
+}
+
+var errDeletionInProgress = errors.New("channel is already being deleted")
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:         "channel_deletions",
+		Description:  "Deletes verification channels whose deletion is due or failed earlier",
+		DefaultCron:  "* * * * *",
+		RunAtStartup: true,
+		Run:          processChannelDeletions,
+	})
+}
+
+// Deletes the channel after the delay, even if the bot restarts in between
+func scheduleChannelDeletion(s *discordgo.Session, channelID string, after time.Duration) {
+	if err := store.scheduleChannelDeletion(channelID, time.Now().Add(after)); err != nil {
+		log.Printf("Failed to schedule deletion of channel %s: %v", channelID, err)
+	}
+	time.AfterFunc(after, func() {
+		if err := processChannelDeletions(s); err != nil {
+			log.Printf("Failed to process channel deletions: %v", err)
+		}
+	})
+}
+
+// Schedules the deletion of every verification channel of a user
+func scheduleUserChannelDeletion(s *discordgo.Session, userID string, after time.Duration) {
+	for _, channelID := range store.verificationChannelsOf(userID) {
+		scheduleChannelDeletion(s, channelID, after)
+	}
+}
+
+func processChannelDeletions(s *discordgo.Session) error {
+	now := time.Now()
+	for _, task := range store.dueChannelDeletions(now) {
+		err := deleteVerificationChannel(s, &task)
+		if errors.Is(err, errDeletionInProgress) {
+			continue
+		}
+		if err == nil || isUnknownChannel(err) {
+			if err := store.removeChannelDeletion(task.ChannelID); err != nil {
+				log.Printf("Failed to remove channel deletion: %v", err)
+			}
+			continue
+		}
+
+		task.Attempts++
+		task.LastError = err.Error()
+		if task.Attempts >= maxChannelDeletionAttempts {
+			log.Printf("Giving up deleting channel %s after %d attempts: %v", task.ChannelID, task.Attempts, err)
+			alertAdmins(s, fmt.Sprintf("⚠️ 認証チャンネル <#%s> を%d回削除できなかったため、自動削除を中止しました. 手動で削除してください: `%v`", task.ChannelID, task.Attempts, err))
+			if err := store.removeChannelDeletion(task.ChannelID); err != nil {
+				log.Printf("Failed to remove channel deletion: %v", err)
+			}
+			continue
+		}
+		task.At = now.Add(time.Duration(task.Attempts) * channelDeletionRetryDelay)
+		if err := store.putChannelDeletion(task); err != nil {
+			log.Printf("Failed to reschedule deletion of channel %s: %v", task.ChannelID, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether Discord says the channel doesn't exist (any more)
+func isUnknownChannel(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	return restErr.Response.StatusCode == http.StatusNotFound ||
+		(restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownChannel)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/wcharczuk/go-chart/v2"
+)
+
+// --- Stats charts ---
+// PNG charts attached to /stats and the weekly summary: verified members per school
+// and the daily trend of the funnel. go-chart's bundled font has no Japanese glyphs,
+// so schools are labelled by their domain rather than their name.
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	// At most this many schools get their own bar, the rest are summed up as "other"
+	chartMaxSchools = 15
+)
+
+// Renders the per-school bar chart and the daily trend line for the days up to and including last, as message attachments
+func statsCharts(last time.Time, days int) ([]*discordgo.File, error) {
+	start := time.Date(last.Year(), last.Month(), last.Day()-days+1, 0, 0, 0, 0, last.Location())
+	end := start.AddDate(0, 0, days)
+
+	schoolsPNG, err := renderSchoolChart(store.verifiedByDomain(start, end))
+	if err != nil {
+		return nil, fmt.Errorf("school chart: %w", err)
+	}
+	trendPNG, err := renderTrendChart(start, days)
+	if err != nil {
+		return nil, fmt.Errorf("trend chart: %w", err)
+	}
+	return []*discordgo.File{
+		{Name: "schools.png", ContentType: "image/png", Reader: bytes.NewReader(schoolsPNG)},
+		{Name: "trend.png", ContentType: "image/png", Reader: bytes.NewReader(trendPNG)},
+	}, nil
+}
+
+func renderSchoolChart(counts map[string]int) ([]byte, error) {
+	domains := make([]string, 0, len(counts))
+	for domain := range counts {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(a, b int) bool {
+		if counts[domains[a]] != counts[domains[b]] {
+			return counts[domains[a]] > counts[domains[b]]
+		}
+		return domains[a] < domains[b]
+	})
+
+	var bars []chart.Value
+	other := 0
+	for idx, domain := range domains {
+		if idx >= chartMaxSchools {
+			other += counts[domain]
+			continue
+		}
+		bars = append(bars, chart.Value{Label: chartLabel(domain), Value: float64(counts[domain])})
+	}
+	if other > 0 {
+		bars = append(bars, chart.Value{Label: "other", Value: float64(other)})
+	}
+	if len(bars) == 0 {
+		// go-chart refuses to render an empty bar chart
+		bars = append(bars, chart.Value{Label: "-", Value: 0})
+	}
+
+	graph := chart.BarChart{
+		Title:      "Verified members per school",
+		Width:      chartWidth,
+		Height:     chartHeight,
+		BarWidth:   min(60, max(8, (chartWidth-100)/len(bars)-10)),
+		Background: chart.Style{Padding: chart.Box{Top: 40, Bottom: 20}},
+		XAxis:      chart.Style{TextRotationDegrees: 45},
+		YAxis:      chart.YAxis{Range: &chart.ContinuousRange{Min: 0, Max: chartMax(bars)}},
+		Bars:       bars,
+	}
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderTrendChart(start time.Time, days int) ([]byte, error) {
+	dates := make([]time.Time, days)
+	started := make([]float64, days)
+	verified := make([]float64, days)
+	for idx := range dates {
+		dates[idx] = start.AddDate(0, 0, idx)
+		stats := store.dailyStats(dates[idx].Format(statsDateFormat))
+		started[idx] = float64(stats[stageButtonClicked])
+		verified[idx] = float64(stats[stageVerified])
+	}
+	if days == 1 {
+		// A line needs two points
+		dates = append(dates, start.AddDate(0, 0, 1))
+		started = append(started, started[0])
+		verified = append(verified, verified[0])
+	}
+
+	graph := chart.Chart{
+		Title:      "Daily verifications",
+		Width:      chartWidth,
+		Height:     chartHeight,
+		Background: chart.Style{Padding: chart.Box{Top: 40, Left: 20}},
+		XAxis:      chart.XAxis{ValueFormatter: chart.TimeValueFormatterWithFormat("01-02")},
+		YAxis:      chart.YAxis{Range: &chart.ContinuousRange{Min: 0, Max: max(1, maxOf(started), maxOf(verified))}},
+		Series: []chart.Series{
+			chart.TimeSeries{Name: "started", XValues: dates, YValues: started},
+			chart.TimeSeries{Name: "verified", XValues: dates, YValues: verified},
+		},
+	}
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Shortens "tokyo.kosen-ac.jp" to "tokyo"
+func chartLabel(domain string) string {
+	if label, _, ok := strings.Cut(domain, "."); ok && label != "" {
+		return label
+	}
+	return domain
+}
+
+func chartMax(bars []chart.Value) float64 {
+	highest := 1.0
+	for _, bar := range bars {
+		highest = max(highest, bar.Value)
+	}
+	return highest
+}
+
+func maxOf(values []float64) float64 {
+	highest := 0.0
+	for _, v := range values {
+		highest = max(highest, v)
+	}
+	return highest
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Per-guild command switches ---
+// A guild can turn off commands it doesn't use, with disabled_commands in its guilds
+// entry or with /command at runtime. With guild-scoped registration the commands are
+// left out of the guild's command list; with global registration they stay visible but
+// answer that they are turned off.
+
+// Commands that can't be turned off, so an admin can always turn the others back on
+const commandSwitchName = "command"
+
+var lockedCommands = map[string]bool{commandSwitchName: true}
+
+// Checks that every name is a command the bot registers and may be turned off
+func validateDisabledCommands(names []string) error {
+	known := make(map[string]bool)
+	for _, cmd := range commandDefinitions() {
+		known[cmd.Name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		if lockedCommands[name] {
+			return fmt.Errorf("/%s can't be disabled", name)
+		}
+	}
+	return nil
+}
+
+func commandEnabled(guild, name string) bool {
+	if lockedCommands[name] {
+		return true
+	}
+	if enabled, ok := store.commandOverride(guild, name); ok {
+		return enabled
+	}
+	if gc, ok := config.Guilds[guild]; ok {
+		for _, disabled := range gc.DisabledCommands {
+			if disabled == name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the commands to register in a guild ("" registers globally, where nothing is left out)
+func enabledCommandDefinitions(guild string) []*discordgo.ApplicationCommand {
+	var commands []*discordgo.ApplicationCommand
+	for _, cmd := range commandDefinitions() {
+		if guild == "" || commandEnabled(guild, cmd.Name) {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+func commandGateMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	if rt.kind != routeCommand && rt.kind != routeAutocomplete {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if !commandEnabled(guildOrDefault(i), rt.name) {
+			if rt.kind == routeCommand {
+				respondError(s, i, localized(i, msgCommandDisabled))
+			}
+			return
+		}
+		next(s, i)
+	}
+}
+
+func commandSwitchCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     commandSwitchName,
+		Description:              "Show or turn commands on and off in this server (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "name", Description: "Command to change, without the slash"},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "state", Description: "New state", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: featureStateOn, Value: featureStateOn},
+				{Name: featureStateOff, Value: featureStateOff},
+				{Name: featureStateReset, Value: featureStateReset},
+			}},
+		},
+	}
+}
+
+func handleCommandSwitch(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	name := strings.TrimPrefix(optionString(i, "name"), "/")
+	state := optionString(i, "state")
+	if name != "" && state != "" {
+		if err := validateDisabledCommands([]string{name}); err != nil {
+			respondError(s, i, fmt.Sprintf("エラー: `/%s` は変更できません (%v).", name, err))
+			return
+		}
+		var err error
+		switch state {
+		case featureStateReset:
+			err = store.clearCommandOverride(i.GuildID, name)
+		default:
+			err = store.setCommandOverride(i.GuildID, name, state == featureStateOn)
+		}
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save command override", err)
+			return
+		}
+		log.Printf("Command /%s set to %s in guild %s by %s", name, state, i.GuildID, interactionUser(i).ID)
+		// Guild-scoped registration leaves disabled commands out, so the list has to be synced
+		if config.CommandScope == commandScopeGuild && i.GuildID == guildID {
+			go func() {
+				if err := registerCommands(s, false); err != nil {
+					log.Printf("Failed to sync commands after /command: %v", err)
+				}
+			}()
+		}
+	}
+
+	var names []string
+	for _, cmd := range commandDefinitions() {
+		names = append(names, cmd.Name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, cmd := range names {
+		mark := "✅"
+		if !commandEnabled(i.GuildID, cmd) {
+			mark = "❌"
+		}
+		line := fmt.Sprintf("%s `/%s`", mark, cmd)
+		if _, overridden := store.commandOverride(i.GuildID, cmd); overridden {
+			line += " (手動設定)"
+		}
+		lines = append(lines, line)
+	}
+	respondEphemeral(s, i, strings.Join(lines, "\n"))
+}
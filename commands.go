@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Command registration ---
+
+// The slash commands the bot provides
+func commandDefinitions() []*discordgo.ApplicationCommand {
+	allowInDMs := true
+	commands := []*discordgo.ApplicationCommand{
+		{Name: "verify", Description: "Start verification with your Kosen email.", DMPermission: &allowInDMs, Options: []*discordgo.ApplicationCommandOption{{Type: discordgo.ApplicationCommandOptionString, Name: "email", Description: "Your Kosen email address", Required: true}}},
+		{Name: "code", Description: "Enter the verification code sent to your email.", DMPermission: &allowInDMs, Options: []*discordgo.ApplicationCommandOption{{Type: discordgo.ApplicationCommandOptionString, Name: "code", Description: "The 6-digit verification code", Required: true}}},
+		{Name: "appeal", Description: "Appeal to the moderators if you cannot verify with your email.", DMPermission: &allowInDMs},
+		featureCommand(),
+		statsCommand(),
+		testEmailCommand(),
+		previewEmailCommand(),
+		uptimeCommand(),
+		maintenanceCommand(),
+		mailQueueCommand(),
+		rolesCommand(),
+		exportStatsCommand(),
+		apiKeyCommand(),
+		debugCommand(),
+		assistCommand(),
+		jobsCommand(),
+		auditCommand(),
+		lockdownCommand(),
+		unverifyCommand(),
+		commandSwitchCommand(),
+		waitlistCommand(),
+		setupCommand(),
+		schoolPauseCommand(),
+		migrateDomainCommand(),
+		announceCommand(),
+	}
+	return append(commands, schoolModeratorCommandDefinitions()...)
+}
+
+// Returns the string value of a named command option, or "" if it wasn't given
+func optionString(i *discordgo.InteractionCreate, name string) string {
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Name == name {
+			return opt.StringValue()
+		}
+	}
+	return ""
+}
+
+// Registers the commands in the configured scope and removes the ones this bot
+// left behind in the other scope, so switching modes doesn't show every command twice
+func registerCommands(s *discordgo.Session, force bool) error {
+	appID := s.State.User.ID
+	target := guildID
+	if config.CommandScope == commandScopeGlobal {
+		target = ""
+	}
+
+	for _, scope := range store.commandScopes() {
+		if scope == target {
+			continue
+		}
+		if err := removeRegisteredCommands(s, appID, scope); err != nil {
+			return fmt.Errorf("could not clean up commands in scope %q: %w", scope, err)
+		}
+	}
+	return syncCommands(s, appID, target, enabledCommandDefinitions(target), force)
+}
+
+// Deletes every command the bot registered in a scope ("" for global)
+func removeRegisteredCommands(s *discordgo.Session, appID, scope string) error {
+	names := store.registeredCommands(scope)
+	if len(names) == 0 {
+		return store.setRegisteredCommands(scope, nil)
+	}
+	existing, err := s.ApplicationCommands(appID, scope)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]bool)
+	for _, name := range names {
+		owned[name] = true
+	}
+	for _, cmd := range existing {
+		if !owned[cmd.Name] {
+			continue
+		}
+		if err := s.ApplicationCommandDelete(appID, scope, cmd.ID); err != nil {
+			return err
+		}
+	}
+	log.Printf("Removed %d commands from previous scope %q.", len(names), scope)
+	return store.setRegisteredCommands(scope, nil)
+}
+
+// Brings the registered commands in line with desired, only touching commands that changed.
+// Commands the bot never registered (e.g. added by hand) are left alone.
+// With force, everything is overwritten in one bulk call instead.
+func syncCommands(s *discordgo.Session, appID, guild string, desired []*discordgo.ApplicationCommand, force bool) error {
+	if force {
+		log.Println("Force-syncing commands with a bulk overwrite...")
+		if _, err := s.ApplicationCommandBulkOverwrite(appID, guild, desired); err != nil {
+			return err
+		}
+		return store.setRegisteredCommands(guild, commandNames(desired))
+	}
+
+	existing, err := s.ApplicationCommands(appID, guild)
+	if err != nil {
+		return fmt.Errorf("could not fetch existing commands: %w", err)
+	}
+	existingByName := make(map[string]*discordgo.ApplicationCommand)
+	for _, cmd := range existing {
+		existingByName[cmd.Name] = cmd
+	}
+
+	created, updated, deleted := 0, 0, 0
+	for _, cmd := range desired {
+		current, ok := existingByName[cmd.Name]
+		switch {
+		case !ok:
+			if _, err := s.ApplicationCommandCreate(appID, guild, cmd); err != nil {
+				return fmt.Errorf("could not create /%s: %w", cmd.Name, err)
+			}
+			created++
+		case commandFingerprint(current) != commandFingerprint(cmd):
+			if _, err := s.ApplicationCommandEdit(appID, guild, current.ID, cmd); err != nil {
+				return fmt.Errorf("could not update /%s: %w", cmd.Name, err)
+			}
+			updated++
+		}
+	}
+
+	desiredNames := make(map[string]bool)
+	for _, cmd := range desired {
+		desiredNames[cmd.Name] = true
+	}
+	for _, name := range store.registeredCommands(guild) {
+		current, ok := existingByName[name]
+		if !ok || desiredNames[name] {
+			continue
+		}
+		if err := s.ApplicationCommandDelete(appID, guild, current.ID); err != nil {
+			return fmt.Errorf("could not delete /%s: %w", name, err)
+		}
+		deleted++
+	}
+
+	log.Printf("Commands synced: %d created, %d updated, %d deleted, %d unchanged.",
+		created, updated, deleted, len(desired)-created-updated)
+	return store.setRegisteredCommands(guild, commandNames(desired))
+}
+
+func commandNames(commands []*discordgo.ApplicationCommand) []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+// canonicalCommand is the comparable form of a command, ignoring server-assigned fields and null-vs-empty differences
+type canonicalCommand struct {
+	Type                     discordgo.ApplicationCommandType
+	Description              string
+	DMPermission             bool
+	DefaultMemberPermissions int64
+	Options                  []canonicalOption
+}
+
+type canonicalOption struct {
+	Type         discordgo.ApplicationCommandOptionType
+	Name         string
+	Description  string
+	Required     bool
+	Autocomplete bool
+	Choices      []string
+	MinLength    int
+	MaxLength    int
+	Options      []canonicalOption
+}
+
+func commandFingerprint(cmd *discordgo.ApplicationCommand) string {
+	c := canonicalCommand{
+		Type:         cmd.Type,
+		Description:  cmd.Description,
+		DMPermission: cmd.DMPermission == nil || *cmd.DMPermission,
+		Options:      canonicalOptions(cmd.Options),
+	}
+	if c.Type == 0 {
+		c.Type = discordgo.ChatApplicationCommand
+	}
+	if cmd.DefaultMemberPermissions != nil {
+		c.DefaultMemberPermissions = *cmd.DefaultMemberPermissions
+	} else {
+		c.DefaultMemberPermissions = -1
+	}
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+func canonicalOptions(options []*discordgo.ApplicationCommandOption) []canonicalOption {
+	var out []canonicalOption
+	for _, o := range options {
+		co := canonicalOption{
+			Type:         o.Type,
+			Name:         o.Name,
+			Description:  o.Description,
+			Required:     o.Required,
+			Autocomplete: o.Autocomplete,
+			MaxLength:    o.MaxLength,
+			Options:      canonicalOptions(o.Options),
+		}
+		if o.MinLength != nil {
+			co.MinLength = *o.MinLength
+		}
+		for _, choice := range o.Choices {
+			co.Choices = append(co.Choices, fmt.Sprintf("%s=%v", choice.Name, choice.Value))
+		}
+		out = append(out, co)
+	}
+	return out
+}
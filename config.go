@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Configuration ---
+
+// Config holds the optional settings from config.json.
+// Secrets and Discord IDs stay in environment variables.
+type Config struct {
+	EmailRules EmailRules `json:"email_rules"`
+	// "guild" registers commands in DISCORD_GUILD_ID only (instant updates, handy in development),
+	// "global" registers them for every guild the bot is in (changes can take a while to show up)
+	CommandScope string `json:"command_scope"`
+	// Code lifetime, attempt and resend limits, lockouts and cooldowns
+	Policy Policy `json:"policy"`
+	// Deprecated: use policy.cooldowns. Still merged into the policy if set.
+	Cooldowns map[string]Duration `json:"cooldowns,omitempty"`
+	// Feature flags, see knownFeatures
+	Features map[string]bool `json:"features"`
+	// The verification post in the welcome channel
+	Welcome WelcomeMessage `json:"welcome"`
+	// Landing channels besides DISCORD_WELCOME_CHANNEL_ID, each with its own post
+	WelcomeChannels []*WelcomeChannel `json:"welcome_channels"`
+	// When to call moderators into a struggling user's verification channel
+	AutoEscalation AutoEscalation `json:"auto_escalation"`
+	// What to do if the SMTP check at startup fails: "fail" (exit), "warn" (alert admins) or "off"
+	SMTPPreflight string `json:"smtp_preflight"`
+	// Public base URL of the web server on WEB_ADDR ("https://verify.example.com");
+	// enables the magic link and QR code in verification emails
+	PublicURL string `json:"public_url"`
+	// What to do when a member gains a verification role without a record: "remove", "alert" or "off" (default).
+	// Anything but "off" needs the privileged server members intent.
+	RoleProtection string `json:"role_protection"`
+	// Nickname set from the real name when the real_name feature is on
+	Nickname NicknameConfig `json:"nickname"`
+	// Roles members can pick for themselves after verifying, at most 25
+	OptInRoles []OptInRole `json:"opt_in_roles"`
+	// Limited access without verification, offered by the "guest" welcome button
+	Guest GuestConfig `json:"guest"`
+	// Authenticated SMTP connections kept open between emails
+	SMTPPool SMTPPoolConfig `json:"smtp_pool"`
+	// When to stop sending mail during a provider outage
+	MailCircuit MailCircuitConfig `json:"mail_circuit"`
+	// Thresholds and countermeasures for join surges
+	RaidProtection RaidProtection `json:"raid_protection"`
+	// Permissions in verification channels for the member and for extra roles such as moderators
+	ChannelPermissions ChannelPermissions `json:"channel_permissions"`
+	// Extra categories for verification channels once DISCORD_PRIVATE_CATEGORY_ID holds 50 channels
+	OverflowCategories []string `json:"overflow_categories"`
+	// Out-of-band alerting when the gateway stays down
+	Watchdog WatchdogConfig `json:"watchdog"`
+	// Cron schedules of the scheduled jobs, keyed by job name
+	Schedules map[string]JobSchedule `json:"schedules"`
+	// When to report a domain whose verification volume jumps
+	DomainAnomaly DomainAnomalyConfig `json:"domain_anomaly"`
+	// DM sent to members whose verification the bot removed
+	ReverifyReminder ReverifyReminder `json:"reverify_reminder"`
+	// Limits on concurrent verifications during a spike
+	Capacity CapacityConfig `json:"capacity"`
+	// Language for users who haven't picked one with the language button: "ja" or "en"
+	Locale string `json:"locale"`
+	// Replacement texts for the denial messages, keyed by message then language
+	Messages map[string]map[string]string `json:"messages"`
+	// How long a handler may run, keyed by command name or custom ID prefix, "default" for the rest; 0 disables the limit
+	HandlerTimeouts map[string]Duration `json:"handler_timeouts"`
+	// HTTP callback for external membership systems, fired when a member's verification status changes
+	Callback CallbackConfig `json:"callback"`
+	// Steps run in order after a member is verified
+	SuccessActions []SuccessAction `json:"success_actions"`
+	// Pinning and reposting of the welcome message
+	WelcomeUpkeep WelcomeUpkeep `json:"welcome_upkeep"`
+	// IANA time zone for daily stats, cron schedules and displayed dates
+	TimeZone string `json:"time_zone"`
+	// Gateway intents and state caching
+	Intents IntentsConfig `json:"intents"`
+	// Daily sending limits of the mail accounts, and an optional fallback account
+	MailQuota MailQuotaConfig `json:"mail_quota"`
+	// Limited role given to newly verified members before their full roles
+	Probation ProbationConfig `json:"probation"`
+	// Texts for /announce, keyed by name; replace or add to the built-in ones
+	Announcements map[string]string `json:"announcements"`
+	// Addresses or CIDR ranges of the reverse proxies in front of WEB_ADDR; X-Forwarded-For
+	// is only believed from these
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Per-guild overrides, keyed by guild ID
+	Guilds map[string]*GuildConfig `json:"guilds"`
+
+	timeZone       *time.Location
+	trustedProxies []netip.Prefix
+	jobSettings    map[string]jobSettings
+}
+
+type GuildConfig struct {
+	EmailRules *EmailRules     `json:"email_rules,omitempty"`
+	Features   map[string]bool `json:"features,omitempty"`
+	Welcome    *WelcomeMessage `json:"welcome,omitempty"`
+	Policy     *Policy         `json:"policy,omitempty"`
+	Nickname   *NicknameConfig `json:"nickname,omitempty"`
+	// Replaces the global list; an empty list disables the picker
+	OptInRoles []OptInRole `json:"opt_in_roles,omitempty"`
+	Locale     string      `json:"locale,omitempty"`
+	// Commands this guild doesn't use, by name without the slash
+	DisabledCommands []string `json:"disabled_commands,omitempty"`
+	// Merged over the global messages
+	Messages map[string]map[string]string `json:"messages,omitempty"`
+	// Replaces the global probation settings
+	Probation *ProbationConfig `json:"probation,omitempty"`
+	// The guild's own role, welcome channel and category, as printed by /setup; the
+	// DISCORD_* environment variables are used for the main guild and when these are empty
+	VerifiedRoleID    string `json:"verified_role_id,omitempty"`
+	WelcomeChannelID  string `json:"welcome_channel_id,omitempty"`
+	PrivateCategoryID string `json:"private_category_id,omitempty"`
+}
+
+// EmailRules decides which addresses may be used for verification.
+// An address must match at least one allowed suffix or pattern, and its local part must satisfy the local-part constraints.
+type EmailRules struct {
+	// Domains accepted as-is or as a parent domain ("kosen-ac.jp" accepts "tokyo.kosen-ac.jp")
+	AllowedSuffixes []string `json:"allowed_suffixes"`
+	// Regular expressions matched against the whole address
+	Patterns []string `json:"patterns"`
+	// Regular expression the part before the "@" must match, if set
+	LocalPartPattern   string `json:"local_part_pattern"`
+	LocalPartMaxLength int    `json:"local_part_max_length"`
+
+	patterns  []*regexp.Regexp
+	localPart *regexp.Regexp
+}
+
+// Duration is a time.Duration written as a string ("90s", "5m") in JSON
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+const (
+	commandScopeGuild  = "guild"
+	commandScopeGlobal = "global"
+)
+
+var config *Config
+
+func defaultConfig() *Config {
+	return &Config{
+		EmailRules:    EmailRules{AllowedSuffixes: []string{"kosen-ac.jp"}},
+		CommandScope:  commandScopeGuild,
+		Welcome:       defaultWelcomeMessage(),
+		SMTPPreflight: preflightFail,
+		Watchdog:      WatchdogConfig{MaxDowntime: Duration{5 * time.Minute}},
+		AutoEscalation: AutoEscalation{
+			MaxCodeFailures: 5,
+			Resends:         true,
+		},
+		Policy:             defaultPolicy(),
+		RoleProtection:     roleProtectionOff,
+		Nickname:           NicknameConfig{Template: "{{.Name}}", Truncate: truncateName},
+		ChannelPermissions: defaultChannelPermissions(),
+		Guest:              defaultGuestConfig(),
+		RaidProtection:     defaultRaidProtection(),
+		MailCircuit:        defaultMailCircuitConfig(),
+		SMTPPool:           defaultSMTPPoolConfig(),
+		HandlerTimeouts:    defaultHandlerTimeouts(),
+		ReverifyReminder:   defaultReverifyReminder(),
+		DomainAnomaly:      defaultDomainAnomalyConfig(),
+		Intents:            defaultIntentsConfig(),
+		TimeZone:           defaultTimeZone,
+		Callback:           defaultCallbackConfig(),
+		MailQuota:          defaultMailQuotaConfig(),
+	}
+}
+
+// Loads config.json, falling back to the defaults if it does not exist
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	file, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No %s found, using default configuration.", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	} else if err := json.Unmarshal(file, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	if cfg.CommandScope != commandScopeGuild && cfg.CommandScope != commandScopeGlobal {
+		return nil, fmt.Errorf("command_scope must be %q or %q, got %q", commandScopeGuild, commandScopeGlobal, cfg.CommandScope)
+	}
+	if err := cfg.EmailRules.compile(); err != nil {
+		return nil, fmt.Errorf("email_rules: %w", err)
+	}
+	switch cfg.SMTPPreflight {
+	case preflightFail, preflightWarn, preflightOff:
+	default:
+		return nil, fmt.Errorf("smtp_preflight must be %q, %q or %q, got %q", preflightFail, preflightWarn, preflightOff, cfg.SMTPPreflight)
+	}
+	if len(cfg.Cooldowns) > 0 {
+		log.Printf("%s: \"cooldowns\" is deprecated, move it to \"policy.cooldowns\".", path)
+		// "cooldowns": null in the policy leaves the map nil
+		if cfg.Policy.Cooldowns == nil {
+			cfg.Policy.Cooldowns = make(map[string]Duration)
+		}
+		for command, d := range cfg.Cooldowns {
+			cfg.Policy.Cooldowns[command] = d
+		}
+	}
+	if cfg.AutoEscalation.MaxResends != 0 {
+		log.Printf("%s: \"auto_escalation.max_resends\" is deprecated, the limit is \"policy.max_resends\"; use \"auto_escalation.resends\" to turn the escalation on or off.", path)
+		cfg.AutoEscalation.Resends = cfg.AutoEscalation.MaxResends > 0
+	}
+	switch cfg.RoleProtection {
+	case roleProtectionRemove, roleProtectionAlert, roleProtectionOff:
+	default:
+		return nil, fmt.Errorf("role_protection must be %q, %q or %q, got %q", roleProtectionRemove, roleProtectionAlert, roleProtectionOff, cfg.RoleProtection)
+	}
+	if err := cfg.Nickname.compile(); err != nil {
+		return nil, fmt.Errorf("nickname: %w", err)
+	}
+	if err := cfg.Policy.validate(); err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	if cfg.PublicURL != "" && !strings.HasPrefix(cfg.PublicURL, "https://") && !strings.HasPrefix(cfg.PublicURL, "http://") {
+		return nil, fmt.Errorf("public_url must start with https:// or http://, got %q", cfg.PublicURL)
+	}
+	if cfg.Welcome.ButtonLabel == "" {
+		return nil, fmt.Errorf("welcome.button_label must not be empty")
+	}
+	if err := validateWelcomeButtons(cfg.Welcome.Buttons); err != nil {
+		return nil, fmt.Errorf("welcome.buttons: %w", err)
+	}
+	if err := validateFeatures(cfg.Features); err != nil {
+		return nil, fmt.Errorf("features: %w", err)
+	}
+	for idx, wc := range cfg.WelcomeChannels {
+		if err := wc.validate(); err != nil {
+			return nil, fmt.Errorf("welcome_channels[%d]: %w", idx, err)
+		}
+	}
+	if cfg.MailCircuit.FailureThreshold > 0 && cfg.MailCircuit.OpenDuration.Duration <= 0 {
+		return nil, fmt.Errorf("mail_circuit.open_duration must be positive")
+	}
+	if err := cfg.SMTPPool.validate(); err != nil {
+		return nil, fmt.Errorf("smtp_pool: %w", err)
+	}
+	if err := cfg.DomainAnomaly.validate(); err != nil {
+		return nil, fmt.Errorf("domain_anomaly: %w", err)
+	}
+	if err := cfg.Capacity.validate(); err != nil {
+		return nil, fmt.Errorf("capacity: %w", err)
+	}
+	if err := cfg.Callback.validate(); err != nil {
+		return nil, fmt.Errorf("callback: %w", err)
+	}
+	if cfg.timeZone, err = time.LoadLocation(cfg.TimeZone); err != nil {
+		return nil, fmt.Errorf("time_zone: %w", err)
+	}
+	if err := cfg.WelcomeUpkeep.validate(); err != nil {
+		return nil, fmt.Errorf("welcome_upkeep: %w", err)
+	}
+	if err := cfg.Intents.validate(); err != nil {
+		return nil, fmt.Errorf("intents: %w", err)
+	}
+	if err := cfg.MailQuota.validate(); err != nil {
+		return nil, fmt.Errorf("mail_quota: %w", err)
+	}
+	if err := cfg.Probation.validate(); err != nil {
+		return nil, fmt.Errorf("probation: %w", err)
+	}
+	if err := validateAnnouncements(cfg.Announcements); err != nil {
+		return nil, fmt.Errorf("announcements: %w", err)
+	}
+	if cfg.trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if err := validateHandlerTimeouts(cfg.HandlerTimeouts); err != nil {
+		return nil, fmt.Errorf("handler_timeouts: %w", err)
+	}
+	if cfg.jobSettings, err = parseJobSchedules(cfg.Schedules); err != nil {
+		return nil, fmt.Errorf("schedules: %w", err)
+	}
+	if err := cfg.RaidProtection.validate(); err != nil {
+		return nil, fmt.Errorf("raid_protection: %w", err)
+	}
+	if err := cfg.Guest.validate(); err != nil {
+		return nil, fmt.Errorf("guest: %w", err)
+	}
+	if err := cfg.ChannelPermissions.validate(); err != nil {
+		return nil, fmt.Errorf("channel_permissions: %w", err)
+	}
+	if err := validateSuccessActions(cfg.SuccessActions); err != nil {
+		return nil, fmt.Errorf("success_actions: %w", err)
+	}
+	if err := validateOptInRoles(cfg.OptInRoles); err != nil {
+		return nil, fmt.Errorf("opt_in_roles: %w", err)
+	}
+	if err := validateLocale(cfg.Locale); err != nil {
+		return nil, fmt.Errorf("locale: %w", err)
+	}
+	if err := validateMessages(cfg.Messages); err != nil {
+		return nil, fmt.Errorf("messages: %w", err)
+	}
+	for guild, gc := range cfg.Guilds {
+		if err := validateLocale(gc.Locale); err != nil {
+			return nil, fmt.Errorf("guilds.%s.locale: %w", guild, err)
+		}
+		if err := validateMessages(gc.Messages); err != nil {
+			return nil, fmt.Errorf("guilds.%s.messages: %w", guild, err)
+		}
+		if err := validateDisabledCommands(gc.DisabledCommands); err != nil {
+			return nil, fmt.Errorf("guilds.%s.disabled_commands: %w", guild, err)
+		}
+		if err := validateFeatures(gc.Features); err != nil {
+			return nil, fmt.Errorf("guilds.%s.features: %w", guild, err)
+		}
+		if gc.Nickname != nil {
+			if gc.Nickname.Truncate == "" {
+				gc.Nickname.Truncate = cfg.Nickname.Truncate
+			}
+			if err := gc.Nickname.compile(); err != nil {
+				return nil, fmt.Errorf("guilds.%s.nickname: %w", guild, err)
+			}
+		}
+		if err := validateOptInRoles(gc.OptInRoles); err != nil {
+			return nil, fmt.Errorf("guilds.%s.opt_in_roles: %w", guild, err)
+		}
+		if gc.Policy != nil {
+			if err := gc.Policy.validate(); err != nil {
+				return nil, fmt.Errorf("guilds.%s.policy: %w", guild, err)
+			}
+		}
+		if gc.Probation != nil {
+			if err := gc.Probation.validate(); err != nil {
+				return nil, fmt.Errorf("guilds.%s.probation: %w", guild, err)
+			}
+		}
+		// An empty list keeps the global buttons
+		if gc.Welcome != nil && len(gc.Welcome.Buttons) > 0 {
+			if err := validateWelcomeButtons(gc.Welcome.Buttons); err != nil {
+				return nil, fmt.Errorf("guilds.%s.welcome.buttons: %w", guild, err)
+			}
+		}
+		if gc.EmailRules == nil {
+			continue
+		}
+		if err := gc.EmailRules.compile(); err != nil {
+			return nil, fmt.Errorf("guilds.%s.email_rules: %w", guild, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Returns the email rules for a guild, falling back to the global rules
+func (c *Config) emailRulesFor(guildID string) *EmailRules {
+	if gc, ok := c.Guilds[guildID]; ok && gc.EmailRules != nil {
+		return gc.EmailRules
+	}
+	return &c.EmailRules
+}
+
+// Returns the general verified role of a guild
+func (c *Config) verifiedRoleFor(guild string) string {
+	if gc, ok := c.Guilds[guild]; ok && gc.VerifiedRoleID != "" {
+		return gc.VerifiedRoleID
+	}
+	return verifiedRoleID
+}
+
+// Returns the main welcome channel of a guild
+func (c *Config) welcomeChannelFor(guild string) string {
+	if gc, ok := c.Guilds[guild]; ok && gc.WelcomeChannelID != "" {
+		return gc.WelcomeChannelID
+	}
+	return welcomeChannelID
+}
+
+// Returns the verification channel category of a guild
+func (c *Config) privateCategoryFor(guild string) string {
+	if gc, ok := c.Guilds[guild]; ok && gc.PrivateCategoryID != "" {
+		return gc.PrivateCategoryID
+	}
+	return privateCategoryID
+}
+
+func (r *EmailRules) compile() error {
+	r.patterns = nil
+	for _, p := range r.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	r.localPart = nil
+	if r.LocalPartPattern != "" {
+		re, err := regexp.Compile(r.LocalPartPattern)
+		if err != nil {
+			return fmt.Errorf("invalid local_part_pattern %q: %w", r.LocalPartPattern, err)
+		}
+		r.localPart = re
+	}
+	if len(r.AllowedSuffixes) == 0 && len(r.Patterns) == 0 {
+		return fmt.Errorf("at least one allowed suffix or pattern is required")
+	}
+	return nil
+}
+
+func (r *EmailRules) allows(email string) bool {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return false
+	}
+	local, domain := parts[0], strings.ToLower(parts[1])
+
+	if r.LocalPartMaxLength > 0 && len(local) > r.LocalPartMaxLength {
+		return false
+	}
+	if r.localPart != nil && !r.localPart.MatchString(local) {
+		return false
+	}
+
+	for _, suffix := range r.AllowedSuffixes {
+		suffix = strings.ToLower(suffix)
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Short human-readable description of the accepted addresses, for error messages
+func (r *EmailRules) describe() string {
+	if len(r.AllowedSuffixes) == 0 {
+		return "許可された形式"
+	}
+	return "`" + strings.Join(r.AllowedSuffixes, "`, `") + "`"
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// --- config-schema subcommand ---
+// Prints every config.json key with its type, default and description. The keys and
+// types come from the Config struct and the defaults from defaultConfig(); the
+// descriptions are the field comments of the source the binary was built from, which is
+// embedded for this purpose, so the output always matches the binary being run.
+// -format json prints the same as a JSON array.
+
+//go:embed *.go
+var configSources embed.FS
+
+type schemaEntry struct {
+	Key         string          `json:"key"`
+	Type        string          `json:"type"`
+	Default     json.RawMessage `json:"default,omitempty"`
+	Description string          `json:"description,omitempty"`
+}
+
+// Names of the types written as strings in JSON
+var schemaLeafTypes = map[reflect.Type]string{
+	reflect.TypeOf(Duration{}):  "duration",
+	reflect.TypeOf(HexColor(0)): "color",
+}
+
+func printConfigSchema(w io.Writer, format string) error {
+	docs, err := sourceFieldDocs()
+	if err != nil {
+		return fmt.Errorf("failed to read embedded source: %w", err)
+	}
+	var entries []schemaEntry
+	collectSchema(&entries, docs, "", reflect.ValueOf(*defaultConfig()), true)
+
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	case "text":
+		for _, e := range entries {
+			line := e.Key + " (" + e.Type
+			if e.Default != nil {
+				line += ", default " + string(e.Default)
+			}
+			fmt.Fprintln(w, line+")")
+			if e.Description != "" {
+				fmt.Fprintln(w, "    "+strings.ReplaceAll(e.Description, "\n", "\n    "))
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, want \"text\" or \"json\"", format)
+}
+
+// Appends an entry for every JSON key of v's struct type. hasDefault is false below maps and
+// slices, whose elements have no default of their own.
+func collectSchema(entries *[]schemaEntry, docs map[string]map[string]string, prefix string, v reflect.Value, hasDefault bool) {
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		key := prefix + name
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		entry := schemaEntry{Key: key, Type: schemaTypeName(fieldType), Description: docs[t.Name()][field.Name]}
+		if entry.Description == "" && isSchemaStruct(fieldType) {
+			entry.Description = docs[fieldType.Name()][""]
+		}
+
+		value := v.Field(idx)
+		if hasDefault && !isSchemaStruct(fieldType) && !(value.Kind() == reflect.Pointer && value.IsNil()) && !(isSchemaCollection(fieldType) && value.Len() == 0) {
+			entry.Default = schemaDefault(value.Interface())
+		}
+		*entries = append(*entries, entry)
+
+		switch {
+		case isSchemaStruct(fieldType):
+			if value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					collectSchema(entries, docs, key+".", reflect.Zero(fieldType), false)
+					continue
+				}
+				value = value.Elem()
+			}
+			collectSchema(entries, docs, key+".", value, hasDefault)
+		case isSchemaCollection(fieldType):
+			elem, elemKey := fieldType.Elem(), key+"[]"
+			if fieldType.Kind() == reflect.Map {
+				elemKey = key + ".*"
+			}
+			if elem.Kind() == reflect.Pointer {
+				elem = elem.Elem()
+			}
+			if isSchemaStruct(elem) {
+				collectSchema(entries, docs, elemKey+".", reflect.Zero(elem), false)
+			}
+		}
+	}
+}
+
+// Marshals a default without escaping "<" and ">", which custom emojis and mentions use
+func schemaDefault(v any) json.RawMessage {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+func isSchemaStruct(t reflect.Type) bool {
+	_, leaf := schemaLeafTypes[t]
+	return t.Kind() == reflect.Struct && !leaf
+}
+
+func isSchemaCollection(t reflect.Type) bool {
+	return t.Kind() == reflect.Map || t.Kind() == reflect.Slice
+}
+
+func schemaTypeName(t reflect.Type) string {
+	if name, ok := schemaLeafTypes[t]; ok {
+		return name
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaTypeName(t.Elem())
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + schemaTypeName(t.Elem())
+	case reflect.Map:
+		return "map of " + schemaTypeName(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return t.Kind().String()
+}
+
+// Returns the doc comments of struct fields, keyed by type name then field name.
+// The type's own doc comment is under the empty field name.
+func sourceFieldDocs() (map[string]map[string]string, error) {
+	docs := make(map[string]map[string]string)
+	files, err := configSources.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	for _, f := range files {
+		src, err := configSources.ReadFile(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(fset, f.Name(), src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				fields := make(map[string]string)
+				docs[typeSpec.Name.Name] = fields
+				doc := typeSpec.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				fields[""] = commentText(doc)
+				structType, ok := typeSpec.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				for _, field := range structType.Fields.List {
+					text := commentText(field.Doc)
+					if text == "" {
+						text = commentText(field.Comment)
+					}
+					for _, name := range field.Names {
+						fields[name.Name] = text
+					}
+				}
+			}
+		}
+	}
+	return docs, nil
+}
+
+func commentText(group *ast.CommentGroup) string {
+	if group == nil {
+		return ""
+	}
+	return strings.TrimSpace(group.Text())
+}
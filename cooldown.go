@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Command cooldowns ---
+
+var (
+	// Last use of a command, keyed by user ID + command name
+	lastCommandUse = make(map[string]time.Time)
+	cooldownMutex  = &sync.Mutex{}
+)
+
+// Limits each user to one use of a command per configured cooldown
+func cooldownMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	if rt.kind != routeCommand {
+		return next
+	}
+	command := rt.name
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		cooldown := config.policyFor(guildOrDefault(i)).Cooldowns[command].Duration
+		if cooldown <= 0 {
+			next(s, i)
+			return
+		}
+
+		key := interactionUser(i).ID + "/" + command
+		now := time.Now()
+		cooldownMutex.Lock()
+		remaining := lastCommandUse[key].Add(cooldown).Sub(now)
+		if remaining <= 0 {
+			lastCommandUse[key] = now
+		}
+		cooldownMutex.Unlock()
+
+		if remaining > 0 {
+			seconds := int(math.Ceil(remaining.Seconds()))
+			respondError(s, i, localized(i, msgCooldown, "{seconds}", strconv.Itoa(seconds)))
+			return
+		}
+		next(s, i)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// --- Duplicate interaction protection ---
+
+// Interaction tokens are only valid for 15 minutes, so a redelivery can't arrive later than that
+const interactionDedupeWindow = 15 * time.Minute
+
+var (
+	seenInteractions     = make(map[string]time.Time)
+	seenInteractionsLock = &sync.Mutex{}
+
+	// Channels with a deletion in progress
+	deletingChannels sync.Map
+)
+
+// Records an interaction ID, reporting false if it was already handled
+func markInteractionSeen(id string) bool {
+	seenInteractionsLock.Lock()
+	defer seenInteractionsLock.Unlock()
+
+	now := time.Now()
+	for seenID, at := range seenInteractions {
+		if now.Sub(at) > interactionDedupeWindow {
+			delete(seenInteractions, seenID)
+		}
+	}
+	if _, seen := seenInteractions[id]; seen {
+		return false
+	}
+	seenInteractions[id] = now
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Owner diagnostics ---
+// /debug is only for the owners of the bot application (or its team members), not for
+// server admins: it shows internal state, runs scheduled jobs on demand and switches
+// verbose logging on without a restart.
+
+const (
+	debugActionState   = "state"
+	debugActionRun     = "run"
+	debugActionLogging = "logging"
+
+	jobDailySummary = "daily_summary"
+	jobMailQueue    = "mail_queue"
+	jobRoleGrants   = "role_grants"
+)
+
+var (
+	// User IDs of the application owner or team members, fetched on ready
+	botOwnerIDs      = make(map[string]bool)
+	botOwnerIDsMutex = &sync.Mutex{}
+
+	debugLogging atomic.Bool
+)
+
+// Logs only while debug logging is switched on with /debug
+func debugf(format string, args ...any) {
+	if debugLogging.Load() {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// Remembers who owns the application, so /debug can be limited to them
+func loadBotOwners(s *discordgo.Session) {
+	app, err := s.Application("@me")
+	if err != nil {
+		log.Printf("Failed to fetch application owner, /debug is unavailable: %v", err)
+		return
+	}
+	botOwnerIDsMutex.Lock()
+	defer botOwnerIDsMutex.Unlock()
+	if app.Owner != nil {
+		botOwnerIDs[app.Owner.ID] = true
+	}
+	if app.Team != nil {
+		for _, member := range app.Team.Members {
+			if member.User != nil {
+				botOwnerIDs[member.User.ID] = true
+			}
+		}
+	}
+}
+
+func isBotOwner(userID string) bool {
+	botOwnerIDsMutex.Lock()
+	defer botOwnerIDsMutex.Unlock()
+	return botOwnerIDs[userID]
+}
+
+func debugCommand() *discordgo.ApplicationCommand {
+	// Hidden from everyone but administrators; the handler further limits it to the owners
+	permissions := int64(discordgo.PermissionAdministrator)
+	allowInDMs := true
+	return &discordgo.ApplicationCommand{
+		Name:                     "debug",
+		Description:              "Inspect and control the bot's internals (bot owner only).",
+		DefaultMemberPermissions: &permissions,
+		DMPermission:             &allowInDMs,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "action", Description: "What to do", Required: true, Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: debugActionState, Value: debugActionState},
+				{Name: debugActionRun, Value: debugActionRun},
+				{Name: debugActionLogging, Value: debugActionLogging},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "job", Description: "Scheduled job to run now (run)", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: jobDailySummary, Value: jobDailySummary},
+				{Name: jobMailQueue, Value: jobMailQueue},
+				{Name: jobRoleGrants, Value: jobRoleGrants},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "state", Description: "Debug logging on or off (logging)", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: featureStateOn, Value: featureStateOn},
+				{Name: featureStateOff, Value: featureStateOff},
+			}},
+		},
+	}
+}
+
+func handleDebug(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	if !isBotOwner(userID) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	switch optionString(i, "action") {
+	case debugActionRun:
+		job := optionString(i, "job")
+		if job == "" {
+			respondError(s, i, "エラー: job を指定してください.")
+			return
+		}
+		log.Printf("Job %s run manually by %s", job, userID)
+		respondEphemeral(s, i, fmt.Sprintf("`%s` を実行します.", job))
+		go runJob(s, job)
+	case debugActionLogging:
+		switch optionString(i, "state") {
+		case featureStateOn:
+			setDebugLogging(true)
+		case featureStateOff:
+			setDebugLogging(false)
+		}
+		log.Printf("Debug logging set to %v by %s", debugLogging.Load(), userID)
+		respondEphemeral(s, i, fmt.Sprintf("デバッグログ: %v", debugLogging.Load()))
+	default:
+		respondInteraction(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{internalStateEmbed(s)}, Flags: discordgo.MessageFlagsEphemeral},
+		})
+	}
+}
+
+// Debug logging also turns on discordgo's own gateway and REST logging. The session's
+// LogLevel is read by the gateway goroutines without a lock, so it is set once before
+// connecting and the filtering happens here instead.
+func installDiscordLogger(s *discordgo.Session) {
+	s.LogLevel = discordgo.LogDebug
+	discordgo.Logger = func(msgL, caller int, format string, a ...any) {
+		if msgL > discordgo.LogError && !debugLogging.Load() {
+			return
+		}
+		log.Printf("[DG%d] %s", msgL, fmt.Sprintf(format, a...))
+	}
+}
+
+func setDebugLogging(on bool) {
+	debugLogging.Store(on)
+}
+
+// Runs one pass of a scheduled job immediately
+func runJob(s *discordgo.Session, job string) {
+	switch job {
+	case jobDailySummary:
+		scheduled := findJob(jobDailySummary)
+		if !scheduled.begin() {
+			log.Printf("Job %s is already running", job)
+			return
+		}
+		// Posts again even if the scheduled run already did
+		started := time.Now()
+		err := postDailySummary(s, localNow().AddDate(0, 0, -1).Format(statsDateFormat))
+		if err != nil {
+			log.Printf("Job %s failed: %v", job, err)
+		}
+		scheduled.finish(started, err)
+	case jobMailQueue:
+		retryDueEmails(s)
+	case jobRoleGrants:
+		retryDueRoleGrants(s)
+	}
+	log.Printf("Job %s finished", job)
+}
+
+func internalStateEmbed(s *discordgo.Session) *discordgo.MessageEmbed {
+	verificationMutex.Lock()
+	pending := len(pendingVerifications)
+	verificationMutex.Unlock()
+	seenInteractionsLock.Lock()
+	seen := len(seenInteractions)
+	seenInteractionsLock.Unlock()
+	cooldownMutex.Lock()
+	cooldowns := len(lastCommandUse)
+	cooldownMutex.Unlock()
+	troubleMutex.Lock()
+	troubles := len(verificationTroubles)
+	troubleMutex.Unlock()
+	apiWindowMutex.Lock()
+	windows := len(apiWindows)
+	apiWindowMutex.Unlock()
+	s.State.RLock()
+	guilds := len(s.State.Guilds)
+	members := 0
+	for _, g := range s.State.Guilds {
+		members += len(g.Members)
+	}
+	s.State.RUnlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return &discordgo.MessageEmbed{
+		Title: "内部状態",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "認証待ち", Value: fmt.Sprint(pending), Inline: true},
+			{Name: "ロール付与キュー", Value: fmt.Sprint(store.roleGrantQueueLength()), Inline: true},
+			{Name: "メールキュー", Value: fmt.Sprintf("%d (送信不能 %d)", store.mailQueueLength(), len(store.deadLetters())), Inline: true},
+			{Name: "Goroutine", Value: fmt.Sprint(runtime.NumGoroutine()), Inline: true},
+			{Name: "ヒープ", Value: fmt.Sprintf("%.1f MiB", float64(mem.HeapAlloc)/(1<<20)), Inline: true},
+			{Name: "デバッグログ", Value: fmt.Sprint(debugLogging.Load()), Inline: true},
+			{Name: "処理済みインタラクション", Value: fmt.Sprint(seen), Inline: true},
+			{Name: "クールダウン", Value: fmt.Sprint(cooldowns), Inline: true},
+			{Name: "認証トラブル", Value: fmt.Sprint(troubles), Inline: true},
+			{Name: "APIレート制限", Value: fmt.Sprint(windows), Inline: true},
+			{Name: "キャッシュ (サーバー/メンバー)", Value: fmt.Sprintf("%d / %d", guilds, members), Inline: true},
+			{Name: "Gateway", Value: fmt.Sprintf("接続 %v, 遅延 %s", gatewayConnected.Load(), s.HeartbeatLatency().Round(time.Millisecond)), Inline: true},
+		},
+		Color: 0x5865F2,
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- DM support ---
+// Commands may arrive from a DM, where i.Member is nil and i.GuildID is empty.
+// Handlers must go through these helpers instead of touching i.Member directly.
+
+const dmGuildPickerID = "dm_guild_picker"
+
+var (
+	// Guild chosen with the DM guild picker, keyed by user ID
+	dmGuildChoices = make(map[string]string)
+	dmGuildMutex   = &sync.Mutex{}
+)
+
+// Returns the user who triggered an interaction, whether it came from a guild or a DM
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+func isDM(i *discordgo.InteractionCreate) bool {
+	return i.GuildID == ""
+}
+
+// Returns the interaction's guild, or the configured guild for DMs
+func guildOrDefault(i *discordgo.InteractionCreate) string {
+	if isDM(i) {
+		return guildID
+	}
+	return i.GuildID
+}
+
+// Rejects commands sent from a DM when the target guild has DM commands turned off
+func dmMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		// The setup checklist is sent by DM to whoever added the bot to a new guild
+		if isDM(i) && !featureEnabled(guildID, featureDMCommands) && !isSetupRoute(rt) {
+			respondError(s, i, localized(i, msgDMDisabled))
+			return
+		}
+		next(s, i)
+	}
+}
+
+func isSetupRoute(rt route) bool {
+	return rt.kind == routeComponent && strings.HasPrefix(rt.name, "setup_")
+}
+
+// Resolves which guild an interaction is about. In a DM this is, in order: the guild of the user's
+// pending or completed verification, the guild they picked earlier, or the only guild the bot serves.
+// ok is false when the user has to pick a guild first.
+func resolveTargetGuild(s *discordgo.Session, i *discordgo.InteractionCreate) (target string, ok bool) {
+	if !isDM(i) {
+		return i.GuildID, true
+	}
+	userID := interactionUser(i).ID
+
+	verificationMutex.Lock()
+	data, pending := pendingVerifications[userID]
+	verificationMutex.Unlock()
+	if pending && data.GuildID != "" {
+		return data.GuildID, true
+	}
+	if member, verified := store.isVerified(userID); verified && member.GuildID != "" {
+		return member.GuildID, true
+	}
+
+	dmGuildMutex.Lock()
+	choice, chosen := dmGuildChoices[userID]
+	dmGuildMutex.Unlock()
+	if chosen {
+		return choice, true
+	}
+
+	if len(s.State.Guilds) <= 1 {
+		return guildID, true
+	}
+	return "", false
+}
+
+// Returns the member for the interaction's user in the target guild, fetching it when invoked from a DM
+func interactionMember(s *discordgo.Session, i *discordgo.InteractionCreate, target string) (*discordgo.Member, error) {
+	if i.Member != nil && i.GuildID == target {
+		return i.Member, nil
+	}
+	userID := interactionUser(i).ID
+	if member, err := s.State.Member(target, userID); err == nil {
+		return member, nil
+	}
+	return s.GuildMember(target, userID)
+}
+
+// Asks a DM user which of the bot's guilds they want to verify for
+func respondGuildPicker(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	var options []discordgo.SelectMenuOption
+	for _, g := range s.State.Guilds {
+		if _, err := s.GuildMember(g.ID, userID); err != nil {
+			continue
+		}
+		options = append(options, discordgo.SelectMenuOption{Label: g.Name, Value: g.ID})
+		if len(options) == 25 {
+			break
+		}
+	}
+	if len(options) == 0 {
+		respondError(s, i, "エラー: ボットが参加しているサーバーにあなたが見つかりませんでした. サーバー内でコマンドを実行してください.")
+		return
+	}
+
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "どのサーバーの認証を行いますか?",
+			Flags:   discordgo.MessageFlagsEphemeral,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.SelectMenu{CustomID: dmGuildPickerID, Placeholder: "サーバーを選択", Options: options},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to send guild picker: %v", err)
+	}
+}
+
+func handleGuildPicked(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	values := i.MessageComponentData().Values
+	if len(values) == 0 {
+		return
+	}
+	dmGuildMutex.Lock()
+	dmGuildChoices[interactionUser(i).ID] = values[0]
+	dmGuildMutex.Unlock()
+
+	guildName := values[0]
+	if g, err := s.State.Guild(values[0]); err == nil {
+		guildName = g.Name
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("**%s** を選択しました. もう一度コマンドを実行してください.", guildName),
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to confirm guild choice: %v", err)
+	}
+}
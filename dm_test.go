@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestInteractionUser(t *testing.T) {
+	memberUser := &discordgo.User{ID: "member"}
+	dmUser := &discordgo.User{ID: "dm"}
+	tests := []struct {
+		name        string
+		interaction *discordgo.Interaction
+		want        string
+	}{
+		{"guild", &discordgo.Interaction{GuildID: "g1", Member: &discordgo.Member{User: memberUser}}, "member"},
+		{"dm without member", &discordgo.Interaction{User: dmUser}, "dm"},
+		{"member preferred over user", &discordgo.Interaction{GuildID: "g1", Member: &discordgo.Member{User: memberUser}, User: dmUser}, "member"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := interactionUser(&discordgo.InteractionCreate{Interaction: tt.interaction})
+			if got == nil || got.ID != tt.want {
+				t.Errorf("interactionUser() = %v, want user %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveTargetGuild(t *testing.T) {
+	st, err := openStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldConfig, oldGuildID := store, config, guildID
+	store, config, guildID = st, defaultConfig(), "default"
+	t.Cleanup(func() { store, config, guildID = oldStore, oldConfig, oldGuildID })
+
+	if err := store.putVerifiedMember(verifiedMember{UserID: "verified", GuildID: "g-verified"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.putVerifiedMember(verifiedMember{UserID: "waitlisted", GuildID: "g-waitlisted", Waitlisted: true}); err != nil {
+		t.Fatal(err)
+	}
+	verificationMutex.Lock()
+	pendingVerifications["pending"] = verificationData{GuildID: "g-pending"}
+	verificationMutex.Unlock()
+	dmGuildMutex.Lock()
+	dmGuildChoices["chosen"] = "g-chosen"
+	dmGuildMutex.Unlock()
+	t.Cleanup(func() {
+		verificationMutex.Lock()
+		delete(pendingVerifications, "pending")
+		delete(pendingDirty, "pending")
+		verificationMutex.Unlock()
+		dmGuildMutex.Lock()
+		delete(dmGuildChoices, "chosen")
+		dmGuildMutex.Unlock()
+	})
+
+	dm := func(userID string) *discordgo.Interaction {
+		return &discordgo.Interaction{User: &discordgo.User{ID: userID}}
+	}
+	tests := []struct {
+		name        string
+		interaction *discordgo.Interaction
+		guilds      int
+		want        string
+		wantOK      bool
+	}{
+		{"guild interaction", &discordgo.Interaction{GuildID: "g1", Member: &discordgo.Member{User: &discordgo.User{ID: "u"}}}, 2, "g1", true},
+		{"dm with pending verification", dm("pending"), 2, "g-pending", true},
+		{"dm from verified member", dm("verified"), 2, "g-verified", true},
+		{"dm from waitlisted member", dm("waitlisted"), 2, "", false},
+		{"dm with chosen guild", dm("chosen"), 2, "g-chosen", true},
+		{"dm with a single guild", dm("stranger"), 1, "default", true},
+		{"dm with several guilds", dm("stranger"), 2, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := discordgo.NewState()
+			for n := 0; n < tt.guilds; n++ {
+				state.Guilds = append(state.Guilds, &discordgo.Guild{ID: string(rune('a' + n))})
+			}
+			s := &discordgo.Session{State: state}
+			got, ok := resolveTargetGuild(s, &discordgo.InteractionCreate{Interaction: tt.interaction})
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("resolveTargetGuild() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
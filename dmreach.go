@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Unreachable DMs ---
+// A member who blocked the bot or closed DMs from server members can't be DMed; Discord
+// answers with "Cannot send messages to this user". Such members are flagged in the store
+// and DMs to them are skipped for dmRetryAfter instead of failing every time a job runs.
+// Notices that matter to the member go through notifyUser, which falls back to their
+// verification channel, or failing that keeps the notice and shows it ephemerally the
+// next time they use the bot.
+
+const (
+	// Flagged members are tried again after this long, in case they opened their DMs
+	dmRetryAfter = 7 * 24 * time.Hour
+
+	// Undelivered notices kept per member; older ones are dropped
+	maxUndeliveredNotices = 5
+)
+
+var errDMUnreachable = errors.New("user does not accept DMs from the bot")
+
+type dmUnreachableUser struct {
+	LastFailure time.Time `json:"last_failure"`
+	// Notices that couldn't be delivered, shown the next time the member uses the bot
+	Notices []string `json:"notices,omitempty"`
+}
+
+var directMessages = newCounter("kosen_verify_direct_messages_total", "DMs to members, by result.", "result")
+
+func sendDirectMessage(s *discordgo.Session, userID, content string) error {
+	if flagged, ok := store.dmUnreachable(userID); ok && time.Since(flagged.LastFailure) < dmRetryAfter {
+		directMessages.inc("skipped")
+		return errDMUnreachable
+	}
+	channel, err := s.UserChannelCreate(userID)
+	if err == nil {
+		_, err = sendText(s, channel.ID, content)
+	}
+	if isCannotSendToUser(err) {
+		directMessages.inc("unreachable")
+		if err := store.markDMUnreachable(userID, ""); err != nil {
+			log.Printf("Failed to save unreachable DMs of %s: %v", userID, err)
+		}
+		return errDMUnreachable
+	}
+	if err != nil {
+		directMessages.inc("failed")
+		return err
+	}
+	directMessages.inc("sent")
+	if _, ok := store.dmUnreachable(userID); ok {
+		if err := store.clearDMUnreachable(userID); err != nil {
+			log.Printf("Failed to clear unreachable DMs of %s: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+func isCannotSendToUser(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeCannotSendMessagesToThisUser
+}
+
+// DMs a notice to the member, falling back to their verification channel or, failing
+// that, to an ephemeral message the next time they use the bot
+func notifyUser(s *discordgo.Session, userID, content string) error {
+	err := sendDirectMessage(s, userID, content)
+	if !errors.Is(err, errDMUnreachable) {
+		return err
+	}
+	for _, channelID := range store.verificationChannelsOf(userID) {
+		if _, err := sendText(s, channelID, fmt.Sprintf("<@%s> %s", userID, content)); err == nil {
+			return nil
+		}
+	}
+	debugf("DMs to %s are closed; keeping the notice for their next interaction", userID)
+	return store.markDMUnreachable(userID, content)
+}
+
+// Shows the member the notices that couldn't be DMed once their interaction has been answered
+func undeliveredNoticesMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	if rt.kind == routeAutocomplete {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		next(s, i)
+		userID := interactionUser(i).ID
+		flagged, ok := store.dmUnreachable(userID)
+		if !ok || len(flagged.Notices) == 0 {
+			return
+		}
+		for _, notice := range flagged.Notices {
+			_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+				Content: "📬 " + notice,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			})
+			// A handler that opened a modal can't be followed up; the notices wait for the next interaction
+			if err != nil {
+				debugf("Failed to show undelivered notices to %s: %v", userID, err)
+				return
+			}
+		}
+		if err := store.takeUndeliveredNotices(userID, len(flagged.Notices)); err != nil {
+			log.Printf("Failed to clear undelivered notices of %s: %v", userID, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Domain migrations ---
+// When a school moves to a new email domain, /migratedomain moves its verified members to
+// the new domain in the store, so they keep their roles once roles.json lists the new
+// domain. Optionally every member is emailed at their address on the new domain with a
+// one-click link confirming they still have it; confirming replaces the address on
+// record. /migratedomain action:status shows how many have confirmed.
+
+const (
+	migrateActionStart  = "start"
+	migrateActionStatus = "status"
+
+	reconfirmPath         = "/reconfirm"
+	reconfirmEmailSubject = "Discord Verification: Confirm your new school address"
+
+	// Spaces out the reconfirmation emails so one migration doesn't trip the provider's rate limits
+	reconfirmEmailInterval = 2 * time.Second
+	// A reconfirmation link stops working this long after it was sent
+	reconfirmLinkTTL = 14 * 24 * time.Hour
+)
+
+type domainMigration struct {
+	OldDomain string    `json:"old_domain"`
+	NewDomain string    `json:"new_domain"`
+	StartedAt time.Time `json:"started_at"`
+	By        string    `json:"by"`
+	// Members moved to the new domain, keyed by user ID
+	Members map[string]*migratedMember `json:"members"`
+}
+
+type migratedMember struct {
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+	// Hash of the reconfirmation link's secret; empty until the email is sent
+	TokenHash   string    `json:"token_hash,omitempty"`
+	SentAt      time.Time `json:"sent_at,omitempty"`
+	ConfirmedAt time.Time `json:"confirmed_at,omitempty"`
+}
+
+func migrateDomainCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "migratedomain",
+		Description:              "Move a school's verified members to its new email domain (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "action", Description: "What to do", Required: true, Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "start", Value: migrateActionStart},
+				{Name: "status", Value: migrateActionStatus},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "The school's old email domain", Required: true, Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "new_domain", Description: "The school's new email domain"},
+			{Type: discordgo.ApplicationCommandOptionBoolean, Name: "email", Description: "Email members at their new address to confirm it"},
+		},
+	}
+}
+
+func handleMigrateDomain(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	oldDomain := strings.ToLower(strings.TrimSpace(optionString(i, "school")))
+	if domain, ok := resolveSchool(oldDomain); ok {
+		oldDomain = domain
+	}
+
+	if optionString(i, "action") == migrateActionStatus {
+		migration, ok := store.domainMigration(oldDomain)
+		if !ok {
+			respondError(s, i, fmt.Sprintf("エラー: `%s` の移行記録はありません.", oldDomain))
+			return
+		}
+		respondEphemeral(s, i, migrationStatus(migration))
+		return
+	}
+
+	newDomain := strings.ToLower(strings.TrimSpace(optionString(i, "new_domain")))
+	if newDomain == "" || !strings.Contains(newDomain, ".") || strings.Contains(newDomain, "@") || newDomain == oldDomain {
+		respondError(s, i, "エラー: `new_domain` に移行先のドメイン (例: `tokyo.kosen-ac.jp`) を指定してください.")
+		return
+	}
+	sendEmails := false
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Name == "email" {
+			sendEmails = opt.BoolValue()
+		}
+	}
+	if sendEmails && !magicLinksEnabled() {
+		respondError(s, i, "エラー: 確認メールのリンクには `public_url` と `WEB_ADDR` の設定が必要です.")
+		return
+	}
+
+	userID := interactionUser(i).ID
+	migration, err := store.startDomainMigration(oldDomain, newDomain, userID)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 移行の保存に失敗しました.", "Failed to start domain migration", err)
+		return
+	}
+	if len(migration.Members) == 0 {
+		respondEphemeral(s, i, fmt.Sprintf("`%s` で認証されたメンバーはいません.", oldDomain))
+		return
+	}
+	log.Printf("Domain migration %s -> %s started by %s: %d members", oldDomain, newDomain, userID, len(migration.Members))
+	alertAdmins(s, fmt.Sprintf("🔀 <@%s> が `%s` のメンバー%d人を `%s` に移行しました.", userID, oldDomain, len(migration.Members), newDomain))
+
+	message := fmt.Sprintf("🔀 `%s` の認証済みメンバー%d人を `%s` に移行しました.", oldDomain, len(migration.Members), newDomain)
+	if _, ok := schools[newDomain]; !ok {
+		message += fmt.Sprintf("\n⚠️ roles.json に `%s` がありません. 新しいドメインで学校ロールを付与するには roles.json に追加してください.", newDomain)
+	}
+	if sendEmails {
+		go sendReconfirmEmails(s, oldDomain)
+		message += "\n新しいアドレスへの確認メールを順に送信します. 進み具合は `/migratedomain action:status` で確認できます."
+	}
+	respondEphemeral(s, i, message)
+}
+
+func migrationStatus(m domainMigration) string {
+	sent, confirmed := 0, 0
+	for _, member := range m.Members {
+		if !member.SentAt.IsZero() {
+			sent++
+		}
+		if !member.ConfirmedAt.IsZero() {
+			confirmed++
+		}
+	}
+	return fmt.Sprintf("🔀 **`%s` → `%s`** (<t:%d:f>, <@%s>)\n対象 %d人 / 確認メール送信済み %d人 / 確認済み %d人",
+		m.OldDomain, m.NewDomain, m.StartedAt.Unix(), m.By, len(m.Members), sent, confirmed)
+}
+
+// Emails every member of a migration who hasn't been sent a link yet
+func sendReconfirmEmails(s *discordgo.Session, oldDomain string) {
+	migration, ok := store.domainMigration(oldDomain)
+	if !ok {
+		return
+	}
+	sent, failed := 0, 0
+	for userID, member := range migration.Members {
+		if !member.SentAt.IsZero() || !member.ConfirmedAt.IsZero() {
+			continue
+		}
+		acct := reserveMailQuota()
+		if acct == nil {
+			alertAdmins(s, fmt.Sprintf("📪 メールの送信上限に達したため、`%s` の確認メールの送信を中断しました (送信済み %d通). 明日 `/migratedomain action:start` を同じ内容で実行すると残りを送信します.", oldDomain, sent))
+			return
+		}
+		token, err := generateMagicToken()
+		if err != nil {
+			releaseMailQuota(acct)
+			log.Printf("Failed to generate reconfirmation token: %v", err)
+			return
+		}
+		msg := composeReconfirmEmail(acct.from, member.NewEmail, reconfirmLink(token))
+		if err := sendMail(context.Background(), acct, member.NewEmail, msg); err != nil {
+			releaseMailQuota(acct)
+			log.Printf("Failed to send reconfirmation email to user %s: %v", userID, err)
+			failed++
+			continue
+		}
+		sent++
+		if err := store.markReconfirmSent(oldDomain, userID, token); err != nil {
+			log.Printf("Failed to save reconfirmation email: %v", err)
+		}
+		time.Sleep(reconfirmEmailInterval)
+	}
+	log.Printf("Sent %d reconfirmation emails for %s (%d failed).", sent, oldDomain, failed)
+	alertAdmins(s, fmt.Sprintf("🔀 `%s` の確認メールを%d通送信しました (失敗 %d通).", oldDomain, sent, failed))
+}
+
+func reconfirmLink(token string) string {
+	return strings.TrimSuffix(config.PublicURL, "/") + reconfirmPath + "?token=" + url.QueryEscape(token)
+}
+
+func composeReconfirmEmail(from, to, link string) []byte {
+	text := "学校のメールアドレスが変更されたため、Discordサーバーの認証情報を新しいアドレスに更新します.\r\n" +
+		"次のリンクを開いて確認してください.\r\n" + link + "\r\n\r\n----------\r\n\r\n" +
+		"Your school moved to a new email domain. Open the link below to confirm your new address for the Discord server.\r\n" + link + "\r\n"
+	var buf bytes.Buffer
+	buf.WriteString("To: " + to + "\r\n")
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("Subject: " + reconfirmEmailSubject + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	writeBase64(&buf, []byte(text))
+	return buf.Bytes()
+}
+
+// Like the magic link, a GET only shows the button so mail scanners don't confirm for the user
+func handleReconfirm(s *discordgo.Session, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet:
+		magicLinkPage.Execute(w, magicLinkPageData{Action: reconfirmPath, Token: r.URL.Query().Get("token")})
+	case http.MethodPost:
+		token := r.PostFormValue("token")
+		if detectTokenReplay(s, tokenReconfirm, token, r) {
+			magicLinkPage.Execute(w, magicLinkPageData{Message: "エラー: このリンクは既に使用されています."})
+			return
+		}
+		magicLinkPage.Execute(w, magicLinkPageData{Message: redeemReconfirmLink(token)})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func redeemReconfirmLink(token string) string {
+	if token == "" {
+		return "エラー: リンクが正しくありません."
+	}
+	userID, email, err := store.confirmMigratedMember(token)
+	if err != nil {
+		log.Printf("Failed to save reconfirmation: %v", err)
+		return "エラー: 確認を保存できませんでした. しばらくしてからもう一度お試しください."
+	}
+	if userID == "" {
+		return "エラー: このリンクは無効か、期限切れか、既に使用されています."
+	}
+	consumeToken(tokenReconfirm, token, userID)
+	log.Printf("User %s confirmed their new address.", userID)
+	return fmt.Sprintf("新しいメールアドレス (%s) を確認しました. ありがとうございました.", email)
+}
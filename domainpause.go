@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Per-school pause ---
+// When one school's mail system is down its students never receive their code, and each
+// retry only adds another email to the pile. /schoolpause stops verification for that
+// school's addresses, telling its students why and when it should work again, while every
+// other school carries on. Queued emails to a paused school wait without using up attempts.
+
+const (
+	schoolPauseActionPause  = "pause"
+	schoolPauseActionResume = "resume"
+	schoolPauseActionList   = "list"
+
+	maxSchoolPauseHours = 24 * 14
+)
+
+type domainPause struct {
+	Domain string    `json:"domain"`
+	Since  time.Time `json:"since"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	// When the school's mail is expected to work again; zero if unknown
+	Estimate time.Time `json:"estimate,omitempty"`
+}
+
+func schoolPauseCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minHours := float64(1)
+	return &discordgo.ApplicationCommand{
+		Name:                     "schoolpause",
+		Description:              "Pause or resume verification for one school's email domain (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "action", Description: "What to do", Required: true, Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "pause", Value: schoolPauseActionPause},
+				{Name: "resume", Value: schoolPauseActionResume},
+				{Name: "list", Value: schoolPauseActionList},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "School name or email domain", Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "hours", Description: "Estimated hours until the school's mail works again", MinValue: &minHours, MaxValue: maxSchoolPauseHours},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "reason", Description: "Shown to the school's students"},
+		},
+	}
+}
+
+func handleSchoolPause(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	userID := interactionUser(i).ID
+	action := optionString(i, "action")
+	if action == schoolPauseActionList {
+		respondEphemeral(s, i, domainPauseList())
+		return
+	}
+
+	domain, ok := resolveSchool(optionString(i, "school"))
+	if !ok {
+		respondError(s, i, "エラー: 学校が見つかりません. 候補から選んでください.")
+		return
+	}
+	switch action {
+	case schoolPauseActionPause:
+		pause := domainPause{Domain: domain, Since: time.Now(), By: userID, Reason: optionString(i, "reason")}
+		for _, opt := range i.ApplicationCommandData().Options {
+			if opt.Name == "hours" {
+				pause.Estimate = time.Now().Add(time.Duration(opt.IntValue()) * time.Hour)
+			}
+		}
+		if err := store.setDomainPause(pause); err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save domain pause", err)
+			return
+		}
+		log.Printf("Verification for %s paused by %s", domain, userID)
+		alertModerators(s, fmt.Sprintf("⏸️ <@%s> が%sの認証を一時停止しました.", userID, schoolName(domain)))
+		respondEphemeral(s, i, fmt.Sprintf("⏸️ %s (`%s`) の認証を一時停止しました. 再開するには `/schoolpause action:resume` を実行してください.", schoolName(domain), domain))
+	case schoolPauseActionResume:
+		if _, paused := store.domainPause(domain); !paused {
+			respondEphemeral(s, i, fmt.Sprintf("%sの認証は停止されていません.", schoolName(domain)))
+			return
+		}
+		if err := store.removeDomainPause(domain); err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to remove domain pause", err)
+			return
+		}
+		log.Printf("Verification for %s resumed by %s", domain, userID)
+		alertModerators(s, fmt.Sprintf("▶️ <@%s> が%sの認証を再開しました.", userID, schoolName(domain)))
+		respondEphemeral(s, i, fmt.Sprintf("▶️ %sの認証を再開しました.", schoolName(domain)))
+	}
+}
+
+func domainPauseList() string {
+	pauses := store.domainPauses()
+	if len(pauses) == 0 {
+		return "一時停止中の学校はありません."
+	}
+	sort.Slice(pauses, func(a, b int) bool { return pauses[a].Since.Before(pauses[b].Since) })
+	lines := []string{"⏸️ **一時停止中の学校**"}
+	for _, p := range pauses {
+		line := fmt.Sprintf("- %s (`%s`) <t:%d:R>から, <@%s>", schoolName(p.Domain), p.Domain, p.Since.Unix(), p.By)
+		if !p.Estimate.IsZero() {
+			line += fmt.Sprintf(", 再開の目安 <t:%d:f>", p.Estimate.Unix())
+		}
+		if p.Reason != "" {
+			line += ": " + p.Reason
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the pause covering an address, if its school is paused
+func pausedDomainFor(email string) (domainPause, bool) {
+	return store.domainPause(emailDomain(email))
+}
+
+// Replies with the pause notice and returns true if the address's school is paused
+func respondIfDomainPaused(s *discordgo.Session, i *discordgo.InteractionCreate, email string) bool {
+	pause, paused := pausedDomainFor(email)
+	if !paused {
+		return false
+	}
+	lang := interactionLanguage(i)
+	reason := ""
+	if pause.Reason != "" {
+		reason = pause.Reason + " "
+	}
+	estimate := ""
+	if pause.Estimate.After(time.Now()) {
+		if lang == langEN {
+			estimate = fmt.Sprintf("It should work again <t:%d:R>. ", pause.Estimate.Unix())
+		} else {
+			estimate = fmt.Sprintf("再開の目安は<t:%d:R>です. ", pause.Estimate.Unix())
+		}
+	}
+	respondEphemeral(s, i, localized(i, msgDomainPaused, "{school}", schoolName(pause.Domain), "{reason}", reason, "{estimate}", estimate))
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Email confirmation ---
+// /verify doesn't send right away: the user first sees the address (partly masked, since
+// the prompt may end up in a screenshot) with Confirm and Edit buttons. A typo caught
+// here costs neither an email from the resend quota nor a cooldown.
+
+const (
+	emailConfirmButtonID = "email_confirm"
+	emailEditButtonID    = "email_edit"
+	emailEditModalID     = "email_edit_modal"
+	emailEditInputID     = "email"
+
+	emailConfirmationTTL = 10 * time.Minute
+)
+
+type emailConfirmation struct {
+	Email     string
+	GuildID   string
+	ExpiresAt time.Time
+}
+
+var (
+	emailConfirmations     = make(map[string]emailConfirmation) // keyed by user ID
+	emailConfirmationMutex = &sync.Mutex{}
+)
+
+// Masks the end of the local part ("s123456@..." becomes "s1234xx@...") and keeps the
+// domain, where most typos are
+func maskEmailForConfirmation(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 2 {
+		return email
+	}
+	return email[:at-2] + "xx" + email[at:]
+}
+
+func askEmailConfirmation(s *discordgo.Session, i *discordgo.InteractionCreate, target, email string) {
+	userID := interactionUser(i).ID
+	emailConfirmationMutex.Lock()
+	emailConfirmations[userID] = emailConfirmation{Email: email, GuildID: target, ExpiresAt: time.Now().Add(emailConfirmationTTL)}
+	emailConfirmationMutex.Unlock()
+
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("`%s` に認証メールを送信します. よろしいですか?", maskEmailForConfirmation(email)),
+			Flags:   discordgo.MessageFlagsEphemeral,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.Button{Label: "送信する", Style: discordgo.SuccessButton, CustomID: emailConfirmButtonID},
+					discordgo.Button{Label: "修正する", Style: discordgo.SecondaryButton, CustomID: emailEditButtonID},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to ask for email confirmation: %v", err)
+	}
+}
+
+// Returns the address waiting for confirmation, if it hasn't expired
+func pendingEmailConfirmation(userID string) (emailConfirmation, bool) {
+	emailConfirmationMutex.Lock()
+	defer emailConfirmationMutex.Unlock()
+	c, ok := emailConfirmations[userID]
+	if ok && time.Now().After(c.ExpiresAt) {
+		delete(emailConfirmations, userID)
+		return emailConfirmation{}, false
+	}
+	return c, ok
+}
+
+func handleEmailConfirm(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	emailConfirmationMutex.Lock()
+	c, ok := emailConfirmations[userID]
+	delete(emailConfirmations, userID)
+	emailConfirmationMutex.Unlock()
+	if !ok || time.Now().After(c.ExpiresAt) {
+		respondError(s, i, "エラー: この確認は期限切れか、既に使用されています. もう一度 `/verify` を実行してください.")
+		return
+	}
+	if respondIfMaintenance(s, i) {
+		return
+	}
+	if remaining := lockoutRemaining(userID); remaining > 0 {
+		respondError(s, i, lockoutMessage(i, remaining))
+		return
+	}
+	sendVerificationCode(s, i, c.GuildID, c.Email)
+}
+
+func handleEmailEdit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	c, ok := pendingEmailConfirmation(interactionUser(i).ID)
+	if !ok {
+		respondError(s, i, "エラー: この確認は期限切れか、既に使用されています. もう一度 `/verify` を実行してください.")
+		return
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: emailEditModalID,
+			Title:    "メールアドレスの修正",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:  emailEditInputID,
+						Label:     "学校のメールアドレス",
+						Style:     discordgo.TextInputShort,
+						Value:     c.Email,
+						Required:  true,
+						MaxLength: 254,
+					},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to open email edit modal: %v", err)
+	}
+}
+
+func handleEmailEditSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	c, ok := pendingEmailConfirmation(interactionUser(i).ID)
+	if !ok {
+		respondError(s, i, "エラー: この確認は期限切れです. もう一度 `/verify` を実行してください.")
+		return
+	}
+	email := normalizeEmail(modalValue(i.ModalSubmitData(), emailEditInputID))
+	if !checkVerificationAddress(s, i, c.GuildID, email) {
+		return
+	}
+	askEmailConfirmation(s, i, c.GuildID, email)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// --- Email normalization ---
+// Addresses are normalized before they are checked against the email rules: NFKC folds
+// full-width and other compatibility characters ("ｔａｒｏ＠…" becomes "taro@…") and
+// invisible characters pasted along with the address are dropped. Addresses mixing
+// scripts, like a Cyrillic "о" in "kosen-ac.jp", are rejected outright so a lookalike
+// domain can't pass the suffix check.
+
+// Characters that render as nothing and only ever get into addresses by accident or on purpose
+var invisibleChars = strings.NewReplacer(
+	"\u200b", "", // zero width space
+	"\u200c", "", // zero width non-joiner
+	"\u200d", "", // zero width joiner
+	"\u2060", "", // word joiner
+	"\ufeff", "", // zero width no-break space
+	"\u00ad", "", // soft hyphen
+)
+
+// Scripts a letter in an address is attributed to; letters outside them count as "other"
+var emailScripts = []struct {
+	Name  string
+	Table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+}
+
+// Applies NFKC, drops invisible characters and surrounding whitespace, and lowercases the domain
+func normalizeEmail(email string) string {
+	email = strings.TrimSpace(invisibleChars.Replace(norm.NFKC.String(email)))
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		email = email[:at] + strings.ToLower(email[at:])
+	}
+	return email
+}
+
+// Reports whether the letters of an address come from more than one script
+func hasMixedScripts(email string) bool {
+	seen := ""
+	for _, r := range email {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		script := "other"
+		for _, s := range emailScripts {
+			if unicode.Is(s.Table, r) {
+				script = s.Name
+				break
+			}
+		}
+		if seen != "" && seen != script {
+			return true
+		}
+		seen = script
+	}
+	return false
+}
+
+// --- Code normalization ---
+// Japanese IMEs often type the code in full-width digits ("１２３４５６"), and codes copied
+// from the email pick up spaces or get read in groups with a hyphen. NFKC folds the digits,
+// and separators and invisible characters are dropped before the code is compared.
+
+// Separators people put between groups of digits, after NFKC (which already turns "－" into "-")
+var codeSeparators = strings.NewReplacer(
+	"-", "",
+	"\u2010", "", // hyphen
+	"\u2011", "", // non-breaking hyphen
+	"\u2012", "", // figure dash
+	"\u2013", "", // en dash
+	"\u2014", "", // em dash
+	"\u2212", "", // minus sign
+	"\u30fc", "", // katakana prolonged sound mark, typed for "-" with a Japanese IME
+	"_", "",
+	".", "",
+)
+
+func normalizeCode(code string) string {
+	code = codeSeparators.Replace(invisibleChars.Replace(norm.NFKC.String(code)))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Domain typo suggestions ---
+// A rejected address whose domain is a letter or two away from a known school domain
+// ("tokyo.kosen-ac.jo", "tokyo.kosenac.jp") gets a suggestion with a button that puts the
+// corrected address through the usual confirmation.
+
+const (
+	emailSuggestButtonID = "email_suggest"
+
+	// Largest edit distance still treated as a typo
+	maxDomainTypoDistance = 2
+)
+
+var (
+	emailSuggestions     = make(map[string]emailConfirmation) // keyed by user ID
+	emailSuggestionMutex = &sync.Mutex{}
+)
+
+// Returns the corrected address for a near-miss domain, or "" if nothing is close enough
+func suggestEmailCorrection(rules *EmailRules, email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return ""
+	}
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+
+	var candidates []string
+	for known := range schools {
+		candidates = append(candidates, known)
+	}
+	// Without a school list, keep the school label and fix the rest
+	if label, _, ok := strings.Cut(domain, "."); ok {
+		for _, suffix := range rules.AllowedSuffixes {
+			candidates = append(candidates, label+"."+strings.ToLower(suffix))
+		}
+	}
+
+	best, bestDistance := "", maxDomainTypoDistance+1
+	for _, candidate := range candidates {
+		if candidate == domain {
+			continue
+		}
+		if d := editDistance(domain, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" || !rules.allows(local+"@"+best) {
+		return ""
+	}
+	return local + "@" + best
+}
+
+// Levenshtein distance between two ASCII strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Tells the user the address was rejected, offering the suggestion as a button
+func respondWithEmailSuggestion(s *discordgo.Session, i *discordgo.InteractionCreate, target, message, suggestion string) {
+	markInteractionFailed(i)
+	emailSuggestionMutex.Lock()
+	emailSuggestions[interactionUser(i).ID] = emailConfirmation{Email: suggestion, GuildID: target, ExpiresAt: time.Now().Add(emailConfirmationTTL)}
+	emailSuggestionMutex.Unlock()
+
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("%s\nもしかして: `%s`", message, suggestion),
+			Flags:   discordgo.MessageFlagsEphemeral,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.Button{Label: "このアドレスを使う", Style: discordgo.PrimaryButton, CustomID: emailSuggestButtonID},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to suggest email correction: %v", err)
+	}
+}
+
+func handleEmailSuggestion(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	emailSuggestionMutex.Lock()
+	c, ok := emailSuggestions[userID]
+	delete(emailSuggestions, userID)
+	emailSuggestionMutex.Unlock()
+	if !ok || time.Now().After(c.ExpiresAt) {
+		respondError(s, i, "エラー: この候補は期限切れです. もう一度 `/verify` を実行してください.")
+		return
+	}
+	if !checkVerificationAddress(s, i, c.GuildID, c.Email) {
+		return
+	}
+	askEmailConfirmation(s, i, c.GuildID, c.Email)
+}
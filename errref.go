@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Returns a short random ID tying a user-facing error to its log entry
+func newErrorRef() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Tells the user an internal error happened. The interaction may already have been
+// acknowledged by the time a handler fails, so fall back to a follow-up message.
+func respondInternalError(s *discordgo.Session, i *discordgo.InteractionCreate, ref string) {
+	content := fmt.Sprintf("エラー: 内部エラーが発生しました. 管理者に連絡してください. (参照ID: `%s`)", ref)
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil && !errors.Is(err, errInteractionClosed) {
+		s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{Content: content, Flags: discordgo.MessageFlagsEphemeral})
+	}
+}
+
+// Logs an internal error with full context under a new reference ID, and shows the user
+// message with that ID appended so admins can find the log entry from a screenshot
+func respondWithErrorRef(s *discordgo.Session, i *discordgo.InteractionCreate, userMessage, context string, err error) {
+	ref := newErrorRef()
+	log.Printf("ERROR [%s] %s: %v (user=%s guild=%s channel=%s interaction=%s)",
+		ref, context, err, interactionUser(i).ID, i.GuildID, i.ChannelID, i.ID)
+	respondError(s, i, fmt.Sprintf("%s (参照ID: `%s`)", userMessage, ref))
+}
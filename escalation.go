@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Escalation to human moderators ---
+
+const callModeratorButtonID = "call_moderator_button"
+
+func callModeratorButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "担当者を呼ぶ",
+		Style:    discordgo.SecondaryButton,
+		CustomID: callModeratorButtonID,
+		Emoji:    &discordgo.ComponentEmoji{Name: "🙋"},
+	}
+}
+
+func handleCallModerator(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	ownerID, ok := store.verificationChannelOwner(i.ChannelID)
+	if !ok || ownerID != interactionUser(i).ID {
+		respondError(s, i, "エラー: このボタンは認証チャンネルの本人のみ使用できます.")
+		return
+	}
+	if !featureEnabled(i.GuildID, featureEscalation) {
+		respondError(s, i, "エラー: 現在このサーバーでは担当者の呼び出しを受け付けていません.")
+		return
+	}
+
+	escalated, err := escalateToModerators(s, i.ChannelID, ownerID, "ユーザーが担当者の対応を求めています.")
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 担当者の呼び出しに失敗しました. 時間をおいてお試しください.", "Failed to escalate verification channel", err)
+		return
+	}
+	if !escalated {
+		respondEphemeral(s, i, "既に担当者を呼び出しています. 対応をお待ちください.")
+		return
+	}
+	respondEphemeral(s, i, "担当者を呼び出しました. このチャンネルで対応をお待ちください.")
+}
+
+// Grants the moderator role access to a verification channel and pings it.
+// Returns false without doing anything if the channel was already escalated.
+func escalateToModerators(s *discordgo.Session, channelID, userID, reason string) (bool, error) {
+	if moderatorRoleID == "" {
+		return false, fmt.Errorf("DISCORD_MODERATOR_ROLE_ID is not set")
+	}
+	marked, err := store.markVerificationChannelEscalated(channelID)
+	if err != nil || !marked {
+		return false, err
+	}
+
+	err = s.ChannelPermissionSet(channelID, moderatorRoleID, discordgo.PermissionOverwriteTypeRole,
+		discordgo.PermissionViewChannel|discordgo.PermissionSendMessages|discordgo.PermissionReadMessageHistory, 0)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = sendMessage(s, channelID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("<@&%s> %s (<@%s>)", moderatorRoleID, reason, userID),
+		AllowedMentions: &discordgo.MessageAllowedMentions{Roles: []string{moderatorRoleID}},
+	})
+	return true, err
+}
+
+// --- Automatic escalation ---
+
+// AutoEscalation calls moderators into a verification channel when the user keeps failing.
+// A limit of 0 disables that trigger.
+type AutoEscalation struct {
+	MaxCodeFailures int `json:"max_code_failures"`
+	// Also call them when the user has used up policy.max_resends
+	Resends bool `json:"resends"`
+	// Deprecated: the resend limit is policy.max_resends; a positive value turns on resends
+	MaxResends int `json:"max_resends,omitempty"`
+}
+
+type verificationTrouble struct {
+	CodeFailures int
+	Emails       int
+	// Email requests counted against policy.max_resends, reset by a lockout
+	Requests    int
+	LockedUntil time.Time
+}
+
+var (
+	// Failed codes and sent emails per user since their last successful verification
+	verificationTroubles = make(map[string]*verificationTrouble)
+	troubleMutex         = &sync.Mutex{}
+)
+
+// Records a wrong code and escalates if the user hit the configured limit
+func recordCodeFailure(s *discordgo.Session, userID string) {
+	troubleMutex.Lock()
+	t := troubleFor(userID)
+	t.CodeFailures++
+	failures := t.CodeFailures
+	troubleMutex.Unlock()
+
+	if limit := config.AutoEscalation.MaxCodeFailures; limit > 0 && failures == limit {
+		autoEscalate(s, userID, fmt.Sprintf("認証コードの入力に %d 回失敗しています.", failures))
+	}
+}
+
+// Records a sent verification email and escalates once the user has used up their resends
+func recordEmailSent(s *discordgo.Session, userID string, p Policy) {
+	troubleMutex.Lock()
+	t := troubleFor(userID)
+	t.Emails++
+	resends := t.Emails - 1
+	troubleMutex.Unlock()
+
+	if limit := p.MaxResends; config.AutoEscalation.Resends && limit > 0 && resends == limit {
+		autoEscalate(s, userID, fmt.Sprintf("認証メールを %d 回再送しています.", resends))
+	}
+}
+
+func clearVerificationTrouble(userID string) {
+	troubleMutex.Lock()
+	delete(verificationTroubles, userID)
+	troubleMutex.Unlock()
+}
+
+// troubleMutex must be held
+func troubleFor(userID string) *verificationTrouble {
+	t, ok := verificationTroubles[userID]
+	if !ok {
+		t = &verificationTrouble{}
+		verificationTroubles[userID] = t
+	}
+	return t
+}
+
+func autoEscalate(s *discordgo.Session, userID, reason string) {
+	if moderatorRoleID == "" || !featureEnabled(guildID, featureEscalation) {
+		return
+	}
+	for _, channelID := range store.verificationChannelsOf(userID) {
+		escalated, err := escalateToModerators(s, channelID, userID, "認証が進んでいないようです: "+reason)
+		if err != nil {
+			log.Printf("Failed to auto-escalate verification channel %s: %v", channelID, err)
+			continue
+		}
+		if escalated {
+			log.Printf("Auto-escalated verification channel %s: %s", channelID, reason)
+		}
+	}
+}
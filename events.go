@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification events ---
+// A member can end up verified through the email code, a magic link, an appeal, an ID
+// card review, the end of probation or the waitlist. Instead of every one of those paths
+// calling each feature that cares, they publish the event here and the features
+// subscribe from init, the same way jobs register with the scheduler.
+
+type verifiedHandler func(s *discordgo.Session, member verifiedMember)
+
+var verifiedHandlers []verifiedHandler
+
+func onVerified(handler verifiedHandler) {
+	verifiedHandlers = append(verifiedHandlers, handler)
+}
+
+// Tells the subscribers a member was verified; called once the roles are granted
+func publishVerified(s *discordgo.Session, member verifiedMember) {
+	if member.GuildID == "" {
+		member.GuildID = guildID
+	}
+	for _, handler := range verifiedHandlers {
+		handler(s, member)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- FAQ ---
+
+const (
+	faqButtonID   = "faq_button"
+	faqPagePrefix = "faq_page:"
+)
+
+type faqEntry struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+var faqEntries []faqEntry
+
+// Loads the FAQ shown by the help button in verification channels
+func loadFAQ(path string) error {
+	file, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No %s found, the FAQ button is disabled.", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(file, &faqEntries); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	log.Printf("Successfully loaded %d FAQ entries.", len(faqEntries))
+	return nil
+}
+
+func faqButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "困ったら",
+		Style:    discordgo.SecondaryButton,
+		CustomID: faqButtonID,
+		Emoji:    &discordgo.ComponentEmoji{Name: "💡"},
+	}
+}
+
+func handleFAQ(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if len(faqEntries) == 0 {
+		respondEphemeral(s, i, "FAQは現在準備中です. お困りの場合は管理者にお問い合わせください.")
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: faqPage(0, discordgo.MessageFlagsEphemeral),
+	})
+}
+
+// Handles the previous/next buttons by replacing the FAQ message with another page
+func handleFAQPage(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	page, err := strconv.Atoi(strings.TrimPrefix(i.MessageComponentData().CustomID, faqPagePrefix))
+	if err != nil || len(faqEntries) == 0 {
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: faqPage(page, 0),
+	})
+}
+
+func faqPage(page int, flags discordgo.MessageFlags) *discordgo.InteractionResponseData {
+	page = (page%len(faqEntries) + len(faqEntries)) % len(faqEntries)
+	entry := faqEntries[page]
+	embed := &discordgo.MessageEmbed{
+		Title:       "Q. " + entry.Question,
+		Description: entry.Answer,
+		Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("%d / %d", page+1, len(faqEntries))},
+		Color:       0x5865F2,
+	}
+	return &discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{embed},
+		Flags:  flags,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "前へ", Style: discordgo.SecondaryButton, CustomID: faqPagePrefix + strconv.Itoa(page-1), Disabled: len(faqEntries) == 1},
+				discordgo.Button{Label: "次へ", Style: discordgo.SecondaryButton, CustomID: faqPagePrefix + strconv.Itoa(page+1), Disabled: len(faqEntries) == 1},
+			}},
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Feature flags ---
+// A flag is resolved in order: runtime override set with /feature, the guild's config,
+// the global config, then the built-in default below.
+
+const (
+	featureAppeals          = "appeals"
+	featureIDCard           = "id_card"
+	featureEscalation       = "escalation"
+	featureDMCommands       = "dm_commands"
+	featureRealName         = "real_name"
+	featureRequireScreening = "require_screening"
+	featureStateOn          = "on"
+	featureStateOff         = "off"
+	featureStateReset       = "default"
+)
+
+type featureInfo struct {
+	Default     bool
+	Description string
+}
+
+var knownFeatures = map[string]featureInfo{
+	featureAppeals:          {true, "/appeal による申し立て"},
+	featureIDCard:           {true, "学生証の画像による手動認証"},
+	featureEscalation:       {true, "認証チャンネルの「担当者を呼ぶ」ボタン"},
+	featureDMCommands:       {true, "DMからのコマンド実行"},
+	featureRealName:         {false, "認証後の本名ニックネームの登録と維持"},
+	featureRequireScreening: {false, "ルールへの同意(メンバースクリーニング)が済むまで認証ボタンを無効にする"},
+}
+
+func validateFeatures(flags map[string]bool) error {
+	for name := range flags {
+		if _, ok := knownFeatures[name]; !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+func featureEnabled(guild, name string) bool {
+	if enabled, ok := store.featureOverride(guild, name); ok {
+		return enabled
+	}
+	if gc, ok := config.Guilds[guild]; ok {
+		if enabled, ok := gc.Features[name]; ok {
+			return enabled
+		}
+	}
+	if enabled, ok := config.Features[name]; ok {
+		return enabled
+	}
+	return knownFeatures[name].Default
+}
+
+func sortedFeatureNames() []string {
+	names := make([]string, 0, len(knownFeatures))
+	for name := range knownFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func featureCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, name := range sortedFeatureNames() {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: name})
+	}
+	return &discordgo.ApplicationCommand{
+		Name:                     "feature",
+		Description:              "Show or change feature flags for this server (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "name", Description: "Feature to change", Choices: choices},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "state", Description: "New state", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: featureStateOn, Value: featureStateOn},
+				{Name: featureStateOff, Value: featureStateOff},
+				{Name: featureStateReset, Value: featureStateReset},
+			}},
+		},
+	}
+}
+
+func handleFeature(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	name, state := optionString(i, "name"), optionString(i, "state")
+	if name != "" && state != "" {
+		var err error
+		switch state {
+		case featureStateReset:
+			err = store.clearFeatureOverride(i.GuildID, name)
+		default:
+			err = store.setFeatureOverride(i.GuildID, name, state == featureStateOn)
+		}
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save feature override", err)
+			return
+		}
+		log.Printf("Feature %s set to %s in guild %s by %s", name, state, i.GuildID, interactionUser(i).ID)
+	}
+	note := ""
+	if featureEnabled(i.GuildID, name) {
+		note = intentRestartNote(s, name)
+	}
+
+	var lines []string
+	for _, feature := range sortedFeatureNames() {
+		mark := "❌"
+		if featureEnabled(i.GuildID, feature) {
+			mark = "✅"
+		}
+		line := fmt.Sprintf("%s `%s` — %s", mark, feature, knownFeatures[feature].Description)
+		if _, overridden := store.featureOverride(i.GuildID, feature); overridden {
+			line += " (手動設定)"
+		}
+		lines = append(lines, line)
+	}
+	respondEphemeral(s, i, strings.Join(lines, "\n")+note)
+}
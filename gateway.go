@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Gateway connection state ---
+
+const (
+	gatewayOpenAttempts    = 10
+	gatewayOpenBaseBackoff = 2 * time.Second
+	gatewayOpenMaxBackoff  = 2 * time.Minute
+	gatewayPollInterval    = 5 * time.Second
+)
+
+var (
+	gatewayConnected atomic.Bool
+
+	// When the current outage started; zero while connected
+	disconnectedAt time.Time
+	outageMutex    = &sync.Mutex{}
+)
+
+// Opens the gateway, retrying with exponential backoff so a brief Discord outage
+// or network hiccup at boot doesn't leave the bot dead
+func openGateway(dg *discordgo.Session) error {
+	backoff := gatewayOpenBaseBackoff
+	var err error
+	for attempt := 1; attempt <= gatewayOpenAttempts; attempt++ {
+		if err = dg.Open(); err == nil {
+			return nil
+		}
+		log.Printf("Error opening connection (attempt %d/%d): %v. Retrying in %s.", attempt, gatewayOpenAttempts, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > gatewayOpenMaxBackoff {
+			backoff = gatewayOpenMaxBackoff
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", gatewayOpenAttempts, err)
+}
+
+// Blocks until the gateway is connected. Time-sensitive background jobs call this
+// so they pause during an outage instead of failing every attempt.
+func waitForGateway() {
+	for !gatewayConnected.Load() {
+		time.Sleep(gatewayPollInterval)
+	}
+}
+
+func onConnect(s *discordgo.Session, c *discordgo.Connect) {
+	markGatewayUp(s)
+}
+
+func onResumed(s *discordgo.Session, r *discordgo.Resumed) {
+	markGatewayUp(s)
+}
+
+func onDisconnect(s *discordgo.Session, d *discordgo.Disconnect) {
+	gatewayConnected.Store(false)
+	outageMutex.Lock()
+	if disconnectedAt.IsZero() {
+		disconnectedAt = time.Now()
+	}
+	outageMutex.Unlock()
+	log.Println("Gateway connection lost, background jobs are paused until it comes back.")
+}
+
+func markGatewayUp(s *discordgo.Session) {
+	gatewayConnected.Store(true)
+	outageMutex.Lock()
+	started := disconnectedAt
+	disconnectedAt = time.Time{}
+	outageMutex.Unlock()
+
+	if !started.IsZero() {
+		log.Printf("Gateway connection restored after an outage of %s.", time.Since(started).Round(time.Second))
+	}
+	onGatewayRecovered(s)
+}
+
+// Work held back during an outage is resumed as soon as Discord is reachable again
+func onGatewayRecovered(s *discordgo.Session) {
+	if n := store.rescheduleRoleGrants(); n > 0 {
+		log.Printf("Gateway is back, retrying %d queued role grants now.", n)
+	}
+}
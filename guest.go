@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Guest access ---
+// The "guest" welcome button gives prospective students a limited role without email
+// verification so they can look around. When the guest period ends they are reminded to
+// verify, and with on_expiry "remove" they also lose the guest role.
+
+const (
+	guestButtonID = "guest_button"
+
+	guestExpiryRemind = "remind"
+	guestExpiryRemove = "remove"
+
+	guestPollInterval = time.Minute
+)
+
+type GuestConfig struct {
+	// Role granted by the guest button; the button is not shown without it
+	RoleID      string `json:"role_id"`
+	ButtonLabel string `json:"button_label"`
+	// How long guest access lasts, 0 for no limit
+	Expiry Duration `json:"expiry"`
+	// What happens when it ends: "remind" (DM only) or "remove" (DM and remove the role)
+	OnExpiry string `json:"on_expiry"`
+}
+
+type guestEntry struct {
+	UserID    string    `json:"user_id"`
+	GuildID   string    `json:"guild_id"`
+	GrantedAt time.Time `json:"granted_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func defaultGuestConfig() GuestConfig {
+	return GuestConfig{ButtonLabel: "ゲストとして参加", Expiry: Duration{72 * time.Hour}, OnExpiry: guestExpiryRemind}
+}
+
+func (g GuestConfig) validate() error {
+	switch g.OnExpiry {
+	case guestExpiryRemind, guestExpiryRemove:
+	default:
+		return fmt.Errorf("on_expiry must be %q or %q, got %q", guestExpiryRemind, guestExpiryRemove, g.OnExpiry)
+	}
+	if g.Expiry.Duration < 0 {
+		return fmt.Errorf("expiry must not be negative")
+	}
+	return nil
+}
+
+func guestButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    config.Guest.ButtonLabel,
+		Style:    discordgo.SecondaryButton,
+		CustomID: guestButtonID,
+		Emoji:    &discordgo.ComponentEmoji{Name: "👀"},
+	}
+}
+
+func handleGuestButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	if config.Guest.RoleID == "" {
+		respondError(s, i, "エラー: ゲスト参加は設定されていません.")
+		return
+	}
+	if _, verified := store.isVerified(userID); verified {
+		respondEphemeral(s, i, "既に認証済みです.")
+		return
+	}
+	if guest, ok := store.guest(userID); ok {
+		respondEphemeral(s, i, "既にゲストとして参加しています."+guestExpiryNote(guest))
+		return
+	}
+
+	if err := s.GuildMemberRoleAdd(i.GuildID, userID, config.Guest.RoleID); err != nil {
+		respondWithErrorRef(s, i, "エラー: ゲストロールの付与に失敗しました. 管理者に連絡してください.", "Failed to add guest role", err)
+		return
+	}
+	guest := guestEntry{UserID: userID, GuildID: i.GuildID, GrantedAt: time.Now()}
+	if config.Guest.Expiry.Duration > 0 {
+		guest.ExpiresAt = guest.GrantedAt.Add(config.Guest.Expiry.Duration)
+	}
+	if err := store.putGuest(guest); err != nil {
+		log.Printf("Failed to save guest %s: %v", userID, err)
+	}
+	log.Printf("User %s joined as a guest", userID)
+	respondEphemeral(s, i, "ゲストとして参加しました. 一部のチャンネルを閲覧できます. 高専生の方は認証すると全てのチャンネルを利用できます."+guestExpiryNote(guest))
+}
+
+func guestExpiryNote(guest guestEntry) string {
+	if guest.ExpiresAt.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("\nゲスト期間は <t:%d:R> に終了します.", guest.ExpiresAt.Unix())
+}
+
+// Drops the guest role and record once a guest has verified
+func endGuestAccess(s *discordgo.Session, userID string) {
+	guest, ok := store.guest(userID)
+	if !ok {
+		return
+	}
+	if err := s.GuildMemberRoleRemove(guest.GuildID, userID, config.Guest.RoleID); err != nil {
+		log.Printf("Failed to remove guest role from %s: %v", userID, err)
+	}
+	if err := store.removeGuest(userID); err != nil {
+		log.Printf("Failed to remove guest %s: %v", userID, err)
+	}
+}
+
+// Background loop ending expired guest periods
+func runGuestExpiry(s *discordgo.Session) {
+	if config.Guest.RoleID == "" {
+		return
+	}
+	ticker := time.NewTicker(guestPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !gatewayConnected.Load() {
+			continue
+		}
+		for _, guest := range store.expiredGuests(time.Now()) {
+			expireGuest(s, guest)
+		}
+	}
+}
+
+func expireGuest(s *discordgo.Session, guest guestEntry) {
+	message := fmt.Sprintf("ゲスト期間が終了しました. 引き続き参加するには <#%s> から高専のメールアドレスで認証してください.", welcomeChannelID)
+	if config.Guest.OnExpiry == guestExpiryRemove {
+		if err := s.GuildMemberRoleRemove(guest.GuildID, guest.UserID, config.Guest.RoleID); err != nil {
+			log.Printf("Failed to remove guest role from %s: %v", guest.UserID, err)
+			return
+		}
+		message = fmt.Sprintf("ゲスト期間が終了したため、ゲストロールを外しました. 高専生の方は <#%s> から認証するとサーバーを利用できます.", welcomeChannelID)
+	}
+	if err := notifyUser(s, guest.UserID, message); err != nil {
+		log.Printf("Failed to send guest expiry DM to %s: %v", guest.UserID, err)
+	}
+	log.Printf("Guest period of %s ended (%s)", guest.UserID, config.Guest.OnExpiry)
+
+	// A reminded guest keeps the role but is only reminded once
+	if config.Guest.OnExpiry == guestExpiryRemove {
+		if err := store.removeGuest(guest.UserID); err != nil {
+			log.Printf("Failed to remove guest %s: %v", guest.UserID, err)
+		}
+		return
+	}
+	guest.ExpiresAt = time.Time{}
+	if err := store.putGuest(guest); err != nil {
+		log.Printf("Failed to save guest %s: %v", guest.UserID, err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Student ID card verification ---
+// Alternative path for students whose school mail doesn't work: they upload a photo of
+// their student ID card in the private channel and a moderator reviews it by hand.
+
+const (
+	idCardApprovePrefix = "idcard_approve:"
+	idCardDenyPrefix    = "idcard_deny:"
+	maxIDCardImageBytes = 8 << 20
+	// The download runs in the gateway event handler, so a slow CDN mustn't hold it up
+	idCardDownloadTimeout = 15 * time.Second
+)
+
+func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.Bot {
+		return
+	}
+	ownerID, ok := store.verificationChannelOwner(m.ChannelID)
+	if !ok || ownerID != m.Author.ID || !featureEnabled(m.GuildID, featureIDCard) {
+		return
+	}
+	for _, attachment := range m.Attachments {
+		if strings.HasPrefix(attachment.ContentType, "image/") {
+			handleIDCardUpload(s, m.Message, attachment)
+			return
+		}
+	}
+}
+
+func handleIDCardUpload(s *discordgo.Session, m *discordgo.Message, image *discordgo.MessageAttachment) {
+	if modChannelID == "" {
+		sendText(s, m.ChannelID, "エラー: 現在このサーバーでは学生証による認証を受け付けていません.")
+		return
+	}
+	if review, ok := store.idCardReview(m.Author.ID); ok && review.Status == reviewStatusPending {
+		sendText(s, m.ChannelID, "既に学生証を審査中です. 結果が出るまでお待ちください.")
+		return
+	}
+	if image.Size > maxIDCardImageBytes {
+		sendText(s, m.ChannelID, "エラー: 画像のサイズが大きすぎます. 8MB以下の画像をアップロードしてください.")
+		return
+	}
+
+	// Re-upload the image to the mod channel so the review doesn't depend on the original message
+	data, err := downloadIDCardImage(image.URL)
+	if err != nil {
+		log.Printf("Failed to download ID card image: %v", err)
+		sendText(s, m.ChannelID, "エラー: 画像の取得に失敗しました. もう一度アップロードしてください.")
+		return
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title: "学生証の審査",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "ユーザー", Value: fmt.Sprintf("<@%s> (%s)", m.Author.ID, m.Author.Username)},
+		},
+		Image: &discordgo.MessageEmbedImage{URL: "attachment://" + image.Filename},
+		Color: 0xFEE75C,
+	}
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "承認", Style: discordgo.SuccessButton, CustomID: idCardApprovePrefix + m.Author.ID},
+			discordgo.Button{Label: "却下", Style: discordgo.DangerButton, CustomID: idCardDenyPrefix + m.Author.ID},
+		}},
+	}
+	reviewMsg, err := sendMessage(s, modChannelID, &discordgo.MessageSend{
+		Embed:      embed,
+		Components: components,
+		Files:      []*discordgo.File{{Name: image.Filename, ContentType: image.ContentType, Reader: bytes.NewReader(data)}},
+	})
+	if err != nil {
+		log.Printf("Failed to post ID card review: %v", err)
+		sendText(s, m.ChannelID, "エラー: 学生証の送信に失敗しました. 時間をおいてお試しください.")
+		return
+	}
+
+	err = store.putIDCardReview(idCardReview{
+		UserID:          m.Author.ID,
+		ChannelID:       m.ChannelID,
+		UploadMessageID: m.ID,
+		ReviewMessageID: reviewMsg.ID,
+		Status:          reviewStatusPending,
+		SubmittedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to save ID card review: %v", err)
+	}
+
+	sendText(s, m.ChannelID, "学生証を管理者に送信しました. 審査結果が出るまでこのチャンネルでお待ちください.")
+}
+
+// Downloads an uploaded image, giving up after idCardDownloadTimeout or maxIDCardImageBytes
+func downloadIDCardImage(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), idCardDownloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxIDCardImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxIDCardImageBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxIDCardImageBytes)
+	}
+	return data, nil
+}
+
+// Handles the Approve/Deny buttons on an ID card review in the mod channel
+func handleIDCardDecision(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !hasManageRoles(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	customID := i.MessageComponentData().CustomID
+	approved := strings.HasPrefix(customID, idCardApprovePrefix)
+	targetID := strings.TrimPrefix(strings.TrimPrefix(customID, idCardApprovePrefix), idCardDenyPrefix)
+
+	status := reviewStatusDenied
+	var domain string
+	var member *discordgo.Member
+	if approved {
+		status = reviewStatusApproved
+		var ok bool
+		if domain, ok = attemptedDomain(targetID); !ok {
+			respondError(s, i, fmt.Sprintf("エラー: <@%s> がどの学校の生徒か分かりません. `/approve` で学校を指定して承認してください.", targetID))
+			return
+		}
+		var err error
+		if member, err = s.GuildMember(i.GuildID, targetID); err != nil {
+			respondWithErrorRef(s, i, "エラー: メンバー情報を取得できませんでした. ユーザーがサーバーを退出している可能性があります.", "Failed to fetch member for approved ID card", err)
+			return
+		}
+	}
+	review, decided, err := store.decideIDCardReview(targetID, status, interactionUser(i).ID)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 審査結果を保存できませんでした.", "Failed to save ID card review", err)
+		return
+	}
+	if !decided {
+		respondEphemeral(s, i, "この審査は既に処理されています.")
+		return
+	}
+
+	var outcome string
+	var result verificationOutcome
+	if approved {
+		// The school's cap and probation apply as they do to email verification. Nothing is
+		// recorded if the roles can't be granted.
+		result, err = admitMember(s, member, verifiedMember{UserID: targetID, GuildID: i.GuildID, Domain: domain, Method: verifiedByIDCard})
+		if err != nil {
+			// Left pending so it can be approved again once the problem is fixed
+			if err := store.reopenIDCardReview(targetID); err != nil {
+				log.Printf("Failed to reopen ID card review of %s: %v", targetID, err)
+			}
+			respondWithErrorRef(s, i, "エラー: ロールの付与に失敗しました. ユーザーがサーバーを退出している可能性があります.", "Failed to add roles for approved ID card", err)
+			return
+		}
+		outcome = fmt.Sprintf("✅ <@%s> により承認されました.", interactionUser(i).ID)
+		if result.Waitlisted {
+			outcome += fmt.Sprintf(" %sの参加枠が埋まっているため、順番待ちに登録しました.", schoolName(domain))
+		}
+	} else {
+		outcome = fmt.Sprintf("❌ <@%s> により却下されました.", interactionUser(i).ID)
+	}
+
+	// Drop the image from the review message as well; only the decision is kept
+	embed := &discordgo.MessageEmbed{
+		Title: "学生証の審査",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "ユーザー", Value: fmt.Sprintf("<@%s>", targetID)},
+			{Name: "結果", Value: outcome},
+		},
+		Color: 0xED4245,
+	}
+	if approved {
+		embed.Color = 0x57F287
+	}
+	err = respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:      []*discordgo.MessageEmbed{embed},
+			Components:  []discordgo.MessageComponent{},
+			Attachments: &[]*discordgo.MessageAttachment{},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to update ID card review: %v", err)
+	}
+
+	if err := s.ChannelMessageDelete(review.ChannelID, review.UploadMessageID); err != nil {
+		log.Printf("Failed to delete ID card upload: %v", err)
+	}
+
+	if !approved {
+		sendText(s, review.ChannelID, "学生証を確認できませんでした. 学生証全体がはっきり写った画像をもう一度アップロードしてください.")
+		return
+	}
+
+	if result.Waitlisted {
+		sendText(s, review.ChannelID, fmt.Sprintf("学生証が承認されました (%s). ただし現在この学校の参加枠が埋まっているため、順番待ちに登録しました. 参加できるようになったらDMでお知らせします.", schoolName(domain)))
+		scheduleChannelDeletion(s, review.ChannelID, 10*time.Second)
+		return
+	}
+	message := "学生証が承認されました! このチャンネルは10秒後に自動的に消えます."
+	if result.Probation > 0 {
+		message += "\n" + probationNote(result.Probation)
+	}
+	sendText(s, review.ChannelID, message)
+	scheduleChannelDeletion(s, review.ChannelID, 10*time.Second)
+}
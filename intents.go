@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Gateway intents ---
+// Which gateway intents are requested, and what the state cache keeps, is derived from
+// the enabled features so the bot doesn't receive (and cache) every member and message
+// of a large guild when nothing uses them. Each privileged intent can be forced on or
+// off in config. Intents are fixed when the gateway connects, so turning on a feature
+// with /feature that needs a new intent only takes effect after a restart.
+
+const (
+	intentAuto = "auto"
+	intentOn   = "on"
+	intentOff  = "off"
+)
+
+type IntentsConfig struct {
+	// Server members intent, for join handlers, nickname upkeep and role protection: "auto", "on" or "off"
+	Members string `json:"members"`
+	// Message content intent, for ID card uploads: "auto", "on" or "off"; message events are
+	// still received without it when welcome_upkeep needs them
+	MessageContent string `json:"message_content"`
+	// Presence intent; no feature needs it, so "auto" leaves it off
+	Presences string `json:"presences"`
+	// Keep members in the state cache: "auto" caches them only when role protection needs the previous roles
+	CacheMembers string `json:"cache_members"`
+	// Messages kept per channel in the state cache; 0 disables message caching
+	MaxCachedMessages int `json:"max_cached_messages"`
+}
+
+func defaultIntentsConfig() IntentsConfig {
+	return IntentsConfig{Members: intentAuto, MessageContent: intentAuto, Presences: intentAuto, CacheMembers: intentAuto}
+}
+
+func (c IntentsConfig) validate() error {
+	for name, mode := range map[string]string{"members": c.Members, "message_content": c.MessageContent, "presences": c.Presences, "cache_members": c.CacheMembers} {
+		switch mode {
+		case intentAuto, intentOn, intentOff:
+		default:
+			return fmt.Errorf("%s must be %q, %q or %q, got %q", name, intentAuto, intentOn, intentOff, mode)
+		}
+	}
+	if c.MaxCachedMessages < 0 {
+		return fmt.Errorf("max_cached_messages must not be negative")
+	}
+	return nil
+}
+
+// Reports whether a feature is on in any guild the bot is configured for
+func featureEnabledAnywhere(name string) bool {
+	if featureEnabled(guildID, name) {
+		return true
+	}
+	for guild := range config.Guilds {
+		if featureEnabled(guild, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveIntentMode(mode string, needed bool) bool {
+	switch mode {
+	case intentOn:
+		return true
+	case intentOff:
+		return false
+	}
+	return needed
+}
+
+func membersIntentNeeded() bool {
+	return featureEnabledAnywhere(featureRealName) || featureEnabledAnywhere(featureRequireScreening) ||
+		config.welcomeFor(guildID).DMText != "" || config.RoleProtection != roleProtectionOff || config.RaidProtection.MaxJoins > 0 ||
+		probationEnabledAnywhere()
+}
+
+// Returns the intents to identify with
+func gatewayIntents() discordgo.Intent {
+	intents := discordgo.IntentsGuilds
+	// Both privileged intents must also be enabled in the developer portal
+	if resolveIntentMode(config.Intents.MessageContent, featureEnabledAnywhere(featureIDCard)) {
+		intents |= discordgo.IntentsGuildMessages | discordgo.IntentsMessageContent
+	}
+	// Welcome upkeep only counts messages and needs no content
+	if config.WelcomeUpkeep.Pin || config.WelcomeUpkeep.RepostAfter > 0 {
+		intents |= discordgo.IntentsGuildMessages
+	}
+	if resolveIntentMode(config.Intents.Members, membersIntentNeeded()) {
+		intents |= discordgo.IntentsGuildMembers
+	}
+	if resolveIntentMode(config.Intents.Presences, false) {
+		intents |= discordgo.IntentsGuildPresences
+	}
+	return intents
+}
+
+// Sets the intents and limits the state cache to what the enabled features use
+func configureGateway(dg *discordgo.Session) {
+	intents := gatewayIntents()
+	dg.Identify.Intents = intents
+	members := intents&discordgo.IntentsGuildMembers != 0
+	// Role protection compares against the roles before the update, which only the cache knows
+	dg.State.TrackMembers = members && resolveIntentMode(config.Intents.CacheMembers, config.RoleProtection != roleProtectionOff)
+	dg.State.TrackPresences = intents&discordgo.IntentsGuildPresences != 0
+	dg.State.TrackVoice = false
+	dg.State.MaxMessageCount = config.Intents.MaxCachedMessages
+	log.Printf("Gateway intents: %s (member cache: %t)", describeIntents(intents), dg.State.TrackMembers)
+}
+
+func describeIntents(intents discordgo.Intent) string {
+	names := []string{"guilds"}
+	for _, intent := range []struct {
+		flag discordgo.Intent
+		name string
+	}{
+		{discordgo.IntentsGuildMessages, "guild_messages"},
+		{discordgo.IntentsMessageContent, "message_content"},
+		{discordgo.IntentsGuildMembers, "guild_members"},
+		{discordgo.IntentsGuildPresences, "guild_presences"},
+	} {
+		if intents&intent.flag != 0 {
+			names = append(names, intent.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Returns a note for /feature when turning a feature on needs an intent the bot didn't connect with
+func intentRestartNote(s *discordgo.Session, name string) string {
+	var needed discordgo.Intent
+	switch name {
+	case featureIDCard:
+		needed = discordgo.IntentsMessageContent
+	case featureRealName, featureRequireScreening:
+		needed = discordgo.IntentsGuildMembers
+	default:
+		return ""
+	}
+	if s.Identify.Intents&needed != 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n⚠️ `%s` を有効にするにはボットの再起動が必要です (必要なインテントが未接続です).", name)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- User language preference ---
+
+const (
+	langJA = "ja"
+	langEN = "en"
+
+	languageToggleButtonID = "language_toggle_button"
+)
+
+// Returns the language a user picked with the language button, Japanese by default
+func userLanguage(userID string) string {
+	if lang, ok := store.userLanguage(userID); ok {
+		return lang
+	}
+	return langJA
+}
+
+func handleLanguageToggle(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	lang := langEN
+	if userLanguage(userID) == langEN {
+		lang = langJA
+	}
+	if err := store.setUserLanguage(userID, lang); err != nil {
+		log.Printf("Failed to save language preference: %v", err)
+	}
+
+	if lang == langEN {
+		respondEphemeral(s, i, "Language set to English. The bot will guide you in English from now on.")
+	} else {
+		respondEphemeral(s, i, "言語を日本語に設定しました.")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Linked roles ---
+// Exposes the verification state as Discord role connection metadata, so server owners can
+// require "高専生" in a linked role. Set the application's Linked Roles Verification URL to
+// <public_url>/linked-role and its OAuth2 redirect to <public_url>/linked-role/callback.
+// Needs DISCORD_CLIENT_SECRET and the web server (WEB_ADDR + public_url).
+// The users' OAuth2 tokens are kept in the state file encrypted with AES-GCM under a key
+// derived from DISCORD_CLIENT_SECRET, so neither state.json nor an export-state archive
+// is enough to act as the users. Changing the secret makes users link their account again.
+
+const (
+	linkedRolePath         = "/linked-role"
+	linkedRoleCallbackPath = "/linked-role/callback"
+	linkedRoleStateCookie  = "linked_role_state"
+	discordOAuthAuthorize  = "https://discord.com/oauth2/authorize"
+	discordOAuthToken      = "https://discord.com/api/v10/oauth2/token"
+	discordCurrentUser     = "https://discord.com/api/v10/users/@me"
+	linkedRolePlatformName = "高専認証"
+)
+
+type linkedRoleToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Marks an encrypted token in the state file; older files have them in plain text
+const sealedTokenPrefix = "enc:"
+
+func linkedRoleTokenCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("linked-role-tokens:" + clientSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealToken(plain string) (string, error) {
+	aead, err := linkedRoleTokenCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return sealedTokenPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func openToken(stored string) (string, error) {
+	sealed, ok := strings.CutPrefix(stored, sealedTokenPrefix)
+	if !ok {
+		return stored, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	aead, err := linkedRoleTokenCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed token too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt token, was DISCORD_CLIENT_SECRET changed? %w", err)
+	}
+	return string(plain), nil
+}
+
+// Returns the token as written to the state file
+func (t linkedRoleToken) sealed() (linkedRoleToken, error) {
+	var err error
+	if !strings.HasPrefix(t.AccessToken, sealedTokenPrefix) {
+		if t.AccessToken, err = sealToken(t.AccessToken); err != nil {
+			return t, err
+		}
+	}
+	if !strings.HasPrefix(t.RefreshToken, sealedTokenPrefix) {
+		t.RefreshToken, err = sealToken(t.RefreshToken)
+	}
+	return t, err
+}
+
+// Returns the token as read from the state file, decrypted
+func (t linkedRoleToken) opened() (linkedRoleToken, error) {
+	var err error
+	if t.AccessToken, err = openToken(t.AccessToken); err != nil {
+		return t, err
+	}
+	t.RefreshToken, err = openToken(t.RefreshToken)
+	return t, err
+}
+
+var roleConnectionMetadata = []*discordgo.ApplicationRoleConnectionMetadata{
+	{Type: discordgo.ApplicationRoleConnectionMetadataBooleanEqual, Key: "kosen_verified", Name: "高専生", Description: "学校のメールアドレスで認証済み"},
+	{Type: discordgo.ApplicationRoleConnectionMetadataDatetimeGreaterThanOrEqual, Key: "verified_at", Name: "認証からの日数", Description: "認証してからの日数"},
+	{Type: discordgo.ApplicationRoleConnectionMetadataIntegerGreaterThanOrEqual, Key: "grade", Name: "学年", Description: "登録した学年"},
+}
+
+func linkedRolesEnabled() bool {
+	return clientSecret != "" && magicLinksEnabled()
+}
+
+func linkedRoleRedirectURI() string {
+	return strings.TrimSuffix(config.PublicURL, "/") + linkedRoleCallbackPath
+}
+
+// Declares the metadata keys linked roles can be configured with
+func registerRoleConnectionMetadata(s *discordgo.Session) {
+	if !linkedRolesEnabled() {
+		return
+	}
+	if _, err := s.ApplicationRoleConnectionMetadataUpdate(s.State.User.ID, roleConnectionMetadata); err != nil {
+		log.Printf("Failed to register role connection metadata: %v", err)
+	}
+}
+
+// Sends the user to Discord's OAuth2 consent screen
+func handleLinkedRoleStart(w http.ResponseWriter, r *http.Request) {
+	if !linkedRolesEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: linkedRoleStateCookie, Value: state, Path: linkedRolePath, MaxAge: 600, HttpOnly: true, Secure: strings.HasPrefix(config.PublicURL, "https://"), SameSite: http.SameSiteLaxMode})
+	query := url.Values{
+		"client_id":     {botApplicationID},
+		"redirect_uri":  {linkedRoleRedirectURI()},
+		"response_type": {"code"},
+		"scope":         {"identify role_connections.write"},
+		"state":         {state},
+		"prompt":        {"consent"},
+	}
+	http.Redirect(w, r, discordOAuthAuthorize+"?"+query.Encode(), http.StatusFound)
+}
+
+func handleLinkedRoleCallback(s *discordgo.Session, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	show := func(message string) { magicLinkPage.Execute(w, magicLinkPageData{Message: message}) }
+
+	cookie, err := r.Cookie(linkedRoleStateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != r.URL.Query().Get("state") {
+		show("エラー: セッションの有効期限が切れました. Discordからもう一度お試しください.")
+		return
+	}
+	state := cookie.Value
+	// The state is used up whatever happens next
+	http.SetCookie(w, &http.Cookie{Name: linkedRoleStateCookie, Path: linkedRolePath, MaxAge: -1})
+	if detectTokenReplay(s, tokenOAuthState, state, r) {
+		show("エラー: このログインは既に使用されています. Discordからもう一度お試しください.")
+		return
+	}
+	token, err := exchangeOAuthToken(url.Values{"grant_type": {"authorization_code"}, "code": {r.URL.Query().Get("code")}, "redirect_uri": {linkedRoleRedirectURI()}})
+	if err != nil {
+		log.Printf("Failed to exchange linked role OAuth code: %v", err)
+		show("エラー: Discordとの連携に失敗しました. もう一度お試しください.")
+		return
+	}
+	userID, err := oauthUserID(token.AccessToken)
+	if err != nil {
+		log.Printf("Failed to fetch linked role user: %v", err)
+		show("エラー: Discordとの連携に失敗しました. もう一度お試しください.")
+		return
+	}
+	consumeToken(tokenOAuthState, state, userID)
+	if err := store.setLinkedRoleToken(userID, token); err != nil {
+		log.Printf("Failed to save linked role token: %v", err)
+	}
+	if err := pushRoleConnection(userID); err != nil {
+		log.Printf("Failed to push role connection for %s: %v", userID, err)
+		show("エラー: 認証情報の送信に失敗しました. もう一度お試しください.")
+		return
+	}
+	if _, verified := store.isVerified(userID); !verified {
+		show("連携しました. サーバーで高専生の認証を完了すると、連携ロールの条件に自動的に反映されます.")
+		return
+	}
+	show("連携しました! Discordに戻ってください.")
+}
+
+// Posts to the OAuth2 token endpoint with the client credentials
+func exchangeOAuthToken(form url.Values) (linkedRoleToken, error) {
+	form.Set("client_id", botApplicationID)
+	form.Set("client_secret", clientSecret)
+	resp, err := httpClient.PostForm(discordOAuthToken, form)
+	if err != nil {
+		return linkedRoleToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return linkedRoleToken{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return linkedRoleToken{}, err
+	}
+	return linkedRoleToken{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func oauthUserID(accessToken string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, discordCurrentUser, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("users/@me returned %s", resp.Status)
+	}
+	var user discordgo.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// Pushes the role connection in the background, logging failures
+func updateRoleConnection(userID string) {
+	if err := pushRoleConnection(userID); err != nil {
+		log.Printf("Failed to update role connection for %s: %v", userID, err)
+	}
+}
+
+// Updates the user's role connection from their verification record; members on probation
+// don't count as verified yet. Does nothing for users who never linked their account.
+func pushRoleConnection(userID string) error {
+	token, ok := store.linkedRoleToken(userID)
+	if !ok || !linkedRolesEnabled() {
+		return nil
+	}
+	if time.Now().After(token.ExpiresAt.Add(-time.Minute)) {
+		refreshed, err := exchangeOAuthToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token.RefreshToken}})
+		if err != nil {
+			return fmt.Errorf("could not refresh token: %w", err)
+		}
+		token = refreshed
+		if err := store.setLinkedRoleToken(userID, token); err != nil {
+			log.Printf("Failed to save linked role token: %v", err)
+		}
+	}
+
+	conn := &discordgo.ApplicationRoleConnection{PlatformName: linkedRolePlatformName, Metadata: map[string]string{"kosen_verified": "0"}}
+	if member, verified := store.isVerified(userID); verified && member.ProbationUntil.IsZero() {
+		conn.PlatformUsername = schoolName(member.Domain)
+		conn.Metadata["kosen_verified"] = "1"
+		conn.Metadata["verified_at"] = member.VerifiedAt.UTC().Format(time.RFC3339)
+		if grade, ok := parseGrade(member.Grade); ok {
+			conn.Metadata["grade"] = strconv.Itoa(grade)
+		}
+	}
+
+	user, err := discordgo.New("Bearer " + token.AccessToken)
+	if err != nil {
+		return err
+	}
+	_, err = user.UserApplicationRoleConnectionUpdate(botApplicationID, conn)
+	return err
+}
+
+// Reads the number out of a grade like "3年" or "３"
+func parseGrade(grade string) (int, bool) {
+	for _, r := range grade {
+		if unicode.IsDigit(r) {
+			if r >= '０' && r <= '９' {
+				r = r - '０' + '0'
+			}
+			if r >= '0' && r <= '9' {
+				return int(r - '0'), true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Welcome channel lockdown ---
+// Incident controls run by the bot, so moderators don't have to change channel settings
+// by hand: slow mode on the welcome channels, and a lockdown that greys out the start
+// button on every welcome post. Unlike maintenance mode, users who already have a
+// channel can carry on, including sending emails.
+
+const (
+	lockdownActionLock     = "lock"
+	lockdownActionUnlock   = "unlock"
+	lockdownActionSlowmode = "slowmode"
+
+	// Discord's upper bound for slow mode
+	maxSlowmodeSeconds = 21600
+)
+
+type lockdownState struct {
+	Since  time.Time `json:"since"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func lockdownCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minSeconds := 0.0
+	return &discordgo.ApplicationCommand{
+		Name:                     "lockdown",
+		Description:              "Lock verification or set slow mode on the welcome channels (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "action", Description: "What to do", Required: true, Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "lock (disable the start button)", Value: lockdownActionLock},
+				{Name: "unlock", Value: lockdownActionUnlock},
+				{Name: "slowmode", Value: lockdownActionSlowmode},
+			}},
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "seconds", Description: "Slow mode interval, 0 turns it off", MinValue: &minSeconds, MaxValue: maxSlowmodeSeconds},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "reason", Description: "Notice shown to users while locked"},
+		},
+	}
+}
+
+func handleLockdown(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	userID := interactionUser(i).ID
+
+	switch optionString(i, "action") {
+	case lockdownActionLock:
+		state := &lockdownState{Since: time.Now(), By: userID, Reason: optionString(i, "reason")}
+		if err := store.setLockdown(state); err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save lockdown", err)
+			return
+		}
+		log.Printf("Verification locked down by %s", userID)
+		setupVerificationButton(s)
+		alertModerators(s, fmt.Sprintf("🔒 <@%s> が認証の受付を停止しました.", userID))
+		respondEphemeral(s, i, "🔒 認証の受付を停止しました. 認証ボタンは無効になっています. 解除するには `/lockdown action:unlock` を実行してください.")
+	case lockdownActionUnlock:
+		if err := store.setLockdown(nil); err != nil {
+			respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save lockdown", err)
+			return
+		}
+		log.Printf("Verification lockdown lifted by %s", userID)
+		setupVerificationButton(s)
+		alertModerators(s, fmt.Sprintf("🔓 <@%s> が認証の受付を再開しました.", userID))
+		respondEphemeral(s, i, "🔓 認証の受付を再開しました.")
+	case lockdownActionSlowmode:
+		seconds := 0
+		for _, opt := range i.ApplicationCommandData().Options {
+			if opt.Name == "seconds" {
+				seconds = int(opt.IntValue())
+			}
+		}
+		if failed := setWelcomeSlowmode(s, seconds); len(failed) > 0 {
+			respondError(s, i, fmt.Sprintf("エラー: 一部のチャンネルで低速モードを変更できませんでした: %s", mentionChannels(failed)))
+			return
+		}
+		log.Printf("Welcome channel slow mode set to %ds by %s", seconds, userID)
+		if seconds == 0 {
+			respondEphemeral(s, i, "歓迎チャンネルの低速モードを解除しました.")
+		} else {
+			respondEphemeral(s, i, fmt.Sprintf("歓迎チャンネルの低速モードを%d秒に設定しました.", seconds))
+		}
+	}
+}
+
+// Returns the channels the welcome post is in
+func welcomeChannelIDs() []string {
+	ids := []string{welcomeChannelID}
+	for _, wc := range config.WelcomeChannels {
+		ids = append(ids, wc.ChannelID)
+	}
+	return ids
+}
+
+// Sets slow mode on every welcome channel and returns the ones that could not be changed
+func setWelcomeSlowmode(s *discordgo.Session, seconds int) []string {
+	var failed []string
+	for _, channelID := range welcomeChannelIDs() {
+		if _, err := s.ChannelEdit(channelID, &discordgo.ChannelEdit{RateLimitPerUser: &seconds}); err != nil {
+			log.Printf("Failed to set slow mode on %s: %v", channelID, err)
+			failed = append(failed, channelID)
+		}
+	}
+	return failed
+}
+
+func mentionChannels(ids []string) string {
+	text := ""
+	for idx, id := range ids {
+		if idx > 0 {
+			text += ", "
+		}
+		text += "<#" + id + ">"
+	}
+	return text
+}
+
+func verificationLocked() bool {
+	_, on := store.lockdown()
+	return on
+}
+
+// Replies with the lockdown notice and returns true if verification is locked.
+// The button is disabled during a lockdown, but an old client may still send the click.
+func respondIfLockedDown(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	state, on := store.lockdown()
+	if !on {
+		return false
+	}
+	notice := state.Reason
+	if notice == "" {
+		notice = localized(i, msgLockdown)
+	}
+	respondEphemeral(s, i, "🔒 "+notice)
+	return true
+}
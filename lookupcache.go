@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Role and channel lookups ---
+// Category checks, the setup wizard and the permission check look up a guild's roles and
+// channels on every verification. The state cache answers most of these from memory; when
+// it doesn't have the guild yet, the answer comes from the REST API and is kept here, so
+// a guild the state doesn't know yet doesn't cost a request per click. Only those REST
+// answers are cached: they expire after lookupCacheTTL and are dropped as soon as a
+// gateway event says the roles or channels changed. Lookups the state or the cache
+// answered count as hits, the ones that had to call the API as misses.
+
+const lookupCacheTTL = 5 * time.Minute
+
+var lookupCacheResults = newCounter("kosen_verify_lookup_cache_total", "Role and channel lookups by cache and result (hit or miss).", "cache", "result")
+
+var (
+	guildCache         = newLookupCache[*discordgo.Guild]("guild")
+	guildRolesCache    = newLookupCache[[]*discordgo.Role]("guild_roles")
+	guildChannelsCache = newLookupCache[[]*discordgo.Channel]("guild_channels")
+	channelCache       = newLookupCache[*discordgo.Channel]("channel")
+)
+
+type lookupCache[V any] struct {
+	name    string
+	mu      sync.Mutex
+	entries map[string]lookupEntry[V]
+}
+
+type lookupEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newLookupCache[V any](name string) *lookupCache[V] {
+	return &lookupCache[V]{name: name, entries: make(map[string]lookupEntry[V])}
+}
+
+// Returns the value from the state cache if it has one, then from the cached REST
+// answers, and calls fetch only when neither has it
+func (c *lookupCache[V]) get(key string, state func() (V, bool), fetch func() (V, error)) (V, error) {
+	if value, ok := state(); ok {
+		lookupCacheResults.inc(c.name, "hit")
+		return value, nil
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		lookupCacheResults.inc(c.name, "hit")
+		return entry.value, nil
+	}
+	lookupCacheResults.inc(c.name, "miss")
+	value, err := fetch()
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	c.entries[key] = lookupEntry[V]{value: value, expires: time.Now().Add(lookupCacheTTL)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+func (c *lookupCache[V]) invalidate(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+func (c *lookupCache[V]) clear() {
+	c.mu.Lock()
+	c.entries = make(map[string]lookupEntry[V])
+	c.mu.Unlock()
+}
+
+func cachedGuild(s *discordgo.Session, guildID string) (*discordgo.Guild, error) {
+	return guildCache.get(guildID, func() (*discordgo.Guild, bool) {
+		guild, err := s.State.Guild(guildID)
+		return guild, err == nil
+	}, func() (*discordgo.Guild, error) {
+		return s.Guild(guildID)
+	})
+}
+
+func cachedGuildRoles(s *discordgo.Session, guildID string) ([]*discordgo.Role, error) {
+	return guildRolesCache.get(guildID, func() ([]*discordgo.Role, bool) {
+		guild, err := s.State.Guild(guildID)
+		if err != nil {
+			return nil, false
+		}
+		s.State.RLock()
+		defer s.State.RUnlock()
+		return append([]*discordgo.Role(nil), guild.Roles...), true
+	}, func() ([]*discordgo.Role, error) {
+		return s.GuildRoles(guildID)
+	})
+}
+
+func cachedGuildChannels(s *discordgo.Session, guildID string) ([]*discordgo.Channel, error) {
+	return guildChannelsCache.get(guildID, func() ([]*discordgo.Channel, bool) {
+		guild, err := s.State.Guild(guildID)
+		if err != nil {
+			return nil, false
+		}
+		s.State.RLock()
+		defer s.State.RUnlock()
+		return append([]*discordgo.Channel(nil), guild.Channels...), true
+	}, func() ([]*discordgo.Channel, error) {
+		return s.GuildChannels(guildID)
+	})
+}
+
+func cachedChannel(s *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	return channelCache.get(channelID, func() (*discordgo.Channel, bool) {
+		channel, err := s.State.Channel(channelID)
+		return channel, err == nil
+	}, func() (*discordgo.Channel, error) {
+		return s.Channel(channelID)
+	})
+}
+
+// Drops the entries a gateway event makes stale
+func onLookupCacheEvent(s *discordgo.Session, event any) {
+	switch e := event.(type) {
+	case *discordgo.GuildRoleCreate:
+		guildCache.invalidate(e.GuildID)
+		guildRolesCache.invalidate(e.GuildID)
+	case *discordgo.GuildRoleUpdate:
+		guildCache.invalidate(e.GuildID)
+		guildRolesCache.invalidate(e.GuildID)
+	case *discordgo.GuildRoleDelete:
+		guildCache.invalidate(e.GuildID)
+		guildRolesCache.invalidate(e.GuildID)
+	case *discordgo.ChannelCreate:
+		guildChannelsCache.invalidate(e.GuildID)
+		channelCache.invalidate(e.ID)
+	case *discordgo.ChannelUpdate:
+		guildChannelsCache.invalidate(e.GuildID)
+		channelCache.invalidate(e.ID)
+	case *discordgo.ChannelDelete:
+		guildChannelsCache.invalidate(e.GuildID)
+		channelCache.invalidate(e.ID)
+	case *discordgo.GuildCreate:
+		guildCache.invalidate(e.ID)
+		guildRolesCache.invalidate(e.ID)
+		guildChannelsCache.invalidate(e.ID)
+	case *discordgo.GuildUpdate:
+		guildCache.invalidate(e.ID)
+		guildRolesCache.invalidate(e.ID)
+	case *discordgo.GuildDelete:
+		guildCache.invalidate(e.ID)
+		guildRolesCache.invalidate(e.ID)
+		guildChannelsCache.invalidate(e.ID)
+	case *discordgo.Ready:
+		// Events missed while disconnected without a resume are not replayed
+		guildCache.clear()
+		guildRolesCache.clear()
+		guildChannelsCache.clear()
+		channelCache.clear()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Magic links ---
+// When public_url is configured, the verification email also carries a one-click link
+// (and a QR code of it) so a student reading mail on their phone doesn't have to type the
+// code on their PC. The link opens a confirmation page first: mail scanners prefetch
+// links, and a plain GET must not consume the code.
+
+const magicLinkPath = "/verify"
+
+var magicLinkPage = template.Must(template.New("magiclink").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>高専認証</title></head>
+<body style="font-family: sans-serif; max-width: 32em; margin: 3em auto; padding: 0 1em;">
+{{if .Token}}
+<p>ボタンを押すとDiscordサーバーの認証を完了します.</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit" style="font-size: 1.2em; padding: 0.5em 2em;">認証する</button>
+</form>
+{{else}}
+<p>{{.Message}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+type magicLinkPageData struct {
+	Action  string
+	Token   string
+	Message string
+}
+
+func magicLinksEnabled() bool {
+	return config.PublicURL != "" && webAddr != ""
+}
+
+func generateMagicToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func magicLink(token string) string {
+	return strings.TrimSuffix(config.PublicURL, "/") + magicLinkPath + "?token=" + url.QueryEscape(token)
+}
+
+// Serves the magic link and linked role pages and the partner API on WEB_ADDR
+func startWebServer(s *discordgo.Session, addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(magicLinkPath, func(w http.ResponseWriter, r *http.Request) { handleMagicLink(s, w, r) })
+	mux.HandleFunc(reconfirmPath, func(w http.ResponseWriter, r *http.Request) { handleReconfirm(s, w, r) })
+	mux.HandleFunc(linkedRolePath, handleLinkedRoleStart)
+	mux.HandleFunc(linkedRoleCallbackPath, func(w http.ResponseWriter, r *http.Request) { handleLinkedRoleCallback(s, w, r) })
+	registerAPIRoutes(mux)
+	go func() {
+		log.Printf("Serving web pages on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Web server stopped: %v", err)
+		}
+	}()
+}
+
+func handleMagicLink(s *discordgo.Session, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet:
+		magicLinkPage.Execute(w, magicLinkPageData{Action: magicLinkPath, Token: r.URL.Query().Get("token")})
+	case http.MethodPost:
+		token := r.PostFormValue("token")
+		if detectTokenReplay(s, tokenMagicLink, token, r) {
+			magicLinkPage.Execute(w, magicLinkPageData{Message: "エラー: このリンクは既に使用されています. 他の人から転送されたリンクでは認証できません. Discordで /verify を実行してください."})
+			return
+		}
+		magicLinkPage.Execute(w, magicLinkPageData{Message: redeemMagicLink(s, token)})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Completes the verification the token belongs to and returns the message to show
+func redeemMagicLink(s *discordgo.Session, token string) string {
+	if token == "" {
+		return "エラー: リンクが正しくありません."
+	}
+
+	verificationMutex.Lock()
+	var userID string
+	var data verificationData
+	hash := tokenHash(token)
+	for id, pending := range pendingVerifications {
+		if pending.TokenHash != "" && hmac.Equal([]byte(pending.TokenHash), []byte(hash)) {
+			userID, data = id, pending
+			deletePendingVerification(id)
+			break
+		}
+	}
+	verificationMutex.Unlock()
+	if userID == "" {
+		return "エラー: このリンクは無効か、既に使用されています. Discordで認証コードを入力するか、もう一度 /verify を実行してください."
+	}
+	if data.expired(time.Now()) {
+		return "エラー: このリンクの有効期限が切れています. Discordでもう一度 /verify を実行してください."
+	}
+
+	data.markCodeEntered()
+	restore := func() {
+		verificationMutex.Lock()
+		setPendingVerification(userID, data)
+		verificationMutex.Unlock()
+	}
+	member, err := s.GuildMember(data.GuildID, userID)
+	if err != nil {
+		log.Printf("Failed to look up member %s for magic link: %v", userID, err)
+		restore()
+		return "エラー: サーバーのメンバー情報を取得できませんでした. サーバーに参加しているか確認してください."
+	}
+	outcome, err := completeVerification(s, data.GuildID, userID, member, data)
+	if errors.Is(err, errSchoolFull) {
+		return schoolFullMessage(outcome.Domain)
+	}
+	if err != nil {
+		log.Printf("Failed to add roles via magic link: %v", err)
+		restore()
+		if errors.Is(err, errSchoolRoleFailed) {
+			return "エラー: 学校ロールの付与に失敗したため、認証を取り消しました. 少し待ってからもう一度リンクを開いてください."
+		}
+		return "エラー: 学生ロールの付与に失敗しました. 管理者に連絡してください."
+	}
+	consumeToken(tokenMagicLink, token, userID)
+	if outcome.Waitlisted {
+		scheduleUserChannelDeletion(s, userID, 10*time.Second)
+		return waitlistedMessage(outcome.Domain)
+	}
+
+	if featureEnabled(data.GuildID, featureRealName) {
+		// The channel is deleted once the name has been entered
+		if err := postRealNamePrompt(s, userID, fmt.Sprintf("メールのリンクから認証に成功しました! (%s)", schoolName(outcome.Domain))); err != nil {
+			log.Printf("Failed to ask %s for their real name: %v", userID, err)
+		}
+		message := fmt.Sprintf("認証に成功しました! (%s) Discordに戻って、名前を登録してください.", schoolName(outcome.Domain))
+		if outcome.RolesDelayed {
+			message += " ロールの付与が混み合っているため遅れています. 数分以内に自動的に付与されます."
+		}
+		if outcome.Probation > 0 {
+			message += " " + probationNote(outcome.Probation)
+		}
+		return message
+	}
+
+	channels := store.verificationChannelsOf(userID)
+	for _, channelID := range channels {
+		sendText(s, channelID, fmt.Sprintf("<@%s> メールのリンクから認証に成功しました! (%s) このチャンネルは10秒後に自動的に消えます.", userID, schoolName(outcome.Domain)))
+	}
+	scheduleUserChannelDeletion(s, userID, 10*time.Second)
+
+	message := fmt.Sprintf("認証に成功しました! (%s) Discordに戻ってください.", schoolName(outcome.Domain))
+	if outcome.RolesDelayed {
+		message += " ロールの付与が混み合っているため遅れています. 数分以内に自動的に付与されます."
+	}
+	if outcome.Probation > 0 {
+		message += " " + probationNote(outcome.Probation)
+	}
+	return message
+}
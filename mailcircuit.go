@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Mail circuit breaker ---
+// After failure_threshold transient send failures in a row the breaker opens: sends fail
+// fast with errMailerDown, new emails go straight to the queue and the queue pauses, so
+// an outage doesn't burn every queued email's attempts. Every open_duration the SMTP login
+// is probed; once it works again (or any send gets through) the breaker closes and the
+// queue drains. Openings and closings are reported to the admin channel.
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+
+	mailCircuitPollInterval = 15 * time.Second
+)
+
+type MailCircuitConfig struct {
+	// Consecutive transient failures that open the breaker, 0 to disable it
+	FailureThreshold int `json:"failure_threshold"`
+	// How long the breaker stays open before the provider is probed again
+	OpenDuration Duration `json:"open_duration"`
+}
+
+func defaultMailCircuitConfig() MailCircuitConfig {
+	return MailCircuitConfig{FailureThreshold: 5, OpenDuration: Duration{time.Minute}}
+}
+
+type mailCircuitBreaker struct {
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// Receives true when the breaker opens and false when it closes again
+	events chan bool
+}
+
+var (
+	mailCircuit = &mailCircuitBreaker{state: circuitClosed, events: make(chan bool, 16)}
+
+	mailCircuitOpenGauge   = newGauge("kosen_verify_mail_circuit_open", "1 while the mail circuit breaker is open.")
+	mailCircuitTransitions = newCounter("kosen_verify_mail_circuit_transitions_total", "Mail circuit breaker state changes by new state.", "state")
+)
+
+// Reports whether a send may go ahead
+func (b *mailCircuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == circuitClosed
+}
+
+func (b *mailCircuitBreaker) isOpen() bool {
+	return !b.allow()
+}
+
+// Records the outcome of a send or probe
+func (b *mailCircuitBreaker) record(err error) {
+	if config.MailCircuit.FailureThreshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch {
+	case err == nil:
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.transition(circuitClosed)
+		}
+	case b.state == circuitHalfOpen:
+		// Any failed probe reopens the breaker, or nothing would ever probe again
+		b.failures++
+		b.openedAt = time.Now()
+		b.transition(circuitOpen)
+	case isTransientMailError(err):
+		b.failures++
+		if b.state == circuitClosed && b.failures >= config.MailCircuit.FailureThreshold {
+			b.openedAt = time.Now()
+			b.transition(circuitOpen)
+		}
+	}
+}
+
+// Moves an open breaker whose open_duration has passed to half-open, reporting whether it did
+func (b *mailCircuitBreaker) startProbe(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != circuitOpen || now.Sub(b.openedAt) < config.MailCircuit.OpenDuration.Duration {
+		return false
+	}
+	b.transition(circuitHalfOpen)
+	return true
+}
+
+// The caller holds b.mutex
+func (b *mailCircuitBreaker) transition(state string) {
+	log.Printf("Mail circuit breaker %s -> %s", b.state, state)
+	wasOpen := b.state != circuitClosed
+	b.state = state
+	mailCircuitTransitions.inc(state)
+	switch {
+	case state == circuitOpen && !wasOpen:
+		mailCircuitOpenGauge.set(1)
+		b.notify(true)
+	case state == circuitClosed:
+		mailCircuitOpenGauge.set(0)
+		b.notify(false)
+	}
+}
+
+// Never blocks a send; if nobody is reporting, the log line above has to do
+func (b *mailCircuitBreaker) notify(opened bool) {
+	select {
+	case b.events <- opened:
+	default:
+	}
+}
+
+// Probes the provider while the breaker is open and reports openings and closings
+func runMailCircuit(s *discordgo.Session) {
+	ticker := time.NewTicker(mailCircuitPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case opened := <-mailCircuit.events:
+			if opened {
+				alertAdmins(s, fmt.Sprintf("📪 メール送信が%d回続けて失敗したため、送信を一時停止しました. 新しい認証メールはキューに入り、%sごとに復旧を確認します.",
+					config.MailCircuit.FailureThreshold, config.MailCircuit.OpenDuration.Duration))
+			} else {
+				alertAdmins(s, "📬 メール送信が復旧しました. キューに入っていた認証メールを順に送信します.")
+			}
+		case <-ticker.C:
+			if mailCircuit.startProbe(time.Now()) {
+				err := smtpPreflight()
+				if err != nil {
+					log.Printf("Mail provider probe failed: %v", err)
+				}
+				mailCircuit.record(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// --- Mailer ---
+
+const (
+	smtpHost = "smtp.gmail.com"
+	smtpAddr = "smtp.gmail.com:587"
+
+	smtpPreflightTimeout = 15 * time.Second
+	// Upper bound for one send, so a server that stops answering can't hold a goroutine forever
+	smtpSendTimeout = time.Minute
+)
+
+// What to do when the SMTP preflight fails at startup
+const (
+	preflightFail = "fail"
+	preflightWarn = "warn"
+	preflightOff  = "off"
+)
+
+// Unix time of the last email the SMTP server accepted
+var lastEmailSent atomic.Int64
+
+// Label for the mail metrics, so a second provider can be told apart later
+const mailProvider = "gmail"
+
+// Categories of failed sends, for spotting throttling before users notice
+const (
+	mailErrorAuth              = "auth"
+	mailErrorQuota             = "quota"
+	mailErrorNetwork           = "network"
+	mailErrorRecipientRejected = "recipient_rejected"
+	mailErrorOther             = "other"
+)
+
+var (
+	emailSendSeconds = newHistogram("kosen_verify_email_send_seconds", "Time taken to hand a verification email to the mail provider.",
+		[]float64{0.25, 0.5, 1, 2, 5, 10, 30}, "provider", "result")
+	emailErrors = newCounter("kosen_verify_email_errors_total", "Failed email sends by provider and error category.", "provider", "category")
+)
+
+const emailSubject = "Discord Verification Code"
+
+type verificationEmail struct {
+	To   string `json:"to"`
+	Code string `json:"code"`
+	// Optional one-click verification link, also shown as a QR code
+	MagicLink string `json:"magic_link,omitempty"`
+	// Optional jump link to the user's verification channel
+	ChannelLink string `json:"channel_link,omitempty"`
+	// langJA or langEN; the email carries both, this one first
+	Language string `json:"language,omitempty"`
+}
+
+// The sentences of the verification email in one language.
+// The HTML ones take the escaped code, magic link or channel link as their argument.
+type emailText struct {
+	Code, Channel, Magic             string
+	HTMLCode, HTMLMagic, HTMLChannel string
+}
+
+// Exchange students get the same school addresses, so every email is bilingual
+var emailTexts = map[string]emailText{
+	langJA: {
+		Code:        "あなたの認証コードは: %s です.",
+		Channel:     "認証チャンネルに戻ってコードを入力してください:",
+		Magic:       "次のリンクを開いても認証を完了できます:",
+		HTMLCode:    "<p>あなたの認証コードは: <b>%s</b> です.</p>",
+		HTMLMagic:   `<p>スマートフォンでこのメールを見ている場合は <a href="%s">こちらのリンク</a> から、パソコンの場合はこのメールのQRコードをスマートフォンで読み取って認証を完了できます.</p>`,
+		HTMLChannel: `<p>コードを入力する場合は <a href="%s">認証チャンネル</a> に戻ってください.</p>`,
+	},
+	langEN: {
+		Code:        "Your verification code is: %s",
+		Channel:     "Go back to your verification channel and enter the code:",
+		Magic:       "You can also complete verification by opening this link:",
+		HTMLCode:    "<p>Your verification code is: <b>%s</b></p>",
+		HTMLMagic:   `<p>If you are reading this on your phone, <a href="%s">open this link</a>; on a computer, scan the QR code in this email with your phone to complete verification.</p>`,
+		HTMLChannel: `<p>To enter the code, go back to <a href="%s">your verification channel</a>.</p>`,
+	},
+}
+
+// The preferred language first, then the other one
+func (mail verificationEmail) languages() []string {
+	if mail.Language == langEN {
+		return []string{langEN, langJA}
+	}
+	return []string{langJA, langEN}
+}
+
+func (mail verificationEmail) plainText() string {
+	var sections []string
+	for _, lang := range mail.languages() {
+		t := emailTexts[lang]
+		text := fmt.Sprintf(t.Code, mail.Code) + "\r\n"
+		if mail.ChannelLink != "" {
+			text += "\r\n" + t.Channel + "\r\n" + mail.ChannelLink + "\r\n"
+		}
+		if mail.MagicLink != "" {
+			text += "\r\n" + t.Magic + "\r\n" + mail.MagicLink + "\r\n"
+		}
+		sections = append(sections, text)
+	}
+	return strings.Join(sections, "\r\n----------\r\n\r\n")
+}
+
+func (mail verificationEmail) html() string {
+	code := template.HTMLEscapeString(mail.Code)
+	magic := template.HTMLEscapeString(mail.MagicLink)
+	channel := template.HTMLEscapeString(mail.ChannelLink)
+	var sections []string
+	for _, lang := range mail.languages() {
+		t := emailTexts[lang]
+		html := fmt.Sprintf(t.HTMLCode, code) + "\n" + fmt.Sprintf(t.HTMLMagic, magic) + "\n"
+		if mail.ChannelLink != "" {
+			html += fmt.Sprintf(t.HTMLChannel, channel) + "\n"
+		}
+		sections = append(sections, fmt.Sprintf("<div lang=\"%s\">\n%s</div>\n", lang, html))
+	}
+	return sections[0] + `<p><img src="cid:qr@verify" alt="QR" width="256" height="256"></p>` + "\n<hr>\n" + strings.Join(sections[1:], "")
+}
+
+func sendVerificationEmail(ctx context.Context, mail verificationEmail) error {
+	if !mailCircuit.allow() {
+		return errMailerDown
+	}
+	acct := reserveMailQuota()
+	if acct == nil {
+		return errMailQuotaExhausted
+	}
+	msg, err := mail.compose(acct.from)
+	if err != nil {
+		releaseMailQuota(acct)
+		return fmt.Errorf("could not build email: %w", err)
+	}
+	start := time.Now()
+	err = sendMail(ctx, acct, mail.To, msg)
+	// The caller giving up or its handler timing out says nothing about the provider
+	if ctx.Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		mailCircuit.record(err)
+	}
+	if err != nil {
+		releaseMailQuota(acct)
+		emailSendSeconds.observe(time.Since(start).Seconds(), acct.name, "error")
+		emailErrors.inc(acct.name, classifyMailError(err))
+		return err
+	}
+	emailSendSeconds.observe(time.Since(start).Seconds(), acct.name, "ok")
+	lastEmailSent.Store(time.Now().Unix())
+	return nil
+}
+
+// Sorts an SMTP failure into one of the mailError categories by its reply code
+func classifyMailError(err error) string {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return mailErrorNetwork
+		}
+		// smtp.SendMail wraps auth failures from PlainAuth without a reply code
+		if strings.Contains(err.Error(), "auth") {
+			return mailErrorAuth
+		}
+		return mailErrorOther
+	}
+	msg := strings.ToLower(protoErr.Msg)
+	switch {
+	case protoErr.Code == 530 || protoErr.Code == 534 || protoErr.Code == 535:
+		return mailErrorAuth
+	case protoErr.Code == 421 || protoErr.Code == 452 || strings.Contains(msg, "quota") || strings.Contains(msg, "rate limit"):
+		return mailErrorQuota
+	case protoErr.Code == 550 || protoErr.Code == 551 || protoErr.Code == 553 || strings.HasPrefix(protoErr.Msg, "5.1."):
+		return mailErrorRecipientRejected
+	}
+	return mailErrorOther
+}
+
+// Builds the MIME message: plain text, plus an HTML part with an inline QR code when there is a magic link
+func (mail verificationEmail) compose(from string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("To: " + mail.To + "\r\n")
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("Subject: " + emailSubject + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	text := mail.plainText()
+	if mail.MagicLink == "" {
+		buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64(&buf, []byte(text))
+		return buf.Bytes(), nil
+	}
+	qr, err := qrcode.Encode(mail.MagicLink, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+	html := mail.html()
+
+	alt := multipart.NewWriter(&buf)
+	buf.WriteString("Content-Type: multipart/alternative; boundary=" + alt.Boundary() + "\r\n\r\n")
+	if err := writeBase64Part(alt, textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}}, []byte(text)); err != nil {
+		return nil, err
+	}
+
+	var related bytes.Buffer
+	rel := multipart.NewWriter(&related)
+	if err := writeBase64Part(rel, textproto.MIMEHeader{"Content-Type": {"text/html; charset=UTF-8"}}, []byte(html)); err != nil {
+		return nil, err
+	}
+	qrHeader := textproto.MIMEHeader{
+		"Content-Type":        {"image/png"},
+		"Content-ID":          {"<qr@verify>"},
+		"Content-Disposition": {`inline; filename="qr.png"`},
+	}
+	if err := writeBase64Part(rel, qrHeader, qr); err != nil {
+		return nil, err
+	}
+	if err := rel.Close(); err != nil {
+		return nil, err
+	}
+	part, err := alt.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/related; boundary=" + rel.Boundary()}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(related.Bytes())
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeBase64Part(w *multipart.Writer, header textproto.MIMEHeader, data []byte) error {
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeBase64(&buf, data)
+	_, err = part.Write(buf.Bytes())
+	return err
+}
+
+// Writes data base64-encoded in 76 character lines, as MIME requires
+func writeBase64(buf *bytes.Buffer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+}
+
+func lastEmailSentAt() time.Time {
+	if t := lastEmailSent.Load(); t != 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Time{}
+}
+
+// Walks through connect, EHLO, STARTTLS and AUTH without sending anything,
+// returning an error that says which step failed and what to check
+func smtpPreflight() error {
+	conn, err := net.DialTimeout("tcp", smtpAddr, smtpPreflightTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s (network or firewall problem): %w", smtpAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpPreflightTimeout))
+
+	c, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%s did not answer like an SMTP server: %w", smtpAddr, err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return fmt.Errorf("EHLO was rejected: %w", err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return errors.New("server does not offer STARTTLS, refusing to send credentials in plain text")
+	}
+	if err := c.StartTLS(&tls.Config{ServerName: smtpHost}); err != nil {
+		return fmt.Errorf("STARTTLS failed (TLS certificate or protocol problem): %w", err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", gmailAddress, gmailAppPassword, smtpHost)); err != nil {
+		return fmt.Errorf("authentication failed, check GMAIL_ADDRESS and GMAIL_APP_PASSWORD (Gmail needs an app password, not the account password): %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Mail queue ---
+// Emails that fail with a temporary error are persisted and retried in the background.
+// Once they run out of attempts they are moved to a dead-letter list that admins can
+// inspect and requeue with /mailqueue after the mail provider recovers.
+
+const (
+	mailMaxAttempts    = 5
+	mailBaseBackoff    = time.Minute
+	mailMaxBackoff     = 30 * time.Minute
+	mailPollInterval   = 15 * time.Second
+	mailRetryAllButton = "mail_retry_all"
+)
+
+// Returned instead of sending while the mail circuit breaker is open
+var errMailerDown = errors.New("mail provider is down, email queued")
+
+type queuedEmail struct {
+	UserID  string            `json:"user_id"`
+	GuildID string            `json:"guild_id"`
+	Mail    verificationEmail `json:"mail"`
+	// tokenHash of the magic link's secret
+	TokenHash   string    `json:"token_hash,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+}
+
+// Reports whether an SMTP failure is worth retrying: 4xx replies and network errors are,
+// 5xx replies (bad address, rejected credentials) are not
+func isTransientMailError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	return true
+}
+
+// Sends the email, queueing it for background retry if the failure looks transient.
+// queued is true when the email will be retried, in which case err describes the first failure.
+func sendVerificationEmailWithRetry(ctx context.Context, userID string, data verificationData, mail verificationEmail) (queued bool, err error) {
+	// Emails are spaced out during a raid; the queue sends this one when its slot comes up
+	if wait := reserveEmailSlot(time.Now()); wait > 0 {
+		err = store.enqueueEmail(queuedEmail{
+			UserID:      userID,
+			GuildID:     data.GuildID,
+			Mail:        mail,
+			TokenHash:   data.TokenHash,
+			QueuedAt:    time.Now(),
+			NextAttempt: time.Now().Add(wait),
+		})
+		if err == nil {
+			return true, nil
+		}
+		log.Printf("Failed to queue throttled email, sending it now: %v", err)
+	}
+	if mailCircuit.isOpen() {
+		err = store.enqueueEmail(queuedEmail{
+			UserID:      userID,
+			GuildID:     data.GuildID,
+			Mail:        mail,
+			TokenHash:   data.TokenHash,
+			QueuedAt:    time.Now(),
+			NextAttempt: time.Now(),
+			LastError:   errMailerDown.Error(),
+		})
+		if err != nil {
+			log.Printf("Failed to queue email: %v", err)
+			return false, errMailerDown
+		}
+		log.Printf("Mail provider is down, queued verification email for user %s", userID)
+		return true, errMailerDown
+	}
+	err = sendVerificationEmail(ctx, mail)
+	// A cancelled send belongs to a handler that gave up; the user was already told to retry
+	if err == nil || !isTransientMailError(err) || ctx.Err() != nil {
+		return false, err
+	}
+	qerr := store.enqueueEmail(queuedEmail{
+		UserID:      userID,
+		GuildID:     data.GuildID,
+		Mail:        mail,
+		TokenHash:   data.TokenHash,
+		QueuedAt:    time.Now(),
+		Attempts:    1,
+		NextAttempt: time.Now().Add(mailBaseBackoff),
+		LastError:   err.Error(),
+	})
+	if qerr != nil {
+		log.Printf("Failed to queue email: %v", qerr)
+		return false, err
+	}
+	log.Printf("Queued verification email for user %s for retry: %v", userID, err)
+	return true, err
+}
+
+func runMailQueue(s *discordgo.Session) {
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Retries would only burn attempts while the mail setup is being changed
+		if _, on := store.maintenance(); on {
+			continue
+		}
+		// Waits for the breaker's probe instead of failing every queued email
+		if mailCircuit.isOpen() {
+			continue
+		}
+		retryDueEmails(s)
+	}
+}
+
+// Serializes passes over the mail queue, so a manual run from /debug can't send an email
+// the scheduled pass is sending too
+var mailQueuePass sync.Mutex
+
+func retryDueEmails(s *discordgo.Session) {
+	mailQueuePass.Lock()
+	defer mailQueuePass.Unlock()
+	for _, mail := range store.dueEmails(time.Now()) {
+		retryEmail(s, mail)
+	}
+}
+
+func retryEmail(s *discordgo.Session, q queuedEmail) {
+	// The pending code is normally restored from the store after a restart; a state file from
+	// before it was saved there only has the queue to go by.
+	// An email for a code that has since been replaced by a new /verify is dropped.
+	verificationMutex.Lock()
+	pending, ok := pendingVerifications[q.UserID]
+	if !ok {
+		setPendingVerification(q.UserID, verificationData{CodeHash: codeHash(q.UserID, q.Mail.Code), Email: q.Mail.To, GuildID: q.GuildID, TokenHash: q.TokenHash,
+			ExpiresAt: config.policyFor(q.GuildID).codeExpiry(time.Now())})
+	}
+	verificationMutex.Unlock()
+	if ok && !pending.codeMatches(q.UserID, q.Mail.Code) {
+		log.Printf("Dropping queued email for user %s: superseded by a newer code.", q.UserID)
+		if err := store.removeQueuedEmail(q.UserID); err != nil {
+			log.Printf("Failed to remove email from queue: %v", err)
+		}
+		return
+	}
+
+	if _, paused := pausedDomainFor(q.Mail.To); paused {
+		// The school's mail is down; the email goes out once the school is resumed
+		return
+	}
+	err := sendVerificationEmail(context.Background(), q.Mail)
+	if err == nil {
+		log.Printf("Verification email for user %s sent after %d attempts.", q.UserID, q.Attempts+1)
+		// The code's lifetime starts when it actually reaches the user
+		verificationMutex.Lock()
+		if pending, ok := pendingVerifications[q.UserID]; ok && pending.codeMatches(q.UserID, q.Mail.Code) {
+			pending.ExpiresAt = config.policyFor(q.GuildID).codeExpiry(time.Now())
+			setPendingVerification(q.UserID, pending)
+		}
+		verificationMutex.Unlock()
+		recordFunnel(stageEmailDelivered)
+		if err := store.removeQueuedEmail(q.UserID); err != nil {
+			log.Printf("Failed to remove email from queue: %v", err)
+		}
+		notifyDeferredEmailSent(s, q.UserID)
+		return
+	}
+
+	if errors.Is(err, errMailerDown) || errors.Is(err, errMailQuotaExhausted) {
+		// The breaker opened or the quota ran out in the meantime; this doesn't count as an attempt
+		return
+	}
+	q.Attempts++
+	q.LastError = err.Error()
+	if q.Attempts >= mailMaxAttempts || !isTransientMailError(err) {
+		log.Printf("Giving up on verification email for user %s: %v", q.UserID, err)
+		countDaily(statEmailFailed)
+		if err := store.deadLetterEmail(q); err != nil {
+			log.Printf("Failed to move email to the dead-letter list: %v", err)
+		}
+		alertAdmins(s, fmt.Sprintf("⚠️ <@%s> への認証メールの送信が %d 回失敗しました. `/mailqueue` で確認してください.\n最後のエラー: `%s`",
+			q.UserID, q.Attempts, q.LastError))
+		return
+	}
+
+	backoff := mailBaseBackoff << (q.Attempts - 1)
+	if backoff > mailMaxBackoff {
+		backoff = mailMaxBackoff
+	}
+	q.NextAttempt = time.Now().Add(backoff)
+	if err := store.enqueueEmail(q); err != nil {
+		log.Printf("Failed to update queued email: %v", err)
+	}
+}
+
+// Tells the user their delayed email finally went out, in their verification channel or by DM
+func notifyDeferredEmailSent(s *discordgo.Session, userID string) {
+	verificationMutex.Lock()
+	expiresAt := pendingVerifications[userID].ExpiresAt
+	verificationMutex.Unlock()
+	lang := userLanguage(userID)
+	message := "遅れていた認証メールを送信しました. メールを確認し、`/code` コマンドで認証を完了させてください."
+	if lang == langEN {
+		message = "Your delayed verification email has been sent. Check your inbox and finish with the `/code` command."
+	}
+	message += codeExpiryNote(expiresAt, lang)
+	if channelID, ok := store.latestVerificationChannel(userID); ok {
+		if _, err := sendText(s, channelID, fmt.Sprintf("<@%s> %s", userID, message)); err == nil {
+			return
+		}
+	}
+	if err := sendDirectMessage(s, userID, message); err != nil {
+		log.Printf("Failed to tell %s their email was sent: %v", userID, err)
+	}
+}
+
+// --- /mailqueue ---
+
+func mailQueueCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "mailqueue",
+		Description:              "Show queued and undeliverable verification emails (admin only).",
+		DefaultMemberPermissions: &permissions,
+	}
+}
+
+func handleMailQueue(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	dead := store.deadLetters()
+	content := fmt.Sprintf("再送待ち: %d件\n送信不能: %d件", store.mailQueueLength(), len(dead))
+	var lines []string
+	for idx, q := range dead {
+		if idx == 10 {
+			lines = append(lines, fmt.Sprintf("…他 %d件", len(dead)-idx))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• <@%s> `%s` (%d回失敗, <t:%d:R>): `%s`", q.UserID, maskEmail(q.Mail.To), q.Attempts, q.QueuedAt.Unix(), redact(q.LastError)))
+	}
+	if len(lines) > 0 {
+		content += "\n" + strings.Join(lines, "\n")
+	}
+
+	data := &discordgo.InteractionResponseData{
+		Content:         content,
+		Flags:           discordgo.MessageFlagsEphemeral,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}
+	if len(dead) > 0 {
+		data.Components = []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "すべて再送", Style: discordgo.PrimaryButton, CustomID: mailRetryAllButton, Emoji: &discordgo.ComponentEmoji{Name: "🔁"}},
+			}},
+		}
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+}
+
+func handleMailRetryAll(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	n, err := store.requeueDeadLetters()
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 再送の登録に失敗しました.", "Failed to requeue dead letters", err)
+		return
+	}
+	log.Printf("%d dead-letter emails requeued by %s", n, interactionUser(i).ID)
+	content := fmt.Sprintf("🔁 %d件のメールを再送キューに戻しました.", n)
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: content, Components: []discordgo.MessageComponent{}},
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Mail quotas ---
+// Gmail stops sending after 500 emails a day (2000 for Workspace), which a school's
+// entrance announcement can reach by the evening. Emails sent are counted per account and
+// day, admins are warned once an account reaches warn_at of its limit, and a fallback SMTP
+// account, if configured, takes over once the primary one is used up. Past every limit,
+// emails wait in the mail queue until the next day. An email is counted when its account
+// is picked, and given back if it isn't sent, so concurrent sends can't overshoot a limit.
+
+const fallbackPasswordEnv = "FALLBACK_SMTP_PASSWORD"
+
+type MailQuotaConfig struct {
+	// Emails the Gmail account may send per day; 0 disables counting against a limit
+	DailyLimit int `json:"daily_limit"`
+	// Share of a limit at which admins are warned, between 0 and 1
+	WarnAt float64 `json:"warn_at"`
+	// Optional account used once the Gmail quota is used up; the password comes from FALLBACK_SMTP_PASSWORD
+	Fallback *FallbackSMTP `json:"fallback,omitempty"`
+}
+
+type FallbackSMTP struct {
+	Name string `json:"name"`
+	// Host and port of a STARTTLS submission server, such as "smtp.sendgrid.net:587"
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	From     string `json:"from"`
+	// 0 means unlimited
+	DailyLimit int `json:"daily_limit"`
+}
+
+func defaultMailQuotaConfig() MailQuotaConfig {
+	return MailQuotaConfig{DailyLimit: 500, WarnAt: 0.8}
+}
+
+func (c MailQuotaConfig) validate() error {
+	if c.DailyLimit < 0 {
+		return fmt.Errorf("daily_limit must not be negative")
+	}
+	if c.WarnAt <= 0 || c.WarnAt > 1 {
+		return fmt.Errorf("warn_at must be between 0 and 1")
+	}
+	if f := c.Fallback; f != nil {
+		if f.Name == "" || f.Addr == "" || f.Username == "" || f.From == "" {
+			return fmt.Errorf("fallback: name, addr, username and from are required")
+		}
+		if _, _, err := net.SplitHostPort(f.Addr); err != nil {
+			return fmt.Errorf("fallback: addr: %w", err)
+		}
+		if f.Name == mailProvider {
+			return fmt.Errorf("fallback: name %q is taken by the primary account", f.Name)
+		}
+		if f.DailyLimit < 0 {
+			return fmt.Errorf("fallback: daily_limit must not be negative")
+		}
+	}
+	return nil
+}
+
+// An SMTP server and the account the bot logs in with
+type smtpAccount struct {
+	name       string
+	host       string
+	addr       string
+	username   string
+	password   string
+	from       string
+	dailyLimit int
+	pool       *smtpConnPool
+
+	warnMutex sync.Mutex
+	// Day the warn_at warning was last queued, so it is sent once a day
+	warnedOn string
+}
+
+var (
+	accountsOnce sync.Once
+	accounts     []*smtpAccount
+
+	errMailQuotaExhausted = errors.New("daily sending quota of every mail account is used up")
+
+	mailQuotaAlerts = make(chan string, 4)
+
+	mailQuotaRemaining = newGauge("kosen_verify_mail_quota_remaining", "Emails each mail account may still send today; -1 if unlimited.", "provider")
+)
+
+// Returns the mail accounts in the order they are used, the Gmail account first
+func mailAccounts() []*smtpAccount {
+	accountsOnce.Do(func() {
+		accounts = []*smtpAccount{{
+			name:       mailProvider,
+			host:       smtpHost,
+			addr:       smtpAddr,
+			username:   gmailAddress,
+			password:   gmailAppPassword,
+			from:       gmailAddress,
+			dailyLimit: config.MailQuota.DailyLimit,
+			pool:       newSMTPConnPool(),
+		}}
+		if f := config.MailQuota.Fallback; f != nil {
+			host, _, _ := net.SplitHostPort(f.Addr)
+			accounts = append(accounts, &smtpAccount{
+				name:       f.Name,
+				host:       host,
+				addr:       f.Addr,
+				username:   f.Username,
+				password:   os.Getenv(fallbackPasswordEnv),
+				from:       f.From,
+				dailyLimit: f.DailyLimit,
+				pool:       newSMTPConnPool(),
+			})
+		}
+	})
+	return accounts
+}
+
+func mailSentStat(acct *smtpAccount) string {
+	return "mail_sent_" + acct.name
+}
+
+// Emails the account sent today in the configured time zone
+func (acct *smtpAccount) sentToday() int {
+	return store.dailyStats(localNow().Format(statsDateFormat))[mailSentStat(acct)]
+}
+
+// Emails the account may still send today, or -1 if it has no limit
+func (acct *smtpAccount) remaining() int {
+	if acct.dailyLimit <= 0 {
+		return -1
+	}
+	return max(acct.dailyLimit-acct.sentToday(), 0)
+}
+
+// Returns the first account with quota left, or nil if all are used up
+func pickMailAccount() *smtpAccount {
+	for _, acct := range mailAccounts() {
+		if acct.remaining() != 0 {
+			return acct
+		}
+	}
+	return nil
+}
+
+// Picks the first account with quota left and counts the email against it before it is
+// sent; returns nil if every account is used up
+func reserveMailQuota() *smtpAccount {
+	date := localNow().Format(statsDateFormat)
+	for _, acct := range mailAccounts() {
+		sent, reserved, err := store.reserveDailyStat(date, mailSentStat(acct), acct.dailyLimit)
+		if err != nil {
+			log.Printf("Failed to save mail count of %s: %v", acct.name, err)
+		}
+		if reserved {
+			acct.quotaUsed(date, sent)
+			return acct
+		}
+	}
+	return nil
+}
+
+// Gives back the quota reserved for an email that wasn't sent
+func releaseMailQuota(acct *smtpAccount) {
+	if err := store.decrementDailyStat(localNow().Format(statsDateFormat), mailSentStat(acct)); err != nil {
+		log.Printf("Failed to save mail count of %s: %v", acct.name, err)
+	}
+	mailQuotaRemaining.set(float64(acct.remaining()), acct.name)
+}
+
+// Queues a warning when the account first reaches its threshold today, or runs out
+func (acct *smtpAccount) quotaUsed(date string, sent int) {
+	if acct.dailyLimit <= 0 {
+		mailQuotaRemaining.set(-1, acct.name)
+		return
+	}
+	remaining := max(acct.dailyLimit-sent, 0)
+	mailQuotaRemaining.set(float64(remaining), acct.name)
+	threshold := int(math.Ceil(float64(acct.dailyLimit) * config.MailQuota.WarnAt))
+	var alert string
+	switch {
+	case remaining == 0 && len(mailAccounts()) > 1 && pickMailAccount() != nil:
+		alert = fmt.Sprintf("📮 メールアカウント `%s` の本日の送信上限 (%d通) に達したため、`%s` に切り替えました.", acct.name, acct.dailyLimit, pickMailAccount().name)
+	case remaining == 0:
+		alert = fmt.Sprintf("📪 メールアカウント `%s` の本日の送信上限 (%d通) に達しました. 新しい認証メールは明日まで送信待ちになります.", acct.name, acct.dailyLimit)
+	case sent >= threshold && acct.claimWarning(date):
+		alert = fmt.Sprintf("⚠️ メールアカウント `%s` の本日の送信数が上限の%d%%に達しました (%d/%d通).", acct.name, int(config.MailQuota.WarnAt*100), sent, acct.dailyLimit)
+	default:
+		return
+	}
+	select {
+	case mailQuotaAlerts <- alert:
+	default:
+	}
+}
+
+// Reports whether the threshold warning for date is still to be sent, and marks it sent
+func (acct *smtpAccount) claimWarning(date string) bool {
+	acct.warnMutex.Lock()
+	defer acct.warnMutex.Unlock()
+	if acct.warnedOn == date {
+		return false
+	}
+	acct.warnedOn = date
+	return true
+}
+
+// Posts the quota warnings queued by the mailer
+func runMailQuotaAlerts(s *discordgo.Session) {
+	for _, acct := range mailAccounts() {
+		mailQuotaRemaining.set(float64(acct.remaining()), acct.name)
+		if acct.password == "" {
+			log.Printf("Mail account %s has no password set, check %s.", acct.name, fallbackPasswordEnv)
+		}
+	}
+	for alert := range mailQuotaAlerts {
+		log.Println(alert)
+		alertAdmins(s, alert)
+	}
+}
+
+// Describes each account's use of its quota, for /uptime
+func mailQuotaSummary() string {
+	var lines []string
+	for _, acct := range mailAccounts() {
+		if acct.dailyLimit <= 0 {
+			lines = append(lines, fmt.Sprintf("`%s` %d通 (上限なし)", acct.name, acct.sentToday()))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("`%s` %s (残り%d通)", acct.name, capacityUsage(acct.sentToday(), acct.dailyLimit, "通"), acct.remaining()))
+	}
+	return strings.Join(lines, "\n")
+}
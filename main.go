@@ -3,11 +3,13 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json" // FIX 1: Corrected typo from "encording"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/smtp"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,8 +22,30 @@ import (
 
 // FIX 3.1: Create a struct to hold verification data
 type verificationData struct {
-	Code  string
-	Email string
+	// See codeHash
+	CodeHash string `json:"code_hash"`
+	Email    string `json:"email"`
+	GuildID  string `json:"guild_id"`
+	// tokenHash of the magic link's secret, empty if magic links are off
+	TokenHash string `json:"token_hash,omitempty"`
+	// Zero if the code doesn't expire
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// Wrong codes entered so far
+	Attempts int `json:"attempts,omitempty"`
+	// The right code or link was entered; the funnel counts it once even if granting the roles is retried
+	CodeEntered bool `json:"code_entered,omitempty"`
+}
+
+// Counts the code_entered funnel stage the first time the right code or link comes in
+func (d *verificationData) markCodeEntered() {
+	if !d.CodeEntered {
+		recordFunnel(stageCodeEntered)
+		d.CodeEntered = true
+	}
+}
+
+func (d verificationData) expired(now time.Time) bool {
+	return !d.ExpiresAt.IsZero() && now.After(d.ExpiresAt)
 }
 
 var (
@@ -32,13 +56,29 @@ var (
 	gmailAppPassword  string
 	welcomeChannelID  string
 	privateCategoryID string
+	modChannelID      string // Optional: where appeals and manual reviews are posted
+	moderatorRoleID   string // Optional: role called into verification channels on escalation
+	adminChannelID    string // Optional: where operational alerts are posted
+	archiveChannelID  string // Optional: where transcripts of deleted verification channels are posted
+	stateFile         string
+	auditLogFile      string // Optional: JSON Lines file the interaction audit log is appended to
+	configFile        string
+	faqFile           string
+	forceSync         bool // Overwrite all commands on startup instead of diffing them
+	metricsAddr       string
+	lineChannelToken  string // Optional: LINE Messaging API token for watchdog alerts
+	webAddr           string // Optional: listen address for the magic link and linked role pages
+	clientSecret      string // Optional: OAuth2 client secret, enables linked roles
+	botApplicationID  string // Set once logged in; the OAuth2 client ID
+
+	membershipCallbackSecret string // Signs the membership callbacks; required when callback.url is set
 
 	// FIX 3.2: Update the map to use the new struct
 	pendingVerifications = make(map[string]verificationData)
 	verificationMutex    = &sync.Mutex{}
 
 	// This will hold the data from roles.json
-	schoolRoleIDs = make(map[string]string)
+	schools = make(map[string]schoolMapping)
 )
 
 const (
@@ -54,10 +94,51 @@ func init() {
 	gmailAppPassword = os.Getenv("GMAIL_APP_PASSWORD")
 	welcomeChannelID = os.Getenv("DISCORD_WELCOME_CHANNEL_ID")
 	privateCategoryID = os.Getenv("DISCORD_PRIVATE_CATEGORY_ID")
+	modChannelID = os.Getenv("DISCORD_MOD_CHANNEL_ID")
+	moderatorRoleID = os.Getenv("DISCORD_MODERATOR_ROLE_ID")
+	adminChannelID = os.Getenv("DISCORD_ADMIN_CHANNEL_ID")
+	archiveChannelID = os.Getenv("DISCORD_ARCHIVE_CHANNEL_ID")
+	stateFile = os.Getenv("STATE_FILE")
+	if stateFile == "" {
+		stateFile = "state.json"
+	}
+	auditLogFile = os.Getenv("AUDIT_LOG_FILE")
+	metricsAddr = os.Getenv("METRICS_ADDR")
+	lineChannelToken = os.Getenv("LINE_CHANNEL_ACCESS_TOKEN")
+	webAddr = os.Getenv("WEB_ADDR")
+	clientSecret = os.Getenv("DISCORD_CLIENT_SECRET")
+	membershipCallbackSecret = os.Getenv("MEMBERSHIP_CALLBACK_SECRET")
+	faqFile = os.Getenv("FAQ_FILE")
+	if faqFile == "" {
+		faqFile = "faq.json"
+	}
+	configFile = os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config.json"
+	}
+}
 
-	if botToken == "" || guildID == "" || verifiedRoleID == "" || gmailAddress == "" || gmailAppPassword == "" || welcomeChannelID == "" {
-		log.Fatal("Error: Not all required environment variables are set.")
+// Returns an error naming the required environment variables that are not set
+func requiredEnvError() error {
+	required := map[string]string{
+		"DISCORD_BOT_TOKEN":          botToken,
+		"DISCORD_GUILD_ID":           guildID,
+		"DISCORD_VERIFIED_ROLE_ID":   verifiedRoleID,
+		"GMAIL_ADDRESS":              gmailAddress,
+		"GMAIL_APP_PASSWORD":         gmailAppPassword,
+		"DISCORD_WELCOME_CHANNEL_ID": welcomeChannelID,
+	}
+	var missing []string
+	for name, value := range required {
+		if value == "" {
+			missing = append(missing, name)
+		}
 	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("not set: %s", strings.Join(missing, ", "))
 }
 
 // Loads the roles from the JSON file
@@ -67,166 +148,660 @@ func loadRoleIDs() error {
 		return fmt.Errorf("could not read roles.json: %w", err)
 	}
 
-	err = json.Unmarshal(file, &schoolRoleIDs)
+	err = json.Unmarshal(file, &schools)
 	if err != nil {
 		return fmt.Errorf("could not parse roles.json: %w", err)
 	}
 
-	log.Printf("Successfully loaded %d school role mappings.", len(schoolRoleIDs))
+	log.Printf("Successfully loaded %d school role mappings.", len(schools))
 	return nil
 }
 
 // --- Main Function ---
 func main() {
+	flag.BoolVar(&forceSync, "force-sync", false, "overwrite all slash commands instead of only syncing changes")
+	force := flag.Bool("force", false, "import-state: overwrite existing files")
+	online := flag.Bool("online", false, "validate-config: also check Discord IDs and the SMTP login")
+	format := flag.String("format", "text", "config-schema: output format, \"text\" or \"json\"")
+	flag.Parse()
+
+	if flag.Arg(0) == "validate-config" {
+		if !validateConfig(*online) {
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "config-schema" {
+		if err := printConfigSchema(os.Stdout, *format); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if err := requiredEnvError(); err != nil {
+		log.Fatalf("Error: Not all required environment variables are set (%v).", err)
+	}
+
+	// Subcommands for moving the bot between hosts: export-state <file>, import-state <file>
+	switch flag.Arg(0) {
+	case "export-state", "import-state":
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: %s [-force] %s <archive>", os.Args[0], flag.Arg(0))
+		}
+		var err error
+		if flag.Arg(0) == "export-state" {
+			err = exportState(flag.Arg(1))
+		} else {
+			err = importState(flag.Arg(1), *force)
+		}
+		if err != nil {
+			log.Fatalf("CRITICAL: %v", err)
+		}
+		return
+	case "":
+	default:
+		log.Fatalf("Unknown subcommand %q", flag.Arg(0))
+	}
+
 	// FIX 2: Load the roles.json file at startup
 	if err := loadRoleIDs(); err != nil {
 		log.Fatalf("CRITICAL: %v", err)
 	}
 
+	var err error
+	config, err = loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("CRITICAL: %v", err)
+	}
+	configureJobs(config.jobSettings)
+
+	store, err = openStore(stateFile)
+	if err != nil {
+		log.Fatalf("CRITICAL: %v", err)
+	}
+	loadPendingVerifications()
+	if n, err := store.sealLinkedRoleTokens(); err != nil {
+		log.Printf("Failed to encrypt linked role tokens: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted %d linked role tokens saved by an older version.", n)
+	}
+
+	if err := loadFAQ(faqFile); err != nil {
+		log.Fatalf("CRITICAL: %v", err)
+	}
+
+	var preflightErr error
+	if config.SMTPPreflight != preflightOff {
+		log.Println("Checking SMTP configuration...")
+		preflightErr = smtpPreflight()
+		if preflightErr != nil && config.SMTPPreflight == preflightFail {
+			log.Fatalf("CRITICAL: SMTP preflight failed: %v", preflightErr)
+		}
+		if preflightErr == nil {
+			log.Println("SMTP preflight passed.")
+		}
+	}
+
 	dg, err := discordgo.New("Bot " + botToken)
 	if err != nil {
 		log.Fatalf("Error creating Discord session: %v", err)
 	}
+	installDiscordLogger(dg)
 
 	dg.AddHandler(onReady)
-	dg.AddHandler(interactionHandler)
-	dg.Identify.Intents = discordgo.IntentsGuilds
-
-	err = dg.Open()
+	dg.AddHandler(newInteractionRouter().handle)
+	dg.AddHandler(onMessageCreate)
+	dg.AddHandler(onWelcomeChannelMessage)
+	dg.AddHandler(onConnect)
+	dg.AddHandler(onDisconnect)
+	dg.AddHandler(onResumed)
+	dg.AddHandler(onGuildMemberUpdate)
+	dg.AddHandler(onGuildMemberAdd)
+	dg.AddHandler(onScreeningUpdate)
+	dg.AddHandler(onProtectedRoleUpdate)
+	dg.AddHandler(onRaidMemberAdd)
+	dg.AddHandler(onGuildCreate)
+	dg.AddHandler(onProbationMemberUpdate)
+	dg.AddHandler(onLookupCacheEvent)
+	configureGateway(dg)
+
+	err = openGateway(dg)
 	if err != nil {
 		log.Fatalf("Error opening connection: %v", err)
 	}
 
+	<-commandsRegistered
+	if preflightErr != nil {
+		sdNotify("READY=1\nSTATUS=Running, but the SMTP preflight failed")
+	} else {
+		sdNotify("READY=1\nSTATUS=Running")
+	}
+
+	if preflightErr != nil {
+		alertAdmins(dg, fmt.Sprintf("⚠️ SMTPの事前チェックに失敗しました. 認証メールが送信できない可能性があります.\n```\n%v\n```", preflightErr))
+	}
+
+	go runRoleGrantRetries(dg)
+	go runMailQueue(dg)
+	go runMailCircuit(dg)
+	go runSMTPPoolPruner()
+	go runCallbackOutbox(dg)
+	go runMailQuotaAlerts(dg)
+	go runScheduler(dg)
+	go runWatchdog(dg)
+	go runGuestExpiry(dg)
+	go runRaidMonitor(dg)
+	go runPendingVerificationWriter()
+	go runAPIUsageFlusher()
+	go runSystemdWatchdog(dg)
+	startMetricsServer(metricsAddr)
+	startWebServer(dg, webAddr)
+
 	log.Println("Bot is now running. Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-sc
 
 	log.Println("Shutting down bot.")
+	sdNotify("STOPPING=1")
+	closeSMTPPool()
+	writePendingVerifications()
+	flushAPIKeyUsage()
 	dg.Close()
 }
 
 // --- Handlers ---
 func onReady(s *discordgo.Session, r *discordgo.Ready) {
 	log.Printf("Logged in as: %s#%s", s.State.User.Username, s.State.User.Discriminator)
-	commands := []*discordgo.ApplicationCommand{
-		{Name: "verify", Description: "Start verification with your Kosen email.", Options: []*discordgo.ApplicationCommandOption{{Type: discordgo.ApplicationCommandOptionString, Name: "email", Description: "Your Kosen email address", Required: true}}},
-		{Name: "code", Description: "Enter the verification code sent to your email.", Options: []*discordgo.ApplicationCommandOption{{Type: discordgo.ApplicationCommandOptionString, Name: "code", Description: "The 6-digit verification code", Required: true}}},
-	}
+	botApplicationID = s.State.User.ID
 	log.Println("Registering commands...")
-	_, err := s.ApplicationCommandBulkOverwrite(s.State.User.ID, guildID, commands)
+	err := registerCommands(s, forceSync)
 	if err != nil {
 		log.Fatalf("Could not register commands: %v", err)
 	}
 	log.Println("Commands successfully registered.")
+	markCommandsRegistered()
+	loadBotOwners(s)
+	registerRoleConnectionMetadata(s)
 	setupVerificationButton(s)
 }
 
-func interactionHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	switch i.Type {
-	case discordgo.InteractionApplicationCommand:
-		switch i.ApplicationCommandData().Name {
-		case "verify":
-			handleVerify(s, i)
-		case "code":
-			handleCode(s, i)
-		}
-	case discordgo.InteractionMessageComponent:
-		if i.MessageComponentData().CustomID == startVerificationButtonID {
-			handleStartVerification(s, i)
-		}
-	}
+// Maps every command and component to its handler
+func newInteractionRouter() *router {
+	r := newRouter()
+	r.use(recoveryMiddleware, dedupeMiddleware, loggingMiddleware, timeoutMiddleware, welcomeAnalyticsMiddleware, dmMiddleware, commandGateMiddleware, schoolModeratorMiddleware, cooldownMiddleware, undeliveredNoticesMiddleware)
+
+	r.command("verify", handleVerify)
+	r.command("code", handleCode)
+	r.command("appeal", handleAppeal)
+	r.command("feature", handleFeature)
+	r.command("stats", handleStats)
+	r.command("testemail", handleTestEmail)
+	r.command("uptime", handleUptime)
+	r.command("maintenance", handleMaintenance)
+	r.command("mailqueue", handleMailQueue)
+	r.command("roles", handleRoles)
+	r.command("exportstats", handleExportStats)
+	r.command("apikey", handleAPIKey)
+	r.command("debug", handleDebug)
+	r.command("assist", handleAssist)
+	r.command("jobs", handleJobs)
+	r.command("audit", handleAudit)
+	r.command("lockdown", handleLockdown)
+	r.command("unverify", handleUnverify)
+	r.command(commandSwitchName, handleCommandSwitch)
+	r.command("previewemail", handlePreviewEmail)
+	r.command("waitlist", handleWaitlist)
+	r.command("setup", handleSetup)
+	r.command("schoolpause", handleSchoolPause)
+	r.command("migratedomain", handleMigrateDomain)
+	r.command("announce", handleAnnounce)
+	r.command("whois", handleWhois)
+	r.command("pending", handlePending)
+	r.command("approve", handleApprove)
+	r.autocomplete("stats", handleSchoolAutocomplete)
+	r.autocomplete("waitlist", handleSchoolAutocomplete)
+	r.autocomplete("schoolpause", handleSchoolAutocomplete)
+	r.autocomplete("migratedomain", handleSchoolAutocomplete)
+	r.autocomplete("announce", handleAnnounceAutocomplete)
+	r.autocomplete("approve", handleModeratedSchoolAutocomplete)
+	r.component(emailConfirmButtonID, handleEmailConfirm)
+	r.component(emailEditButtonID, handleEmailEdit)
+	r.modal(emailEditModalID, handleEmailEditSubmit)
+	r.component(emailSuggestButtonID, handleEmailSuggestion)
+
+	r.component(startVerificationButtonID, handleStartVerification)
+	r.component(welcomeHelpButtonID, handleWelcomeHelp)
+	r.component(languageToggleButtonID, handleLanguageToggle)
+	r.component(callModeratorButtonID, handleCallModerator)
+	r.component(faqButtonID, handleFAQ)
+	r.component(faqPagePrefix, handleFAQPage)
+	r.component(dmGuildPickerID, handleGuildPicked)
+	r.component(appealApprovePrefix, handleAppealDecision)
+	r.component(appealDenyPrefix, handleAppealDecision)
+	r.component(idCardApprovePrefix, handleIDCardDecision)
+	r.component(idCardDenyPrefix, handleIDCardDecision)
+	r.component(mailRetryAllButton, handleMailRetryAll)
+	r.component(realNameButtonID, handleRealNameButton)
+	r.component(optInRolesSelectID, handleOptInRolesSelect)
+	r.component(guestButtonID, handleGuestButton)
+	r.component(setupStartPrefix, handleSetupStart)
+	r.component(setupCreatePrefix, handleSetupCreate)
+	r.component(setupRefreshPrefix, handleSetupRefresh)
+
+	r.modal(appealModalID, handleAppealSubmit)
+	r.modal(realNameModalID, handleRealNameSubmit)
+	r.modal(raidChallengeModalID, handleRaidChallengeSubmit)
+	return r
 }
 
 // --- Logic Functions ---
 
 func handleVerify(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	email := i.ApplicationCommandData().Options[0].StringValue()
-	userID := i.Member.User.ID
+	email := normalizeEmail(i.ApplicationCommandData().Options[0].StringValue())
+	userID := interactionUser(i).ID
 
-	domainParts := strings.Split(email, "@")
-	if len(domainParts) != 2 || !isValidKosenEmail(domainParts[1]) {
-		respondEphemeral(s, i, "エラー: `kosen-ac.jp`で終わる有効な高専のメールアドレスを入力してください.")
+	target, ok := resolveTargetGuild(s, i)
+	if !ok {
+		respondGuildPicker(s, i)
 		return
 	}
+	if respondIfMaintenance(s, i) {
+		return
+	}
+	if remaining := lockoutRemaining(userID); remaining > 0 {
+		respondError(s, i, lockoutMessage(i, remaining))
+		return
+	}
+	if !checkVerificationAddress(s, i, target, email) {
+		return
+	}
+	askEmailConfirmation(s, i, target, email)
+}
+
+// Rejects addresses that can't be used, telling the user why
+func checkVerificationAddress(s *discordgo.Session, i *discordgo.InteractionCreate, target, email string) bool {
+	userID := interactionUser(i).ID
+	if hasMixedScripts(email) {
+		log.Printf("Rejected address with mixed scripts from user %s", userID)
+		respondError(s, i, "エラー: メールアドレスに紛らわしい文字が含まれています. 半角英数字で入力し直してください.")
+		return false
+	}
+	rules := config.emailRulesForUser(target, userID)
+	if !rules.allows(email) {
+		message := fmt.Sprintf("エラー: %sで終わる有効な学校のメールアドレスを入力してください.", rules.describe())
+		if suggestion := suggestEmailCorrection(rules, email); suggestion != "" {
+			respondWithEmailSuggestion(s, i, target, message, suggestion)
+		} else {
+			respondError(s, i, message)
+		}
+		return false
+	}
+	if respondIfDomainPaused(s, i, email) {
+		return false
+	}
+	// Retrying while the email is stuck in the queue would only stack up more codes
+	if queued, ok := store.queuedEmailFor(userID); ok && queued.Mail.To == email {
+		respondEphemeral(s, i, "このアドレスへの認証メールは送信待ちです. 送信され次第お知らせしますので、もう一度 `/verify` を実行せずにお待ちください.")
+		return false
+	}
+	return true
+}
+
+// Sends the code to an address the user has confirmed
+func sendVerificationCode(s *discordgo.Session, i *discordgo.InteractionCreate, target, email string) {
+	userID := interactionUser(i).ID
+	policy := config.policyFor(target)
+	if respondIfPendingFull(s, i) {
+		return
+	}
+	if !allowEmailRequest(userID, policy) {
+		log.Printf("User %s locked out after too many verification emails.", userID)
+		respondError(s, i, lockoutMessage(i, policy.LockoutDuration.Duration))
+		return
+	}
+	recordFunnel(stageEmailSubmitted)
 
 	code, err := generateVerificationCode()
 	if err != nil {
-		log.Printf("Failed to generate code: %v", err)
-		respondEphemeral(s, i, "エラー: 内部エラーが発生しました. 管理者に連絡してください.")
+		respondWithErrorRef(s, i, "エラー: 内部エラーが発生しました. 管理者に連絡してください.", "Failed to generate code", err)
 		return
 	}
 
+	mail := verificationEmail{To: email, Code: code, ChannelLink: verificationChannelLink(i, userID), Language: userLanguage(userID)}
+	var token string
+	if magicLinksEnabled() {
+		token, err = generateMagicToken()
+		if err != nil {
+			respondWithErrorRef(s, i, "エラー: 内部エラーが発生しました. 管理者に連絡してください.", "Failed to generate magic link token", err)
+			return
+		}
+		mail.MagicLink = magicLink(token)
+	}
+
 	// FIX 3.3: Store both the code and the email
+	data := verificationData{CodeHash: codeHash(userID, code), Email: email, GuildID: target, ExpiresAt: policy.codeExpiry(time.Now())}
+	if token != "" {
+		data.TokenHash = tokenHash(token)
+	}
 	verificationMutex.Lock()
-	pendingVerifications[userID] = verificationData{Code: code, Email: email}
+	setPendingVerification(userID, data)
 	verificationMutex.Unlock()
 
-	err = sendVerificationEmail(email, code)
+	queued, err := sendVerificationEmailWithRetry(interactionContext(i), userID, data, mail)
+	if queued {
+		recordEmailSent(s, userID, policy)
+		respondEphemeral(s, i, "メールサーバーの障害または混雑のため、認証メールの送信が遅れています. 送信でき次第、自動的に送信してこのチャンネルかDMでお知らせします. もう一度 `/verify` を実行する必要はありません.")
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to send email: %v", err)
-		respondEphemeral(s, i, "エラー: 認証メールの送信に失敗しました. 時間をおいてお試しください.")
+		countDaily(statEmailFailed)
+		respondWithErrorRef(s, i, "エラー: 認証メールの送信に失敗しました. 時間をおいてお試しください.", "Failed to send email", err)
 		return
 	}
+	recordFunnel(stageEmailDelivered)
+	recordEmailSent(s, userID, policy)
+	if owner, ok := store.verificationChannelOwner(i.ChannelID); ok && owner == userID {
+		go moveToSchoolCategory(s, i.ChannelID, emailDomain(email))
+		go postProgressEmbed(s, i.ChannelID, email, data.ExpiresAt)
+	}
 
-	respondEphemeral(s, i, "6桁の認証番号を送信しました. メールを確認し、`/code` コマンドで認証を完了させてください.")
+	lang := interactionLanguage(i)
+	message := "6桁の認証番号を送信しました. メールを確認し、`/code` コマンドで認証を完了させてください."
+	if lang == langEN {
+		message = "A 6-digit code has been sent. Check your inbox and finish with the `/code` command."
+	}
+	respondEphemeral(s, i, message+codeExpiryNote(data.ExpiresAt, lang))
 }
 
 func handleCode(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	userCode := i.ApplicationCommandData().Options[0].StringValue()
-	userID := i.Member.User.ID
+	userCode := normalizeCode(i.ApplicationCommandData().Options[0].StringValue())
+	userID := interactionUser(i).ID
 
-	// FIX 3.4: Retrieve the stored verification data
+	target, ok := resolveTargetGuild(s, i)
+	if !ok {
+		respondGuildPicker(s, i)
+		return
+	}
+	member, err := interactionMember(s, i, target)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: サーバーのメンバー情報を取得できませんでした. サーバーに参加しているか確認してください.", "Failed to look up member in guild "+target, err)
+		return
+	}
+
+	if remaining := lockoutRemaining(userID); remaining > 0 {
+		respondError(s, i, lockoutMessage(i, remaining))
+		return
+	}
+	policy := config.policyFor(target)
+
+	// FIX 3.4: Retrieve the stored verification data.
+	// The code is consumed under the lock so a second /code running concurrently can't verify twice.
 	verificationMutex.Lock()
 	data, ok := pendingVerifications[userID]
+	expired := ok && data.expired(time.Now())
+	lockedOut := false
+	switch {
+	case !ok:
+	case expired, data.codeMatches(userID, userCode):
+		deletePendingVerification(userID)
+	default:
+		data.Attempts++
+		if policy.MaxAttempts > 0 && data.Attempts >= policy.MaxAttempts {
+			deletePendingVerification(userID)
+			lockedOut = true
+		} else {
+			setPendingVerification(userID, data)
+		}
+	}
 	verificationMutex.Unlock()
 
-	if !ok || userCode != data.Code {
-		respondEphemeral(s, i, "エラー: 認証コードが間違っています.")
+	if expired {
+		respondError(s, i, "エラー: 認証コードの有効期限が切れています. もう一度 `/verify` コマンドでメールを送信してください.")
 		return
 	}
+	if lockedOut {
+		log.Printf("User %s locked out after %d wrong codes.", userID, data.Attempts)
+		lockOut(userID, policy.LockoutDuration.Duration)
+		countDaily(statCodeFailed)
+		respondError(s, i, "エラー: 認証コードを間違えた回数が多すぎるため、このコードは無効になりました.\n"+lockoutMessage(i, policy.LockoutDuration.Duration))
+		recordCodeFailure(s, userID)
+		return
+	}
+	if !ok || !data.codeMatches(userID, userCode) {
+		if _, verified := store.isVerified(userID); verified && !ok && memberHasRole(member, verifiedRoleID) {
+			respondEphemeral(s, i, "既に認証済みです.")
+			return
+		}
+		countDaily(statCodeFailed)
+		lang := interactionLanguage(i)
+		message := "エラー: 認証コードが間違っています."
+		if lang == langEN {
+			message = "Error: The code is incorrect."
+		}
+		if ok {
+			message += codeExpiryNote(data.ExpiresAt, lang)
+		}
+		respondError(s, i, message)
+		recordCodeFailure(s, userID)
+		return
+	}
+	data.markCodeEntered()
 
-	// First, add the general "verified" role
-	err := s.GuildMemberRoleAdd(i.GuildID, userID, verifiedRoleID)
+	outcome, err := completeVerification(s, target, userID, member, data)
+	if errors.Is(err, errSchoolFull) {
+		respondError(s, i, schoolFullMessage(outcome.Domain))
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to add general role: %v", err)
-		respondEphemeral(s, i, "エラー: 学生ロールの付与に失敗しました. 管理者に連絡してください.")
+		// Put the code back so the user can try again once the problem is fixed
+		verificationMutex.Lock()
+		setPendingVerification(userID, data)
+		verificationMutex.Unlock()
+		if errors.Is(err, errSchoolRoleFailed) {
+			respondWithErrorRef(s, i, "エラー: 学校ロールの付与に失敗したため、認証を取り消しました. 少し待ってからもう一度 `/code` で同じコードを入力してください.", "Failed to add school role for "+schoolName(outcome.Domain), err)
+			return
+		}
+		respondWithErrorRef(s, i, "エラー: 学生ロールの付与に失敗しました. 管理者に連絡してください.", "Failed to add general role", err)
+		return
+	}
+	// The emailed link is spent too, so opening it later shows up as a replay
+	if data.TokenHash != "" {
+		consumeTokenHash(tokenMagicLink, data.TokenHash, userID)
+	}
+	if outcome.Waitlisted {
+		respondEphemeral(s, i, waitlistedMessage(outcome.Domain))
+		scheduleUserChannelDeletion(s, userID, 10*time.Second)
 		return
 	}
 
-	// Then, add the school-specific role
-	domainParts := strings.Split(data.Email, "@")
-	domain := domainParts[1]
-	schoolRoleID, roleExists := schoolRoleIDs[domain]
-
-	if roleExists {
-		// FIX 4: Use '=' instead of ':=' because err is already declared
-		err = s.GuildMemberRoleAdd(i.GuildID, userID, schoolRoleID)
-		if err != nil {
-			log.Printf("Failed to add school role: %v", err)
-			respondEphemeral(s, i, "エラー: 学校ロールの付与に失敗しました. 管理者に連絡してください.")
-			// Note: We don't return here, because they still got the main role.
+	// Leave time to pick opt-in roles before the channel disappears
+	optIn := optInRolesComponents(target, member)
+	deleteAfter := 10
+	if optIn != nil {
+		deleteAfter = 60
+	}
+	message := fmt.Sprintf("認証に成功しました! (%s) このチャンネルは%d秒後に自動的に消えます.", schoolName(outcome.Domain), deleteAfter)
+	if isDM(i) {
+		message = fmt.Sprintf("認証に成功しました! (%s) 認証チャンネルは%d秒後に自動的に消えます.", schoolName(outcome.Domain), deleteAfter)
+	}
+	if outcome.RolesDelayed {
+		message += "\nロールの付与が混み合っているため遅れています. 数分以内に自動的に付与されます."
+	}
+	if outcome.Probation > 0 {
+		message += "\n" + probationNote(outcome.Probation)
+	}
+	if featureEnabled(target, featureRealName) {
+		// The channel is deleted once the name has been entered
+		message = fmt.Sprintf("認証に成功しました! (%s)", schoolName(outcome.Domain))
+		if outcome.RolesDelayed {
+			message += "\nロールの付与が混み合っているため遅れています. 数分以内に自動的に付与されます."
+		}
+		if outcome.Probation > 0 {
+			message += "\n" + probationNote(outcome.Probation)
 		}
+		respondInteraction(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content:    message + "\nこのサーバーでは本名のニックネームが必要です. 下のボタンから名前を登録してください.",
+				Components: append([]discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{realNameButton()}}}, optIn...),
+				Flags:      discordgo.MessageFlagsEphemeral,
+			},
+		})
+		return
+	}
+	if optIn != nil {
+		respondInteraction(s, i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content:    message + "\n参加したいロールがあれば下のメニューから選んでください. 後から /roles でも変更できます.",
+				Components: optIn,
+				Flags:      discordgo.MessageFlagsEphemeral,
+			},
+		})
 	} else {
-		log.Printf("No role mapping found for domain: %s", domain)
+		respondEphemeral(s, i, message)
 	}
 
-	respondEphemeral(s, i, "認証に成功しました! このチャンネルは10秒後に自動的に消えます.")
+	// Only ever delete the user's own verification channels, never the channel /code was run in
+	scheduleUserChannelDeletion(s, userID, time.Duration(deleteAfter)*time.Second)
+}
 
-	verificationMutex.Lock()
-	delete(pendingVerifications, userID)
-	verificationMutex.Unlock()
+type verificationOutcome struct {
+	Domain string
+	// Some roles failed transiently and are queued for retry
+	RolesDelayed bool
+	// The school was at its cap, so no roles were granted
+	Waitlisted bool
+	// Only the probation role was granted; the full roles follow after this long
+	Probation time.Duration
+}
+
+// Grants the roles and records the member once their code has been accepted.
+// An error means the member didn't get their roles and nothing was recorded; it wraps
+// errSchoolRoleFailed if the general role was granted but has been taken back, and
+// errSchoolFull if a member verified for another school tried to switch to a full one.
+func completeVerification(s *discordgo.Session, target, userID string, member *discordgo.Member, data verificationData) (verificationOutcome, error) {
+	outcome, err := admitMember(s, member, verifiedMember{
+		UserID:  userID,
+		GuildID: target,
+		Email:   data.Email,
+		Domain:  emailDomain(data.Email),
+		Method:  verifiedByEmail,
+	})
+	if err == nil {
+		recordFunnel(stageVerified)
+	}
+	return outcome, err
+}
+
+// Admits a member whose school has been established, by email or by a moderator: waitlists
+// them if the school is at its cap, otherwise grants the probation or full roles, and
+// records them. Errors are as for completeVerification.
+func admitMember(s *discordgo.Session, member *discordgo.Member, record verifiedMember) (verificationOutcome, error) {
+	userID, target := record.UserID, record.GuildID
+	outcome := verificationOutcome{Domain: record.Domain}
+	record.VerifiedAt = time.Now()
+	if schoolFull(outcome.Domain, userID) {
+		// Waitlisting would replace the member's verification for their current school
+		if current, ok := store.isVerified(userID); ok {
+			return outcome, fmt.Errorf("%w: %s is verified for %s", errSchoolFull, userID, current.Domain)
+		}
+		// Someone already waiting keeps their place
+		if current, ok := store.verifiedMember(userID); ok && current.Domain == record.Domain {
+			record.VerifiedAt = current.VerifiedAt
+		}
+		outcome.Waitlisted = true
+		return outcome, waitlistMember(record)
+	}
 
-	time.Sleep(10 * time.Second)
-	_, err = s.ChannelDelete(i.ChannelID)
+	var err error
+	probation := config.probationFor(target)
+	if probation.enabled() {
+		outcome.RolesDelayed, err = grantProbationRole(s, target, userID, member, probation)
+		outcome.Probation = probation.Duration.Duration
+	} else {
+		outcome.RolesDelayed, err = grantVerifiedRoles(s, target, userID, member, outcome.Domain)
+	}
 	if err != nil {
-		log.Printf("Failed to delete channel: %v", err)
+		return outcome, err
+	}
+
+	record.RolesPending = outcome.RolesDelayed
+	if outcome.Probation > 0 {
+		record.ProbationUntil = record.VerifiedAt.Add(outcome.Probation)
 	}
+	err = store.putVerifiedMember(record)
+	if err != nil {
+		log.Printf("Failed to save verified member: %v", err)
+	}
+
+	clearVerificationTrouble(userID)
+	revokeAssistAccess(s, userID)
+	endGuestAccess(s, userID)
+	log.Printf("User %s verified as a student of %s.", userID, schoolName(outcome.Domain))
+	// Members on probation are announced, and count as verified for linked roles, once they get their full roles
+	if outcome.Probation == 0 {
+		announceVerification(s, userID, outcome.Domain)
+		publishVerified(s, record)
+		go updateRoleConnection(userID)
+	}
+	return outcome, nil
+}
+
+// Grants the general and school roles. Transient failures are retried in the background,
+// in which case delayed is true. An error means neither role is left granted; it wraps
+// errSchoolRoleFailed if the general role was granted but has been taken back.
+func grantVerifiedRoles(s *discordgo.Session, target, userID string, member *discordgo.Member, domain string) (delayed bool, err error) {
+	// First, add the general "verified" role
+	generalGranted, generalQueued := false, false
+	generalRoleID := config.verifiedRoleFor(target)
+	if !memberHasRole(member, generalRoleID) {
+		queued, err := grantRoleWithRetry(s, target, userID, generalRoleID)
+		if err != nil && !queued {
+			return false, err
+		}
+		generalGranted, generalQueued = !queued, queued
+		delayed = queued
+	}
+
+	// Then, add the school-specific role
+	school, roleExists := schools[domain]
+
+	if roleExists && school.RoleID != "" && !memberHasRole(member, school.RoleID) {
+		queued, err := grantRoleWithRetry(s, target, userID, school.RoleID)
+		delayed = delayed || queued
+		if err != nil && !queued {
+			rollbackGeneralRole(s, target, userID, domain, generalGranted, generalQueued)
+			return delayed, fmt.Errorf("%w: %v", errSchoolRoleFailed, err)
+		}
+	} else {
+		log.Printf("No role mapping found for domain: %s", domain)
+	}
+	return delayed, nil
 }
 
 // ... (handleStartVerification and other helper functions are the same as the last correct version) ...
 func handleStartVerification(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	userID := interactionUser(i).ID
+	if !beginStartClick(userID) {
+		ignoreClick(s, i)
+		return
+	}
+	defer endStartClick(userID)
+	if respondIfMaintenance(s, i) || respondIfLockedDown(s, i) || respondIfScreeningPending(s, i) {
+		return
+	}
+	recordRaidEvent(s, raidEventStart)
+	if respondIfProtective(s, i) || respondIfChannelsFull(s, i) {
+		return
+	}
+	createVerificationChannel(s, i)
+}
+
+// Creates the user's private verification channel and posts the instructions in it
+func createVerificationChannel(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	recordFunnel(stageButtonClicked)
+	respondInteraction(s, i, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
 			Content: "Creating a private verification channel for you...",
@@ -234,25 +809,37 @@ func handleStartVerification(s *discordgo.Session, i *discordgo.InteractionCreat
 		},
 	})
 
-	channelName := fmt.Sprintf("認証-%s", i.Member.User.Username)
-	channel, err := s.GuildChannelCreateComplex(guildID, discordgo.GuildChannelCreateData{
-		Name:     channelName,
-		Type:     discordgo.ChannelTypeGuildText,
-		ParentID: privateCategoryID,
-		PermissionOverwrites: []*discordgo.PermissionOverwrite{
-			{ID: guildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
-			{ID: i.Member.User.ID, Type: discordgo.PermissionOverwriteTypeMember, Allow: discordgo.PermissionViewChannel},
-			{
-				ID:    s.State.User.ID,
-				Type:  discordgo.PermissionOverwriteTypeMember,
-				Allow: discordgo.PermissionViewChannel | discordgo.PermissionSendMessages,
-			},
-		},
-	})
+	user := interactionUser(i)
+	if wc := config.welcomeChannel(i.ChannelID); wc != nil && wc.Language != "" {
+		if _, chosen := store.userLanguage(user.ID); !chosen {
+			if err := store.setUserLanguage(user.ID, wc.Language); err != nil {
+				log.Printf("Failed to save language preference: %v", err)
+			}
+		}
+	}
+	channelName := fmt.Sprintf("認証-%s", user.Username)
+	data := discordgo.GuildChannelCreateData{
+		Name:                 channelName,
+		Type:                 discordgo.ChannelTypeGuildText,
+		ParentID:             verificationCategory(s),
+		PermissionOverwrites: verificationChannelOverwrites(s, user.ID),
+	}
+	channel, err := s.GuildChannelCreateComplex(guildID, data, discordgo.WithContext(interactionContext(i)))
+	// The state cache may not know yet that the category was deleted
+	if err != nil && data.ParentID != "" && isMissingCategoryError(err) && interactionContext(i).Err() == nil {
+		log.Printf("Failed to create private channel in category %s, retrying at the guild root: %v", data.ParentID, err)
+		alertMissingCategory(s, fmt.Sprintf("カテゴリ `%s` に認証チャンネルを作成できませんでした", data.ParentID))
+		data.ParentID = ""
+		channel, err = s.GuildChannelCreateComplex(guildID, data, discordgo.WithContext(interactionContext(i)))
+	}
 	if err != nil {
 		log.Printf("Failed to create private channel: %v", err)
+		editStartResponse(s, i, "エラー: 認証チャンネルを作成できませんでした. しばらくしてからもう一度お試しください. ")
 		return
 	}
+	if err := store.addVerificationChannel(channel.ID, user.ID, i.ChannelID); err != nil {
+		log.Printf("Failed to save verification channel: %v", err)
+	}
 
 	embed := &discordgo.MessageEmbed{
 		Title:       "ようこそ! ",
@@ -260,56 +847,62 @@ func handleStartVerification(s *discordgo.Session, i *discordgo.InteractionCreat
 		Fields: []*discordgo.MessageEmbedField{
 			{Name: "Step 1: Emailの登録", Value: "`/verify`コマンドを使って高専のMicrosoftアドレスを入力してください"},
 			{Name: "Step 2: 認証コードの入力", Value: "`/code` コマンドを使って送信された認証コードを入力してください."},
+			{Name: "メールが届かない場合", Value: "学生証の写真をこのチャンネルにアップロードすると、管理者が手動で確認します."},
 		},
 		Footer: &discordgo.MessageEmbedFooter{Text: "This channel will be deleted automatically upon successful verification."},
 		Color:  0x5865F2,
 	}
+	if userLanguage(user.ID) == langEN {
+		embed.Title = "Welcome!"
+		embed.Description = "This private channel is just for you and the bot.\nFollow the steps below to verify."
+		embed.Fields = []*discordgo.MessageEmbedField{
+			{Name: "Step 1: Register your email", Value: "Enter your Kosen Microsoft address with the `/verify` command."},
+			{Name: "Step 2: Enter the code", Value: "Enter the code you received with the `/code` command."},
+			{Name: "No email?", Value: "Upload a photo of your student ID card in this channel and a moderator will check it by hand."},
+		}
+	}
 
-	s.ChannelMessageSendEmbed(channel.ID, embed)
+	buttons := []discordgo.MessageComponent{faqButton()}
+	if moderatorRoleID != "" && featureEnabled(guildID, featureEscalation) {
+		buttons = append(buttons, callModeratorButton())
+	}
+	message := &discordgo.MessageSend{
+		Embed:      embed,
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}},
+	}
+	sendMessage(s, channel.ID, message)
+	editStartResponseWithLink(s, i, channel.ID)
 }
 
 func setupVerificationButton(s *discordgo.Session) {
-	components := []discordgo.MessageComponent{
-		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
-			discordgo.Button{
-				Label:    "Tap Here to Start Verification",
-				Style:    discordgo.PrimaryButton,
-				CustomID: startVerificationButtonID,
-				Emoji:    &discordgo.ComponentEmoji{Name: "✅"},
-			},
-		}},
-	}
-
-	embed := &discordgo.MessageEmbed{
-		Title:       "高専学生認証システム",
-		Description: "全てのチャンネルを閲覧するためには、高専生であることを認証する必要があります..\n下記のボタンからプライベートチャンネルを作成し、手順に従って認証を完了させてください.",
-		Color:       0x5865F2,
+	postWelcomeMessage(s, welcomeChannelID, config.welcomeFor(guildID))
+	for _, wc := range config.WelcomeChannels {
+		postWelcomeMessage(s, wc.ChannelID, config.welcomeForChannel(guildID, wc.ChannelID))
 	}
+	log.Println("Verification button setup/update complete.")
+}
 
-	messages, err := s.ChannelMessages(welcomeChannelID, 10, "", "", "")
+// Posts the welcome message in a channel, or updates the bot's existing one
+func postWelcomeMessage(s *discordgo.Session, channelID string, welcome WelcomeMessage) {
+	botMessage, err := findWelcomeMessage(s, channelID)
 	if err != nil {
-		log.Printf("Could not get channel messages: %v", err)
+		log.Printf("Could not get messages of welcome channel %s: %v", channelID, err)
 		return
 	}
 
-	var botMessage *discordgo.Message
-	for _, msg := range messages {
-		if msg.Author.ID == s.State.User.ID {
-			botMessage = msg
-			break
+	if botMessage == nil {
+		if _, err := sendWelcomeMessage(s, channelID, welcome); err != nil {
+			log.Printf("Failed to post welcome message in %s: %v", channelID, err)
 		}
+		return
 	}
-
-	if botMessage == nil {
-		s.ChannelMessageSendComplex(welcomeChannelID, &discordgo.MessageSend{Embed: embed, Components: components})
-	} else {
-		s.ChannelMessageEditComplex(&discordgo.MessageEdit{Channel: welcomeChannelID, ID: botMessage.ID, Embed: embed, Components: &components})
+	components := welcome.components()
+	msg, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{Channel: channelID, ID: botMessage.ID, Embed: welcome.embed(), Components: &components})
+	if err != nil {
+		log.Printf("Failed to update welcome message in %s: %v", channelID, err)
+		return
 	}
-	log.Println("Verification button setup/update complete.")
-}
-
-func isValidKosenEmail(domain string) bool {
-	return domain == "kosen-ac.jp" || strings.HasSuffix(domain, ".kosen-ac.jp")
+	trackWelcomeMessage(s, msg)
 }
 
 func generateVerificationCode() (string, error) {
@@ -320,15 +913,93 @@ func generateVerificationCode() (string, error) {
 	return fmt.Sprintf("%06d", int(b[0])<<24|int(b[1])<<16|int(b[2])<<8|int(b[3]))[:6], nil
 }
 
-func sendVerificationEmail(recipient, code string) error {
-	auth := smtp.PlainAuth("", gmailAddress, gmailAppPassword, "smtp.gmail.com")
-	msg := []byte("To: " + recipient + "\r\n" + "Subject: Discord Verification Code\r\n\r\n" + "あなたの認証コードは: " + code + " です." + "\r\n")
-	return smtp.SendMail("smtp.gmail.com:587", auth, gmailAddress, []string{recipient}, msg)
+// Returns a discord.com jump link to the user's verification channel, or "" if they have none
+func verificationChannelLink(i *discordgo.InteractionCreate, userID string) string {
+	channelID := ""
+	if owner, ok := store.verificationChannelOwner(i.ChannelID); ok && owner == userID {
+		channelID = i.ChannelID
+	} else if latest, ok := store.latestVerificationChannel(userID); ok {
+		channelID = latest
+	}
+	if channelID == "" {
+		return ""
+	}
+	// Verification channels are always created in the main guild
+	return channelJumpURL(guildID, channelID)
+}
+
+// Deletes a verification channel now; use scheduleChannelDeletion to delete it later
+func deleteVerificationChannel(s *discordgo.Session, task *channelDeletion) error {
+	channelID := task.ChannelID
+	if _, inProgress := deletingChannels.LoadOrStore(channelID, true); inProgress {
+		return errDeletionInProgress
+	}
+	defer deletingChannels.Delete(channelID)
+
+	if !task.Archived {
+		// Checked against the store too, since task may be a copy taken before an earlier attempt
+		claimed, err := store.claimTranscriptArchive(channelID)
+		if err != nil {
+			log.Printf("Failed to record transcript archive of %s: %v", channelID, err)
+		}
+		if claimed || err != nil {
+			archiveTranscript(s, channelID)
+		}
+		task.Archived = true
+	}
+	_, err := s.ChannelDelete(channelID)
+	if err != nil && !isUnknownChannel(err) {
+		log.Printf("Failed to delete channel: %v", err)
+		return err
+	}
+	if err := store.removeVerificationChannel(channelID); err != nil {
+		log.Printf("Failed to remove verification channel from store: %v", err)
+	}
+	return nil
+}
+
+// Posts an operational alert to the admin channel, or only logs it if none is configured
+func alertAdmins(s *discordgo.Session, message string) {
+	log.Printf("ALERT: %s", message)
+	countDaily(statAlerts)
+	if adminChannelID == "" {
+		return
+	}
+	if _, err := sendText(s, adminChannelID, message); err != nil {
+		log.Printf("Failed to post alert to admin channel: %v", err)
+	}
+}
+
+func memberHasRole(member *discordgo.Member, roleID string) bool {
+	if member == nil {
+		return false
+	}
+	for _, id := range member.Roles {
+		if id == roleID {
+			return true
+		}
+	}
+	return false
+}
+
+func hasManageRoles(member *discordgo.Member) bool {
+	return member != nil && member.Permissions&discordgo.PermissionManageRoles != 0
+}
+
+// Admin commands require Manage Server; member is nil for DMs
+func isAdmin(member *discordgo.Member) bool {
+	return member != nil && member.Permissions&discordgo.PermissionManageGuild != 0
 }
 
 func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	respondInteraction(s, i, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
 	})
 }
+
+// Like respondEphemeral, and records the interaction as failed in the audit log
+func respondError(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	markInteractionFailed(i)
+	respondEphemeral(s, i, content)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Maintenance mode ---
+// While on, no new verification channels are created and no emails are sent.
+// Codes that were already sent can still be entered with /code.
+
+const defaultMaintenanceNotice = "現在メンテナンス中のため、認証を一時的に停止しています. しばらくしてからお試しください."
+
+type maintenanceState struct {
+	Since   time.Time `json:"since"`
+	By      string    `json:"by"`
+	Message string    `json:"message,omitempty"`
+}
+
+func maintenanceCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "maintenance",
+		Description:              "Pause new verifications, e.g. during an SMTP migration (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "state", Description: "New state", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: featureStateOn, Value: featureStateOn},
+				{Name: featureStateOff, Value: featureStateOff},
+			}},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "message", Description: "Notice shown to users instead of the default one"},
+		},
+	}
+}
+
+func handleMaintenance(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	var err error
+	switch optionString(i, "state") {
+	case featureStateOn:
+		err = store.setMaintenance(&maintenanceState{Since: time.Now(), By: interactionUser(i).ID, Message: optionString(i, "message")})
+		log.Printf("Maintenance mode enabled by %s", interactionUser(i).ID)
+	case featureStateOff:
+		err = store.setMaintenance(nil)
+		log.Printf("Maintenance mode disabled by %s", interactionUser(i).ID)
+	}
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: 設定の保存に失敗しました.", "Failed to save maintenance mode", err)
+		return
+	}
+
+	m, on := store.maintenance()
+	if !on {
+		respondEphemeral(s, i, "メンテナンスモードはオフです.")
+		return
+	}
+	respondEphemeral(s, i, fmt.Sprintf("🛠️ メンテナンスモードはオンです (<@%s>, <t:%d:R>から).\n表示中のお知らせ: %s", m.By, m.Since.Unix(), m.notice()))
+}
+
+func (m *maintenanceState) notice() string {
+	if m.Message != "" {
+		return m.Message
+	}
+	return defaultMaintenanceNotice
+}
+
+// Replies with the maintenance notice and returns true if maintenance mode is on
+func respondIfMaintenance(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	m, on := store.maintenance()
+	if !on {
+		return false
+	}
+	notice := m.Message
+	if notice == "" {
+		notice = localized(i, msgMaintenance)
+	}
+	respondEphemeral(s, i, "🛠️ "+notice)
+	return true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --- Metrics ---
+// A minimal Prometheus text-format exporter; enough for counters, gauges and histograms with labels.
+
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by the rendered label set
+
+	// Histograms only: upper bounds of the buckets and the observations per label set
+	buckets    []float64
+	histograms map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry []*metric
+)
+
+func newMetric(kind metricKind, name, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	metricsMu.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric(metricCounter, name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric(metricGauge, name, help, labels...)
+}
+
+// buckets are the upper bounds in increasing order; +Inf is implied
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(metricHistogram, name, help, labels...)
+	m.buckets = buckets
+	m.histograms = make(map[string]*histogramValue)
+	return m
+}
+
+// Records one observation in a histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	key := m.labelKey(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogramValue{counts: make([]uint64, len(m.buckets))}
+		m.histograms[key] = h
+	}
+	for idx, bound := range m.buckets {
+		if value <= bound {
+			h.counts[idx]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Adds delta to the series with the given label values (in the order the labels were declared)
+func (m *metric) add(delta float64, labelValues ...string) {
+	key := m.labelKey(labelValues)
+	m.mu.Lock()
+	m.values[key] += delta
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(value float64, labelValues ...string) {
+	key := m.labelKey(labelValues)
+	m.mu.Lock()
+	m.values[key] = value
+	m.mu.Unlock()
+}
+
+func (m *metric) labelKey(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(values), len(m.labels)))
+	}
+	pairs := make([]string, len(values))
+	for idx, v := range values {
+		pairs[idx] = fmt.Sprintf("%s=%q", m.labels[idx], v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			fmt.Fprintf(b, "%s %g\n", m.name, m.values[key])
+		} else {
+			fmt.Fprintf(b, "%s{%s} %g\n", m.name, key, m.values[key])
+		}
+	}
+
+	keys = keys[:0]
+	for key := range m.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := m.histograms[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for idx, bound := range m.buckets {
+			cumulative += h.counts[idx]
+			fmt.Fprintf(b, "%s_bucket{%sle=\"%g\"} %d\n", m.name, prefix, bound, cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", m.name, prefix, h.count)
+		if key == "" {
+			fmt.Fprintf(b, "%s_sum %g\n%s_count %d\n", m.name, h.sum, m.name, h.count)
+		} else {
+			fmt.Fprintf(b, "%s_sum{%s} %g\n%s_count{%s} %d\n", m.name, key, h.sum, m.name, key, h.count)
+		}
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metricsMu.Lock()
+	for _, m := range metricsRegistry {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// Serves /metrics for Prometheus if METRICS_ADDR is set
+func startMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
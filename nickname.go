@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Real-name nicknames ---
+// Servers that require real names turn on the real_name feature (per guild with
+// guilds.<id>.features or /feature). After verifying, the member enters their name in a
+// modal, the bot sets their nickname from the nickname template, and any later nickname
+// change that doesn't match the recorded one is reverted. The prompt is shown by whatever
+// completed the verification: /code answers with it, and a magic link posts it in the
+// member's verification channel or DMs it. Reverting nickname changes needs the server
+// members intent, which the bot only requests at connect, so turning the feature on
+// with /feature while the bot runs needs a restart for that part.
+
+const (
+	realNameButtonID     = "real_name_button"
+	realNameModalID      = "real_name_modal"
+	realNameInputID      = "real_name"
+	realNameGradeID      = "real_name_grade"
+	realNameMaxChars     = 20
+	discordNicknameChars = 32
+)
+
+// How a nickname longer than Discord's 32 characters is shortened
+const (
+	// Cut the rendered nickname at the end
+	truncateEnd = "end"
+	// Shorten the name and keep the rest of the template intact, e.g. "【3年】高専 太…"
+	truncateName = "name"
+)
+
+// NicknameConfig controls the nickname set from the member's real name
+type NicknameConfig struct {
+	// text/template with .Name, .School and .Grade, e.g. "{{.School}}|{{.Name}}" or "【{{.Grade}}】{{.Name}}".
+	// The modal only asks for the grade if the template uses it.
+	Template string `json:"template"`
+	// truncateEnd or truncateName
+	Truncate string `json:"truncate"`
+
+	tmpl *template.Template
+}
+
+type nicknameFields struct {
+	Name   string
+	School string
+	Grade  string
+}
+
+func (n *NicknameConfig) compile() error {
+	switch n.Truncate {
+	case truncateEnd, truncateName:
+	default:
+		return fmt.Errorf("truncate must be %q or %q, got %q", truncateEnd, truncateName, n.Truncate)
+	}
+	tmpl, err := template.New("nickname").Option("missingkey=error").Parse(n.Template)
+	if err != nil {
+		return err
+	}
+	// Catch references to fields that don't exist now rather than at the first verification
+	if err := tmpl.Execute(io.Discard, nicknameFields{}); err != nil {
+		return err
+	}
+	n.tmpl = tmpl
+	return nil
+}
+
+func (n *NicknameConfig) usesGrade() bool {
+	return strings.Contains(n.Template, ".Grade")
+}
+
+func (n *NicknameConfig) execute(fields nicknameFields) (string, error) {
+	var b strings.Builder
+	if err := n.tmpl.Execute(&b, fields); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Renders the nickname, shortened to fit Discord's limit
+func (n *NicknameConfig) render(fields nicknameFields) (string, error) {
+	nick, err := n.execute(fields)
+	if err != nil {
+		return "", err
+	}
+	overflow := len([]rune(nick)) - discordNicknameChars
+	if overflow <= 0 {
+		return nick, nil
+	}
+	if n.Truncate == truncateName {
+		// Keep at least one character of the name plus the ellipsis
+		if name := []rune(fields.Name); len(name)-overflow-1 >= 1 {
+			fields.Name = string(name[:len(name)-overflow-1]) + "…"
+			if nick, err = n.execute(fields); err != nil {
+				return "", err
+			}
+		}
+	}
+	if runes := []rune(nick); len(runes) > discordNicknameChars {
+		nick = string(runes[:discordNicknameChars])
+	}
+	return nick, nil
+}
+
+// Returns the nickname settings for a guild, falling back to the global ones
+func (c *Config) nicknameFor(guildID string) *NicknameConfig {
+	if gc, ok := c.Guilds[guildID]; ok && gc.Nickname != nil {
+		return gc.Nickname
+	}
+	return &c.Nickname
+}
+
+func realNameButton() discordgo.MessageComponent {
+	return discordgo.Button{
+		Label:    "名前を登録する",
+		Style:    discordgo.PrimaryButton,
+		CustomID: realNameButtonID,
+		Emoji:    &discordgo.ComponentEmoji{Name: "📝"},
+	}
+}
+
+// Asks a member who verified outside Discord for their name, in their verification
+// channel or, failing that, by DM
+func postRealNamePrompt(s *discordgo.Session, userID, content string) error {
+	msg := &discordgo.MessageSend{
+		Content:    fmt.Sprintf("<@%s> %s\nこのサーバーでは本名のニックネームが必要です. 下のボタンから名前を登録してください.", userID, content),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{realNameButton()}}},
+	}
+	for _, channelID := range store.verificationChannelsOf(userID) {
+		if _, err := sendMessage(s, channelID, msg); err == nil {
+			return nil
+		}
+	}
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		return err
+	}
+	_, err = sendMessage(s, channel.ID, msg)
+	return err
+}
+
+// Opens the modal for the member's real name
+func handleRealNameButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	member, ok := store.isVerified(interactionUser(i).ID)
+	if !ok {
+		respondError(s, i, "エラー: 先に認証を完了させてください.")
+		return
+	}
+	inputs := []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				CustomID:    realNameInputID,
+				Label:       "氏名",
+				Style:       discordgo.TextInputShort,
+				Placeholder: "例: 高専 太郎",
+				Required:    true,
+				MaxLength:   realNameMaxChars,
+			},
+		}},
+	}
+	if config.nicknameFor(member.GuildID).usesGrade() {
+		inputs = append(inputs, discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				CustomID:    realNameGradeID,
+				Label:       "学年",
+				Style:       discordgo.TextInputShort,
+				Placeholder: "例: 3年",
+				Required:    true,
+				MaxLength:   10,
+			},
+		}})
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID:   realNameModalID,
+			Title:      "名前の登録",
+			Components: inputs,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to open real name modal: %v", err)
+	}
+}
+
+func handleRealNameSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	member, ok := store.isVerified(userID)
+	if !ok {
+		respondError(s, i, "エラー: 先に認証を完了させてください.")
+		return
+	}
+	name := strings.TrimSpace(modalValue(i.ModalSubmitData(), realNameInputID))
+	if name == "" {
+		respondError(s, i, "エラー: 名前を入力してください.")
+		return
+	}
+
+	fields := nicknameFields{
+		Name:   name,
+		School: schoolName(member.Domain),
+		Grade:  strings.TrimSpace(modalValue(i.ModalSubmitData(), realNameGradeID)),
+	}
+	nick, err := config.nicknameFor(member.GuildID).render(fields)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: ニックネームの作成に失敗しました. 管理者に連絡してください.", "Failed to render nickname", err)
+		return
+	}
+	// Record first so the member update watcher doesn't revert our own change
+	if err := store.setMemberNickname(userID, name, fields.Grade, nick); err != nil {
+		respondWithErrorRef(s, i, "エラー: 名前の保存に失敗しました. 管理者に連絡してください.", "Failed to save real name", err)
+		return
+	}
+	if err := s.GuildMemberNickname(member.GuildID, userID, nick); err != nil {
+		respondWithErrorRef(s, i, "エラー: ニックネームの変更に失敗しました. 管理者に連絡してください.", "Failed to set nickname", err)
+		return
+	}
+	log.Printf("Nickname of %s set from real name.", userID)
+	if err := pushRoleConnection(userID); err != nil {
+		log.Printf("Failed to update role connection for %s: %v", userID, err)
+	}
+
+	respondEphemeral(s, i, fmt.Sprintf("ニックネームを「%s」に設定しました. 認証チャンネルは10秒後に自動的に消えます.", nick))
+	scheduleUserChannelDeletion(s, userID, 10*time.Second)
+}
+
+// Reverts nickname changes of members whose nickname was set from their real name
+func onGuildMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.Member == nil || m.User == nil || !featureEnabled(m.GuildID, featureRealName) {
+		return
+	}
+	member, ok := store.isVerified(m.User.ID)
+	if !ok || member.Nickname == "" || member.GuildID != m.GuildID || m.Nick == member.Nickname {
+		return
+	}
+	log.Printf("Reverting nickname change of %s.", m.User.ID)
+	if err := s.GuildMemberNickname(m.GuildID, m.User.ID, member.Nickname); err != nil {
+		log.Printf("Failed to revert nickname of %s: %v", m.User.ID, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Membership screening ---
+// Guilds can make new members accept the rules (membership screening / onboarding) before
+// they can talk. Discord marks members who haven't finished it as pending, so no guild
+// setting is needed: their welcome DM is held back until they finish, and with the
+// require_screening feature the verification button refuses them too.
+
+var (
+	// Members who joined while screening was pending, waiting for their welcome DM
+	awaitingScreening = make(map[string]bool)
+	screeningMutex    = &sync.Mutex{}
+)
+
+// Rejects members who haven't completed screening, when the guild requires it
+func respondIfScreeningPending(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	if i.Member == nil || !i.Member.Pending || !featureEnabled(i.GuildID, featureRequireScreening) {
+		return false
+	}
+	respondError(s, i, "エラー: 先にサーバーのルールに同意してください. 同意した後にもう一度ボタンを押してください.")
+	return true
+}
+
+func onGuildMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	if m.Member == nil || m.User == nil || m.User.Bot || config.welcomeFor(m.GuildID).DMText == "" {
+		return
+	}
+	if m.Pending {
+		screeningMutex.Lock()
+		awaitingScreening[m.GuildID+"/"+m.User.ID] = true
+		screeningMutex.Unlock()
+		return
+	}
+	sendWelcomeDM(s, m.GuildID, m.User.ID)
+}
+
+// Sends the held-back welcome DM once the member finishes screening
+func onScreeningUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.Member == nil || m.User == nil || m.Pending {
+		return
+	}
+	key := m.GuildID + "/" + m.User.ID
+	screeningMutex.Lock()
+	waiting := awaitingScreening[key]
+	delete(awaitingScreening, key)
+	screeningMutex.Unlock()
+	if waiting {
+		sendWelcomeDM(s, m.GuildID, m.User.ID)
+	}
+}
+
+func sendWelcomeDM(s *discordgo.Session, guild, userID string) {
+	text := config.welcomeFor(guild).DMText
+	text = strings.ReplaceAll(text, "{channel}", fmt.Sprintf("<#%s>", welcomeChannelID))
+	// Members with closed DMs still find the welcome channel, so the DM isn't kept for later
+	if err := sendDirectMessage(s, userID, text); errors.Is(err, errDMUnreachable) {
+		debugf("Welcome DM to %s skipped: %v", userID, err)
+	} else if err != nil {
+		log.Printf("Failed to send welcome DM to %s: %v", userID, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Opt-in roles ---
+// Roles members can pick for themselves after verifying (部活, interest channels,
+// announcements). The picker is attached to the success message and can be reopened
+// any time with /roles.
+
+const (
+	optInRolesSelectID = "opt_in_roles"
+	maxOptInRoles      = 25 // Discord's limit for select menu options
+)
+
+type OptInRole struct {
+	RoleID      string `json:"role_id"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	// A unicode emoji, or a custom one written as <:name:id>
+	Emoji string `json:"emoji"`
+}
+
+func validateOptInRoles(roles []OptInRole) error {
+	if len(roles) > maxOptInRoles {
+		return fmt.Errorf("at most %d roles are allowed, got %d", maxOptInRoles, len(roles))
+	}
+	for idx, role := range roles {
+		if role.RoleID == "" || role.Label == "" {
+			return fmt.Errorf("entry %d: role_id and label are required", idx)
+		}
+	}
+	return nil
+}
+
+// Returns the opt-in roles for a guild; a guild list replaces the global one
+func (c *Config) optInRolesFor(guildID string) []OptInRole {
+	if gc, ok := c.Guilds[guildID]; ok && gc.OptInRoles != nil {
+		return gc.OptInRoles
+	}
+	return c.OptInRoles
+}
+
+// Builds the select menu with the member's current roles preselected, or nil if the guild has none
+func optInRolesComponents(guildID string, member *discordgo.Member) []discordgo.MessageComponent {
+	roles := config.optInRolesFor(guildID)
+	if len(roles) == 0 {
+		return nil
+	}
+	minValues := 0
+	options := make([]discordgo.SelectMenuOption, 0, len(roles))
+	for _, role := range roles {
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       role.Label,
+			Value:       role.RoleID,
+			Description: role.Description,
+			Emoji:       parseComponentEmoji(role.Emoji),
+			Default:     memberHasRole(member, role.RoleID),
+		})
+	}
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				CustomID:    optInRolesSelectID,
+				Placeholder: "参加したいロールを選んでください (任意)",
+				MinValues:   &minValues,
+				MaxValues:   len(options),
+				Options:     options,
+			},
+		}},
+	}
+}
+
+func rolesCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "roles",
+		Description: "Choose optional roles such as clubs and interests.",
+	}
+}
+
+func handleRoles(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	member, ok := store.isVerified(interactionUser(i).ID)
+	if !ok {
+		respondError(s, i, "エラー: 先に認証を完了させてください.")
+		return
+	}
+	discordMember, err := interactionMember(s, i, member.GuildID)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: サーバーのメンバー情報を取得できませんでした.", "Failed to look up member for /roles", err)
+		return
+	}
+	components := optInRolesComponents(member.GuildID, discordMember)
+	if components == nil {
+		respondEphemeral(s, i, "このサーバーには選択できるロールがありません.")
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "参加したいロールを選んでください. 選択を外すとロールも外れます.",
+			Components: components,
+			Flags:      discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// Adds the selected opt-in roles and removes the deselected ones
+func handleOptInRolesSelect(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	member, ok := store.isVerified(userID)
+	if !ok {
+		respondError(s, i, "エラー: 先に認証を完了させてください.")
+		return
+	}
+	discordMember, err := interactionMember(s, i, member.GuildID)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: サーバーのメンバー情報を取得できませんでした.", "Failed to look up member for opt-in roles", err)
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, value := range i.MessageComponentData().Values {
+		selected[value] = true
+	}
+	var added, removed, failed int
+	for _, role := range config.optInRolesFor(member.GuildID) {
+		has := memberHasRole(discordMember, role.RoleID)
+		counter := &added
+		switch {
+		case selected[role.RoleID] && !has:
+			err = s.GuildMemberRoleAdd(member.GuildID, userID, role.RoleID)
+		case !selected[role.RoleID] && has:
+			err = s.GuildMemberRoleRemove(member.GuildID, userID, role.RoleID)
+			counter = &removed
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to update opt-in role %s for %s: %v", role.RoleID, userID, err)
+			counter = &failed
+		}
+		*counter++
+	}
+
+	if failed > 0 {
+		respondError(s, i, fmt.Sprintf("エラー: %d件のロールを更新できませんでした. 管理者に連絡してください.", failed))
+		return
+	}
+	respondEphemeral(s, i, fmt.Sprintf("ロールを更新しました (追加 %d, 削除 %d).", added, removed))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification channel permissions ---
+// Verification channels are hidden from @everyone. config.json decides what the member
+// being verified may do there and which other roles (e.g. moderators auditing live
+// verifications) can see them. Permissions are written by name, see permissionNames.
+
+type ChannelPermissions struct {
+	// Granted to the member being verified
+	User []string `json:"user"`
+	// Extra role overwrites, applied as written
+	Roles []RoleOverwrite `json:"roles"`
+}
+
+type RoleOverwrite struct {
+	RoleID string   `json:"role_id"`
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+}
+
+var permissionNames = map[string]int64{
+	"view_channel":         discordgo.PermissionViewChannel,
+	"send_messages":        discordgo.PermissionSendMessages,
+	"read_message_history": discordgo.PermissionReadMessageHistory,
+	"attach_files":         discordgo.PermissionAttachFiles,
+	"embed_links":          discordgo.PermissionEmbedLinks,
+	"add_reactions":        discordgo.PermissionAddReactions,
+	"use_slash_commands":   discordgo.PermissionUseSlashCommands,
+	"manage_messages":      discordgo.PermissionManageMessages,
+	"manage_channels":      discordgo.PermissionManageChannels,
+	"mention_everyone":     discordgo.PermissionMentionEveryone,
+}
+
+func defaultChannelPermissions() ChannelPermissions {
+	return ChannelPermissions{User: []string{"view_channel"}}
+}
+
+// Combines permission names into their bits
+func permissionBits(names []string) (int64, error) {
+	var bits int64
+	for _, name := range names {
+		bit, ok := permissionNames[name]
+		if !ok {
+			known := make([]string, 0, len(permissionNames))
+			for n := range permissionNames {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return 0, fmt.Errorf("unknown permission %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+		bits |= bit
+	}
+	return bits, nil
+}
+
+func (p ChannelPermissions) validate() error {
+	if _, err := permissionBits(p.User); err != nil {
+		return fmt.Errorf("user: %w", err)
+	}
+	for idx, role := range p.Roles {
+		if role.RoleID == "" {
+			return fmt.Errorf("roles[%d]: role_id is required", idx)
+		}
+		if _, err := permissionBits(role.Allow); err != nil {
+			return fmt.Errorf("roles[%d].allow: %w", idx, err)
+		}
+		if _, err := permissionBits(role.Deny); err != nil {
+			return fmt.Errorf("roles[%d].deny: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// The overwrites for a new verification channel. The names were checked when the config was loaded.
+func verificationChannelOverwrites(s *discordgo.Session, userID string) []*discordgo.PermissionOverwrite {
+	userAllow, _ := permissionBits(config.ChannelPermissions.User)
+	overwrites := []*discordgo.PermissionOverwrite{
+		{ID: guildID, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+		{ID: userID, Type: discordgo.PermissionOverwriteTypeMember, Allow: userAllow},
+		{
+			ID:    s.State.User.ID,
+			Type:  discordgo.PermissionOverwriteTypeMember,
+			Allow: discordgo.PermissionViewChannel | discordgo.PermissionSendMessages,
+		},
+	}
+	for _, role := range config.ChannelPermissions.Roles {
+		allow, _ := permissionBits(role.Allow)
+		deny, _ := permissionBits(role.Deny)
+		overwrites = append(overwrites, &discordgo.PermissionOverwrite{ID: role.RoleID, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny})
+	}
+	return overwrites
+}
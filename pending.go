@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// --- Pending verification persistence ---
+// The handlers work on the pendingVerifications map, and changes to it are written to
+// the store in batches by runPendingVerificationWriter, so a code emailed before a
+// restart still works after it without every /verify and /code waiting for a disk write.
+// Only hashes of the code and the magic link token are kept, so neither the state file
+// nor an export-state archive gives away a working code. The code's hash is keyed with
+// the bot token, as a plain hash of six digits is trivially reversed.
+
+// How long changes are collected before they are written
+const pendingWriteDelay = 500 * time.Millisecond
+
+var (
+	// Users whose pending verification changed since the last write, guarded by verificationMutex
+	pendingDirty = make(map[string]bool)
+	pendingWake  = make(chan struct{}, 1)
+	// Serializes writes, so an older batch can't land after a newer one
+	pendingWriteMutex = &sync.Mutex{}
+)
+
+func codeHash(userID, code string) string {
+	mac := hmac.New(sha256.New, []byte(botToken))
+	mac.Write([]byte(userID + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d verificationData) codeMatches(userID, code string) bool {
+	return hmac.Equal([]byte(d.CodeHash), []byte(codeHash(userID, code)))
+}
+
+// Must be called with verificationMutex held
+func setPendingVerification(userID string, data verificationData) {
+	pendingVerifications[userID] = data
+	markPendingDirty(userID)
+}
+
+// Must be called with verificationMutex held
+func deletePendingVerification(userID string) {
+	delete(pendingVerifications, userID)
+	markPendingDirty(userID)
+}
+
+func markPendingDirty(userID string) {
+	pendingDirty[userID] = true
+	select {
+	case pendingWake <- struct{}{}:
+	default:
+	}
+}
+
+func runPendingVerificationWriter() {
+	for range pendingWake {
+		time.Sleep(pendingWriteDelay)
+		writePendingVerifications()
+	}
+}
+
+// Writes the changed pending verifications; also called on shutdown
+func writePendingVerifications() {
+	pendingWriteMutex.Lock()
+	defer pendingWriteMutex.Unlock()
+
+	verificationMutex.Lock()
+	if len(pendingDirty) == 0 {
+		verificationMutex.Unlock()
+		return
+	}
+	// A missing entry means the verification is gone
+	changes := make(map[string]*verificationData, len(pendingDirty))
+	for userID := range pendingDirty {
+		if data, ok := pendingVerifications[userID]; ok {
+			changes[userID] = &data
+		} else {
+			changes[userID] = nil
+		}
+	}
+	pendingDirty = make(map[string]bool)
+	verificationMutex.Unlock()
+
+	if err := store.savePendingVerifications(changes); err != nil {
+		log.Printf("Failed to save %d pending verifications: %v", len(changes), err)
+		// Tried again with the next change
+		verificationMutex.Lock()
+		for userID := range changes {
+			pendingDirty[userID] = true
+		}
+		verificationMutex.Unlock()
+	}
+}
+
+// Restores the pending verifications saved before the last shutdown, dropping expired codes
+func loadPendingVerifications() {
+	now := time.Now()
+	restored := 0
+	verificationMutex.Lock()
+	defer verificationMutex.Unlock()
+	for userID, data := range store.pendingVerifications() {
+		if data.expired(now) {
+			deletePendingVerification(userID)
+			continue
+		}
+		pendingVerifications[userID] = data
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("Restored %d pending verifications.", restored)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Permission self-check ---
+// A permission removed by a server admin used to show up only as a failed role grant or
+// channel creation in the middle of someone's verification. The permission_check job
+// compares the bot's effective permissions in every configured channel and category with
+// what the bot needs there and tells the admins exactly what is missing where. A report is
+// only posted when it changes, and once more when everything is fixed.
+
+// Permissions the bot needs, in the order they are reported, with their names in the Discord client
+var checkedPermissions = []struct {
+	bit  int64
+	name string
+}{
+	{discordgo.PermissionViewChannel, "チャンネルを見る"},
+	{discordgo.PermissionSendMessages, "メッセージを送信"},
+	{discordgo.PermissionEmbedLinks, "埋め込みリンク"},
+	{discordgo.PermissionAttachFiles, "ファイルを添付"},
+	{discordgo.PermissionReadMessageHistory, "メッセージ履歴を読む"},
+	{discordgo.PermissionManageChannels, "チャンネルの管理"},
+	{discordgo.PermissionManageRoles, "ロールの管理"},
+	{discordgo.PermissionManageMessages, "メッセージの管理"},
+}
+
+const (
+	// Welcome channels: posting and finding the welcome message, and slow mode during lockdown
+	welcomeChannelPermissions = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionEmbedLinks |
+		discordgo.PermissionReadMessageHistory | discordgo.PermissionManageChannels
+	// Verification categories: creating channels with permission overwrites
+	categoryPermissions = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionManageChannels |
+		discordgo.PermissionManageRoles
+	// Moderator, admin and archive channels
+	reportChannelPermissions = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionEmbedLinks |
+		discordgo.PermissionAttachFiles
+)
+
+var lastPermissionReport struct {
+	sync.Mutex
+	text string
+}
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:         "permission_check",
+		Description:  "Checks the bot still has the permissions it needs in the configured channels",
+		DefaultCron:  "20 * * * *",
+		RunAtStartup: true,
+		Run:          checkBotPermissions,
+	})
+}
+
+func checkBotPermissions(s *discordgo.Session) error {
+	problems, err := missingPermissions(s)
+	if err != nil {
+		return err
+	}
+	report := strings.Join(problems, "\n")
+
+	lastPermissionReport.Lock()
+	changed := report != lastPermissionReport.text
+	lastPermissionReport.text = report
+	lastPermissionReport.Unlock()
+	if !changed {
+		return nil
+	}
+	if report == "" {
+		log.Println("Bot permissions are complete again.")
+		alertAdmins(s, "✅ ボットに必要な権限がすべて揃いました.")
+		return nil
+	}
+	log.Printf("Bot is missing permissions:\n%s", report)
+	alertAdmins(s, "⚠️ ボットに必要な権限が不足しています. 認証の途中で失敗する前に、サーバー設定で付与してください.\n"+report)
+	return nil
+}
+
+// Returns one line per place where the bot lacks permissions, empty if nothing is missing
+func missingPermissions(s *discordgo.Session) ([]string, error) {
+	botID := s.State.User.ID
+	guild, err := cachedGuild(s, guildID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch guild: %w", err)
+	}
+	member, err := s.State.Member(guildID, botID)
+	if err != nil {
+		if member, err = s.GuildMember(guildID, botID); err != nil {
+			return nil, fmt.Errorf("fetch bot member: %w", err)
+		}
+	}
+
+	var problems []string
+	if missing := discordgo.PermissionManageRoles &^ guildPermissions(guild, botID, member.Roles); missing != 0 {
+		problems = append(problems, fmt.Sprintf("- サーバー全体: %s", permissionList(missing)))
+	}
+	problems = append(problems, unmanageableRoles(guild, member.Roles)...)
+
+	check := func(channelID string, needed int64, label string) {
+		if channelID == "" {
+			return
+		}
+		perms, err := s.UserChannelPermissions(botID, channelID)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("- %s <#%s>: チャンネルを参照できません (`%v`)", label, channelID, err))
+			return
+		}
+		if missing := needed &^ perms; missing != 0 {
+			problems = append(problems, fmt.Sprintf("- %s <#%s>: %s", label, channelID, permissionList(missing)))
+		}
+	}
+	welcomeNeeded := int64(welcomeChannelPermissions)
+	if config.WelcomeUpkeep.Pin {
+		// Pinning, and deleting the pin notice
+		welcomeNeeded |= discordgo.PermissionManageMessages
+	}
+	for _, channelID := range welcomeChannelIDs() {
+		check(channelID, welcomeNeeded, "ウェルカムチャンネル")
+	}
+	for _, categoryID := range append([]string{privateCategoryID}, config.OverflowCategories...) {
+		check(categoryID, categoryPermissions, "認証カテゴリ")
+	}
+	if privateCategoryID == "" {
+		if missing := discordgo.PermissionManageChannels &^ guildPermissions(guild, botID, member.Roles); missing != 0 {
+			problems = append(problems, fmt.Sprintf("- サーバー全体 (認証チャンネルの作成): %s", permissionList(missing)))
+		}
+	}
+	check(modChannelID, reportChannelPermissions, "モデレーター用チャンネル")
+	check(adminChannelID, reportChannelPermissions, "管理者用チャンネル")
+	check(archiveChannelID, reportChannelPermissions, "アーカイブチャンネル")
+	return problems, nil
+}
+
+// Returns the member's permissions outside any channel
+func guildPermissions(guild *discordgo.Guild, userID string, roles []string) int64 {
+	if userID == guild.OwnerID {
+		return discordgo.PermissionAll
+	}
+	held := make(map[string]bool)
+	for _, roleID := range roles {
+		held[roleID] = true
+	}
+	var perms int64
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID || held[role.ID] {
+			perms |= role.Permissions
+		}
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll
+	}
+	return perms
+}
+
+// Reports verification roles at or above the bot's highest role, which Discord won't let it grant
+func unmanageableRoles(guild *discordgo.Guild, botRoles []string) []string {
+	positions := make(map[string]int)
+	for _, role := range guild.Roles {
+		positions[role.ID] = role.Position
+	}
+	highest := 0
+	for _, roleID := range botRoles {
+		highest = max(highest, positions[roleID])
+	}
+
+	// Sorted, as schools is a map and a reordered report would alert admins again
+	var schoolRoleIDs []string
+	for _, school := range schools {
+		schoolRoleIDs = append(schoolRoleIDs, school.RoleID)
+	}
+	slices.Sort(schoolRoleIDs)
+	roleIDs := append([]string{verifiedRoleID}, schoolRoleIDs...)
+	var problems []string
+	seen := make(map[string]bool)
+	for _, roleID := range roleIDs {
+		position, ok := positions[roleID]
+		if roleID == "" || seen[roleID] || !ok || position < highest {
+			continue
+		}
+		seen[roleID] = true
+		problems = append(problems, fmt.Sprintf("- ロール <@&%s>: ボットのロールより上にあるため付与できません. ボットのロールを上に移動してください", roleID))
+	}
+	return problems
+}
+
+func permissionList(bits int64) string {
+	var names []string
+	for _, p := range checkedPermissions {
+		if bits&p.bit != 0 {
+			names = append(names, "「"+p.name+"」")
+		}
+	}
+	return strings.Join(names, " ") + " がありません"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification policy ---
+// Every limit the verification flow enforces, in one place. A guild's policy only needs
+// the fields it changes; zero values fall back to the global policy.
+
+type Policy struct {
+	// How long a code stays valid after it is sent; 0 means until the next /verify
+	CodeTTL Duration `json:"code_ttl"`
+	// Wrong codes before the code is discarded and the user is locked out; 0 means unlimited
+	MaxAttempts int `json:"max_attempts"`
+	// Emails a user may request on top of the first before being locked out; 0 means unlimited
+	MaxResends int `json:"max_resends"`
+	// How long a user who hit a limit has to wait
+	LockoutDuration Duration `json:"lockout_duration"`
+	// Minimum time between two uses of a command by the same user, keyed by command name
+	Cooldowns map[string]Duration `json:"cooldowns"`
+}
+
+func defaultPolicy() Policy {
+	return Policy{
+		CodeTTL:         Duration{15 * time.Minute},
+		MaxAttempts:     5,
+		MaxResends:      5,
+		LockoutDuration: Duration{30 * time.Minute},
+		Cooldowns: map[string]Duration{
+			"verify": {60 * time.Second},
+			"code":   {3 * time.Second},
+			"appeal": {30 * time.Second},
+		},
+	}
+}
+
+// Returns the policy for a guild, with its overrides applied over the global policy
+func (c *Config) policyFor(guildID string) Policy {
+	p := c.Policy
+	gc, ok := c.Guilds[guildID]
+	if !ok || gc.Policy == nil {
+		return p
+	}
+	o := gc.Policy
+	if o.CodeTTL.Duration != 0 {
+		p.CodeTTL = o.CodeTTL
+	}
+	if o.MaxAttempts != 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.MaxResends != 0 {
+		p.MaxResends = o.MaxResends
+	}
+	if o.LockoutDuration.Duration != 0 {
+		p.LockoutDuration = o.LockoutDuration
+	}
+	if len(o.Cooldowns) > 0 {
+		p.Cooldowns = make(map[string]Duration)
+		for command, d := range c.Policy.Cooldowns {
+			p.Cooldowns[command] = d
+		}
+		for command, d := range o.Cooldowns {
+			p.Cooldowns[command] = d
+		}
+	}
+	return p
+}
+
+func (p Policy) validate() error {
+	if p.CodeTTL.Duration < 0 || p.LockoutDuration.Duration < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if p.MaxAttempts < 0 || p.MaxResends < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// Returns when a newly sent code expires, or the zero time if codes don't expire
+func (p Policy) codeExpiry(now time.Time) time.Time {
+	if p.CodeTTL.Duration <= 0 {
+		return time.Time{}
+	}
+	return now.Add(p.CodeTTL.Duration)
+}
+
+// Tells the user how long their code is valid; Discord renders the countdown and the
+// clock time in the reader's own time zone. Empty if codes don't expire.
+func codeExpiryNote(expiresAt time.Time, lang string) string {
+	if expiresAt.IsZero() {
+		return ""
+	}
+	if lang == langEN {
+		return fmt.Sprintf(" The code expires <t:%d:R> (at <t:%d:t>).", expiresAt.Unix(), expiresAt.Unix())
+	}
+	return fmt.Sprintf(" コードの有効期限は<t:%d:R> (<t:%d:t>まで) です.", expiresAt.Unix(), expiresAt.Unix())
+}
+
+// Posts where the user stands in their verification channel, which stays visible after
+// the ephemeral replies are gone
+func postProgressEmbed(s *discordgo.Session, channelID, email string, expiresAt time.Time) {
+	embed := &discordgo.MessageEmbed{
+		Title:       "📨 認証メールを送信しました",
+		Description: "メールに届いた6桁のコードを `/code` で入力してください.",
+		Color:       0x5865F2,
+		Fields:      []*discordgo.MessageEmbedField{{Name: "送信先", Value: maskEmail(email), Inline: true}},
+	}
+	if !expiresAt.IsZero() {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "有効期限",
+			Value:  fmt.Sprintf("<t:%d:R> (<t:%d:t>)", expiresAt.Unix(), expiresAt.Unix()),
+			Inline: true,
+		})
+	}
+	if _, err := sendMessage(s, channelID, &discordgo.MessageSend{Embed: embed}); err != nil {
+		log.Printf("Failed to post progress in %s: %v", channelID, err)
+	}
+}
+
+// --- Lockouts ---
+
+// Returns how much longer the user is locked out, or 0
+func lockoutRemaining(userID string) time.Duration {
+	troubleMutex.Lock()
+	defer troubleMutex.Unlock()
+	t, ok := verificationTroubles[userID]
+	if !ok {
+		return 0
+	}
+	return time.Until(t.LockedUntil)
+}
+
+func lockOut(userID string, d time.Duration) {
+	troubleMutex.Lock()
+	troubleFor(userID).LockedUntil = time.Now().Add(d)
+	troubleMutex.Unlock()
+}
+
+// Counts an email request against the resend limit, locking the user out once they exceed it.
+// Returns false if the email must not be sent.
+func allowEmailRequest(userID string, p Policy) bool {
+	if p.MaxResends <= 0 {
+		return true
+	}
+	troubleMutex.Lock()
+	defer troubleMutex.Unlock()
+	t := troubleFor(userID)
+	t.Requests++
+	if t.Requests <= p.MaxResends+1 {
+		return true
+	}
+	// Start counting again once the lockout is over
+	t.Requests = 0
+	t.LockedUntil = time.Now().Add(p.LockoutDuration.Duration)
+	return false
+}
+
+// Responds with how long the user still has to wait, in minutes
+func lockoutMessage(i *discordgo.InteractionCreate, remaining time.Duration) string {
+	minutes := int(math.Ceil(remaining.Minutes()))
+	return localized(i, msgLockout, "{minutes}", strconv.Itoa(minutes))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Probation ---
+// With probation on, a newly verified member first gets only the probation role, which
+// guilds give limited access. The probation job grants the general and school roles once
+// the probation period has passed. A moderator timing the member out during probation
+// restarts the period from the end of the timeout, so members who get flagged stay
+// limited until they have gone a full period without one.
+
+type ProbationConfig struct {
+	// Role granted instead of the general and school roles; empty turns probation off
+	RoleID string `json:"role_id"`
+	// How long a member stays on probation without a timeout
+	Duration Duration `json:"duration"`
+}
+
+func (p ProbationConfig) enabled() bool {
+	return p.RoleID != "" && p.Duration.Duration > 0
+}
+
+func (p ProbationConfig) validate() error {
+	if p.Duration.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	if p.RoleID != "" && p.Duration.Duration == 0 {
+		return fmt.Errorf("duration is required with role_id")
+	}
+	return nil
+}
+
+// Returns the guild's probation settings, which replace the global ones as a whole
+func (c *Config) probationFor(guild string) ProbationConfig {
+	if gc, ok := c.Guilds[guild]; ok && gc.Probation != nil {
+		return *gc.Probation
+	}
+	return c.Probation
+}
+
+func probationEnabledAnywhere() bool {
+	if config.probationFor(guildID).enabled() {
+		return true
+	}
+	for guild := range config.Guilds {
+		if config.probationFor(guild).enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:        "probation",
+		Description: "Grants the full roles to members whose probation has passed",
+		DefaultCron: "*/5 * * * *",
+		Run:         endDueProbations,
+	})
+}
+
+func grantProbationRole(s *discordgo.Session, target, userID string, member *discordgo.Member, probation ProbationConfig) (delayed bool, err error) {
+	if memberHasRole(member, probation.RoleID) {
+		return false, nil
+	}
+	return grantRoleWithRetry(s, target, userID, probation.RoleID)
+}
+
+func probationNote(d time.Duration) string {
+	return fmt.Sprintf("このサーバーでは最初の%sは試用期間です. 期間が終わると、すべてのロールが自動的に付与されます.", d.Round(time.Minute))
+}
+
+// Restarts the probation of a member a moderator timed out
+func onProbationMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.Member == nil || m.User == nil || m.CommunicationDisabledUntil == nil || !m.CommunicationDisabledUntil.After(time.Now()) {
+		return
+	}
+	record, ok := store.verifiedMember(m.User.ID)
+	if !ok || record.ProbationUntil.IsZero() {
+		return
+	}
+	restartProbation(record, *m.CommunicationDisabledUntil)
+}
+
+func restartProbation(record verifiedMember, timeoutEnd time.Time) {
+	until := timeoutEnd.Add(config.probationFor(record.GuildID).Duration.Duration)
+	if !until.After(record.ProbationUntil) {
+		return
+	}
+	if err := store.extendProbation(record.UserID, until); err != nil {
+		log.Printf("Failed to extend probation: %v", err)
+		return
+	}
+	log.Printf("Probation of user %s restarted after a timeout, now ends %s.", record.UserID, until.Format(time.RFC3339))
+}
+
+func endDueProbations(s *discordgo.Session) error {
+	for _, record := range store.probationsDue(time.Now()) {
+		if err := endProbation(s, record); err != nil {
+			if errors.Is(err, errSchoolRoleFailed) {
+				// Stays on probation and is tried again on the next run
+				log.Printf("Failed to end probation of user %s, retrying later: %v", record.UserID, err)
+				continue
+			}
+			log.Printf("Failed to end probation of user %s: %v", record.UserID, err)
+		}
+	}
+	return nil
+}
+
+func endProbation(s *discordgo.Session, record verifiedMember) error {
+	member, err := s.GuildMember(record.GuildID, record.UserID)
+	if err != nil {
+		if isUnknownMember(err) {
+			// Left during probation; the roles are granted on the next run after they rejoin
+			return nil
+		}
+		return err
+	}
+	if member.CommunicationDisabledUntil != nil && member.CommunicationDisabledUntil.After(time.Now()) {
+		restartProbation(record, *member.CommunicationDisabledUntil)
+		return nil
+	}
+
+	delayed, err := grantVerifiedRoles(s, record.GuildID, record.UserID, member, record.Domain)
+	if err != nil {
+		return err
+	}
+	if err := store.endProbation(record.UserID, delayed); err != nil {
+		return err
+	}
+	if roleID := config.probationFor(record.GuildID).RoleID; roleID != "" && memberHasRole(member, roleID) {
+		if err := s.GuildMemberRoleRemove(record.GuildID, record.UserID, roleID); err != nil {
+			recordRoleInconsistency(record.GuildID, record.UserID, record.Domain, fmt.Sprintf("probation role removal failed: %v", err))
+		}
+	}
+	log.Printf("Probation of user %s ended.", record.UserID)
+	announceVerification(s, record.UserID, record.Domain)
+	record.ProbationUntil = time.Time{}
+	publishVerified(s, record)
+	go updateRoleConnection(record.UserID)
+	if err := notifyUser(s, record.UserID, "試用期間が終わりました. サーバーのすべてのロールが付与されました."); err != nil {
+		debugf("Failed to tell %s their probation ended: %v", record.UserID, err)
+	}
+	return nil
+}
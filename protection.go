@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verified role protection ---
+// Members who gain the verified role or a school role without a verification record
+// (e.g. a moderator assigned it by hand) are reported, and with role_protection "remove"
+// the role is taken away again. Only gains seen in the member cache are checked, so members
+// verified before the bot kept records are left alone.
+
+const (
+	roleProtectionRemove = "remove"
+	roleProtectionAlert  = "alert"
+	roleProtectionOff    = "off"
+
+	// The bot records a verification right after granting the roles
+	roleProtectionGrace = 10 * time.Second
+)
+
+// Verification methods recorded for members
+const (
+	verifiedByEmail  = "email"
+	verifiedByIDCard = "id_card"
+	verifiedByAppeal = "appeal"
+	// Approved by hand with /approve
+	verifiedByModerator = "moderator"
+)
+
+func protectedRoles() map[string]bool {
+	roles := map[string]bool{verifiedRoleID: true}
+	for _, school := range schools {
+		if school.RoleID != "" {
+			roles[school.RoleID] = true
+		}
+	}
+	return roles
+}
+
+func onProtectedRoleUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if config.RoleProtection == roleProtectionOff || m.Member == nil || m.User == nil || m.BeforeUpdate == nil || m.User.Bot {
+		return
+	}
+	protected := protectedRoles()
+	had := make(map[string]bool)
+	for _, id := range m.BeforeUpdate.Roles {
+		had[id] = true
+	}
+	var gained []string
+	for _, id := range m.Roles {
+		if protected[id] && !had[id] {
+			gained = append(gained, id)
+		}
+	}
+	if len(gained) == 0 {
+		return
+	}
+
+	go func() {
+		time.Sleep(roleProtectionGrace)
+		if _, verified := store.isVerified(m.User.ID); verified {
+			return
+		}
+		removed := false
+		for _, roleID := range gained {
+			action := "手動で付与されました"
+			if config.RoleProtection == roleProtectionRemove {
+				if err := s.GuildMemberRoleRemove(m.GuildID, m.User.ID, roleID); err != nil {
+					log.Printf("Failed to remove manually assigned role %s from %s: %v", roleID, m.User.ID, err)
+				} else {
+					action = "手動で付与されたため削除しました"
+					removed = true
+				}
+			}
+			alertModerators(s, fmt.Sprintf("🛡️ 認証記録のない <@%s> にロール <@&%s> が%s. 認証はボット経由で行ってください.", m.User.ID, roleID, action))
+		}
+		if removed {
+			sendReverifyReminder(s, m.User.ID, "認証を経ずに付与されたロールは外されます")
+		}
+	}()
+}
+
+// Posts to the mod channel, falling back to the admin channel
+func alertModerators(s *discordgo.Session, message string) {
+	if modChannelID == "" {
+		alertAdmins(s, message)
+		return
+	}
+	log.Printf("MOD ALERT: %s", message)
+	_, err := sendMessage(s, modChannelID, &discordgo.MessageSend{
+		Content:         message,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		log.Printf("Failed to post alert to mod channel: %v", err)
+	}
+}
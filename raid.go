@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/text/unicode/norm"
+)
+
+// --- Raid protection ---
+// Joins and verification starts are counted over a sliding window. When either goes
+// over its limit the bot enters protective mode until the rates have stayed normal for
+// calm_period: new accounts are turned away, the start button asks a simple challenge
+// question first, and verification emails are spaced out. Moderators are alerted on
+// both transitions.
+
+const (
+	raidEventJoin  = "join"
+	raidEventStart = "start"
+
+	raidCheckInterval = 30 * time.Second
+
+	raidChallengeModalID = "raid_challenge"
+	raidChallengeInputID = "raid_challenge_answer"
+)
+
+type RaidProtection struct {
+	// Sliding window the limits apply to
+	Window Duration `json:"window"`
+	// Joins and start button presses per window that trigger protective mode, 0 to ignore
+	MaxJoins  int `json:"max_joins"`
+	MaxStarts int `json:"max_starts"`
+	// How long rates must stay below the limits before protective mode ends
+	CalmPeriod Duration `json:"calm_period"`
+	// While protective: minimum Discord account age to start verification, 0 for none
+	MinAccountAge Duration `json:"min_account_age"`
+	// While protective: minimum time between two verification emails, 0 for none
+	EmailInterval Duration `json:"email_interval"`
+	// While protective: ask a challenge question before creating the channel
+	Challenge bool `json:"challenge"`
+}
+
+func defaultRaidProtection() RaidProtection {
+	return RaidProtection{
+		Window:        Duration{time.Minute},
+		CalmPeriod:    Duration{10 * time.Minute},
+		MinAccountAge: Duration{7 * 24 * time.Hour},
+		EmailInterval: Duration{10 * time.Second},
+		Challenge:     true,
+	}
+}
+
+func (r RaidProtection) enabled() bool {
+	return r.MaxJoins > 0 || r.MaxStarts > 0
+}
+
+func (r RaidProtection) validate() error {
+	if r.enabled() && r.Window.Duration <= 0 {
+		return fmt.Errorf("window must be positive")
+	}
+	return nil
+}
+
+var (
+	raidEvents    = make(map[string][]time.Time)
+	raidLastSurge time.Time
+	raidMutex     = &sync.Mutex{}
+
+	protectiveMode atomic.Bool
+
+	// Next time a verification email may go out while protective
+	nextEmailSlot      time.Time
+	nextEmailSlotMutex = &sync.Mutex{}
+
+	// Expected answers to the challenge question, keyed by user ID
+	raidChallenges     = make(map[string]int)
+	raidChallengeMutex = &sync.Mutex{}
+)
+
+var protectiveModeGauge = newGauge("kosen_verify_protective_mode", "1 while raid protection is active.")
+
+// Counts a join or verification start and enters protective mode on a surge
+func recordRaidEvent(s *discordgo.Session, kind string) {
+	cfg := config.RaidProtection
+	limit := cfg.MaxJoins
+	if kind == raidEventStart {
+		limit = cfg.MaxStarts
+	}
+	if limit <= 0 {
+		return
+	}
+
+	now := time.Now()
+	raidMutex.Lock()
+	events := append(pruneRaidEvents(raidEvents[kind], now), now)
+	raidEvents[kind] = events
+	surge := len(events) > limit
+	if surge {
+		raidLastSurge = now
+	}
+	raidMutex.Unlock()
+
+	if surge && protectiveMode.CompareAndSwap(false, true) {
+		protectiveModeGauge.set(1)
+		log.Printf("Raid protection enabled: %d %s events in %s", len(events), kind, cfg.Window.Duration)
+		alertModerators(s, fmt.Sprintf("🛡️ 直近%sで%sが%d件に達したため、保護モードを開始しました. 新しいアカウントの制限、確認問題、メール送信の間隔調整を行います.",
+			cfg.Window.Duration, raidEventLabel(kind), len(events)))
+	}
+}
+
+func raidEventLabel(kind string) string {
+	if kind == raidEventJoin {
+		return "参加"
+	}
+	return "認証開始"
+}
+
+// Drops events older than the window; the caller holds raidMutex
+func pruneRaidEvents(events []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-config.RaidProtection.Window.Duration)
+	kept := events[:0]
+	for _, t := range events {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+func onRaidMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	if m.User == nil || m.User.Bot || m.GuildID != guildID {
+		return
+	}
+	recordRaidEvent(s, raidEventJoin)
+}
+
+// Background loop ending protective mode once the rates have calmed down
+func runRaidMonitor(s *discordgo.Session) {
+	if !config.RaidProtection.enabled() {
+		return
+	}
+	ticker := time.NewTicker(raidCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		raidMutex.Lock()
+		calm := time.Since(raidLastSurge) >= config.RaidProtection.CalmPeriod.Duration
+		for kind, events := range raidEvents {
+			raidEvents[kind] = pruneRaidEvents(events, time.Now())
+		}
+		raidMutex.Unlock()
+		if calm && protectiveMode.CompareAndSwap(true, false) {
+			protectiveModeGauge.set(0)
+			log.Println("Raid protection disabled, rates are back to normal")
+			alertModerators(s, "✅ 参加と認証開始のペースが落ち着いたため、保護モードを終了しました.")
+		}
+	}
+}
+
+// Checks the start button while protective. It reports true if it responded, either by
+// turning the user away or by asking the challenge question.
+func respondIfProtective(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	if !protectiveMode.Load() {
+		return false
+	}
+	cfg := config.RaidProtection
+	user := interactionUser(i)
+	if cfg.MinAccountAge.Duration > 0 {
+		created, err := discordgo.SnowflakeTimestamp(user.ID)
+		if err == nil && time.Since(created) < cfg.MinAccountAge.Duration {
+			log.Printf("Turned away new account %s during protective mode", user.ID)
+			respondEphemeral(s, i, "現在、サーバーへの参加が集中しているため、作成されて間もないアカウントでは認証を開始できません. 時間をおいてお試しいただくか、管理者に連絡してください.")
+			return true
+		}
+	}
+	if !cfg.Challenge {
+		return false
+	}
+
+	a, b := randomDigit(), randomDigit()
+	raidChallengeMutex.Lock()
+	raidChallenges[user.ID] = a + b
+	raidChallengeMutex.Unlock()
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: raidChallengeModalID,
+			Title:    "確認",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:  raidChallengeInputID,
+						Label:     fmt.Sprintf("%d たす %d は?", a, b),
+						Style:     discordgo.TextInputShort,
+						Required:  true,
+						MaxLength: 3,
+					},
+				}},
+			},
+		},
+	})
+	return true
+}
+
+func randomDigit() int {
+	n, err := rand.Int(rand.Reader, big.NewInt(9))
+	if err != nil {
+		return 5
+	}
+	return int(n.Int64()) + 1
+}
+
+// Creates the verification channel once the challenge question was answered correctly
+func handleRaidChallengeSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	userID := interactionUser(i).ID
+	raidChallengeMutex.Lock()
+	expected, ok := raidChallenges[userID]
+	delete(raidChallenges, userID)
+	raidChallengeMutex.Unlock()
+
+	answer, err := strconv.Atoi(strings.TrimSpace(norm.NFKC.String(modalValue(i.ModalSubmitData(), raidChallengeInputID))))
+	if !ok || err != nil || answer != expected {
+		respondError(s, i, "エラー: 答えが正しくありません. もう一度ボタンを押してください.")
+		return
+	}
+	if respondIfChannelsFull(s, i) {
+		return
+	}
+	createVerificationChannel(s, i)
+}
+
+// Returns how long a verification email has to wait while protective, reserving its slot
+func reserveEmailSlot(now time.Time) time.Duration {
+	interval := config.RaidProtection.EmailInterval.Duration
+	if !protectiveMode.Load() || interval <= 0 {
+		return 0
+	}
+	nextEmailSlotMutex.Lock()
+	defer nextEmailSlotMutex.Unlock()
+	slot := nextEmailSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	nextEmailSlot = slot.Add(interval)
+	return slot.Sub(now)
+}
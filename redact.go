@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- PII redaction ---
+// Everything the bot writes (logs, channel posts, DMs, transcripts) goes through redact,
+// so email addresses, verification codes and secrets never end up in log files or Discord
+// channels. The standard logger is wrapped before any init function runs, so plain
+// log.Printf calls are covered without having to remember it, and channel posts and DMs
+// are sent with sendMessage or sendText, never with the session's ChannelMessageSend*.
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	codePattern  = regexp.MustCompile(`\b[0-9]{6}\b`)
+	// Magic link tokens and other long hex secrets
+	hexSecretPattern = regexp.MustCompile(`\b[0-9a-f]{32,}\b`)
+	// Discord bot tokens: three base64url segments separated by dots
+	discordTokenPattern = regexp.MustCompile(`[A-Za-z0-9_\-]{24,}\.[A-Za-z0-9_\-]{6}\.[A-Za-z0-9_\-]{27,}`)
+)
+
+// Installed while package variables are initialized, which is before any init function logs
+var _ = func() bool {
+	log.SetOutput(redactingWriter{os.Stderr})
+	return true
+}()
+
+// Masks an address as "t****@nara.kosen-ac.jp", keeping the domain for context
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "****"
+	}
+	return email[:1] + "****" + email[at:]
+}
+
+// Masks emails and removes codes and secrets from text meant for operators
+func redact(text string) string {
+	text = discordTokenPattern.ReplaceAllString(text, "[token]")
+	text = hexSecretPattern.ReplaceAllString(text, "[token]")
+	text = emailPattern.ReplaceAllStringFunc(text, maskEmail)
+	return codePattern.ReplaceAllString(text, "******")
+}
+
+// Wraps a writer so every line written through it is redacted
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redact(string(p)))); err != nil {
+		return 0, err
+	}
+	// Report the original length; callers don't care that the text changed
+	return len(p), nil
+}
+
+// Sends a message with its text and embeds redacted
+func sendMessage(s *discordgo.Session, channelID string, msg *discordgo.MessageSend) (*discordgo.Message, error) {
+	redacted := *msg
+	redacted.Content = redact(msg.Content)
+	redacted.Embeds = nil
+	for _, embed := range msg.Embeds {
+		redacted.Embeds = append(redacted.Embeds, redactEmbed(embed))
+	}
+	if msg.Embed != nil {
+		redacted.Embed = redactEmbed(msg.Embed)
+	}
+	return s.ChannelMessageSendComplex(channelID, &redacted)
+}
+
+func sendText(s *discordgo.Session, channelID, content string) (*discordgo.Message, error) {
+	return sendMessage(s, channelID, &discordgo.MessageSend{Content: content})
+}
+
+// Returns a copy of the embed with its text redacted
+func redactEmbed(embed *discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	redacted := *embed
+	redacted.Title = redact(embed.Title)
+	redacted.Description = redact(embed.Description)
+	redacted.Fields = nil
+	for _, field := range embed.Fields {
+		f := *field
+		f.Name, f.Value = redact(field.Name), redact(field.Value)
+		redacted.Fields = append(redacted.Fields, &f)
+	}
+	if embed.Footer != nil {
+		footer := *embed.Footer
+		footer.Text = redact(footer.Text)
+		redacted.Footer = &footer
+	}
+	return &redacted
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Role consistency ---
+// A verified member has both the general and their school's role, anyone else has
+// neither. When the school role can't be granted after the general role was, the general
+// role is taken back and the user is asked to enter the code again. If that rollback
+// fails too, or a queued grant runs out of retries, the member is recorded here and the
+// role_reconciliation job brings their roles in line with the verification record.
+
+const maxReconcileAttempts = 5
+
+var errSchoolRoleFailed = errors.New("school role could not be granted")
+
+type roleInconsistency struct {
+	GuildID string `json:"guild_id"`
+	UserID  string `json:"user_id"`
+	// Email domain the roles belong to, for members who end up without a record
+	Domain    string    `json:"domain"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:        "role_reconciliation",
+		Description: "Fixes the roles of members left with only some of their verification roles",
+		DefaultCron: "*/10 * * * *",
+		Run:         reconcileRoles,
+	})
+}
+
+// Records a member whose roles may not match their verification record
+func recordRoleInconsistency(guildID, userID, domain, reason string) {
+	log.Printf("Roles of user %s may be inconsistent: %s", userID, reason)
+	err := store.putRoleInconsistency(roleInconsistency{GuildID: guildID, UserID: userID, Domain: domain, Reason: reason, At: time.Now()})
+	if err != nil {
+		log.Printf("Failed to record role inconsistency: %v", err)
+	}
+}
+
+// Takes back the general role after the school role failed, so the member isn't left half verified
+func rollbackGeneralRole(s *discordgo.Session, guildID, userID, domain string, granted, queued bool) {
+	switch {
+	case queued:
+		if err := store.updateRoleGrant(roleGrant{GuildID: guildID, UserID: userID, RoleID: config.verifiedRoleFor(guildID)}, true); err != nil {
+			log.Printf("Failed to cancel queued role grant: %v", err)
+		}
+		// The grant may have been in flight while it was cancelled
+		recordRoleInconsistency(guildID, userID, domain, "queued general role cancelled after the school role failed")
+	case granted:
+		if err := s.GuildMemberRoleRemove(guildID, userID, config.verifiedRoleFor(guildID)); err != nil {
+			recordRoleInconsistency(guildID, userID, domain, fmt.Sprintf("general role rollback failed: %v", err))
+		}
+	}
+}
+
+// Roles a member should hold according to the verification record
+func expectedRoles(member verifiedMember, ok bool) (want, unwant []string) {
+	roles := []string{config.verifiedRoleFor(member.GuildID)}
+	if school, exists := schools[member.Domain]; exists && school.RoleID != "" {
+		roles = append(roles, school.RoleID)
+	}
+	if probation := config.probationFor(member.GuildID); ok && !member.ProbationUntil.IsZero() && probation.RoleID != "" {
+		return []string{probation.RoleID}, roles
+	}
+	if ok && !member.Waitlisted {
+		return roles, nil
+	}
+	return nil, roles
+}
+
+func reconcileRoles(s *discordgo.Session) error {
+	for _, entry := range store.roleInconsistencies() {
+		err := reconcileMemberRoles(s, entry)
+		if err == nil || isUnknownMember(err) {
+			if err := store.removeRoleInconsistency(entry.UserID); err != nil {
+				log.Printf("Failed to remove role inconsistency: %v", err)
+			}
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if entry.Attempts >= maxReconcileAttempts {
+			log.Printf("Giving up reconciling roles of user %s: %v", entry.UserID, err)
+			alertAdmins(s, fmt.Sprintf("⚠️ <@%s> のロールが認証記録と一致しない状態を%d回修復できませんでした. 手動で確認してください.\n原因: %s\n最後のエラー: `%v`",
+				entry.UserID, entry.Attempts, entry.Reason, err))
+			if err := store.removeRoleInconsistency(entry.UserID); err != nil {
+				log.Printf("Failed to remove role inconsistency: %v", err)
+			}
+			continue
+		}
+		if err := store.putRoleInconsistency(entry); err != nil {
+			log.Printf("Failed to update role inconsistency: %v", err)
+		}
+	}
+	return nil
+}
+
+func reconcileMemberRoles(s *discordgo.Session, entry roleInconsistency) error {
+	member, err := s.GuildMember(entry.GuildID, entry.UserID)
+	if err != nil {
+		return err
+	}
+	record, ok := store.verifiedMember(entry.UserID)
+	if !ok {
+		record.Domain = entry.Domain
+	}
+	want, unwant := expectedRoles(record, ok)
+	for _, roleID := range want {
+		if !memberHasRole(member, roleID) {
+			if err := s.GuildMemberRoleAdd(entry.GuildID, entry.UserID, roleID); err != nil {
+				return err
+			}
+		}
+	}
+	removed := false
+	for _, roleID := range unwant {
+		if memberHasRole(member, roleID) {
+			if err := s.GuildMemberRoleRemove(entry.GuildID, entry.UserID, roleID); err != nil {
+				return err
+			}
+			removed = true
+		}
+	}
+	log.Printf("Reconciled roles of user %s (%s).", entry.UserID, entry.Reason)
+	// Like the other paths that take verification away, tell members without a record how to get it back
+	if removed && !ok {
+		sendReverifyReminder(s, entry.UserID, "認証記録と一致しないロールが外されました")
+	}
+	return nil
+}
+
+func isUnknownMember(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember
+}
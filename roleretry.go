@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Role grant retry queue ---
+
+const (
+	roleGrantMaxAttempts  = 6
+	roleGrantBaseBackoff  = 30 * time.Second
+	roleGrantMaxBackoff   = time.Hour
+	roleGrantPollInterval = 15 * time.Second
+)
+
+// Reports whether a failed Discord call is worth retrying later (rate limits, 5xx, network errors)
+func isTransientDiscordError(err error) bool {
+	var rateLimitErr *discordgo.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return true
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return restErr.Response.StatusCode == http.StatusTooManyRequests || restErr.Response.StatusCode >= 500
+	}
+	return true
+}
+
+// Adds a role, queueing it for background retry if the failure looks transient.
+// queued is true when the grant will be retried, in which case err describes the first failure.
+func grantRoleWithRetry(s *discordgo.Session, guildID, userID, roleID string) (queued bool, err error) {
+	err = s.GuildMemberRoleAdd(guildID, userID, roleID)
+	if err == nil || !isTransientDiscordError(err) {
+		return false, err
+	}
+	qerr := store.enqueueRoleGrant(roleGrant{
+		GuildID:     guildID,
+		UserID:      userID,
+		RoleID:      roleID,
+		Attempts:    1,
+		NextAttempt: time.Now().Add(roleGrantBaseBackoff),
+		LastError:   err.Error(),
+	})
+	if qerr != nil {
+		log.Printf("Failed to queue role grant: %v", qerr)
+		return false, err
+	}
+	log.Printf("Queued role %s for user %s for retry: %v", roleID, userID, err)
+	return true, err
+}
+
+// Background loop retrying queued role grants with exponential backoff.
+// Nothing is attempted while the gateway is down, so an outage doesn't use up the attempts.
+func runRoleGrantRetries(s *discordgo.Session) {
+	ticker := time.NewTicker(roleGrantPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !gatewayConnected.Load() {
+			continue
+		}
+		retryDueRoleGrants(s)
+	}
+}
+
+// Serializes passes over the role grant queue, like mailQueuePass
+var roleGrantPass sync.Mutex
+
+func retryDueRoleGrants(s *discordgo.Session) {
+	roleGrantPass.Lock()
+	defer roleGrantPass.Unlock()
+	for _, grant := range store.dueRoleGrants(time.Now()) {
+		retryRoleGrant(s, grant)
+	}
+}
+
+func retryRoleGrant(s *discordgo.Session, grant roleGrant) {
+	err := s.GuildMemberRoleAdd(grant.GuildID, grant.UserID, grant.RoleID)
+	if err == nil {
+		log.Printf("Role %s granted to user %s after %d attempts.", grant.RoleID, grant.UserID, grant.Attempts+1)
+		if err := store.updateRoleGrant(grant, true); err != nil {
+			log.Printf("Failed to remove role grant from queue: %v", err)
+		}
+		return
+	}
+
+	grant.Attempts++
+	grant.LastError = err.Error()
+	if grant.Attempts >= roleGrantMaxAttempts || !isTransientDiscordError(err) {
+		log.Printf("Giving up on role %s for user %s: %v", grant.RoleID, grant.UserID, err)
+		countDaily(statRoleFailed)
+		if err := store.updateRoleGrant(grant, true); err != nil {
+			log.Printf("Failed to remove role grant from queue: %v", err)
+		}
+		alertAdmins(s, fmt.Sprintf("⚠️ <@%s> へのロール <@&%s> の付与が %d 回失敗しました. 手動で付与してください.\n最後のエラー: `%s`",
+			grant.UserID, grant.RoleID, grant.Attempts, grant.LastError))
+		if member, ok := store.verifiedMember(grant.UserID); ok {
+			recordRoleInconsistency(grant.GuildID, grant.UserID, member.Domain, "queued role grant gave up")
+		}
+		return
+	}
+
+	backoff := roleGrantBaseBackoff << (grant.Attempts - 1)
+	if backoff > roleGrantMaxBackoff {
+		backoff = roleGrantMaxBackoff
+	}
+	grant.NextAttempt = time.Now().Add(backoff)
+	if err := store.updateRoleGrant(grant, false); err != nil {
+		log.Printf("Failed to update role grant: %v", err)
+	}
+}
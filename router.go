@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Interaction router ---
+
+type interactionHandlerFunc func(s *discordgo.Session, i *discordgo.InteractionCreate)
+
+type routeKind string
+
+const (
+	routeCommand   routeKind = "command"
+	routeComponent routeKind = "component"
+	routeModal     routeKind = "modal"
+	// Option suggestions while a command is being typed, routed by command name
+	routeAutocomplete routeKind = "autocomplete"
+)
+
+// route identifies the handler an interaction was dispatched to.
+// For components and modals name is the registered custom ID prefix.
+type route struct {
+	kind routeKind
+	name string
+}
+
+func (r route) String() string {
+	return string(r.kind) + ":" + r.name
+}
+
+// middleware wraps a handler; it runs for every routed interaction in registration order
+type middleware func(rt route, next interactionHandlerFunc) interactionHandlerFunc
+
+type router struct {
+	commands      map[string]interactionHandlerFunc
+	components    map[string]interactionHandlerFunc
+	modals        map[string]interactionHandlerFunc
+	autocompletes map[string]interactionHandlerFunc
+	middleware    []middleware
+}
+
+func newRouter() *router {
+	return &router{
+		commands:      make(map[string]interactionHandlerFunc),
+		components:    make(map[string]interactionHandlerFunc),
+		modals:        make(map[string]interactionHandlerFunc),
+		autocompletes: make(map[string]interactionHandlerFunc),
+	}
+}
+
+func (r *router) use(mw ...middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+func (r *router) command(name string, h interactionHandlerFunc) {
+	r.commands[name] = h
+}
+
+// Registers a handler for every component whose custom ID starts with prefix
+func (r *router) component(prefix string, h interactionHandlerFunc) {
+	r.components[prefix] = h
+}
+
+// Registers a handler for every modal whose custom ID starts with prefix
+func (r *router) modal(prefix string, h interactionHandlerFunc) {
+	r.modals[prefix] = h
+}
+
+// Registers the handler that suggests option values for a command
+func (r *router) autocomplete(command string, h interactionHandlerFunc) {
+	r.autocompletes[command] = h
+}
+
+func (r *router) handle(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	rt, h := r.lookup(i)
+	if h == nil {
+		log.Printf("No handler for interaction %s (type %s)", i.ID, i.Type)
+		return
+	}
+	debugf("Dispatching interaction %s to %s", i.ID, rt)
+	for idx := len(r.middleware) - 1; idx >= 0; idx-- {
+		h = r.middleware[idx](rt, h)
+	}
+	h(s, i)
+}
+
+func (r *router) lookup(i *discordgo.InteractionCreate) (route, interactionHandlerFunc) {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		name := i.ApplicationCommandData().Name
+		return route{routeCommand, name}, r.commands[name]
+	case discordgo.InteractionMessageComponent:
+		return matchPrefix(routeComponent, r.components, i.MessageComponentData().CustomID)
+	case discordgo.InteractionModalSubmit:
+		return matchPrefix(routeModal, r.modals, i.ModalSubmitData().CustomID)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		name := i.ApplicationCommandData().Name
+		return route{routeAutocomplete, name}, r.autocompletes[name]
+	}
+	return route{}, nil
+}
+
+// Picks the longest registered prefix of customID
+func matchPrefix(kind routeKind, handlers map[string]interactionHandlerFunc, customID string) (route, interactionHandlerFunc) {
+	best := ""
+	var h interactionHandlerFunc
+	for prefix, handler := range handlers {
+		if strings.HasPrefix(customID, prefix) && len(prefix) >= len(best) {
+			best, h = prefix, handler
+		}
+	}
+	return route{kind, best}, h
+}
+
+// --- Middleware ---
+
+// Drops interactions Discord delivered more than once
+func dedupeMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if !markInteractionSeen(i.ID) {
+			log.Printf("Ignoring duplicate delivery of interaction %s", i.ID)
+			return
+		}
+		next(s, i)
+	}
+}
+
+// Writes an audit record for every interaction, including ones whose handler panicked.
+// Autocomplete requests arrive on every keystroke and are left out.
+func loggingMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	if rt.kind == routeAutocomplete {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		start := time.Now()
+		defer func() {
+			rec := newAuditRecord(rt, i, start)
+			r := recover()
+			if r != nil {
+				rec.Outcome = outcomePanic
+			}
+			writeAuditRecord(rec)
+			if r != nil {
+				panic(r)
+			}
+		}()
+		next(s, i)
+	}
+}
+
+// Keeps a panicking handler from taking the goroutine down silently: logs the stack,
+// reports it to the admins and tells the user something went wrong
+func recoveryMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		defer func() {
+			if r := recover(); r != nil {
+				ref := newErrorRef()
+				log.Printf("PANIC [%s] in %s: %v\n%s", ref, rt, r, debug.Stack())
+				alertAdmins(s, fmt.Sprintf("🔥 `%s` の処理中に内部エラーが発生しました (参照ID: `%s`): `%v`", rt, ref, r))
+				respondInternalError(s, i, ref)
+			}
+		}()
+		next(s, i)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Scheduler ---
+// Jobs that run on a calendar schedule register here with a default cron expression
+// ("minute hour day-of-month month day-of-week", local time). config.json can change
+// the expression, add jitter or disable a job. A job still running when it comes due
+// again is skipped, and /jobs shows how each one last went.
+
+type JobSchedule struct {
+	Cron string `json:"cron"`
+	// Random delay of up to this long before each run, so several bots don't hit Discord at once
+	Jitter Duration `json:"jitter"`
+	// A nil value keeps the job enabled
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+type scheduledJob struct {
+	Name        string
+	Description string
+	DefaultCron string
+	// Also run once at startup, to catch up on a run missed while the bot was down
+	RunAtStartup bool
+	Run          func(s *discordgo.Session) error
+
+	schedule cronSchedule
+	jitter   time.Duration
+	enabled  bool
+
+	mutex        sync.Mutex
+	running      bool
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+	skipped      int
+}
+
+var (
+	scheduledJobs []*scheduledJob
+
+	jobRunsCounter = newCounter("kosen_verify_job_runs_total", "Scheduled job runs by job and result.", "job", "result")
+)
+
+func registerJob(job *scheduledJob) {
+	scheduledJobs = append(scheduledJobs, job)
+}
+
+func init() {
+	registerJob(&scheduledJob{
+		Name:         "daily_summary",
+		Description:  "Posts yesterday's summary in the admin channel",
+		DefaultCron:  "5 0 * * *",
+		RunAtStartup: true,
+		Run:          runDailySummaryJob,
+	})
+}
+
+// A job's schedule as configured in config.json, parsed but not yet applied
+type jobSettings struct {
+	schedule cronSchedule
+	jitter   time.Duration
+	enabled  bool
+}
+
+// Parses the schedules from config.json without touching the registered jobs,
+// so a config that fails to load leaves them as they were
+func parseJobSchedules(schedules map[string]JobSchedule) (map[string]jobSettings, error) {
+	parsed := make(map[string]jobSettings, len(scheduledJobs))
+	for _, job := range scheduledJobs {
+		cfg := schedules[job.Name]
+		expr := cfg.Cron
+		if expr == "" {
+			expr = job.DefaultCron
+		}
+		schedule, err := parseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", job.Name, err)
+		}
+		parsed[job.Name] = jobSettings{schedule: schedule, jitter: cfg.Jitter.Duration, enabled: cfg.Enabled == nil || *cfg.Enabled}
+	}
+	for name := range schedules {
+		if _, ok := parsed[name]; !ok {
+			return nil, fmt.Errorf("unknown job %q, expected one of %s", name, strings.Join(jobNames(), ", "))
+		}
+	}
+	return parsed, nil
+}
+
+// Applies schedules parsed by parseJobSchedules to the registered jobs
+func configureJobs(settings map[string]jobSettings) {
+	for _, job := range scheduledJobs {
+		if s, ok := settings[job.Name]; ok {
+			job.schedule, job.jitter, job.enabled = s.schedule, s.jitter, s.enabled
+		}
+	}
+}
+
+// Starts due jobs at the top of every minute
+func runScheduler(s *discordgo.Session) {
+	waitForGateway()
+	for _, job := range scheduledJobs {
+		if job.enabled && job.RunAtStartup {
+			go job.start(s, 0)
+		}
+	}
+	for {
+		// Cron fields are matched against the wall clock in the configured time zone
+		now := localNow()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		for _, job := range scheduledJobs {
+			if job.enabled && job.schedule.matches(next) {
+				go job.start(s, job.jitter)
+			}
+		}
+	}
+}
+
+// Marks the job as running, or returns false if a run is already going. Manual runs
+// from /debug go through this too, so they never overlap a scheduled run.
+func (job *scheduledJob) begin() bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if job.running {
+		job.skipped++
+		jobRunsCounter.inc(job.Name, "skipped")
+		return false
+	}
+	job.running = true
+	return true
+}
+
+func (job *scheduledJob) finish(started time.Time, err error) {
+	job.mutex.Lock()
+	job.running = false
+	job.lastRun = started
+	job.lastDuration = time.Since(started)
+	job.lastErr = err
+	job.mutex.Unlock()
+}
+
+// Runs the job unless the previous run is still going
+func (job *scheduledJob) start(s *discordgo.Session, jitter time.Duration) {
+	if !job.begin() {
+		log.Printf("Skipping job %s, the previous run is still going", job.Name)
+		return
+	}
+
+	if jitter > 0 {
+		if n, err := rand.Int(rand.Reader, big.NewInt(int64(jitter))); err == nil {
+			time.Sleep(time.Duration(n.Int64()))
+		}
+	}
+	waitForGateway()
+	started := time.Now()
+	err := job.Run(s)
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.Name, err)
+		jobRunsCounter.inc(job.Name, "error")
+	} else {
+		jobRunsCounter.inc(job.Name, "ok")
+	}
+	job.finish(started, err)
+}
+
+func findJob(name string) *scheduledJob {
+	for _, job := range scheduledJobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+func jobsCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "jobs",
+		Description:              "Show scheduled jobs and how they last ran (admin only).",
+		DefaultMemberPermissions: &permissions,
+	}
+}
+
+func handleJobs(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	embed := &discordgo.MessageEmbed{Title: "スケジュールされたジョブ", Color: 0x5865F2}
+	for _, job := range scheduledJobs {
+		job.mutex.Lock()
+		status := "未実行"
+		switch {
+		case job.running:
+			status = "🔄 実行中"
+		case job.lastErr != nil:
+			status = fmt.Sprintf("❌ <t:%d:R> (%s): `%v`", job.lastRun.Unix(), job.lastDuration.Round(time.Millisecond), job.lastErr)
+		case !job.lastRun.IsZero():
+			status = fmt.Sprintf("✅ <t:%d:R> (%s)", job.lastRun.Unix(), job.lastDuration.Round(time.Millisecond))
+		}
+		if job.skipped > 0 {
+			status += fmt.Sprintf(", 重複のためスキップ %d回", job.skipped)
+		}
+		job.mutex.Unlock()
+
+		schedule := "無効"
+		if job.enabled {
+			schedule = "`" + job.schedule.expr + "`"
+			if next := job.schedule.next(localNow()); !next.IsZero() {
+				schedule += fmt.Sprintf(", 次回 <t:%d:R>", next.Unix())
+			}
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  job.Name,
+			Value: fmt.Sprintf("%s\nスケジュール: %s\n前回: %s", job.Description, schedule, status),
+		})
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
+
+// --- Cron expressions ---
+
+type cronSchedule struct {
+	expr    string
+	minutes map[int]bool
+	hours   map[int]bool
+	days    map[int]bool
+	months  map[int]bool
+	weekday map[int]bool
+	// Whether day-of-month and day-of-week were restricted; if both are, either may match
+	daysSet, weekdaySet bool
+}
+
+// Parses a five-field cron expression. Fields accept "*", numbers, ranges ("1-5"),
+// steps ("*/15", "0-30/10") and comma-separated lists of those.
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	c := cronSchedule{expr: expr}
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, fmt.Errorf("minute: %w", err)
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, fmt.Errorf("hour: %w", err)
+	}
+	if c.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, fmt.Errorf("day of month: %w", err)
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, fmt.Errorf("month: %w", err)
+	}
+	if c.weekday, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, fmt.Errorf("day of week: %w", err)
+	}
+	// Both 0 and 7 mean Sunday
+	if c.weekday[7] {
+		c.weekday[0] = true
+	}
+	c.daysSet = fields[2] != "*"
+	c.weekdaySet = fields[4] != "*"
+	return c, nil
+}
+
+func parseCronField(field string, first, last int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+		lo, hi := first, last
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", from)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				hi = last
+			}
+		}
+		if lo < first || hi > last || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, first, last)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	dayOK, weekdayOK := c.days[t.Day()], c.weekday[int(t.Weekday())]
+	if c.daysSet && c.weekdaySet {
+		return dayOK || weekdayOK
+	}
+	return dayOK && weekdayOK
+}
+
+// Returns the next matching minute after t within a year, or the zero time
+func (c cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(1, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if c.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Sorted names of the registered jobs, for error messages
+func jobNames() []string {
+	names := make([]string, 0, len(scheduledJobs))
+	for _, job := range scheduledJobs {
+		names = append(names, job.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Schools ---
+
+// schoolMapping is one entry of roles.json, keyed by email domain.
+// For backwards compatibility an entry may also be just the role ID string.
+type schoolMapping struct {
+	RoleID string `json:"role_id"`
+	Name   string `json:"name"`
+	// Optional channel where newly verified students of this school are announced
+	AnnounceChannelID string `json:"announce_channel_id,omitempty"`
+	// Optional category the verification channel is moved to once the student enters a school address
+	CategoryID string `json:"category_id,omitempty"`
+	// Optional limit on verified members; students verifying beyond it are waitlisted
+	Cap int `json:"cap,omitempty"`
+	// Optional role whose members may use /whois, /pending and /approve for this school
+	ModeratorRoleID string `json:"moderator_role_id,omitempty"`
+}
+
+func (m *schoolMapping) UnmarshalJSON(data []byte) error {
+	var roleID string
+	if err := json.Unmarshal(data, &roleID); err == nil {
+		*m = schoolMapping{RoleID: roleID}
+		return nil
+	}
+	type plain schoolMapping
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+// Returns the lowercased domain part of an email address
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// Resolves a domain to its display name ("鈴鹿高専"), falling back to the domain itself
+func schoolName(domain string) string {
+	if school, ok := schools[domain]; ok && school.Name != "" {
+		return school.Name
+	}
+	return domain
+}
+
+// Posts a welcome for a newly verified student in their school's announcement channel, if it has one
+func announceVerification(s *discordgo.Session, userID, domain string) {
+	school, ok := schools[domain]
+	if !ok || school.AnnounceChannelID == "" {
+		return
+	}
+	_, err := sendMessage(s, school.AnnounceChannelID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("🎉 %sの新しいメンバー <@%s> さんが認証されました! ようこそ!", schoolName(domain), userID),
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{userID}},
+	})
+	if err != nil {
+		log.Printf("Failed to announce verification in %s: %v", school.AnnounceChannelID, err)
+	}
+}
+
+// --- School autocomplete ---
+// Admin commands with a school option suggest schools from roles.json as the admin types,
+// matching either the display name or the domain. The option value is the domain.
+
+// Discord shows at most 25 suggestions
+const maxAutocompleteChoices = 25
+
+// Returns the focused option of an autocomplete interaction
+func focusedOption(i *discordgo.InteractionCreate) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Focused {
+			return opt
+		}
+	}
+	return nil
+}
+
+// Suggests schools for the focused option of any command that has a school option
+func handleSchoolAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if opt := focusedOption(i); isAdmin(i.Member) && opt != nil && opt.Name == "school" {
+		choices = schoolChoices(opt.StringValue())
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		log.Printf("Failed to answer school autocomplete: %v", err)
+	}
+}
+
+// Returns the schools whose name or domain contains query, sorted by name
+func schoolChoices(query string) []*discordgo.ApplicationCommandOptionChoice {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var domains []string
+	for domain, school := range schools {
+		if strings.Contains(domain, query) || strings.Contains(strings.ToLower(school.Name), query) {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Slice(domains, func(a, b int) bool {
+		return schoolName(domains[a]) < schoolName(domains[b])
+	})
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, domain := range domains[:min(len(domains), maxAutocompleteChoices)] {
+		name := domain
+		if school := schools[domain]; school.Name != "" {
+			name = school.Name + " (" + domain + ")"
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: domain})
+	}
+	return choices
+}
+
+// Resolves what an admin entered for a school option (normally a domain picked from the
+// suggestions, but typed text gets through too) to a domain in roles.json
+func resolveSchool(value string) (domain string, ok bool) {
+	value = strings.TrimSpace(value)
+	if _, ok := schools[strings.ToLower(value)]; ok {
+		return strings.ToLower(value), true
+	}
+	for domain, school := range schools {
+		if school.Name != "" && school.Name == value {
+			return domain, true
+		}
+	}
+	return "", false
+}
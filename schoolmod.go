@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- School moderators ---
+// A school in roles.json can name a moderator role (moderator_role_id). Members with it
+// may use /whois, /pending and /approve, but only for their own school's members;
+// admins may use them for every school. The commands are registered without a default
+// permission so school moderators can see them, and schoolModeratorMiddleware turns
+// away everyone who moderates no school.
+
+var schoolModeratorCommands = map[string]bool{"whois": true, "pending": true, "approve": true}
+
+// Returns the domains the member moderates; all is true for admins
+func moderatedDomains(member *discordgo.Member) (domains map[string]bool, all bool) {
+	if isAdmin(member) {
+		return nil, true
+	}
+	domains = make(map[string]bool)
+	if member == nil {
+		return domains, false
+	}
+	for domain, school := range schools {
+		if school.ModeratorRoleID != "" && memberHasRole(member, school.ModeratorRoleID) {
+			domains[domain] = true
+		}
+	}
+	return domains, false
+}
+
+func moderatesDomain(member *discordgo.Member, domain string) bool {
+	domains, all := moderatedDomains(member)
+	return all || domains[domain]
+}
+
+func schoolModeratorMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	if (rt.kind != routeCommand && rt.kind != routeAutocomplete) || !schoolModeratorCommands[rt.name] {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if domains, all := moderatedDomains(i.Member); !all && len(domains) == 0 {
+			if rt.kind == routeCommand {
+				respondError(s, i, localized(i, msgPermissionDenied))
+			}
+			return
+		}
+		next(s, i)
+	}
+}
+
+func schoolModeratorCommandDefinitions() []*discordgo.ApplicationCommand {
+	allowInDMs := false
+	return []*discordgo.ApplicationCommand{
+		{
+			Name:         "whois",
+			Description:  "Show how a member was verified (admins and school moderators).",
+			DMPermission: &allowInDMs,
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "The member", Required: true},
+			},
+		},
+		{
+			Name:         "pending",
+			Description:  "List verifications waiting for a code (admins and school moderators).",
+			DMPermission: &allowInDMs,
+		},
+		{
+			Name:         "approve",
+			Description:  "Verify a member of your school by hand (admins and school moderators).",
+			DMPermission: &allowInDMs,
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "The member", Required: true},
+				{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "Their school", Required: true, Autocomplete: true},
+			},
+		},
+	}
+}
+
+// Suggests only the schools the member moderates
+func handleModeratedSchoolAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if opt := focusedOption(i); opt != nil && opt.Name == "school" {
+		for _, choice := range schoolChoices(opt.StringValue()) {
+			if moderatesDomain(i.Member, choice.Value.(string)) {
+				choices = append(choices, choice)
+			}
+		}
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		log.Printf("Failed to answer school autocomplete: %v", err)
+	}
+}
+
+func handleWhois(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	user := i.ApplicationCommandData().Options[0].UserValue(nil)
+	record, ok := store.verifiedMember(user.ID)
+	// School moderators can't tell a member of another school from an unverified one
+	if !ok || !moderatesDomain(i.Member, record.Domain) {
+		respondEphemeral(s, i, fmt.Sprintf("<@%s> の認証記録は見つかりませんでした.", user.ID))
+		return
+	}
+	method := record.Method
+	if method == "" {
+		method = verifiedByEmail
+	}
+	lines := []string{
+		fmt.Sprintf("**<@%s>**", user.ID),
+		fmt.Sprintf("学校: %s (`%s`)", schoolName(record.Domain), record.Domain),
+		fmt.Sprintf("認証方法: %s", method),
+		fmt.Sprintf("認証日時: %s", record.VerifiedAt.In(config.location()).Format("2006-01-02 15:04")),
+	}
+	if record.Email != "" {
+		email := record.Email
+		if _, all := moderatedDomains(i.Member); !all {
+			email = maskEmail(email)
+		}
+		lines = append(lines, "メールアドレス: "+email)
+	}
+	if record.Waitlisted {
+		lines = append(lines, "⏳ 順番待ち")
+	}
+	if !record.ProbationUntil.IsZero() {
+		lines = append(lines, fmt.Sprintf("🔰 試用期間中 (<t:%d:R>まで)", record.ProbationUntil.Unix()))
+	}
+	if flagged, ok := store.dmUnreachable(user.ID); ok {
+		lines = append(lines, fmt.Sprintf("📪 DMを受け付けていません (<t:%d:R>に確認)", flagged.LastFailure.Unix()))
+	}
+	respondEphemeral(s, i, strings.Join(lines, "\n"))
+}
+
+func handlePending(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	type entry struct {
+		userID, domain string
+		expiresAt      time.Time
+	}
+	var entries []entry
+	verificationMutex.Lock()
+	for userID, data := range pendingVerifications {
+		if domain := emailDomain(data.Email); moderatesDomain(i.Member, domain) {
+			entries = append(entries, entry{userID, domain, data.ExpiresAt})
+		}
+	}
+	verificationMutex.Unlock()
+	if len(entries) == 0 {
+		respondEphemeral(s, i, "コード入力待ちの認証はありません.")
+		return
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].domain < entries[b].domain })
+
+	lines := []string{fmt.Sprintf("**コード入力待ち %d件**", len(entries))}
+	for idx, e := range entries {
+		if idx == 20 {
+			lines = append(lines, fmt.Sprintf("…ほか%d件", len(entries)-idx))
+			break
+		}
+		line := fmt.Sprintf("- <@%s> %s", e.userID, schoolName(e.domain))
+		if !e.expiresAt.IsZero() {
+			line += fmt.Sprintf(" (期限 <t:%d:R>)", e.expiresAt.Unix())
+		}
+		lines = append(lines, line)
+	}
+	respondEphemeral(s, i, strings.Join(lines, "\n"))
+}
+
+func handleApprove(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	user := i.ApplicationCommandData().Options[0].UserValue(nil)
+	domain, ok := resolveSchool(optionString(i, "school"))
+	if !ok || !moderatesDomain(i.Member, domain) {
+		respondError(s, i, "エラー: 学校が見つからないか、あなたが担当する学校ではありません. 候補から選んでください.")
+		return
+	}
+	if record, ok := store.verifiedMember(user.ID); ok {
+		// A member waitlisted or verified at another school is that school's moderators' business
+		if !moderatesDomain(i.Member, record.Domain) {
+			respondError(s, i, fmt.Sprintf("エラー: <@%s> は既に別の学校で登録されています.", user.ID))
+			return
+		}
+		if !record.Waitlisted {
+			respondEphemeral(s, i, fmt.Sprintf("<@%s> は既に認証されています (%s).", user.ID, schoolName(record.Domain)))
+			return
+		}
+	}
+	member, err := s.GuildMember(i.GuildID, user.ID)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: メンバー情報を取得できませんでした. サーバーに参加しているか確認してください.", "Failed to fetch member to approve", err)
+		return
+	}
+
+	// The school's cap and probation apply as they do to email verification
+	outcome, err := admitMember(s, member, verifiedMember{UserID: user.ID, GuildID: i.GuildID, Domain: domain, Method: verifiedByModerator})
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: ロールの付与に失敗しました.", "Failed to add roles for manual approval", err)
+		return
+	}
+	moderatorID := interactionUser(i).ID
+	if outcome.Waitlisted {
+		respondEphemeral(s, i, fmt.Sprintf("⏳ %sの参加枠が埋まっているため、<@%s> を順番待ちに登録しました. 参加させるには管理者が `/waitlist` で許可してください.", schoolName(domain), user.ID))
+		return
+	}
+	log.Printf("User %s approved as a student of %s by %s.", user.ID, schoolName(domain), moderatorID)
+	alertModerators(s, fmt.Sprintf("✅ <@%s> が <@%s> を%sの生徒として手動で承認しました.", moderatorID, user.ID, schoolName(domain)))
+	message := fmt.Sprintf("✅ <@%s> を%sの生徒として承認しました.", user.ID, schoolName(domain))
+	if outcome.Probation > 0 {
+		message += " 試用期間が終わると、すべてのロールが付与されます."
+	}
+	respondEphemeral(s, i, message)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Guild setup wizard ---
+// When the bot is invited to a guild it has no configuration for, the person who added it
+// is sent a checklist of what the bot still needs there, by DM if the audit log names
+// them, otherwise in a thread in the guild's system channel. The checklist's button, and
+// /setup, open a wizard that creates the missing role, welcome channel and category, and
+// finally prints the guilds.<id> entry to add to config.json. The environment variables
+// stay pointed at the main guild, so adding a guild never takes the bot away from it.
+
+const (
+	setupStartPrefix   = "setup_start:"
+	setupCreatePrefix  = "setup_create:"
+	setupRefreshPrefix = "setup_refresh:"
+
+	setupItemRole     = "role"
+	setupItemWelcome  = "welcome"
+	setupItemCategory = "category"
+
+	// GuildCreate is also sent for every guild on each connect; only a fresh invite gets a checklist
+	setupInviteWindow = 10 * time.Minute
+)
+
+// Resources the wizard created in a guild, and when its admins were told about the wizard
+type guildSetup struct {
+	RoleID           string    `json:"role_id,omitempty"`
+	WelcomeChannelID string    `json:"welcome_channel_id,omitempty"`
+	CategoryID       string    `json:"category_id,omitempty"`
+	NotifiedAt       time.Time `json:"notified_at,omitempty"`
+}
+
+// A guild the bot has neither environment variables nor a config.json entry for
+func isUnconfiguredGuild(id string) bool {
+	return id != guildID && config.Guilds[id] == nil
+}
+
+func setupCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "setup",
+		Description:              "Check what the bot still needs in this server and create it (admin only).",
+		DefaultMemberPermissions: &permissions,
+	}
+}
+
+func onGuildCreate(s *discordgo.Session, g *discordgo.GuildCreate) {
+	if g.Unavailable || !isUnconfiguredGuild(g.ID) || time.Since(g.JoinedAt) > setupInviteWindow {
+		return
+	}
+	if setup, ok := store.guildSetup(g.ID); ok && !setup.NotifiedAt.IsZero() {
+		return
+	}
+	log.Printf("Added to unconfigured guild %s (%s), sending the setup checklist.", g.Name, g.ID)
+	msg := &discordgo.MessageSend{
+		Content: fmt.Sprintf("👋 **%s** に追加していただきありがとうございます. このサーバーで認証を始めるには、まだ次の設定が必要です.\n%s",
+			g.Name, strings.Join(setupChecklist(s, g.ID), "\n")),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "セットアップを開始", Style: discordgo.PrimaryButton, CustomID: setupStartPrefix + g.ID},
+		}}},
+	}
+	if err := sendSetupNotice(s, g.Guild, msg); err != nil {
+		log.Printf("Failed to send setup checklist for guild %s: %v", g.ID, err)
+		return
+	}
+	if err := store.updateGuildSetup(g.ID, func(setup *guildSetup) { setup.NotifiedAt = time.Now() }); err != nil {
+		log.Printf("Failed to save guild setup: %v", err)
+	}
+}
+
+// DMs the user who added the bot, falling back to a thread in the system channel
+func sendSetupNotice(s *discordgo.Session, g *discordgo.Guild, msg *discordgo.MessageSend) error {
+	if inviter := findInviter(s, g.ID); inviter != "" {
+		channel, err := s.UserChannelCreate(inviter)
+		if err == nil {
+			if _, err = sendMessage(s, channel.ID, msg); err == nil {
+				return nil
+			}
+		}
+		log.Printf("Failed to DM setup checklist to user %s: %v", inviter, err)
+	}
+	if g.SystemChannelID == "" {
+		return fmt.Errorf("no inviter to DM and no system channel")
+	}
+	channelID := g.SystemChannelID
+	thread, err := s.ThreadStartComplex(channelID, &discordgo.ThreadStart{Name: "認証ボットの初期設定", Type: discordgo.ChannelTypeGuildPublicThread, AutoArchiveDuration: 1440})
+	if err != nil {
+		log.Printf("Failed to start setup thread in %s, posting in the channel: %v", channelID, err)
+	} else {
+		channelID = thread.ID
+	}
+	_, err = sendMessage(s, channelID, msg)
+	return err
+}
+
+// Returns the user who added the bot, if the bot may read the audit log
+func findInviter(s *discordgo.Session, guildID string) string {
+	auditLog, err := s.GuildAuditLog(guildID, "", "", int(discordgo.AuditLogActionBotAdd), 10)
+	if err != nil {
+		debugf("Could not read audit log of guild %s: %v", guildID, err)
+		return ""
+	}
+	for _, entry := range auditLog.AuditLogEntries {
+		if entry.TargetID == s.State.User.ID {
+			return entry.UserID
+		}
+	}
+	return ""
+}
+
+// The role, welcome channel and category the bot uses in a guild, or the wizard created there
+func setupTargets(id string) guildSetup {
+	if _, configured := config.Guilds[id]; id == guildID || configured {
+		return guildSetup{RoleID: config.verifiedRoleFor(id), WelcomeChannelID: config.welcomeChannelFor(id), CategoryID: config.privateCategoryFor(id)}
+	}
+	setup, _ := store.guildSetup(id)
+	return setup
+}
+
+// The config.json entry for a guild the wizard set up
+func setupConfigSnippet(id string, targets guildSetup) string {
+	snippet, _ := json.MarshalIndent(map[string]map[string]*GuildConfig{"guilds": {id: {
+		VerifiedRoleID:    targets.RoleID,
+		WelcomeChannelID:  targets.WelcomeChannelID,
+		PrivateCategoryID: targets.CategoryID,
+	}}}, "", "  ")
+	return string(snippet)
+}
+
+// Reports which of the setup items are missing from the guild
+func missingSetupItems(s *discordgo.Session, id string) (missing map[string]bool, schoolRoles int) {
+	targets := setupTargets(id)
+	roles := make(map[string]bool)
+	channels := make(map[string]bool)
+	if guildRoles, err := cachedGuildRoles(s, id); err == nil {
+		for _, role := range guildRoles {
+			roles[role.ID] = true
+		}
+	}
+	if guildChannels, err := cachedGuildChannels(s, id); err == nil {
+		for _, channel := range guildChannels {
+			channels[channel.ID] = true
+		}
+	}
+	for _, school := range schools {
+		if roles[school.RoleID] {
+			schoolRoles++
+		}
+	}
+	missing = map[string]bool{
+		setupItemRole:     !roles[targets.RoleID],
+		setupItemWelcome:  !channels[targets.WelcomeChannelID],
+		setupItemCategory: !channels[targets.CategoryID],
+	}
+	return missing, schoolRoles
+}
+
+func setupChecklist(s *discordgo.Session, id string) []string {
+	missing, schoolRoles := missingSetupItems(s, id)
+	mark := func(missing bool) string {
+		if missing {
+			return "❌"
+		}
+		return "✅"
+	}
+	lines := []string{
+		mark(missing[setupItemRole]) + " 認証済みロール",
+		mark(missing[setupItemWelcome]) + " ウェルカムチャンネル (認証ボタンを置くチャンネル)",
+		mark(missing[setupItemCategory]) + " 認証チャンネルのカテゴリ",
+	}
+	if schoolRoles == 0 {
+		lines = append(lines, "❌ 学校ロールの対応表 (roles.json に、このサーバーのロールが登録されていません)")
+	} else {
+		lines = append(lines, fmt.Sprintf("✅ 学校ロールの対応表 (%d校)", schoolRoles))
+	}
+	return lines
+}
+
+// Builds the wizard: the checklist, a button per item that can be created, and the
+// config.json entry once everything exists
+func setupWizard(s *discordgo.Session, id string) *discordgo.InteractionResponseData {
+	missing, _ := missingSetupItems(s, id)
+	content := "🛠️ **認証ボットのセットアップ**\n" + strings.Join(setupChecklist(s, id), "\n")
+
+	var buttons []discordgo.MessageComponent
+	for _, item := range []struct{ key, label string }{
+		{setupItemRole, "ロールを作成"},
+		{setupItemWelcome, "ウェルカムチャンネルを作成"},
+		{setupItemCategory, "カテゴリを作成"},
+	} {
+		if missing[item.key] {
+			buttons = append(buttons, discordgo.Button{Label: item.label, Style: discordgo.PrimaryButton, CustomID: setupCreatePrefix + item.key + ":" + id})
+		}
+	}
+	buttons = append(buttons, discordgo.Button{Label: "再確認", Style: discordgo.SecondaryButton, CustomID: setupRefreshPrefix + id})
+
+	if !missing[setupItemRole] && !missing[setupItemWelcome] && !missing[setupItemCategory] {
+		if _, configured := config.Guilds[id]; id == guildID || configured {
+			content += "\n\nサーバー側の準備は整っています. 学校ロールは roles.json に登録してください."
+		} else {
+			content += "\n\nサーバー側の準備が整いました. config.json の `guilds` に次の内容を追加してボットを再起動してください. 環境変数は変更しないでください. 学校ロールは roles.json に登録してください.\n```json\n" +
+				setupConfigSnippet(id, setupTargets(id)) + "\n```"
+		}
+	}
+	return &discordgo.InteractionResponseData{
+		Content:    content,
+		Flags:      discordgo.MessageFlagsEphemeral,
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}},
+	}
+}
+
+// Checks the user may manage the guild; setup buttons are also pressed in DMs, where i.Member is nil
+func canSetUp(s *discordgo.Session, id, userID string) bool {
+	guild, err := s.State.Guild(id)
+	if err != nil {
+		return false
+	}
+	member, err := s.GuildMember(id, userID)
+	if err != nil {
+		return false
+	}
+	return guildPermissions(guild, userID, member.Roles)&discordgo.PermissionManageGuild != 0
+}
+
+func handleSetup(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: setupWizard(s, i.GuildID),
+	})
+}
+
+func handleSetupStart(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	id := strings.TrimPrefix(i.MessageComponentData().CustomID, setupStartPrefix)
+	if !canSetUp(s, id, interactionUser(i).ID) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: setupWizard(s, id),
+	})
+}
+
+func handleSetupRefresh(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	id := strings.TrimPrefix(i.MessageComponentData().CustomID, setupRefreshPrefix)
+	if !canSetUp(s, id, interactionUser(i).ID) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: setupWizard(s, id),
+	})
+}
+
+func handleSetupCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	item, id, _ := strings.Cut(strings.TrimPrefix(i.MessageComponentData().CustomID, setupCreatePrefix), ":")
+	if !canSetUp(s, id, interactionUser(i).ID) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	// The main guild's IDs come from the environment and can't be changed from here
+	if id == guildID {
+		respondError(s, i, "エラー: このサーバーの設定は環境変数で指定されています. 環境変数を確認してください.")
+		return
+	}
+	if err := createSetupItem(s, id, item); err != nil {
+		respondWithErrorRef(s, i, "エラー: 作成できませんでした. ボットに「ロールの管理」と「チャンネルの管理」の権限があるか確認してください.", "setup "+item, err)
+		return
+	}
+	log.Printf("Setup: created %s in guild %s for user %s", item, id, interactionUser(i).ID)
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: setupWizard(s, id),
+	})
+}
+
+func createSetupItem(s *discordgo.Session, id, item string) error {
+	// The wizard is redrawn before the gateway event about the new role or channel arrives
+	defer guildRolesCache.invalidate(id)
+	defer guildChannelsCache.invalidate(id)
+	switch item {
+	case setupItemRole:
+		role, err := s.GuildRoleCreate(id, &discordgo.RoleParams{Name: "高専生"})
+		if err != nil {
+			return err
+		}
+		return store.updateGuildSetup(id, func(setup *guildSetup) { setup.RoleID = role.ID })
+	case setupItemWelcome:
+		channel, err := s.GuildChannelCreate(id, "認証", discordgo.ChannelTypeGuildText)
+		if err != nil {
+			return err
+		}
+		return store.updateGuildSetup(id, func(setup *guildSetup) { setup.WelcomeChannelID = channel.ID })
+	case setupItemCategory:
+		// Verification channels get their own overwrites; the category itself stays hidden
+		category, err := s.GuildChannelCreateComplex(id, discordgo.GuildChannelCreateData{
+			Name: "認証チャンネル",
+			Type: discordgo.ChannelTypeGuildCategory,
+			PermissionOverwrites: []*discordgo.PermissionOverwrite{
+				{ID: id, Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return store.updateGuildSetup(id, func(setup *guildSetup) { setup.CategoryID = category.ID })
+	}
+	return fmt.Errorf("unknown setup item %q", item)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// --- SMTP connection pool ---
+// Opening a connection costs a TCP, TLS and AUTH round trip each, and Gmail limits how
+// many connections an account opens, so authenticated connections are kept for the next
+// email. An idle connection is dropped after idle_timeout and checked with NOOP before
+// reuse, because the server may have closed it in the meantime. A connection that failed
+// mid-session is never reused; one whose mail was only rejected is reset and kept.
+// At most max_active emails are sent at once per account; a new connection is only dialed
+// when no idle one is left, so that also bounds the connections open at any time. QUIT is
+// sent under a deadline, as a server that stopped answering would otherwise hang it.
+
+// How long a server gets to answer QUIT before the connection is just closed
+const smtpQuitTimeout = 5 * time.Second
+
+type SMTPPoolConfig struct {
+	// Idle connections kept open; 0 opens a new connection for every email
+	MaxIdle int `json:"max_idle"`
+	// How long a connection may sit unused before it is closed
+	IdleTimeout Duration `json:"idle_timeout"`
+	// Emails sent at once per account; the rest wait for a connection to free up
+	MaxActive int `json:"max_active"`
+}
+
+func defaultSMTPPoolConfig() SMTPPoolConfig {
+	return SMTPPoolConfig{MaxIdle: 2, IdleTimeout: Duration{time.Minute}, MaxActive: 3}
+}
+
+func (c SMTPPoolConfig) validate() error {
+	if c.MaxIdle < 0 {
+		return fmt.Errorf("max_idle must not be negative")
+	}
+	if c.MaxIdle > 0 && c.IdleTimeout.Duration <= 0 {
+		return fmt.Errorf("idle_timeout must be positive")
+	}
+	if c.MaxActive <= 0 {
+		return fmt.Errorf("max_active must be positive")
+	}
+	return nil
+}
+
+type pooledSMTPConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+type smtpConnPool struct {
+	mutex sync.Mutex
+	idle  []*pooledSMTPConn
+	// Holds a token per email being sent
+	active chan struct{}
+}
+
+func newSMTPConnPool() *smtpConnPool {
+	return &smtpConnPool{active: make(chan struct{}, config.SMTPPool.MaxActive)}
+}
+
+var (
+	smtpConnections = newCounter("kosen_verify_smtp_connections_total", "SMTP connections used for sending, by whether they were opened or reused.", "source")
+)
+
+func (c *pooledSMTPConn) close() {
+	c.client.Close()
+}
+
+// Logs out, giving up after smtpQuitTimeout
+func (c *pooledSMTPConn) quit() {
+	c.conn.SetDeadline(time.Now().Add(smtpQuitTimeout))
+	if err := c.client.Quit(); err != nil {
+		c.client.Close()
+	}
+}
+
+// Returns a healthy idle connection, or nil if there is none
+func (p *smtpConnPool) take(now time.Time) *pooledSMTPConn {
+	for {
+		p.mutex.Lock()
+		if len(p.idle) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mutex.Unlock()
+
+		if now.Sub(c.lastUsed) > config.SMTPPool.IdleTimeout.Duration {
+			c.close()
+			continue
+		}
+		c.conn.SetDeadline(now.Add(smtpPreflightTimeout))
+		if err := c.client.Noop(); err != nil {
+			debugf("Dropping pooled SMTP connection that failed NOOP: %v", err)
+			c.close()
+			continue
+		}
+		c.conn.SetDeadline(time.Time{})
+		return c
+	}
+}
+
+// Keeps the connection for the next email, or closes it if the pool is full
+func (p *smtpConnPool) put(c *pooledSMTPConn) {
+	c.conn.SetDeadline(time.Time{})
+	c.lastUsed = time.Now()
+	p.mutex.Lock()
+	if len(p.idle) < config.SMTPPool.MaxIdle {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mutex.Unlock()
+	if c != nil {
+		c.quit()
+	}
+}
+
+// Closes connections that have been idle for too long
+func (p *smtpConnPool) prune(now time.Time) {
+	p.mutex.Lock()
+	var keep, stale []*pooledSMTPConn
+	for _, c := range p.idle {
+		if now.Sub(c.lastUsed) > config.SMTPPool.IdleTimeout.Duration {
+			stale = append(stale, c)
+		} else {
+			keep = append(keep, c)
+		}
+	}
+	p.idle = keep
+	p.mutex.Unlock()
+	for _, c := range stale {
+		c.quit()
+	}
+}
+
+// Connects, upgrades to TLS and logs in
+func dialSMTP(ctx context.Context, acct *smtpAccount) (*pooledSMTPConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", acct.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, acct.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.Hello("localhost"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: acct.host}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if err := c.Auth(smtp.PlainAuth("", acct.username, acct.password, acct.host)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &pooledSMTPConn{conn: conn, client: c}, nil
+}
+
+// Does what smtp.SendMail does over a pooled connection, giving up when ctx is done
+// or smtpSendTimeout passes
+func sendMail(ctx context.Context, acct *smtpAccount, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpSendTimeout)
+	defer cancel()
+
+	select {
+	case acct.pool.active <- struct{}{}:
+		defer func() { <-acct.pool.active }()
+	case <-ctx.Done():
+		return fmt.Errorf("%w (waiting for a free SMTP connection)", ctx.Err())
+	}
+
+	c := acct.pool.take(time.Now())
+	if c != nil {
+		smtpConnections.inc("reused")
+	} else {
+		var err error
+		if c, err = dialSMTP(ctx, acct); err != nil {
+			return contextError(ctx, err)
+		}
+		smtpConnections.inc("new")
+	}
+	// Unblocks whatever read or write is in progress once ctx is done
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+
+	err := sendOn(c.client, acct.from, to, msg)
+	stopped := stop()
+	switch {
+	case err == nil && stopped && config.SMTPPool.MaxIdle > 0:
+		acct.pool.put(c)
+	case err == nil:
+		c.quit()
+	case isRejection(err) && stopped && c.client.Reset() == nil:
+		// The server refused this email, the connection itself is fine
+		acct.pool.put(c)
+	default:
+		c.close()
+	}
+	return contextError(ctx, err)
+}
+
+func sendOn(c *smtp.Client, from, to string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Reports whether the server answered with an error reply rather than the connection failing
+func isRejection(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr)
+}
+
+// Wraps err with the context's error if the context is why it failed
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w (%v)", ctx.Err(), err)
+	}
+	return err
+}
+
+// Closes idle SMTP connections past their idle timeout
+func runSMTPPoolPruner() {
+	for {
+		time.Sleep(15 * time.Second)
+		for _, acct := range mailAccounts() {
+			acct.pool.prune(time.Now())
+		}
+	}
+}
+
+// Logs out of every pooled connection, at shutdown
+func closeSMTPPool() {
+	var idle []*pooledSMTPConn
+	for _, acct := range mailAccounts() {
+		acct.pool.mutex.Lock()
+		idle = append(idle, acct.pool.idle...)
+		acct.pool.idle = nil
+		acct.pool.mutex.Unlock()
+	}
+	for _, c := range idle {
+		c.quit()
+	}
+	if len(idle) > 0 {
+		log.Printf("Closed %d pooled SMTP connections", len(idle))
+	}
+}
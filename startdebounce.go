@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Start button debounce ---
+// Double clicks on the start button used to create two verification channels. Clicks
+// within a few seconds of the previous one, or while the user's channel is still being
+// created, are acknowledged silently and otherwise ignored.
+
+const startDebounce = 5 * time.Second
+
+var startClicks = struct {
+	sync.Mutex
+	last     map[string]time.Time
+	inFlight map[string]bool
+}{last: make(map[string]time.Time), inFlight: make(map[string]bool)}
+
+// Claims the start button for the user; false means the click should be ignored
+func beginStartClick(userID string) bool {
+	startClicks.Lock()
+	defer startClicks.Unlock()
+	now := time.Now()
+	if startClicks.inFlight[userID] || now.Sub(startClicks.last[userID]) < startDebounce {
+		return false
+	}
+	for id, at := range startClicks.last {
+		if now.Sub(at) >= startDebounce && !startClicks.inFlight[id] {
+			delete(startClicks.last, id)
+		}
+	}
+	startClicks.last[userID] = now
+	startClicks.inFlight[userID] = true
+	return true
+}
+
+func endStartClick(userID string) {
+	startClicks.Lock()
+	delete(startClicks.inFlight, userID)
+	startClicks.Unlock()
+}
+
+// Acknowledges an ignored click without posting anything, so Discord doesn't show "interaction failed"
+func ignoreClick(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		debugf("Failed to acknowledge ignored start click: %v", err)
+	}
+}
+
+// Replaces the "Creating..." acknowledgement with the outcome of channel creation
+func editStartResponse(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	if _, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+		log.Printf("Failed to update start verification response: %v", err)
+	}
+}
+
+// --- Jump link ---
+// Many users never notice a new channel appearing in the sidebar, so the acknowledgement
+// links straight to it with both a mention and a link button.
+
+func channelJumpURL(guildID, channelID string) string {
+	return fmt.Sprintf("https://discord.com/channels/%s/%s", guildID, channelID)
+}
+
+// Points the "Creating..." acknowledgement at the user's new verification channel
+func editStartResponseWithLink(s *discordgo.Session, i *discordgo.InteractionCreate, channelID string) {
+	content := fmt.Sprintf("認証チャンネルを作成しました: <#%s>\n下のボタンから移動して認証を進めてください. ", channelID)
+	label := "認証チャンネルへ移動"
+	if userLanguage(interactionUser(i).ID) == langEN {
+		content = fmt.Sprintf("Your verification channel is ready: <#%s>\nUse the button below to jump there and continue.", channelID)
+		label = "Go to your channel"
+	}
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: label, Style: discordgo.LinkButton, URL: channelJumpURL(guildID, channelID)},
+		}},
+	}
+	edit := &discordgo.WebhookEdit{Content: &content, Components: &components}
+	if _, err := s.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		log.Printf("Failed to update start verification response: %v", err)
+	}
+}
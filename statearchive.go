@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --- State export/import ---
+// Moves the bot to a new host: `export-state` bundles the state file and runtime config
+// into one archive, `import-state` writes them back on the other side.
+// The archive is signed with HMAC-SHA256 keyed by the bot token, so only a host
+// running the same bot can import it and a corrupted copy is rejected.
+// Pending verifications are included, but only with hashes of their codes and links.
+
+const stateArchiveVersion = 1
+
+type stateArchive struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// File contents keyed by path, as configured on the exporting host
+	Files map[string][]byte `json:"files"`
+}
+
+type signedStateArchive struct {
+	Archive   json.RawMessage `json:"archive"`
+	Signature string          `json:"signature"`
+}
+
+// Files included in the archive; missing optional files are skipped
+func archivedFiles() []string {
+	return []string{stateFile, configFile, "roles.json", faqFile}
+}
+
+func signArchive(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(botToken))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Writes every persistent file into a single signed archive at path
+func exportState(path string) error {
+	archive := stateArchive{Version: stateArchiveVersion, CreatedAt: time.Now(), Files: make(map[string][]byte)}
+	for _, name := range archivedFiles() {
+		data, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Skipping %s: file does not exist.", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", name, err)
+		}
+		archive.Files[name] = data
+	}
+
+	payload, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	// Not indented: that would reformat the signed payload
+	signed, err := json.Marshal(signedStateArchive{Archive: payload, Signature: signArchive(payload)})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, signed); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	log.Printf("Exported %d files to %s.", len(archive.Files), path)
+	return nil
+}
+
+// Restores the files from an archive made by exportState. The bot must not be running.
+// Existing files are only overwritten with force.
+func importState(path string, force bool) error {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	var signed signedStateArchive
+	if err := json.Unmarshal(file, &signed); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if !hmac.Equal([]byte(signed.Signature), []byte(signArchive(signed.Archive))) {
+		return fmt.Errorf("signature mismatch: the archive is corrupted or was exported with a different bot token")
+	}
+	var archive stateArchive
+	if err := json.Unmarshal(signed.Archive, &archive); err != nil {
+		return fmt.Errorf("could not parse archive: %w", err)
+	}
+	if archive.Version != stateArchiveVersion {
+		return fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+
+	if !force {
+		for name := range archive.Files {
+			if _, err := os.Stat(name); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite it", name)
+			}
+		}
+	}
+	for name, data := range archive.Files {
+		if err := writeFileAtomic(name, data); err != nil {
+			return fmt.Errorf("could not write %s: %w", name, err)
+		}
+	}
+	log.Printf("Imported %d files from %s (exported %s).", len(archive.Files), path, archive.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// Writes data to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
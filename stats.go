@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification funnel ---
+
+const (
+	stageButtonClicked  = "button_clicked"
+	stageEmailSubmitted = "email_submitted"
+	stageEmailDelivered = "email_delivered"
+	stageCodeEntered    = "code_entered"
+	stageVerified       = "verified"
+)
+
+// Other daily counters
+const (
+	statEmailFailed = "email_failed"
+	statCodeFailed  = "code_failed"
+	statRoleFailed  = "role_failed"
+	statAlerts      = "alerts"
+)
+
+// Funnel stages in the order a user goes through them
+var funnelStages = []struct {
+	Name  string
+	Label string
+}{
+	{stageButtonClicked, "ボタンのクリック"},
+	{stageEmailSubmitted, "メールアドレスの入力"},
+	{stageEmailDelivered, "メールの送信"},
+	{stageCodeEntered, "コードの入力"},
+	{stageVerified, "認証完了"},
+}
+
+const statsDateFormat = "2006-01-02"
+
+var funnelCounter = newCounter("kosen_verify_funnel_total", "Users reaching each stage of the verification funnel.", "stage")
+
+func recordFunnel(stage string) {
+	funnelCounter.inc(stage)
+	countDaily(stage)
+}
+
+// Increments today's value of a daily counter
+func countDaily(name string) {
+	if err := store.incrementDailyStat(localNow().Format(statsDateFormat), name); err != nil {
+		log.Printf("Failed to record daily stat %s: %v", name, err)
+	}
+}
+
+func statsCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minDays := 1.0
+	return &discordgo.ApplicationCommand{
+		Name:                     "stats",
+		Description:              "Show verification statistics (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "days", Description: "Number of days to include (default 7)", MinValue: &minDays, MaxValue: 365},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "Also show verifications of this school", Autocomplete: true},
+		},
+	}
+}
+
+func handleStats(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	days := 7
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Name == "days" {
+			days = int(opt.IntValue())
+		}
+	}
+
+	since := localNow().AddDate(0, 0, -days+1).Format(statsDateFormat)
+	counts := store.funnelTotals(since)
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "認証ファネル",
+		Description: fmt.Sprintf("直近%d日間の各段階の件数と、前の段階からの通過率です.", days),
+		Color:       0x5865F2,
+	}
+	prev := 0
+	for idx, stage := range funnelStages {
+		n := counts[stage.Name]
+		value := fmt.Sprintf("%d件", n)
+		if idx > 0 {
+			value += " (" + formatRate(n, prev) + ")"
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: stage.Label, Value: value, Inline: true})
+		prev = n
+	}
+
+	addButtonAnalytics(embed, counts, days)
+	embeds := []*discordgo.MessageEmbed{embed}
+	if value := optionString(i, "school"); value != "" {
+		domain, ok := resolveSchool(value)
+		if !ok {
+			respondError(s, i, fmt.Sprintf("エラー: 学校「%s」が見つかりません. 候補から選んでください.", value))
+			return
+		}
+		embeds = append(embeds, schoolStatsEmbed(domain, days))
+	}
+
+	// The numbers are still useful without the charts
+	files, err := statsCharts(localNow(), days)
+	if err != nil {
+		log.Printf("Failed to render stats charts: %v", err)
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Embeds: embeds, Files: files, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
+
+// Verifications of one school per day over the period
+func schoolStatsEmbed(domain string, days int) *discordgo.MessageEmbed {
+	now := localNow()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, -days+1)
+	perDay := store.verifiedPerDay(since, now.Add(time.Second))
+
+	total := 0
+	var lines []string
+	for d := 0; d < days; d++ {
+		date := now.AddDate(0, 0, -d).Format(statsDateFormat)
+		n := perDay[date][domain]
+		total += n
+		if n > 0 && len(lines) < conversionDays {
+			lines = append(lines, fmt.Sprintf("%s: %d件", date, n))
+		}
+	}
+	value := "認証はありません."
+	if len(lines) > 0 {
+		value = strings.Join(lines, "\n")
+	}
+	return &discordgo.MessageEmbed{
+		Title:       schoolName(domain),
+		Description: fmt.Sprintf("直近%d日間の認証: %d件 (`%s`)", days, total, domain),
+		Color:       0x5865F2,
+		Fields:      []*discordgo.MessageEmbedField{{Name: "認証のあった日", Value: value}},
+	}
+}
+
+// --- Welcome button analytics ---
+// Raw clicks on each welcome button are counted per day, before maintenance or raid
+// checks can turn the user away. Set against completed verifications this shows whether
+// people don't click at all or click and then give up.
+
+// Daily counter name of a welcome button is this prefix plus the button's name in welcome.buttons
+const statWelcomeClickPrefix = "welcome_click_"
+
+// Welcome buttons by custom ID
+var welcomeButtonNames = map[string]string{
+	startVerificationButtonID: welcomeButtonStart,
+	welcomeHelpButtonID:       welcomeButtonHelp,
+	languageToggleButtonID:    welcomeButtonLanguage,
+	guestButtonID:             welcomeButtonGuest,
+}
+
+// How many days of click-to-verification conversion /stats lists
+const conversionDays = 14
+
+var welcomeClickCounter = newCounter("kosen_verify_welcome_clicks_total", "Clicks on the welcome message buttons.", "button")
+
+func welcomeClickStat(button string) string {
+	return statWelcomeClickPrefix + button
+}
+
+func welcomeAnalyticsMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	button, ok := welcomeButtonNames[rt.name]
+	if rt.kind != routeComponent || !ok {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		welcomeClickCounter.inc(button)
+		countDaily(welcomeClickStat(button))
+		next(s, i)
+	}
+}
+
+// Adds the per-button clicks and the daily conversion from start clicks to verifications
+func addButtonAnalytics(embed *discordgo.MessageEmbed, counts map[string]int, days int) {
+	var clicks []string
+	for _, button := range []string{welcomeButtonStart, welcomeButtonHelp, welcomeButtonLanguage, welcomeButtonGuest} {
+		clicks = append(clicks, fmt.Sprintf("%s: %d", button, counts[welcomeClickStat(button)]))
+	}
+	starts := counts[welcomeClickStat(welcomeButtonStart)]
+	embed.Fields = append(embed.Fields,
+		&discordgo.MessageEmbedField{Name: "ボタン別クリック数", Value: strings.Join(clicks, "\n"), Inline: true},
+		&discordgo.MessageEmbedField{Name: "クリック→認証完了", Value: fmt.Sprintf("%d / %d (%s)", counts[stageVerified], starts, formatRate(counts[stageVerified], starts)), Inline: true},
+	)
+
+	lines := []string{"日付        クリック 認証 率"}
+	now := localNow()
+	for d := 0; d < min(days, conversionDays); d++ {
+		date := now.AddDate(0, 0, -d).Format(statsDateFormat)
+		stats := store.dailyStats(date)
+		clicked, verified := stats[welcomeClickStat(welcomeButtonStart)], stats[stageVerified]
+		lines = append(lines, fmt.Sprintf("%s %8d %4d %s", date, clicked, verified, formatRate(verified, clicked)))
+	}
+	embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+		Name:  "日別の転換率",
+		Value: "```\n" + strings.Join(lines, "\n") + "\n```",
+	})
+}
+
+// Formats n/total as a percentage, or "-" when total is zero
+func formatRate(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
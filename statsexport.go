@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Stats export ---
+// /exportstats hands the raw daily counters to the student council as CSV files
+// for their own analysis: one row per day with every counter, and one row per day
+// and school with the number of members verified.
+
+const (
+	defaultExportDays = 30
+	maxExportDays     = 366
+)
+
+// Every daily counter, in the order of the CSV columns
+var exportCounters = []string{
+	stageButtonClicked, stageEmailSubmitted, stageEmailDelivered, stageCodeEntered, stageVerified,
+	statEmailFailed, statCodeFailed, statRoleFailed, statAlerts,
+	welcomeClickStat(welcomeButtonStart), welcomeClickStat(welcomeButtonHelp),
+	welcomeClickStat(welcomeButtonLanguage), welcomeClickStat(welcomeButtonGuest),
+}
+
+func exportStatsCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "exportstats",
+		Description:              "Export daily verification statistics as CSV (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "from", Description: "First day, YYYY-MM-DD (default 30 days ago)"},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "to", Description: "Last day, YYYY-MM-DD (default today)"},
+		},
+	}
+}
+
+func handleExportStats(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	now := localNow()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from := to.AddDate(0, 0, -defaultExportDays+1)
+	var err error
+	if value := optionString(i, "to"); value != "" {
+		if to, err = time.ParseInLocation(statsDateFormat, value, now.Location()); err != nil {
+			respondError(s, i, "エラー: to は YYYY-MM-DD の形式で指定してください.")
+			return
+		}
+	}
+	if value := optionString(i, "from"); value != "" {
+		if from, err = time.ParseInLocation(statsDateFormat, value, now.Location()); err != nil {
+			respondError(s, i, "エラー: from は YYYY-MM-DD の形式で指定してください.")
+			return
+		}
+	}
+	if from.After(to) {
+		respondError(s, i, "エラー: from は to 以前の日付にしてください.")
+		return
+	}
+	if to.Sub(from) >= maxExportDays*24*time.Hour {
+		respondError(s, i, fmt.Sprintf("エラー: 一度に出力できるのは%d日分までです.", maxExportDays))
+		return
+	}
+
+	daily, err := dailyStatsCSV(from, to)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: CSVの作成に失敗しました.", "Failed to export daily stats", err)
+		return
+	}
+	schools, err := schoolStatsCSV(from, to)
+	if err != nil {
+		respondWithErrorRef(s, i, "エラー: CSVの作成に失敗しました.", "Failed to export school stats", err)
+		return
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("%s から %s までの統計です.", from.Format(statsDateFormat), to.Format(statsDateFormat)),
+			Files: []*discordgo.File{
+				{Name: "daily.csv", ContentType: "text/csv", Reader: bytes.NewReader(daily)},
+				{Name: "schools.csv", ContentType: "text/csv", Reader: bytes.NewReader(schools)},
+			},
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	log.Printf("Stats from %s to %s exported by %s", from.Format(statsDateFormat), to.Format(statsDateFormat), interactionUser(i).ID)
+}
+
+// One row per day from from to to (inclusive) with every daily counter
+func dailyStatsCSV(from, to time.Time) ([]byte, error) {
+	rows := [][]string{append([]string{"date"}, exportCounters...)}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(statsDateFormat)
+		stats := store.dailyStats(date)
+		row := []string{date}
+		for _, name := range exportCounters {
+			row = append(row, strconv.Itoa(stats[name]))
+		}
+		rows = append(rows, row)
+	}
+	return writeCSV(rows)
+}
+
+// One row per day and school with the number of members verified that day
+func schoolStatsCSV(from, to time.Time) ([]byte, error) {
+	perDay := store.verifiedPerDay(from, to.AddDate(0, 0, 1))
+	rows := [][]string{{"date", "domain", "school", "verified"}}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(statsDateFormat)
+		domains := make([]string, 0, len(perDay[date]))
+		for domain := range perDay[date] {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+		for _, domain := range domains {
+			rows = append(rows, []string{date, domain, schoolName(domain), strconv.Itoa(perDay[date][domain])})
+		}
+	}
+	return writeCSV(rows)
+}
+
+func writeCSV(rows [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	// Byte order mark, so Excel opens the Japanese school names as UTF-8
+	buf.WriteString("\uFEFF")
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
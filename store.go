@@ -0,0 +1,1418 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Persistent Store ---
+
+// storeData is everything the bot persists between restarts.
+// It is serialized as a whole to a single JSON file.
+type storeData struct {
+	// Private verification channels, keyed by channel ID
+	VerificationChannels map[string]*verificationChannel `json:"verification_channels"`
+	// Student ID card reviews, keyed by user ID
+	IDCardReviews map[string]*idCardReview `json:"id_card_reviews"`
+	// Members who completed email verification, keyed by user ID
+	VerifiedMembers map[string]*verifiedMember `json:"verified_members"`
+	// Role grants that failed and are waiting to be retried
+	RoleGrants []*roleGrant `json:"role_grants"`
+	// Names of the commands the bot registered, keyed by guild ID ("" for global)
+	RegisteredCommands map[string][]string `json:"registered_commands"`
+	// Feature flags changed at runtime with /feature, keyed by guild ID then feature name
+	FeatureOverrides map[string]map[string]bool `json:"feature_overrides"`
+	// Commands turned on or off with /command, keyed by guild ID then command name
+	CommandOverrides map[string]map[string]bool `json:"command_overrides"`
+	// Daily counters, keyed by date (YYYY-MM-DD) then counter name
+	DailyStats map[string]map[string]int `json:"daily_stats"`
+	// Date (YYYY-MM-DD) of the last day covered by the daily summary
+	LastDailySummary string `json:"last_daily_summary"`
+	// Language chosen with the language button, keyed by user ID
+	UserLanguages map[string]string `json:"user_languages"`
+	// Verification emails waiting to be retried, keyed by user ID
+	MailQueue map[string]*queuedEmail `json:"mail_queue"`
+	// Verification emails that ran out of retries
+	DeadLetters []*queuedEmail `json:"dead_letters"`
+	// OAuth2 tokens of users who linked their account for linked roles, keyed by user ID
+	LinkedRoleTokens map[string]*linkedRoleToken `json:"linked_role_tokens"`
+	// Members who joined with the guest button, keyed by user ID
+	Guests map[string]*guestEntry `json:"guests"`
+	// Partner API keys, keyed by key ID
+	APIKeys map[string]*apiKey `json:"api_keys"`
+	// Verification channels waiting to be deleted, keyed by channel ID
+	ChannelDeletions map[string]*channelDeletion `json:"channel_deletions"`
+	// Set while maintenance mode is on
+	Maintenance *maintenanceState `json:"maintenance,omitempty"`
+	// Set while new verifications are locked with /lockdown
+	Lockdown *lockdownState `json:"lockdown,omitempty"`
+	// Members whose roles may not match their verification record, keyed by user ID
+	RoleInconsistencies map[string]*roleInconsistency `json:"role_inconsistencies"`
+	// Membership callbacks waiting to be delivered, oldest first
+	CallbackOutbox []*callbackEvent `json:"callback_outbox"`
+	// Resources the setup wizard created, keyed by guild ID
+	GuildSetups map[string]*guildSetup `json:"guild_setups"`
+	// Schools whose verification is paused with /schoolpause, keyed by email domain
+	DomainPauses map[string]*domainPause `json:"domain_pauses"`
+	// Schools moved to a new email domain with /migratedomain, keyed by the old domain
+	DomainMigrations map[string]*domainMigration `json:"domain_migrations"`
+	// Single-use tokens that have been used, keyed by their SHA-256
+	ConsumedTokens map[string]*consumedToken `json:"consumed_tokens"`
+	// Members the bot can't DM, keyed by user ID
+	DMUnreachable map[string]*dmUnreachableUser `json:"dm_unreachable"`
+	// Codes sent and not yet entered, keyed by user ID
+	PendingVerifications map[string]verificationData `json:"pending_verifications"`
+}
+
+type verifiedMember struct {
+	UserID     string    `json:"user_id"`
+	GuildID    string    `json:"guild_id"`
+	Email      string    `json:"email"`
+	Domain     string    `json:"domain"`
+	VerifiedAt time.Time `json:"verified_at"`
+	// verifiedByEmail, verifiedByIDCard, verifiedByAppeal or verifiedByModerator; empty in old records means email
+	Method string `json:"method,omitempty"`
+	// Verified in our records but still waiting for some roles to be granted
+	RolesPending bool `json:"roles_pending,omitempty"`
+	// Set when the real_name feature is on; Nickname is kept enforced
+	RealName string `json:"real_name,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	Grade    string `json:"grade,omitempty"`
+	// Verified while the school was at its cap; has no roles until released with /waitlist
+	Waitlisted bool `json:"waitlisted,omitempty"`
+	// Set while the member only has the probation role; the full roles are granted then
+	ProbationUntil time.Time `json:"probation_until,omitempty"`
+}
+
+type roleGrant struct {
+	GuildID     string    `json:"guild_id"`
+	UserID      string    `json:"user_id"`
+	RoleID      string    `json:"role_id"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+}
+
+type verificationChannel struct {
+	ChannelID string    `json:"channel_id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Set once a moderator has been called into the channel
+	EscalatedAt time.Time `json:"escalated_at,omitempty"`
+	// Roles given temporary access with /assist, revoked once the member is verified
+	AssistRoleIDs []string `json:"assist_role_ids,omitempty"`
+	// The welcome channel whose button created this channel
+	WelcomeChannelID string `json:"welcome_channel_id,omitempty"`
+}
+
+type idCardReview struct {
+	UserID          string    `json:"user_id"`
+	ChannelID       string    `json:"channel_id"`
+	UploadMessageID string    `json:"upload_message_id"`
+	ReviewMessageID string    `json:"review_message_id"`
+	Status          string    `json:"status"`
+	SubmittedAt     time.Time `json:"submitted_at"`
+	DecidedAt       time.Time `json:"decided_at,omitempty"`
+	DecidedBy       string    `json:"decided_by,omitempty"`
+}
+
+const (
+	reviewStatusPending  = "pending"
+	reviewStatusApproved = "approved"
+	reviewStatusDenied   = "denied"
+)
+
+type Store struct {
+	mu   sync.Mutex
+	path string
+	data storeData
+}
+
+var store *Store
+
+// Opens the store at path, starting empty if the file does not exist yet
+func openStore(path string) (*Store, error) {
+	st := &Store{path: path}
+	file, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, &st.data); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+	}
+	st.data.init()
+	return st, nil
+}
+
+func (d *storeData) init() {
+	if d.VerificationChannels == nil {
+		d.VerificationChannels = make(map[string]*verificationChannel)
+	}
+	if d.IDCardReviews == nil {
+		d.IDCardReviews = make(map[string]*idCardReview)
+	}
+	if d.VerifiedMembers == nil {
+		d.VerifiedMembers = make(map[string]*verifiedMember)
+	}
+	if d.RegisteredCommands == nil {
+		d.RegisteredCommands = make(map[string][]string)
+	}
+	if d.FeatureOverrides == nil {
+		d.FeatureOverrides = make(map[string]map[string]bool)
+	}
+	if d.CommandOverrides == nil {
+		d.CommandOverrides = make(map[string]map[string]bool)
+	}
+	if d.DailyStats == nil {
+		d.DailyStats = make(map[string]map[string]int)
+	}
+	if d.UserLanguages == nil {
+		d.UserLanguages = make(map[string]string)
+	}
+	if d.MailQueue == nil {
+		d.MailQueue = make(map[string]*queuedEmail)
+	}
+	if d.LinkedRoleTokens == nil {
+		d.LinkedRoleTokens = make(map[string]*linkedRoleToken)
+	}
+	if d.Guests == nil {
+		d.Guests = make(map[string]*guestEntry)
+	}
+	if d.APIKeys == nil {
+		d.APIKeys = make(map[string]*apiKey)
+	}
+	if d.ChannelDeletions == nil {
+		d.ChannelDeletions = make(map[string]*channelDeletion)
+	}
+	if d.RoleInconsistencies == nil {
+		d.RoleInconsistencies = make(map[string]*roleInconsistency)
+	}
+	if d.GuildSetups == nil {
+		d.GuildSetups = make(map[string]*guildSetup)
+	}
+	if d.DomainPauses == nil {
+		d.DomainPauses = make(map[string]*domainPause)
+	}
+	if d.DomainMigrations == nil {
+		d.DomainMigrations = make(map[string]*domainMigration)
+	}
+	if d.ConsumedTokens == nil {
+		d.ConsumedTokens = make(map[string]*consumedToken)
+	}
+	if d.DMUnreachable == nil {
+		d.DMUnreachable = make(map[string]*dmUnreachableUser)
+	}
+	if d.PendingVerifications == nil {
+		d.PendingVerifications = make(map[string]verificationData)
+	}
+}
+
+// view runs fn with read access to the data.
+func (st *Store) view(fn func(d *storeData)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(&st.data)
+}
+
+// update runs fn with write access to the data and persists the result.
+func (st *Store) update(fn func(d *storeData)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(&st.data)
+	return st.save()
+}
+
+// Writes the data to a temp file and renames it over the old one, so a crash never leaves a half-written file
+func (st *Store) save() error {
+	file, err := json.MarshalIndent(&st.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, file)
+}
+
+// Checks the state file can still be written
+func (st *Store) ping() error {
+	return st.update(func(d *storeData) {})
+}
+
+// --- Verification channels ---
+
+func (st *Store) addVerificationChannel(channelID, userID, welcomeChannelID string) error {
+	return st.update(func(d *storeData) {
+		d.VerificationChannels[channelID] = &verificationChannel{ChannelID: channelID, UserID: userID, CreatedAt: time.Now(), WelcomeChannelID: welcomeChannelID}
+	})
+}
+
+func (st *Store) removeVerificationChannel(channelID string) error {
+	return st.update(func(d *storeData) { delete(d.VerificationChannels, channelID) })
+}
+
+// Returns the user a verification channel was created for
+func (st *Store) verificationChannelOwner(channelID string) (userID string, ok bool) {
+	st.view(func(d *storeData) {
+		if c, exists := d.VerificationChannels[channelID]; exists {
+			userID, ok = c.UserID, true
+		}
+	})
+	return userID, ok
+}
+
+// Returns the welcome channel a user's verification channel was started from, if any.
+// With several channels the most recently created one wins.
+func (st *Store) welcomeChannelOf(userID string) string {
+	welcome := ""
+	st.view(func(d *storeData) {
+		var latest *verificationChannel
+		for _, c := range d.VerificationChannels {
+			if c.UserID != userID || c.WelcomeChannelID == "" {
+				continue
+			}
+			if latest == nil || c.newerThan(latest) {
+				latest = c
+			}
+		}
+		if latest != nil {
+			welcome = latest.WelcomeChannelID
+		}
+	})
+	return welcome
+}
+
+// Returns the user's most recently created verification channel
+func (st *Store) latestVerificationChannel(userID string) (channelID string, ok bool) {
+	st.view(func(d *storeData) {
+		var latest *verificationChannel
+		for _, c := range d.VerificationChannels {
+			if c.UserID == userID && (latest == nil || c.newerThan(latest)) {
+				latest = c
+			}
+		}
+		if latest != nil {
+			channelID, ok = latest.ChannelID, true
+		}
+	})
+	return channelID, ok
+}
+
+// Channel IDs break ties so the choice doesn't depend on map order
+func (c *verificationChannel) newerThan(other *verificationChannel) bool {
+	if !c.CreatedAt.Equal(other.CreatedAt) {
+		return c.CreatedAt.After(other.CreatedAt)
+	}
+	return c.ChannelID > other.ChannelID
+}
+
+func (st *Store) verificationChannelCount() int {
+	n := 0
+	st.view(func(d *storeData) { n = len(d.VerificationChannels) })
+	return n
+}
+
+// Returns the IDs of all verification channels created for a user
+func (st *Store) verificationChannelsOf(userID string) []string {
+	var ids []string
+	st.view(func(d *storeData) {
+		for id, c := range d.VerificationChannels {
+			if c.UserID == userID {
+				ids = append(ids, id)
+			}
+		}
+	})
+	return ids
+}
+
+// Records or forgets a role given access to a verification channel with /assist
+func (st *Store) setChannelAssist(channelID, roleID string, on bool) error {
+	return st.update(func(d *storeData) {
+		c, exists := d.VerificationChannels[channelID]
+		if !exists {
+			return
+		}
+		kept := c.AssistRoleIDs[:0]
+		for _, id := range c.AssistRoleIDs {
+			if id != roleID {
+				kept = append(kept, id)
+			}
+		}
+		if on {
+			kept = append(kept, roleID)
+		}
+		c.AssistRoleIDs = kept
+	})
+}
+
+func (st *Store) channelAssistRoles(channelID string) []string {
+	var ids []string
+	st.view(func(d *storeData) {
+		if c, exists := d.VerificationChannels[channelID]; exists {
+			ids = append(ids, c.AssistRoleIDs...)
+		}
+	})
+	return ids
+}
+
+// Marks a verification channel as escalated, reporting false if it already was
+func (st *Store) markVerificationChannelEscalated(channelID string) (bool, error) {
+	marked := false
+	err := st.update(func(d *storeData) {
+		if c, exists := d.VerificationChannels[channelID]; exists && c.EscalatedAt.IsZero() {
+			c.EscalatedAt = time.Now()
+			marked = true
+		}
+	})
+	return marked, err
+}
+
+// --- ID card reviews ---
+
+func (st *Store) idCardReview(userID string) (review idCardReview, ok bool) {
+	st.view(func(d *storeData) {
+		if r, exists := d.IDCardReviews[userID]; exists {
+			review, ok = *r, true
+		}
+	})
+	return review, ok
+}
+
+func (st *Store) putIDCardReview(review idCardReview) error {
+	return st.update(func(d *storeData) { d.IDCardReviews[review.UserID] = &review })
+}
+
+// Moves a pending review to status in one update, so two moderators clicking at once
+// can't both decide it. decided is false if it was no longer pending.
+func (st *Store) decideIDCardReview(userID, status, decidedBy string) (review idCardReview, decided bool, err error) {
+	err = st.update(func(d *storeData) {
+		r, ok := d.IDCardReviews[userID]
+		if !ok || r.Status != reviewStatusPending {
+			return
+		}
+		r.Status, r.DecidedAt, r.DecidedBy = status, time.Now(), decidedBy
+		review, decided = *r, true
+	})
+	return review, decided, err
+}
+
+// Puts a decided review back to pending, when the decision couldn't be carried out
+func (st *Store) reopenIDCardReview(userID string) error {
+	return st.update(func(d *storeData) {
+		if r, ok := d.IDCardReviews[userID]; ok {
+			r.Status, r.DecidedAt, r.DecidedBy = reviewStatusPending, time.Time{}, ""
+		}
+	})
+}
+
+// --- Verified members ---
+
+func (st *Store) putVerifiedMember(member verifiedMember) error {
+	return st.update(func(d *storeData) {
+		d.VerifiedMembers[member.UserID] = &member
+		if !member.Waitlisted {
+			queueMembershipCallback(d, callbackVerified, member)
+		}
+	})
+}
+
+func (st *Store) setMemberNickname(userID, realName, grade, nickname string) error {
+	return st.update(func(d *storeData) {
+		if member, ok := d.VerifiedMembers[userID]; ok {
+			member.RealName = realName
+			member.Grade = grade
+			member.Nickname = nickname
+		}
+	})
+}
+
+func (st *Store) verifiedMember(userID string) (member verifiedMember, ok bool) {
+	st.view(func(d *storeData) {
+		if m, exists := d.VerifiedMembers[userID]; exists {
+			member, ok = *m, true
+		}
+	})
+	return member, ok
+}
+
+// Like verifiedMember, but waitlisted members don't count as verified. Use this wherever
+// being verified grants something.
+func (st *Store) isVerified(userID string) (member verifiedMember, ok bool) {
+	member, ok = st.verifiedMember(userID)
+	return member, ok && !member.Waitlisted
+}
+
+// Forgets a verified member and queues the unverified callback for them
+func (st *Store) removeVerifiedMember(userID string) error {
+	return st.update(func(d *storeData) {
+		if member, ok := d.VerifiedMembers[userID]; ok {
+			delete(d.VerifiedMembers, userID)
+			if !member.Waitlisted {
+				queueMembershipCallback(d, callbackUnverified, *member)
+			}
+		}
+	})
+}
+
+// Counts the members verified with the domain, not counting the waitlist
+func (st *Store) schoolMemberCount(domain string) int {
+	n := 0
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			if m.Domain == domain && !m.Waitlisted {
+				n++
+			}
+		}
+	})
+	return n
+}
+
+// Returns copies of the domain's waitlisted members, longest waiting first
+func (st *Store) waitlist(domain string) []verifiedMember {
+	var members []verifiedMember
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			if m.Domain == domain && m.Waitlisted {
+				members = append(members, *m)
+			}
+		}
+	})
+	sort.Slice(members, func(a, b int) bool { return members[a].VerifiedAt.Before(members[b].VerifiedAt) })
+	return members
+}
+
+// Returns the members verified for a guild who aren't waitlisted, only those of domain if it is set
+func (st *Store) verifiedMembersOf(guild, domain string) []verifiedMember {
+	var members []verifiedMember
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			// Records from before multi-guild support have no guild
+			memberGuild := m.GuildID
+			if memberGuild == "" {
+				memberGuild = guildID
+			}
+			if memberGuild == guild && !m.Waitlisted && (domain == "" || m.Domain == domain) {
+				members = append(members, *m)
+			}
+		}
+	})
+	return members
+}
+
+func (st *Store) releaseWaitlisted(userID string, rolesPending bool) error {
+	return st.update(func(d *storeData) {
+		if m, ok := d.VerifiedMembers[userID]; ok && m.Waitlisted {
+			m.Waitlisted = false
+			m.RolesPending = rolesPending
+			queueMembershipCallback(d, callbackVerified, *m)
+		}
+	})
+}
+
+// Returns the members whose probation ended before now
+func (st *Store) probationsDue(now time.Time) []verifiedMember {
+	var due []verifiedMember
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			if !m.ProbationUntil.IsZero() && m.ProbationUntil.Before(now) {
+				due = append(due, *m)
+			}
+		}
+	})
+	return due
+}
+
+func (st *Store) extendProbation(userID string, until time.Time) error {
+	return st.update(func(d *storeData) {
+		if m, ok := d.VerifiedMembers[userID]; ok && !m.ProbationUntil.IsZero() {
+			m.ProbationUntil = until
+		}
+	})
+}
+
+func (st *Store) endProbation(userID string, rolesPending bool) error {
+	return st.update(func(d *storeData) {
+		if m, ok := d.VerifiedMembers[userID]; ok {
+			m.ProbationUntil = time.Time{}
+			m.RolesPending = rolesPending
+		}
+	})
+}
+
+// Counts members verified in [since, until), keyed by email domain
+func (st *Store) verifiedByDomain(since, until time.Time) map[string]int {
+	counts := make(map[string]int)
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			if !m.Waitlisted && !m.VerifiedAt.Before(since) && m.VerifiedAt.Before(until) {
+				counts[m.Domain]++
+			}
+		}
+	})
+	return counts
+}
+
+// Counts members verified in [since, until), keyed by date (YYYY-MM-DD) then email domain
+func (st *Store) verifiedPerDay(since, until time.Time) map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	st.view(func(d *storeData) {
+		for _, m := range d.VerifiedMembers {
+			if m.Waitlisted || m.VerifiedAt.Before(since) || !m.VerifiedAt.Before(until) {
+				continue
+			}
+			date := m.VerifiedAt.In(since.Location()).Format(statsDateFormat)
+			if counts[date] == nil {
+				counts[date] = make(map[string]int)
+			}
+			counts[date][m.Domain]++
+		}
+	})
+	return counts
+}
+
+// --- Role grant retries ---
+
+func (st *Store) enqueueRoleGrant(grant roleGrant) error {
+	return st.update(func(d *storeData) { d.RoleGrants = append(d.RoleGrants, &grant) })
+}
+
+// Returns copies of the grants whose next attempt is due
+func (st *Store) dueRoleGrants(now time.Time) []roleGrant {
+	var due []roleGrant
+	st.view(func(d *storeData) {
+		for _, g := range d.RoleGrants {
+			if !g.NextAttempt.After(now) {
+				due = append(due, *g)
+			}
+		}
+	})
+	return due
+}
+
+func (st *Store) roleGrantQueueLength() int {
+	n := 0
+	st.view(func(d *storeData) { n = len(d.RoleGrants) })
+	return n
+}
+
+// Makes every queued grant due immediately, returning how many there are
+func (st *Store) rescheduleRoleGrants() int {
+	n := 0
+	err := st.update(func(d *storeData) {
+		for _, g := range d.RoleGrants {
+			g.NextAttempt = time.Time{}
+		}
+		n = len(d.RoleGrants)
+	})
+	if err != nil {
+		log.Printf("Failed to reschedule role grants: %v", err)
+	}
+	return n
+}
+
+// Replaces the stored grant for the same guild/user/role, or removes it if done is true
+func (st *Store) updateRoleGrant(grant roleGrant, done bool) error {
+	return st.update(func(d *storeData) {
+		for idx, g := range d.RoleGrants {
+			if g.GuildID != grant.GuildID || g.UserID != grant.UserID || g.RoleID != grant.RoleID {
+				continue
+			}
+			if done {
+				d.RoleGrants = append(d.RoleGrants[:idx], d.RoleGrants[idx+1:]...)
+			} else {
+				*g = grant
+			}
+			break
+		}
+		if member, ok := d.VerifiedMembers[grant.UserID]; ok && done {
+			member.RolesPending = false
+			for _, g := range d.RoleGrants {
+				if g.UserID == grant.UserID {
+					member.RolesPending = true
+				}
+			}
+		}
+	})
+}
+
+// --- Registered commands ---
+
+func (st *Store) registeredCommands(guildID string) []string {
+	var names []string
+	st.view(func(d *storeData) { names = append(names, d.RegisteredCommands[guildID]...) })
+	return names
+}
+
+func (st *Store) setRegisteredCommands(guildID string, names []string) error {
+	return st.update(func(d *storeData) {
+		if len(names) == 0 {
+			delete(d.RegisteredCommands, guildID)
+			return
+		}
+		d.RegisteredCommands[guildID] = names
+	})
+}
+
+// Returns every scope the bot has registered commands in
+func (st *Store) commandScopes() []string {
+	var scopes []string
+	st.view(func(d *storeData) {
+		for scope := range d.RegisteredCommands {
+			scopes = append(scopes, scope)
+		}
+	})
+	return scopes
+}
+
+// --- Feature overrides ---
+
+func (st *Store) featureOverride(guildID, name string) (enabled, ok bool) {
+	st.view(func(d *storeData) { enabled, ok = d.FeatureOverrides[guildID][name] })
+	return enabled, ok
+}
+
+func (st *Store) setFeatureOverride(guildID, name string, enabled bool) error {
+	return st.update(func(d *storeData) {
+		if d.FeatureOverrides[guildID] == nil {
+			d.FeatureOverrides[guildID] = make(map[string]bool)
+		}
+		d.FeatureOverrides[guildID][name] = enabled
+	})
+}
+
+func (st *Store) clearFeatureOverride(guildID, name string) error {
+	return st.update(func(d *storeData) { delete(d.FeatureOverrides[guildID], name) })
+}
+
+// --- Command overrides ---
+
+func (st *Store) commandOverride(guildID, name string) (enabled, ok bool) {
+	st.view(func(d *storeData) { enabled, ok = d.CommandOverrides[guildID][name] })
+	return enabled, ok
+}
+
+func (st *Store) setCommandOverride(guildID, name string, enabled bool) error {
+	return st.update(func(d *storeData) {
+		if d.CommandOverrides[guildID] == nil {
+			d.CommandOverrides[guildID] = make(map[string]bool)
+		}
+		d.CommandOverrides[guildID][name] = enabled
+	})
+}
+
+func (st *Store) clearCommandOverride(guildID, name string) error {
+	return st.update(func(d *storeData) { delete(d.CommandOverrides[guildID], name) })
+}
+
+// --- Daily statistics ---
+
+func (st *Store) incrementDailyStat(date, name string) error {
+	return st.update(func(d *storeData) {
+		if d.DailyStats[date] == nil {
+			d.DailyStats[date] = make(map[string]int)
+		}
+		d.DailyStats[date][name]++
+	})
+}
+
+// Adds one to a daily counter unless it has already reached limit (0 means no limit), and
+// returns the new count. The check and the increment are one update, so concurrent callers
+// can't both take the last unit.
+func (st *Store) reserveDailyStat(date, name string, limit int) (count int, reserved bool, err error) {
+	err = st.update(func(d *storeData) {
+		if d.DailyStats[date] == nil {
+			d.DailyStats[date] = make(map[string]int)
+		}
+		if limit > 0 && d.DailyStats[date][name] >= limit {
+			return
+		}
+		d.DailyStats[date][name]++
+		count, reserved = d.DailyStats[date][name], true
+	})
+	return count, reserved, err
+}
+
+func (st *Store) decrementDailyStat(date, name string) error {
+	return st.update(func(d *storeData) {
+		if d.DailyStats[date][name] > 0 {
+			d.DailyStats[date][name]--
+		}
+	})
+}
+
+// Returns the counters of a single day
+func (st *Store) dailyStats(date string) map[string]int {
+	stats := make(map[string]int)
+	st.view(func(d *storeData) {
+		for name, n := range d.DailyStats[date] {
+			stats[name] = n
+		}
+	})
+	return stats
+}
+
+// Sums the daily counters from the given date (YYYY-MM-DD) onwards
+func (st *Store) funnelTotals(since string) map[string]int {
+	totals := make(map[string]int)
+	st.view(func(d *storeData) {
+		for date, counts := range d.DailyStats {
+			if date < since {
+				continue
+			}
+			for name, n := range counts {
+				totals[name] += n
+			}
+		}
+	})
+	return totals
+}
+
+func (st *Store) lastDailySummary() string {
+	var date string
+	st.view(func(d *storeData) { date = d.LastDailySummary })
+	return date
+}
+
+func (st *Store) setLastDailySummary(date string) error {
+	return st.update(func(d *storeData) { d.LastDailySummary = date })
+}
+
+// --- User languages ---
+
+func (st *Store) userLanguage(userID string) (lang string, ok bool) {
+	st.view(func(d *storeData) { lang, ok = d.UserLanguages[userID] })
+	return lang, ok
+}
+
+func (st *Store) setUserLanguage(userID, lang string) error {
+	return st.update(func(d *storeData) { d.UserLanguages[userID] = lang })
+}
+
+// --- Mail queue ---
+
+// Adds or replaces the queued email for the user; a user only ever needs their latest code
+func (st *Store) enqueueEmail(mail queuedEmail) error {
+	return st.update(func(d *storeData) { d.MailQueue[mail.UserID] = &mail })
+}
+
+// Returns copies of the queued emails whose next attempt is due
+func (st *Store) dueEmails(now time.Time) []queuedEmail {
+	var due []queuedEmail
+	st.view(func(d *storeData) {
+		for _, m := range d.MailQueue {
+			if !m.NextAttempt.After(now) {
+				due = append(due, *m)
+			}
+		}
+	})
+	return due
+}
+
+func (st *Store) queuedEmailFor(userID string) (mail queuedEmail, ok bool) {
+	st.view(func(d *storeData) {
+		if m, exists := d.MailQueue[userID]; exists {
+			mail, ok = *m, true
+		}
+	})
+	return mail, ok
+}
+
+func (st *Store) removeQueuedEmail(userID string) error {
+	return st.update(func(d *storeData) { delete(d.MailQueue, userID) })
+}
+
+func (st *Store) mailQueueLength() int {
+	n := 0
+	st.view(func(d *storeData) { n = len(d.MailQueue) })
+	return n
+}
+
+func (st *Store) deadLetterEmail(mail queuedEmail) error {
+	return st.update(func(d *storeData) {
+		delete(d.MailQueue, mail.UserID)
+		d.DeadLetters = append(d.DeadLetters, &mail)
+	})
+}
+
+func (st *Store) deadLetters() []queuedEmail {
+	var dead []queuedEmail
+	st.view(func(d *storeData) {
+		for _, m := range d.DeadLetters {
+			dead = append(dead, *m)
+		}
+	})
+	return dead
+}
+
+// Moves every dead letter back into the queue, due immediately, returning how many there were
+func (st *Store) requeueDeadLetters() (int, error) {
+	n := 0
+	err := st.update(func(d *storeData) {
+		for _, m := range d.DeadLetters {
+			// A newer email for the same user wins
+			if _, queued := d.MailQueue[m.UserID]; queued {
+				continue
+			}
+			m.Attempts = 0
+			m.NextAttempt = time.Time{}
+			d.MailQueue[m.UserID] = m
+			n++
+		}
+		d.DeadLetters = nil
+	})
+	return n, err
+}
+
+// --- Linked roles ---
+
+// Returns the user's token decrypted; one that can't be decrypted counts as not linked
+func (st *Store) linkedRoleToken(userID string) (token linkedRoleToken, ok bool) {
+	st.view(func(d *storeData) {
+		if t, exists := d.LinkedRoleTokens[userID]; exists {
+			token, ok = *t, true
+		}
+	})
+	if !ok {
+		return token, false
+	}
+	token, err := token.opened()
+	if err != nil {
+		log.Printf("Failed to read linked role token of %s: %v", userID, err)
+		return linkedRoleToken{}, false
+	}
+	return token, true
+}
+
+func (st *Store) setLinkedRoleToken(userID string, token linkedRoleToken) error {
+	sealed, err := token.sealed()
+	if err != nil {
+		return fmt.Errorf("could not encrypt token: %w", err)
+	}
+	return st.update(func(d *storeData) { d.LinkedRoleTokens[userID] = &sealed })
+}
+
+// Encrypts tokens saved in plain text by older versions; returns how many there were
+func (st *Store) sealLinkedRoleTokens() (int, error) {
+	plain := make(map[string]linkedRoleToken)
+	st.view(func(d *storeData) {
+		for userID, t := range d.LinkedRoleTokens {
+			if !strings.HasPrefix(t.AccessToken, sealedTokenPrefix) || !strings.HasPrefix(t.RefreshToken, sealedTokenPrefix) {
+				plain[userID] = *t
+			}
+		}
+	})
+	if len(plain) == 0 {
+		return 0, nil
+	}
+	sealed := make(map[string]linkedRoleToken, len(plain))
+	for userID, t := range plain {
+		s, err := t.sealed()
+		if err != nil {
+			return 0, err
+		}
+		sealed[userID] = s
+	}
+	err := st.update(func(d *storeData) {
+		for userID, t := range sealed {
+			// Skip tokens replaced in the meantime
+			if current, ok := d.LinkedRoleTokens[userID]; ok && *current == plain[userID] {
+				d.LinkedRoleTokens[userID] = &t
+			}
+		}
+	})
+	return len(sealed), err
+}
+
+// --- Guests ---
+
+func (st *Store) putGuest(guest guestEntry) error {
+	return st.update(func(d *storeData) { d.Guests[guest.UserID] = &guest })
+}
+
+func (st *Store) guest(userID string) (guest guestEntry, ok bool) {
+	st.view(func(d *storeData) {
+		if g, exists := d.Guests[userID]; exists {
+			guest, ok = *g, true
+		}
+	})
+	return guest, ok
+}
+
+func (st *Store) removeGuest(userID string) error {
+	return st.update(func(d *storeData) { delete(d.Guests, userID) })
+}
+
+// Returns the guests whose period ended before now
+func (st *Store) expiredGuests(now time.Time) []guestEntry {
+	var expired []guestEntry
+	st.view(func(d *storeData) {
+		for _, g := range d.Guests {
+			if !g.ExpiresAt.IsZero() && g.ExpiresAt.Before(now) {
+				expired = append(expired, *g)
+			}
+		}
+	})
+	return expired
+}
+
+// --- API keys ---
+
+func (st *Store) putAPIKey(key apiKey) error {
+	return st.update(func(d *storeData) { d.APIKeys[key.ID] = &key })
+}
+
+func (st *Store) apiKey(id string) (key apiKey, ok bool) {
+	st.view(func(d *storeData) {
+		if k, exists := d.APIKeys[id]; exists {
+			key, ok = *k, true
+		}
+	})
+	return key, ok
+}
+
+// Returns every key, oldest first
+func (st *Store) apiKeys() []apiKey {
+	var keys []apiKey
+	st.view(func(d *storeData) {
+		for _, k := range d.APIKeys {
+			keys = append(keys, *k)
+		}
+	})
+	sort.Slice(keys, func(a, b int) bool { return keys[a].CreatedAt.Before(keys[b].CreatedAt) })
+	return keys
+}
+
+func (st *Store) revokeAPIKey(id string) (revoked bool, err error) {
+	err = st.update(func(d *storeData) {
+		_, revoked = d.APIKeys[id]
+		delete(d.APIKeys, id)
+	})
+	return revoked, err
+}
+
+func (st *Store) addAPIKeyUsage(usage map[string]apiKeyUsage) error {
+	return st.update(func(d *storeData) {
+		for id, u := range usage {
+			if k, ok := d.APIKeys[id]; ok {
+				k.LastUsedAt = u.LastUsed
+				k.Uses += u.Uses
+			}
+		}
+	})
+}
+
+// --- Maintenance mode ---
+
+func (st *Store) maintenance() (m maintenanceState, on bool) {
+	st.view(func(d *storeData) {
+		if d.Maintenance != nil {
+			m, on = *d.Maintenance, true
+		}
+	})
+	return m, on
+}
+
+// A nil state turns maintenance mode off
+func (st *Store) setMaintenance(m *maintenanceState) error {
+	return st.update(func(d *storeData) { d.Maintenance = m })
+}
+
+// --- Lockdown ---
+
+func (st *Store) lockdown() (l lockdownState, on bool) {
+	st.view(func(d *storeData) {
+		if d.Lockdown != nil {
+			l, on = *d.Lockdown, true
+		}
+	})
+	return l, on
+}
+
+// A nil state lifts the lockdown
+func (st *Store) setLockdown(l *lockdownState) error {
+	return st.update(func(d *storeData) { d.Lockdown = l })
+}
+
+// --- Channel deletions ---
+
+// Keeps the earlier time if the channel is already scheduled
+func (st *Store) scheduleChannelDeletion(channelID string, at time.Time) error {
+	return st.update(func(d *storeData) {
+		if existing, ok := d.ChannelDeletions[channelID]; ok && existing.At.Before(at) {
+			return
+		}
+		d.ChannelDeletions[channelID] = &channelDeletion{ChannelID: channelID, At: at}
+	})
+}
+
+func (st *Store) putChannelDeletion(task channelDeletion) error {
+	return st.update(func(d *storeData) { d.ChannelDeletions[task.ChannelID] = &task })
+}
+
+// Marks the deletion's transcript as archived; claimed is false if it already was
+func (st *Store) claimTranscriptArchive(channelID string) (claimed bool, err error) {
+	err = st.update(func(d *storeData) {
+		task, ok := d.ChannelDeletions[channelID]
+		if ok && task.Archived {
+			return
+		}
+		if ok {
+			task.Archived = true
+		}
+		claimed = true
+	})
+	return claimed, err
+}
+
+func (st *Store) removeChannelDeletion(channelID string) error {
+	return st.update(func(d *storeData) { delete(d.ChannelDeletions, channelID) })
+}
+
+// Returns copies of the deletions that are due
+func (st *Store) dueChannelDeletions(now time.Time) []channelDeletion {
+	var due []channelDeletion
+	st.view(func(d *storeData) {
+		for _, task := range d.ChannelDeletions {
+			if !task.At.After(now) {
+				due = append(due, *task)
+			}
+		}
+	})
+	return due
+}
+
+// --- Membership callbacks ---
+
+// Returns copies of the outbox events, oldest first
+func (st *Store) callbackOutbox() []callbackEvent {
+	var events []callbackEvent
+	st.view(func(d *storeData) {
+		for _, ev := range d.CallbackOutbox {
+			events = append(events, *ev)
+		}
+	})
+	return events
+}
+
+// Queues a webhook success action as a "verified" event for url
+func (st *Store) queueWebhookCallback(url string, member verifiedMember) error {
+	payload, err := newCallbackPayload(callbackVerified, member)
+	if err != nil {
+		return err
+	}
+	return st.update(func(d *storeData) {
+		queueCallbackEvent(d, &callbackEvent{URL: url, Payload: payload, NextAttempt: payload.OccurredAt})
+	})
+}
+
+func (st *Store) putCallback(ev callbackEvent) error {
+	return st.update(func(d *storeData) {
+		for idx, existing := range d.CallbackOutbox {
+			if existing.Payload.ID == ev.Payload.ID {
+				d.CallbackOutbox[idx] = &ev
+				return
+			}
+		}
+	})
+}
+
+func (st *Store) removeCallback(id string) error {
+	return st.update(func(d *storeData) {
+		for idx, ev := range d.CallbackOutbox {
+			if ev.Payload.ID == id {
+				d.CallbackOutbox = append(d.CallbackOutbox[:idx], d.CallbackOutbox[idx+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// --- Role inconsistencies ---
+
+func (st *Store) putRoleInconsistency(entry roleInconsistency) error {
+	return st.update(func(d *storeData) { d.RoleInconsistencies[entry.UserID] = &entry })
+}
+
+func (st *Store) removeRoleInconsistency(userID string) error {
+	return st.update(func(d *storeData) { delete(d.RoleInconsistencies, userID) })
+}
+
+// Returns copies of the recorded inconsistencies
+func (st *Store) roleInconsistencies() []roleInconsistency {
+	var entries []roleInconsistency
+	st.view(func(d *storeData) {
+		for _, entry := range d.RoleInconsistencies {
+			entries = append(entries, *entry)
+		}
+	})
+	return entries
+}
+
+// --- Guild setup ---
+
+func (st *Store) guildSetup(guildID string) (guildSetup, bool) {
+	var setup guildSetup
+	var ok bool
+	st.view(func(d *storeData) {
+		if existing, exists := d.GuildSetups[guildID]; exists {
+			setup, ok = *existing, true
+		}
+	})
+	return setup, ok
+}
+
+func (st *Store) updateGuildSetup(guildID string, fn func(setup *guildSetup)) error {
+	return st.update(func(d *storeData) {
+		setup, ok := d.GuildSetups[guildID]
+		if !ok {
+			setup = &guildSetup{}
+			d.GuildSetups[guildID] = setup
+		}
+		fn(setup)
+	})
+}
+
+// --- Domain pauses ---
+
+func (st *Store) domainPause(domain string) (p domainPause, paused bool) {
+	st.view(func(d *storeData) {
+		if existing, ok := d.DomainPauses[domain]; ok {
+			p, paused = *existing, true
+		}
+	})
+	return p, paused
+}
+
+func (st *Store) setDomainPause(p domainPause) error {
+	return st.update(func(d *storeData) { d.DomainPauses[p.Domain] = &p })
+}
+
+func (st *Store) removeDomainPause(domain string) error {
+	return st.update(func(d *storeData) { delete(d.DomainPauses, domain) })
+}
+
+func (st *Store) domainPauses() []domainPause {
+	var pauses []domainPause
+	st.view(func(d *storeData) {
+		for _, p := range d.DomainPauses {
+			pauses = append(pauses, *p)
+		}
+	})
+	return pauses
+}
+
+// --- Domain migrations ---
+
+// Moves the members still on oldDomain to newDomain and records them in the migration,
+// adding to an earlier migration of the same domain
+func (st *Store) startDomainMigration(oldDomain, newDomain, by string) (domainMigration, error) {
+	var migration domainMigration
+	var conflict error
+	err := st.update(func(d *storeData) {
+		m, ok := d.DomainMigrations[oldDomain]
+		if ok && m.NewDomain != newDomain {
+			conflict = fmt.Errorf("%s was already migrated to %s", oldDomain, m.NewDomain)
+			return
+		}
+		if !ok {
+			m = &domainMigration{OldDomain: oldDomain, NewDomain: newDomain, StartedAt: time.Now(), By: by, Members: make(map[string]*migratedMember)}
+			d.DomainMigrations[oldDomain] = m
+		}
+		for _, member := range d.VerifiedMembers {
+			if member.Domain != oldDomain {
+				continue
+			}
+			local, _, _ := strings.Cut(member.Email, "@")
+			m.Members[member.UserID] = &migratedMember{OldEmail: member.Email, NewEmail: local + "@" + newDomain}
+			member.Domain = newDomain
+		}
+		migration = copyDomainMigration(m)
+	})
+	if conflict != nil {
+		return migration, conflict
+	}
+	return migration, err
+}
+
+func (st *Store) domainMigration(oldDomain string) (migration domainMigration, ok bool) {
+	st.view(func(d *storeData) {
+		if m, exists := d.DomainMigrations[oldDomain]; exists {
+			migration, ok = copyDomainMigration(m), true
+		}
+	})
+	return migration, ok
+}
+
+func (st *Store) markReconfirmSent(oldDomain, userID, token string) error {
+	hash := tokenHash(token)
+	return st.update(func(d *storeData) {
+		if m, ok := d.DomainMigrations[oldDomain]; ok && m.Members[userID] != nil {
+			m.Members[userID].TokenHash = hash
+			m.Members[userID].SentAt = time.Now()
+		}
+	})
+}
+
+// Marks the member the token was sent to as confirmed and records their new address.
+// userID is empty if no unconfirmed member has the token.
+func (st *Store) confirmMigratedMember(token string) (userID, email string, err error) {
+	hash := tokenHash(token)
+	matches := func(member *migratedMember) bool {
+		return member.TokenHash != "" && hmac.Equal([]byte(member.TokenHash), []byte(hash)) &&
+			member.ConfirmedAt.IsZero() && time.Since(member.SentAt) <= reconfirmLinkTTL
+	}
+	var found bool
+	st.view(func(d *storeData) {
+		for _, m := range d.DomainMigrations {
+			for _, member := range m.Members {
+				if matches(member) {
+					found = true
+					return
+				}
+			}
+		}
+	})
+	if !found {
+		return "", "", nil
+	}
+	err = st.update(func(d *storeData) {
+		for _, m := range d.DomainMigrations {
+			for id, member := range m.Members {
+				if !matches(member) {
+					continue
+				}
+				member.ConfirmedAt = time.Now()
+				if verified, ok := d.VerifiedMembers[id]; ok {
+					verified.Email = member.NewEmail
+				}
+				userID, email = id, member.NewEmail
+				return
+			}
+		}
+	})
+	return userID, email, err
+}
+
+func copyDomainMigration(m *domainMigration) domainMigration {
+	migration := *m
+	migration.Members = make(map[string]*migratedMember, len(m.Members))
+	for id, member := range m.Members {
+		copied := *member
+		migration.Members[id] = &copied
+	}
+	return migration
+}
+
+// --- Consumed tokens ---
+
+// Records a used token and forgets the ones used before pruneBefore
+func (st *Store) putConsumedToken(hash string, entry consumedToken, pruneBefore time.Time) error {
+	return st.update(func(d *storeData) {
+		for h, used := range d.ConsumedTokens {
+			if used.At.Before(pruneBefore) {
+				delete(d.ConsumedTokens, h)
+			}
+		}
+		d.ConsumedTokens[hash] = &entry
+	})
+}
+
+// Counts another use of an already used token; ok is false if the token wasn't used.
+// Unknown tokens are looked up without writing, since anyone can post one.
+func (st *Store) recordTokenReplay(hash string) (entry consumedToken, ok bool) {
+	known := false
+	st.view(func(d *storeData) {
+		_, known = d.ConsumedTokens[hash]
+	})
+	if !known {
+		return entry, false
+	}
+	err := st.update(func(d *storeData) {
+		if used, exists := d.ConsumedTokens[hash]; exists {
+			used.Replays++
+			entry, ok = *used, true
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to save token replay: %v", err)
+	}
+	return entry, ok
+}
+
+// --- Unreachable DMs ---
+
+func (st *Store) dmUnreachable(userID string) (user dmUnreachableUser, ok bool) {
+	st.view(func(d *storeData) {
+		var u *dmUnreachableUser
+		if u, ok = d.DMUnreachable[userID]; ok {
+			user = *u
+			user.Notices = append([]string(nil), u.Notices...)
+		}
+	})
+	return user, ok
+}
+
+// Flags the member as unreachable, keeping the notice if one is given
+func (st *Store) markDMUnreachable(userID, notice string) error {
+	return st.update(func(d *storeData) {
+		u, ok := d.DMUnreachable[userID]
+		if !ok {
+			u = &dmUnreachableUser{}
+			d.DMUnreachable[userID] = u
+		}
+		u.LastFailure = time.Now()
+		if notice != "" {
+			u.Notices = append(u.Notices, notice)
+			if len(u.Notices) > maxUndeliveredNotices {
+				u.Notices = u.Notices[len(u.Notices)-maxUndeliveredNotices:]
+			}
+		}
+	})
+}
+
+func (st *Store) clearDMUnreachable(userID string) error {
+	return st.update(func(d *storeData) {
+		delete(d.DMUnreachable, userID)
+	})
+}
+
+// Drops the first n notices, which have been shown
+func (st *Store) takeUndeliveredNotices(userID string, n int) error {
+	return st.update(func(d *storeData) {
+		if u, ok := d.DMUnreachable[userID]; ok {
+			u.Notices = u.Notices[min(n, len(u.Notices)):]
+		}
+	})
+}
+
+// --- Pending verifications ---
+
+func (st *Store) pendingVerifications() map[string]verificationData {
+	pending := make(map[string]verificationData)
+	st.view(func(d *storeData) {
+		for userID, data := range d.PendingVerifications {
+			pending[userID] = data
+		}
+	})
+	return pending
+}
+
+// Applies a batch of changes; a nil entry removes the user's pending verification
+func (st *Store) savePendingVerifications(changes map[string]*verificationData) error {
+	return st.update(func(d *storeData) {
+		for userID, data := range changes {
+			if data == nil {
+				delete(d.PendingVerifications, userID)
+			} else {
+				d.PendingVerifications[userID] = *data
+			}
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Success actions ---
+// Servers can add steps to what happens once someone is verified without changing code.
+// The actions in "success_actions" run in order on every verification event (events.go),
+// whichever way the member was verified; a failed action is logged and the rest still run.
+// Webhooks go through the membership callback outbox, so they are signed and retried
+// the same way and need MEMBERSHIP_CALLBACK_SECRET.
+//
+// Texts may use {user} (a mention), {user_id}, {school}, {domain} and {method}.
+
+const (
+	actionDM       = "dm"
+	actionAnnounce = "announce"
+	actionAddRoles = "add_roles"
+	actionWebhook  = "webhook"
+)
+
+type SuccessAction struct {
+	// "dm", "announce", "add_roles" or "webhook"
+	Type string `json:"type"`
+	// Message for "dm" and "announce"
+	Template string `json:"template,omitempty"`
+	// Channel for "announce"
+	ChannelID string `json:"channel_id,omitempty"`
+	// Roles for "add_roles"
+	RoleIDs []string `json:"role_ids,omitempty"`
+	// Endpoint for "webhook", POSTed a "verified" membership callback event
+	URL string `json:"url,omitempty"`
+}
+
+func init() {
+	onVerified(runSuccessActions)
+}
+
+func validateSuccessActions(actions []SuccessAction) error {
+	for idx, a := range actions {
+		var missing string
+		switch a.Type {
+		case actionDM:
+			if a.Template == "" {
+				missing = "template"
+			}
+		case actionAnnounce:
+			if a.Template == "" || a.ChannelID == "" {
+				missing = "template and channel_id"
+			}
+		case actionAddRoles:
+			if len(a.RoleIDs) == 0 {
+				missing = "role_ids"
+			}
+		case actionWebhook:
+			if a.URL == "" {
+				missing = "url"
+			} else if membershipCallbackSecret == "" {
+				return fmt.Errorf("entry %d: webhook requires MEMBERSHIP_CALLBACK_SECRET", idx)
+			}
+		default:
+			return fmt.Errorf("entry %d: type must be %q, %q, %q or %q, got %q", idx, actionDM, actionAnnounce, actionAddRoles, actionWebhook, a.Type)
+		}
+		if missing != "" {
+			return fmt.Errorf("entry %d: %s requires %s", idx, a.Type, missing)
+		}
+	}
+	return nil
+}
+
+// Runs the configured actions for a newly verified member in the background
+func runSuccessActions(s *discordgo.Session, member verifiedMember) {
+	if len(config.SuccessActions) == 0 {
+		return
+	}
+	go func() {
+		for idx, action := range config.SuccessActions {
+			if err := runSuccessAction(s, action, member); err != nil {
+				log.Printf("Success action %d (%s) failed for user %s: %v", idx, action.Type, member.UserID, err)
+			}
+		}
+	}()
+}
+
+func runSuccessAction(s *discordgo.Session, action SuccessAction, member verifiedMember) error {
+	switch action.Type {
+	case actionDM:
+		return sendDirectMessage(s, member.UserID, expandActionTemplate(action.Template, member))
+	case actionAnnounce:
+		_, err := sendMessage(s, action.ChannelID, &discordgo.MessageSend{
+			Content:         expandActionTemplate(action.Template, member),
+			AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{member.UserID}},
+		})
+		return err
+	case actionAddRoles:
+		for _, roleID := range action.RoleIDs {
+			if queued, err := grantRoleWithRetry(s, member.GuildID, member.UserID, roleID); err != nil && !queued {
+				return fmt.Errorf("role %s: %w", roleID, err)
+			}
+		}
+		return nil
+	case actionWebhook:
+		return store.queueWebhookCallback(action.URL, member)
+	}
+	return fmt.Errorf("unknown action type %q", action.Type)
+}
+
+func expandActionTemplate(template string, member verifiedMember) string {
+	school := ""
+	if member.Domain != "" {
+		school = schoolName(member.Domain)
+	}
+	method := member.Method
+	if method == "" {
+		method = verifiedByEmail
+	}
+	return strings.NewReplacer(
+		"{user}", "<@"+member.UserID+">",
+		"{user_id}", member.UserID,
+		"{school}", school,
+		"{domain}", member.Domain,
+		"{method}", method,
+	).Replace(template)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Daily operations summary ---
+
+// The summary of this day also carries the charts of the week ending on it
+const weeklySummaryDay = time.Sunday
+
+// Posts yesterday's summary unless it was already posted. Scheduled shortly after
+// midnight so the previous day's counters are complete, and run at startup to catch up.
+func runDailySummaryJob(s *discordgo.Session) error {
+	// Nowhere to post; not an error, the summary is optional
+	if adminChannelID == "" {
+		return nil
+	}
+	yesterday := localNow().AddDate(0, 0, -1).Format(statsDateFormat)
+	if store.lastDailySummary() >= yesterday {
+		return nil
+	}
+	return postDailySummary(s, yesterday)
+}
+
+func postDailySummary(s *discordgo.Session, date string) error {
+	stats := store.dailyStats(date)
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("📊 日次レポート (%s)", date),
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "認証完了", Value: fmt.Sprint(stats[stageVerified]), Inline: true},
+			{Name: "認証開始", Value: fmt.Sprint(stats[stageButtonClicked]), Inline: true},
+			{Name: "メール送信", Value: fmt.Sprint(stats[stageEmailDelivered]), Inline: true},
+			{Name: "メール送信失敗", Value: fmt.Sprint(stats[statEmailFailed]), Inline: true},
+			{Name: "コード誤り", Value: fmt.Sprint(stats[statCodeFailed]), Inline: true},
+			{Name: "ロール付与失敗", Value: fmt.Sprint(stats[statRoleFailed]), Inline: true},
+			{Name: "アラート", Value: fmt.Sprint(stats[statAlerts]), Inline: true},
+		},
+		Color: 0x5865F2,
+	}
+	if warnings := configWarnings(); len(warnings) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "⚠️ 設定の警告", Value: "• " + strings.Join(warnings, "\n• ")})
+		embed.Color = 0xFEE75C
+	}
+
+	if _, err := sendMessage(s, adminChannelID, &discordgo.MessageSend{Embed: embed}); err != nil {
+		return fmt.Errorf("could not post daily summary: %w", err)
+	}
+	if day, err := time.ParseInLocation(statsDateFormat, date, config.location()); err == nil && day.Weekday() == weeklySummaryDay {
+		postWeeklyCharts(s, day)
+	}
+	if err := store.setLastDailySummary(date); err != nil {
+		return fmt.Errorf("could not save daily summary date: %w", err)
+	}
+	return nil
+}
+
+func postWeeklyCharts(s *discordgo.Session, day time.Time) {
+	files, err := statsCharts(day, 7)
+	if err != nil {
+		log.Printf("Failed to render weekly charts: %v", err)
+		return
+	}
+	_, err = sendMessage(s, adminChannelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("📈 週次レポート (%sまでの7日間)", day.Format(statsDateFormat)),
+		Files:   files,
+	})
+	if err != nil {
+		log.Printf("Failed to post weekly charts: %v", err)
+	}
+}
+
+// Lists optional settings that are missing or look wrong
+func configWarnings() []string {
+	var warnings []string
+	if privateCategoryID == "" {
+		warnings = append(warnings, "DISCORD_PRIVATE_CATEGORY_ID が未設定です. 認証チャンネルがカテゴリ外に作成されます.")
+	}
+	if modChannelID == "" {
+		warnings = append(warnings, "DISCORD_MOD_CHANNEL_ID が未設定のため、申し立てと学生証認証が利用できません.")
+	}
+	if moderatorRoleID == "" {
+		warnings = append(warnings, "DISCORD_MODERATOR_ROLE_ID が未設定のため、担当者の呼び出しが利用できません.")
+	}
+	for domain, school := range schools {
+		if school.RoleID == "" {
+			warnings = append(warnings, fmt.Sprintf("roles.json の %s にロールIDがありません.", domain))
+		}
+	}
+	if n := store.roleGrantQueueLength(); n > 0 {
+		warnings = append(warnings, fmt.Sprintf("再試行待ちのロール付与が %d 件あります.", n))
+	}
+	return warnings
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- systemd integration ---
+// With Type=notify the unit only counts as started once the bot can actually verify people,
+// and with WatchdogSec set systemd restarts it if the gateway stays dead.
+// Both are no-ops when not running under systemd.
+
+var (
+	// Closed once the first set of commands has been registered
+	commandsRegistered     = make(chan struct{})
+	commandsRegisteredOnce sync.Once
+)
+
+func markCommandsRegistered() {
+	commandsRegisteredOnce.Do(func() { close(commandsRegistered) })
+}
+
+// Sends a state string such as "READY=1" to the service manager
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// Returns the interval systemd expects watchdog pings at, or 0 if the watchdog is off
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the systemd watchdog while the gateway is healthy. Pings stop once it has been
+// down for longer than watchdog.max_downtime, so systemd restarts the bot.
+func runSystemdWatchdog(s *discordgo.Session) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		down, reason := gatewayDownFor(s)
+		if limit := config.Watchdog.MaxDowntime.Duration; limit > 0 && down >= limit {
+			sdNotify("STATUS=Gateway down: " + reason)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
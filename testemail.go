@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- /testemail ---
+
+func testEmailCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "testemail",
+		Description:              "Send a test verification email through the live mailer (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "address", Description: "Where to send the test email", Required: true},
+		},
+	}
+}
+
+func handleTestEmail(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	address := optionString(i, "address")
+
+	// SMTP can easily take longer than the 3 seconds Discord allows for a reply
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		log.Printf("Failed to defer /testemail response: %v", err)
+		return
+	}
+
+	start := time.Now()
+	err = sendVerificationEmail(interactionContext(i), verificationEmail{To: address, Code: "000000", Language: userLanguage(interactionUser(i).ID)})
+	elapsed := time.Since(start).Round(time.Millisecond)
+	log.Printf("Test email to %s requested by %s: elapsed=%s err=%v", address, interactionUser(i).ID, elapsed, err)
+
+	var content string
+	if err != nil {
+		content = fmt.Sprintf("❌ 送信に失敗しました (%s)\n```\n%v\n```", elapsed, err)
+	} else {
+		content = fmt.Sprintf("✅ `%s` に送信しました (%s). コードは `000000` です.", address, elapsed)
+	}
+	if _, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+		log.Printf("Failed to report /testemail result: %v", err)
+	}
+}
+
+// --- /previewemail ---
+// Renders the verification email with sample data, so template edits can be checked
+// without sending real mail.
+
+func previewEmailCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "previewemail",
+		Description:              "Preview the verification email without sending it (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "locale", Description: "Language shown first (default ja)", Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "日本語", Value: langJA},
+				{Name: "English", Value: langEN},
+			}},
+		},
+	}
+}
+
+func handlePreviewEmail(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	locale := optionString(i, "locale")
+	if locale == "" {
+		locale = langJA
+	}
+
+	mail := verificationEmail{
+		To:          "s123456@tokyo.kosen-ac.jp",
+		Code:        "123456",
+		ChannelLink: fmt.Sprintf("https://discord.com/channels/%s/%s", guildID, i.ChannelID),
+		Language:    locale,
+	}
+	if magicLinksEnabled() {
+		mail.MagicLink = magicLink("0123456789abcdef0123456789abcdef0123456789abcdef")
+	}
+	body := mail.plainText()
+	embed := &discordgo.MessageEmbed{
+		Title:       "件名: " + emailSubject,
+		Description: "```\n" + strings.ReplaceAll(body, "\r\n", "\n") + "\n```",
+		Color:       0x5865F2,
+		Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("宛先: %s / コードとリンクはサンプルです", mail.To)},
+	}
+	var files []*discordgo.File
+	if mail.MagicLink != "" {
+		files = append(files, &discordgo.File{Name: "preview.html", ContentType: "text/html", Reader: strings.NewReader(mail.html())})
+	}
+	err := respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}, Files: files, Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		log.Printf("Failed to show email preview: %v", err)
+	}
+}
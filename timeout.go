@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Handler timeouts ---
+// Every handler runs under a deadline from handler_timeouts (keyed by command name or
+// custom ID prefix, with "default" for the rest). When it passes, the user gets an error
+// right away and the interaction's context is cancelled, which aborts the SMTP session
+// and any Discord calls made with interactionContext. The handler goroutine itself
+// cannot be killed; it finishes as soon as those calls return.
+// Discord drops an interaction that isn't acknowledged within 3 seconds, much sooner than
+// any of these timeouts, so a handler that hasn't answered after ackDeadline gets a
+// deferred ephemeral response, and its own response then edits that one. Buttons and
+// menus are deferred as an update of their own message instead, so a handler that
+// updates the message (replacing an appeal's Approve/Deny buttons, say) still edits it
+// rather than a new ephemeral reply. All responses
+// go through respondInteraction for this; once the timeout error has been shown, later
+// responses from the handler are dropped so the user doesn't get two answers.
+
+const defaultTimeoutKey = "default"
+
+const outcomeTimeout = "timeout"
+
+// Leaves some margin before the 3 seconds Discord waits for an acknowledgement
+const ackDeadline = 2500 * time.Millisecond
+
+var errInteractionClosed = errors.New("interaction already answered with a timeout error")
+
+var handlerTimeoutsCounter = newCounter("kosen_verify_handler_timeouts_total", "Interactions whose handler exceeded its timeout, by route.", "route")
+
+// Contexts of the interactions being handled, keyed by interaction ID
+var interactionContexts sync.Map
+
+// How far the response to an interaction has got, keyed by interaction ID
+var interactionAcks sync.Map
+
+type interactionAck struct {
+	mu sync.Mutex
+	// The interaction has been acknowledged, by the handler or by the deferral
+	responded bool
+	// Acknowledged by the deferral, and whether the handler's answer has replaced it
+	deferred bool
+	edited   bool
+	// Deferred as an update of the component's message rather than as a new reply
+	update bool
+	// The timeout error was shown
+	closed bool
+}
+
+func defaultHandlerTimeouts() map[string]Duration {
+	return map[string]Duration{
+		defaultTimeoutKey: {20 * time.Second},
+		// These talk to SMTP, which can be slow without being broken
+		emailConfirmButtonID: {45 * time.Second},
+		"testemail":          {45 * time.Second},
+	}
+}
+
+func validateHandlerTimeouts(timeouts map[string]Duration) error {
+	for name, d := range timeouts {
+		if d.Duration < 0 {
+			return fmt.Errorf("%s: timeout must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// Returns the timeout for a route, or 0 if it may run forever
+func handlerTimeout(rt route) time.Duration {
+	if d, ok := config.HandlerTimeouts[rt.name]; ok {
+		return d.Duration
+	}
+	return config.HandlerTimeouts[defaultTimeoutKey].Duration
+}
+
+// Returns the context of an interaction being handled; it is cancelled when the handler times out
+func interactionContext(i *discordgo.InteractionCreate) context.Context {
+	if ctx, ok := interactionContexts.Load(i.ID); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+// Stops waiting for a handler once its timeout passes. Panics are handed back to this
+// goroutine so recoveryMiddleware still sees them while the handler is being waited for.
+func timeoutMiddleware(rt route, next interactionHandlerFunc) interactionHandlerFunc {
+	// Autocomplete can't be deferred and has no timeout message to show
+	if rt.kind == routeAutocomplete {
+		return next
+	}
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		ack := &interactionAck{}
+		interactionAcks.Store(i.ID, ack)
+		ack.update = rt.kind == routeComponent
+		deferTimer := time.AfterFunc(ackDeadline, func() { deferInteraction(s, i, ack) })
+
+		timeout := handlerTimeout(rt)
+		if timeout <= 0 {
+			defer interactionAcks.Delete(i.ID)
+			defer deferTimer.Stop()
+			next(s, i)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		interactionContexts.Store(i.ID, ctx)
+
+		done := make(chan any, 1)
+		go func() {
+			defer func() {
+				deferTimer.Stop()
+				interactionContexts.Delete(i.ID)
+				interactionAcks.Delete(i.ID)
+				cancel()
+				done <- recover()
+			}()
+			next(s, i)
+		}()
+
+		select {
+		case r := <-done:
+			if r != nil {
+				panic(r)
+			}
+		case <-ctx.Done():
+			handlerTimeoutsCounter.inc(rt.String())
+			failedInteractions.Store(i.ID, outcomeTimeout)
+			ref := newErrorRef()
+			log.Printf("ERROR [%s] %s timed out after %s (user=%s guild=%s channel=%s interaction=%s)",
+				ref, rt, timeout, interactionUser(i).ID, i.GuildID, i.ChannelID, i.ID)
+			respondTimeout(s, i, ack, ref)
+			// Still report a late panic; nobody is waiting for it any more
+			go func() {
+				if r := <-done; r != nil {
+					log.Printf("PANIC in %s after it timed out: %v", rt, r)
+				}
+			}()
+		}
+	}
+}
+
+// Acknowledges an interaction whose handler hasn't answered yet
+func deferInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, ack *interactionAck) {
+	ack.mu.Lock()
+	defer ack.mu.Unlock()
+	if ack.responded || ack.closed {
+		return
+	}
+	resp := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	}
+	if ack.update {
+		resp = &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate}
+	}
+	err := s.InteractionRespond(i.Interaction, resp)
+	if err != nil {
+		log.Printf("Failed to defer interaction %s: %v", i.ID, err)
+		return
+	}
+	ack.responded, ack.deferred = true, true
+}
+
+// Answers an interaction, replacing the deferred response if it was deferred for the handler
+func respondInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, resp *discordgo.InteractionResponse) error {
+	v, ok := interactionAcks.Load(i.ID)
+	if !ok {
+		return s.InteractionRespond(i.Interaction, resp)
+	}
+	ack := v.(*interactionAck)
+	ack.mu.Lock()
+	defer ack.mu.Unlock()
+
+	switch {
+	case ack.closed:
+		debugf("Dropped response to %s after its timeout", i.ID)
+		return errInteractionClosed
+	case !ack.deferred:
+		err := s.InteractionRespond(i.Interaction, resp)
+		if err == nil {
+			ack.responded = true
+		}
+		return err
+	}
+	switch resp.Type {
+	case discordgo.InteractionResponseDeferredChannelMessageWithSource, discordgo.InteractionResponseDeferredMessageUpdate:
+		// Already deferred; the handler edits the response as it would its own
+		return nil
+	case discordgo.InteractionResponseModal:
+		return fmt.Errorf("can't open a modal for interaction %s, it was deferred after %s", i.ID, ackDeadline)
+	}
+	data := resp.Data
+	if data == nil {
+		data = &discordgo.InteractionResponseData{}
+	}
+	// The original response is the component's message; only an update may edit it
+	newMessage := ack.update && resp.Type != discordgo.InteractionResponseUpdateMessage
+	if newMessage || (ack.edited && !ack.update) {
+		flags := discordgo.MessageFlagsEphemeral
+		if newMessage {
+			flags = data.Flags
+		}
+		_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content: data.Content, Components: data.Components, Embeds: data.Embeds,
+			Files: data.Files, AllowedMentions: data.AllowedMentions, Flags: flags,
+		})
+		return err
+	}
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &data.Content, Components: &data.Components, Embeds: &data.Embeds,
+		Files: data.Files, AllowedMentions: data.AllowedMentions,
+	})
+	if err == nil {
+		ack.edited = true
+	}
+	return err
+}
+
+// Shows the timeout error in place of the deferred response, or as a follow-up if the
+// handler already answered, and drops whatever the handler sends afterwards
+func respondTimeout(s *discordgo.Session, i *discordgo.InteractionCreate, ack *interactionAck, ref string) {
+	content := fmt.Sprintf("エラー: 処理に時間がかかりすぎたため中断しました. 時間をおいてもう一度お試しください. (参照ID: `%s`)", ref)
+	ack.mu.Lock()
+	defer ack.mu.Unlock()
+	ack.closed = true
+
+	var err error
+	switch {
+	case !ack.responded:
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+		})
+	// A deferred update would edit the component's own message
+	case ack.deferred && !ack.edited && !ack.update:
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content})
+	default:
+		_, err = s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{Content: content, Flags: discordgo.MessageFlagsEphemeral})
+	}
+	if err != nil {
+		log.Printf("Failed to show timeout of interaction %s: %v", i.ID, err)
+	}
+}
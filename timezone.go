@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+	// Bundled so the default zone works in minimal containers without a zoneinfo database
+	_ "time/tzdata"
+)
+
+// --- Time zone ---
+// Daily stats, summary boundaries, cron schedules and dates shown to people follow the
+// configured time zone instead of the server's, which is usually UTC inside a container.
+
+const defaultTimeZone = "Asia/Tokyo"
+
+// Returns the configured time zone, or the server's before the config is loaded
+func (c *Config) location() *time.Location {
+	if c == nil || c.timeZone == nil {
+		return time.Local
+	}
+	return c.timeZone
+}
+
+// Returns the current time in the configured time zone
+func localNow() time.Time {
+	return time.Now().In(config.location())
+}
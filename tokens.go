@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Single-use tokens ---
+// Magic links, reconfirmation links and OAuth2 states work once. Every token that has
+// been used is recorded (as a hash) for consumedTokenRetention, so a link that is opened
+// again, because it was forwarded, leaked or scraped from a mailbox, is recognised as a
+// replay instead of merely being unknown, and the moderators are told whose link it was.
+
+const (
+	tokenMagicLink  = "magic_link"
+	tokenReconfirm  = "reconfirm"
+	tokenOAuthState = "oauth_state"
+
+	consumedTokenRetention = 30 * 24 * time.Hour
+
+	// Replays of one token reported to the moderators; later ones are only logged
+	maxReplayAlerts = 3
+)
+
+type consumedToken struct {
+	Kind   string    `json:"kind"`
+	UserID string    `json:"user_id"`
+	At     time.Time `json:"at"`
+	// Times the token was presented again after it was used
+	Replays int `json:"replays,omitempty"`
+}
+
+var tokenReplays = newCounter("kosen_verify_token_replays_total", "Used single-use tokens presented again, by kind.", "kind")
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Records that the token was used by userID
+func consumeToken(kind, token, userID string) {
+	consumeTokenHash(kind, tokenHash(token), userID)
+}
+
+func consumeTokenHash(kind, hash, userID string) {
+	err := store.putConsumedToken(hash, consumedToken{Kind: kind, UserID: userID, At: time.Now()}, time.Now().Add(-consumedTokenRetention))
+	if err != nil {
+		log.Printf("Failed to record used %s token: %v", kind, err)
+	}
+}
+
+// Reports whether the token was already used, alerting the moderators if so
+func detectTokenReplay(s *discordgo.Session, kind, token string, r *http.Request) bool {
+	if token == "" {
+		return false
+	}
+	used, ok := store.recordTokenReplay(tokenHash(token))
+	if !ok {
+		return false
+	}
+	tokenReplays.inc(kind)
+	log.Printf("Replay of a used %s token of user %s from %s (replay %d)", kind, used.UserID, requestClient(r), used.Replays)
+	if used.Replays <= maxReplayAlerts {
+		alertModerators(s, fmt.Sprintf("🚨 <t:%d:R>に <@%s> が使用した%sが、もう一度開かれました (%d回目). リンクが転送されたか漏洩した可能性があります.\n接続元: `%s`",
+			used.At.Unix(), used.UserID, tokenKindName(kind), used.Replays, requestClient(r)))
+	}
+	return true
+}
+
+func tokenKindName(kind string) string {
+	switch kind {
+	case tokenMagicLink:
+		return "認証リンク"
+	case tokenReconfirm:
+		return "アドレス確認リンク"
+	case tokenOAuthState:
+		return "連携ロールのログイン"
+	}
+	return kind
+}
+
+// Describes where a request came from. X-Forwarded-For is only followed through the
+// configured trusted proxies, so a client can't put any address it likes in the alert.
+func requestClient(r *http.Request) string {
+	client, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr + " " + r.UserAgent()
+	}
+	addr := client.Addr().Unmap()
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	// Each trusted proxy appended the address it got the request from
+	for idx := len(hops) - 1; idx >= 0 && isTrustedProxy(addr); idx-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[idx]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr.String() + " " + r.UserAgent()
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR range", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Verification transcripts ---
+// Before a verification channel is deleted its messages are posted as a text file to
+// DISCORD_ARCHIVE_CHANNEL_ID, so disputes like "the bot never answered me" can be checked.
+// The transcript is redacted like the logs (see redact.go).
+
+const maxTranscriptMessages = 500
+
+// Fetches the channel's messages, oldest first
+func channelHistory(s *discordgo.Session, channelID string) ([]*discordgo.Message, error) {
+	var all []*discordgo.Message
+	before := ""
+	for len(all) < maxTranscriptMessages {
+		batch, err := s.ChannelMessages(channelID, 100, before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, batch...)
+		if len(batch) < 100 {
+			break
+		}
+		before = batch[len(batch)-1].ID
+	}
+	for l, r := 0, len(all)-1; l < r; l, r = l+1, r-1 {
+		all[l], all[r] = all[r], all[l]
+	}
+	return all, nil
+}
+
+func formatTranscript(channelID, ownerID string, messages []*discordgo.Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Verification channel %s, user %s, archived %s\n\n", channelID, ownerID, localNow().Format(time.RFC3339))
+	for _, m := range messages {
+		author := "unknown"
+		if m.Author != nil {
+			author = m.Author.Username
+			if m.Author.Bot {
+				author += " [bot]"
+			}
+		}
+		var parts []string
+		if m.Content != "" {
+			parts = append(parts, m.Content)
+		}
+		for _, embed := range m.Embeds {
+			parts = append(parts, fmt.Sprintf("[embed: %s]", embed.Title))
+		}
+		for _, attachment := range m.Attachments {
+			parts = append(parts, fmt.Sprintf("[attachment: %s]", attachment.Filename))
+		}
+		line := fmt.Sprintf("[%s] %s: %s", m.Timestamp.In(config.location()).Format("2006-01-02 15:04:05"), author, strings.Join(parts, " "))
+		b.WriteString(redact(line) + "\n")
+	}
+	return b.String()
+}
+
+// Posts a transcript of the verification channel to the archive channel, if one is configured
+func archiveTranscript(s *discordgo.Session, channelID string) {
+	if archiveChannelID == "" {
+		return
+	}
+	ownerID, _ := store.verificationChannelOwner(channelID)
+	messages, err := channelHistory(s, channelID)
+	if err != nil {
+		log.Printf("Failed to fetch messages for transcript of %s: %v", channelID, err)
+		return
+	}
+	transcript := formatTranscript(channelID, ownerID, messages)
+	_, err = sendMessage(s, archiveChannelID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("認証チャンネルの記録: <@%s> (%d件のメッセージ)", ownerID, len(messages)),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Files:           []*discordgo.File{{Name: "transcript-" + channelID + ".txt", ContentType: "text/plain", Reader: strings.NewReader(transcript)}},
+	})
+	if err != nil {
+		log.Printf("Failed to archive transcript of %s: %v", channelID, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Unverify and re-verification reminders ---
+// /unverify takes the verification roles away and forgets the record. Whenever the bot
+// removes a member's verification (that command, or role protection taking back a role
+// given by hand) the member gets a DM saying why and how to verify again, so they aren't
+// left wondering where their channels went.
+
+// ReverifyReminder is the DM sent after the bot removes a member's verification
+type ReverifyReminder struct {
+	// Set to false to never send the reminder
+	Enabled bool `json:"enabled"`
+	// "{reason}" is replaced with the reason and "{channel}" with a link to the welcome channel
+	Template string `json:"template"`
+}
+
+const defaultReverifyTemplate = "サーバーでのあなたの認証が解除されました.\n理由: {reason}\n引き続き参加するには、{channel} のボタンからもう一度認証してください."
+
+func defaultReverifyReminder() ReverifyReminder {
+	return ReverifyReminder{Enabled: true, Template: defaultReverifyTemplate}
+}
+
+// Tells a member their verification was removed and how to verify again
+func sendReverifyReminder(s *discordgo.Session, userID, reason string) {
+	if !config.ReverifyReminder.Enabled {
+		return
+	}
+	text := strings.ReplaceAll(config.ReverifyReminder.Template, "{reason}", reason)
+	text = strings.ReplaceAll(text, "{channel}", fmt.Sprintf("<#%s>", welcomeChannelID))
+	if err := notifyUser(s, userID, text); err != nil {
+		log.Printf("Failed to send re-verification reminder to %s: %v", userID, err)
+	}
+}
+
+func unverifyCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "unverify",
+		Description:              "Remove a member's verification and roles (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "Member to unverify", Required: true},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "reason", Description: "Reason, included in the DM to the member", Required: true},
+			{Type: discordgo.ApplicationCommandOptionBoolean, Name: "notify", Description: "DM the member re-verification instructions (default true)"},
+		},
+	}
+}
+
+func handleUnverify(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	var userID string
+	notify := true
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "user":
+			userID = opt.UserValue(nil).ID
+		case "notify":
+			notify = opt.BoolValue()
+		}
+	}
+	reason := optionString(i, "reason")
+
+	member, ok := store.verifiedMember(userID)
+	if !ok {
+		respondError(s, i, fmt.Sprintf("エラー: <@%s> の認証記録はありません.", userID))
+		return
+	}
+	if err := store.removeVerifiedMember(userID); err != nil {
+		respondWithErrorRef(s, i, "エラー: 認証記録の削除に失敗しました.", "Failed to remove verified member", err)
+		return
+	}
+
+	guild := member.GuildID
+	if guild == "" {
+		guild = guildID
+	}
+	roles := []string{verifiedRoleID}
+	if school, ok := schools[member.Domain]; ok && school.RoleID != "" {
+		roles = append(roles, school.RoleID)
+	}
+	var failed []string
+	for _, roleID := range roles {
+		if err := s.GuildMemberRoleRemove(guild, userID, roleID); err != nil {
+			log.Printf("Failed to remove role %s from %s: %v", roleID, userID, err)
+			failed = append(failed, "<@&"+roleID+">")
+		}
+	}
+	log.Printf("User %s unverified by %s: %s", userID, interactionUser(i).ID, reason)
+	alertModerators(s, fmt.Sprintf("🚫 <@%s> が <@%s> の認証を解除しました. 理由: %s", interactionUser(i).ID, userID, reason))
+	if notify {
+		sendReverifyReminder(s, userID, reason)
+	}
+
+	content := fmt.Sprintf("<@%s> の認証を解除しました.", userID)
+	if len(failed) > 0 {
+		content += fmt.Sprintf(" ただし次のロールを外せませんでした: %s", strings.Join(failed, ", "))
+	}
+	respondEphemeral(s, i, content)
+}
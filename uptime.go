@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- /uptime ---
+
+var startedAt = time.Now()
+
+func uptimeCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	return &discordgo.ApplicationCommand{
+		Name:                     "uptime",
+		Description:              "Show bot uptime and the health of its dependencies (admin only).",
+		DefaultMemberPermissions: &permissions,
+	}
+}
+
+func handleUptime(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+
+	lastEmail := "まだ送信していません"
+	if t := lastEmailSentAt(); !t.IsZero() {
+		lastEmail = fmt.Sprintf("<t:%d:R>", t.Unix())
+	}
+	storeStatus := "✅ 正常"
+	if err := store.ping(); err != nil {
+		storeStatus = fmt.Sprintf("❌ `%v`", err)
+	}
+	verificationMutex.Lock()
+	pending := len(pendingVerifications)
+	verificationMutex.Unlock()
+
+	embed := &discordgo.MessageEmbed{
+		Title: "ボットの状態",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "稼働時間", Value: time.Since(startedAt).Round(time.Second).String(), Inline: true},
+			{Name: "起動日時", Value: fmt.Sprintf("<t:%d:f>", startedAt.Unix()), Inline: true},
+			{Name: "Gateway遅延", Value: s.HeartbeatLatency().Round(time.Millisecond).String(), Inline: true},
+			{Name: "最後のメール送信成功", Value: lastEmail, Inline: true},
+			{Name: "ストア", Value: storeStatus, Inline: true},
+			{Name: "認証待ち", Value: capacityUsage(pending, config.Capacity.MaxPending, "人"), Inline: true},
+			{Name: "ロール付与の再試行待ち", Value: fmt.Sprintf("%d件", store.roleGrantQueueLength()), Inline: true},
+			{Name: "メールの再送待ち", Value: fmt.Sprintf("%d件 (送信不能 %d件)", store.mailQueueLength(), len(store.deadLetters())), Inline: true},
+			{Name: "本日のメール送信枠", Value: mailQuotaSummary()},
+		},
+		Color: 0x5865F2,
+	}
+	if mailCircuit.isOpen() {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "メール送信", Value: "📪 障害のため一時停止中"})
+		embed.Color = 0xED4245
+	}
+	if pickMailAccount() == nil {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "メール送信", Value: "📪 本日の送信上限に達したため明日まで停止中"})
+		embed.Color = 0xED4245
+	}
+	if m, on := store.maintenance(); on {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "メンテナンスモード", Value: fmt.Sprintf("🛠️ <t:%d:R>から", m.Since.Unix())})
+		embed.Color = 0xFEE75C
+	}
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
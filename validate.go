@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- validate-config subcommand ---
+// Checks everything the bot loads at startup without starting it, so a broken config
+// is caught in the deploy pipeline instead of crash-looping after a restart.
+// With -online it also looks up the configured Discord IDs and tries the SMTP login.
+
+var snowflakePattern = regexp.MustCompile(`^[0-9]{17,20}$`)
+
+type validationReport struct {
+	failed bool
+}
+
+func (r *validationReport) check(name string, err error) bool {
+	if err != nil {
+		r.failed = true
+		fmt.Printf("✗ %s: %v\n", name, err)
+		return false
+	}
+	fmt.Printf("✓ %s\n", name)
+	return true
+}
+
+// Runs every check, prints a report and returns false if any check failed
+func validateConfig(online bool) bool {
+	r := &validationReport{}
+
+	r.check("environment variables", requiredEnvError())
+
+	var err error
+	config, err = loadConfig(configFile)
+	configOK := r.check(configFile, err)
+
+	rolesOK := r.check("roles.json", loadRoleIDs())
+	if rolesOK {
+		var bad []string
+		for domain, school := range schools {
+			if school.RoleID != "" && !snowflakePattern.MatchString(school.RoleID) {
+				bad = append(bad, fmt.Sprintf("%s (%q)", domain, school.RoleID))
+			}
+		}
+		var badErr error
+		if len(bad) > 0 {
+			badErr = fmt.Errorf("malformed role IDs: %s", strings.Join(bad, ", "))
+		}
+		r.check("roles.json role IDs", badErr)
+	}
+
+	r.check(faqFile, loadFAQ(faqFile))
+
+	if _, err := os.Stat(stateFile); err == nil {
+		_, err = openStore(stateFile)
+		r.check(stateFile, err)
+	}
+
+	if online {
+		if configOK && rolesOK {
+			validateDiscordIDs(r)
+		}
+		r.check("SMTP login", smtpPreflight())
+	}
+
+	if r.failed {
+		fmt.Println("FAIL")
+	} else {
+		fmt.Println("PASS")
+	}
+	return !r.failed
+}
+
+// Looks up the guild, roles and channels over the REST API
+func validateDiscordIDs(r *validationReport) {
+	dg, err := discordgo.New("Bot " + botToken)
+	if !r.check("Discord session", err) {
+		return
+	}
+	guild, err := dg.Guild(guildID)
+	if !r.check("DISCORD_GUILD_ID", err) {
+		return
+	}
+	roles, err := dg.GuildRoles(guild.ID)
+	if !r.check("guild roles", err) {
+		return
+	}
+	known := make(map[string]bool)
+	for _, role := range roles {
+		known[role.ID] = true
+	}
+	roleErr := func(id string) error {
+		if !known[id] {
+			return fmt.Errorf("role %s not found in guild %s", id, guild.Name)
+		}
+		return nil
+	}
+
+	r.check("DISCORD_VERIFIED_ROLE_ID", roleErr(verifiedRoleID))
+	if moderatorRoleID != "" {
+		r.check("DISCORD_MODERATOR_ROLE_ID", roleErr(moderatorRoleID))
+	}
+	if config.Guest.RoleID != "" {
+		r.check("guest.role_id", roleErr(config.Guest.RoleID))
+	}
+	for _, role := range config.ChannelPermissions.Roles {
+		r.check("channel_permissions.roles "+role.RoleID, roleErr(role.RoleID))
+	}
+	for domain, school := range schools {
+		if school.RoleID != "" {
+			r.check("roles.json "+domain, roleErr(school.RoleID))
+		}
+	}
+
+	channels := map[string]string{
+		"DISCORD_WELCOME_CHANNEL_ID":  welcomeChannelID,
+		"DISCORD_PRIVATE_CATEGORY_ID": privateCategoryID,
+		"DISCORD_MOD_CHANNEL_ID":      modChannelID,
+		"DISCORD_ADMIN_CHANNEL_ID":    adminChannelID,
+		"DISCORD_ARCHIVE_CHANNEL_ID":  archiveChannelID,
+	}
+	for domain, school := range schools {
+		if school.AnnounceChannelID != "" {
+			channels["roles.json "+domain+" announce_channel_id"] = school.AnnounceChannelID
+		}
+	}
+	for _, wc := range config.WelcomeChannels {
+		channels["welcome_channels "+wc.ChannelID] = wc.ChannelID
+	}
+	for name, id := range channels {
+		if id == "" {
+			continue
+		}
+		_, err := dg.Channel(id)
+		r.check(name, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- School caps and waitlist ---
+// A school in the role mapping can set "cap" to limit how many verified members it has.
+// Students who verify once the cap is reached are recorded as waitlisted without any
+// roles, and admins let them in in batches with /waitlist, for example to run invite waves.
+// Releasing ignores the cap, so an admin can let in more than it allows.
+
+const maxWaitlistRelease = 50
+
+// A member verified for one school tried to switch to another that is at its cap
+var errSchoolFull = errors.New("school is at its cap")
+
+// Reports whether verifying the user would exceed the school's cap
+func schoolFull(domain, userID string) bool {
+	school, ok := schools[domain]
+	if !ok || school.Cap <= 0 {
+		return false
+	}
+	// Re-verifying doesn't take another place
+	if member, ok := store.isVerified(userID); ok && member.Domain == domain {
+		return false
+	}
+	return store.schoolMemberCount(domain) >= school.Cap
+}
+
+// Records the member on the school's waitlist instead of granting roles
+func waitlistMember(record verifiedMember) error {
+	record.Waitlisted = true
+	if err := store.putVerifiedMember(record); err != nil {
+		return err
+	}
+	log.Printf("User %s waitlisted: %s is at its cap.", record.UserID, schoolName(record.Domain))
+	clearVerificationTrouble(record.UserID)
+	return nil
+}
+
+func schoolFullMessage(domain string) string {
+	return fmt.Sprintf("エラー: %sの参加枠が埋まっているため、学校を変更できません. 現在の認証はそのまま有効です.", schoolName(domain))
+}
+
+func waitlistedMessage(domain string) string {
+	return fmt.Sprintf("メールアドレスを確認しました (%s). ただし現在この学校の参加枠が埋まっているため、順番待ちに登録しました. 参加できるようになったらDMでお知らせします.", schoolName(domain))
+}
+
+func waitlistCommand() *discordgo.ApplicationCommand {
+	permissions := int64(discordgo.PermissionManageGuild)
+	minRelease := float64(1)
+	return &discordgo.ApplicationCommand{
+		Name:                     "waitlist",
+		Description:              "Show a school's waitlist or let waitlisted students in (admin only).",
+		DefaultMemberPermissions: &permissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "school", Description: "School name or email domain", Required: true, Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionInteger, Name: "release", Description: "Let this many students in, oldest first", MinValue: &minRelease, MaxValue: maxWaitlistRelease},
+		},
+	}
+}
+
+func handleWaitlist(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !isAdmin(i.Member) {
+		respondError(s, i, localized(i, msgPermissionDenied))
+		return
+	}
+	domain, ok := resolveSchool(optionString(i, "school"))
+	if !ok {
+		respondError(s, i, "エラー: 学校が見つかりません. 候補から選んでください.")
+		return
+	}
+	release := 0
+	for _, opt := range i.ApplicationCommandData().Options {
+		if opt.Name == "release" {
+			release = int(opt.IntValue())
+		}
+	}
+
+	waiting := store.waitlist(domain)
+	if release == 0 {
+		respondEphemeral(s, i, waitlistSummary(domain, waiting))
+		return
+	}
+
+	// Granting roles one by one can take longer than the 3 seconds Discord waits
+	respondInteraction(s, i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	var released, failed []string
+	for _, member := range waiting[:min(release, len(waiting))] {
+		if err := releaseWaitlisted(s, member); err != nil {
+			log.Printf("Failed to release waitlisted member %s: %v", member.UserID, err)
+			failed = append(failed, fmt.Sprintf("<@%s> (`%v`)", member.UserID, err))
+			continue
+		}
+		released = append(released, "<@"+member.UserID+">")
+	}
+	log.Printf("%d waitlisted members of %s released by %s", len(released), domain, interactionUser(i).ID)
+
+	content := fmt.Sprintf("%sの順番待ちから%d人を参加させました. 残り%d人です.", schoolName(domain), len(released), len(waiting)-len(released))
+	if len(released) > 0 {
+		content += "\n" + strings.Join(released, " ")
+	}
+	if len(failed) > 0 {
+		content += "\n次のメンバーは参加させられませんでした: " + strings.Join(failed, ", ")
+	}
+	if _, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+		log.Printf("Failed to report /waitlist result: %v", err)
+	}
+}
+
+func waitlistSummary(domain string, waiting []verifiedMember) string {
+	school := schools[domain]
+	capacity := "上限なし"
+	if school.Cap > 0 {
+		capacity = fmt.Sprintf("上限 %d人", school.Cap)
+	}
+	lines := []string{fmt.Sprintf("**%s** 参加中 %d人 (%s) / 順番待ち %d人", schoolName(domain), store.schoolMemberCount(domain), capacity, len(waiting))}
+	for idx, member := range waiting {
+		if idx == 20 {
+			lines = append(lines, fmt.Sprintf("…ほか%d人", len(waiting)-idx))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. <@%s> (%s)", idx+1, member.UserID, member.VerifiedAt.In(config.location()).Format("2006-01-02 15:04")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Grants a waitlisted member their roles and tells them they're in
+func releaseWaitlisted(s *discordgo.Session, member verifiedMember) error {
+	guild := member.GuildID
+	if guild == "" {
+		guild = guildID
+	}
+	roles := []string{verifiedRoleID}
+	if school, ok := schools[member.Domain]; ok && school.RoleID != "" {
+		roles = append(roles, school.RoleID)
+	}
+	pending := false
+	for _, roleID := range roles {
+		queued, err := grantRoleWithRetry(s, guild, member.UserID, roleID)
+		if err != nil && !queued {
+			return err
+		}
+		pending = pending || queued
+	}
+	if err := store.releaseWaitlisted(member.UserID, pending); err != nil {
+		return err
+	}
+	announceVerification(s, member.UserID, member.Domain)
+	member.GuildID = guild
+	publishVerified(s, member)
+	go updateRoleConnection(member.UserID)
+	text := fmt.Sprintf("お待たせしました! %sの参加枠が空いたため、サーバーに参加できるようになりました.", schoolName(member.Domain))
+	if err := notifyUser(s, member.UserID, text); err != nil {
+		log.Printf("Failed to tell %s they left the waitlist: %v", member.UserID, err)
+	}
+	return nil
+}
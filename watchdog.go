@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Connection watchdog ---
+// Discord itself can't be used to report that the bot lost Discord, so outages are
+// reported through out-of-band channels configured here.
+
+type WatchdogConfig struct {
+	// How long the gateway may be down (or without heartbeat ACKs) before alerting
+	MaxDowntime Duration `json:"max_downtime"`
+	// Incoming webhooks receiving {"text": ..., "content": ...}; works for Slack and Discord webhooks
+	WebhookURLs []string `json:"webhook_urls"`
+	// LINE Messaging API push target; the token comes from LINE_CHANNEL_ACCESS_TOKEN
+	LineTo string `json:"line_to"`
+}
+
+const (
+	watchdogInterval = 30 * time.Second
+	linePushURL      = "https://api.line.me/v2/bot/message/push"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func runWatchdog(s *discordgo.Session) {
+	cfg := config.Watchdog
+	if cfg.MaxDowntime.Duration <= 0 || (len(cfg.WebhookURLs) == 0 && cfg.LineTo == "") {
+		log.Println("Watchdog has no out-of-band channels configured, outages will only be logged.")
+	}
+
+	alerted := false
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		down, reason := gatewayDownFor(s)
+		switch {
+		case down >= cfg.MaxDowntime.Duration && cfg.MaxDowntime.Duration > 0 && !alerted:
+			alerted = true
+			notifyOutOfBand(fmt.Sprintf("🚨 高専認証ボット: Discordとの接続が %s 途絶えています (%s). 認証ができない状態です.", down.Round(time.Second), reason))
+		case down == 0 && alerted:
+			alerted = false
+			notifyOutOfBand("✅ 高専認証ボット: Discordとの接続が回復しました.")
+		}
+	}
+}
+
+// Returns how long the gateway has looked dead, or 0 if it is healthy
+func gatewayDownFor(s *discordgo.Session) (time.Duration, string) {
+	outageMutex.Lock()
+	started := disconnectedAt
+	outageMutex.Unlock()
+	if !started.IsZero() {
+		return time.Since(started), "gateway disconnected"
+	}
+
+	// Connected in name only: the heartbeat ACKs stopped arriving
+	s.RLock()
+	lastAck := s.LastHeartbeatAck
+	s.RUnlock()
+	if !lastAck.IsZero() && time.Since(lastAck) > 2*watchdogInterval {
+		return time.Since(lastAck), "no heartbeat ACK"
+	}
+	return 0, ""
+}
+
+// Sends a message to every configured out-of-band channel
+func notifyOutOfBand(message string) {
+	log.Printf("WATCHDOG: %s", message)
+	for _, url := range config.Watchdog.WebhookURLs {
+		if err := postJSON(url, map[string]string{"text": message, "content": message}, nil); err != nil {
+			log.Printf("Failed to send watchdog webhook: %v", err)
+		}
+	}
+	if config.Watchdog.LineTo != "" && lineChannelToken != "" {
+		body := map[string]any{
+			"to":       config.Watchdog.LineTo,
+			"messages": []map[string]string{{"type": "text", "text": message}},
+		}
+		headers := map[string]string{"Authorization": "Bearer " + lineChannelToken}
+		if err := postJSON(linePushURL, body, headers); err != nil {
+			log.Printf("Failed to send LINE notification: %v", err)
+		}
+	}
+}
+
+func postJSON(url string, body any, headers map[string]string) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
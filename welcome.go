@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Welcome message ---
+
+// WelcomeMessage is the embed and button posted in the welcome channel.
+// Empty fields in a guild override fall back to the global values.
+type WelcomeMessage struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Color       HexColor `json:"color"`
+	ImageURL    string   `json:"image_url"`
+	ButtonLabel string   `json:"button_label"`
+	// A unicode emoji, or a custom one written as <:name:id>
+	ButtonEmoji string `json:"button_emoji"`
+	// Buttons under the embed, in order: "start", "help", "language", "guest"
+	Buttons []string `json:"buttons"`
+	// Shown when the help button is pressed
+	HelpText string `json:"help_text"`
+	// Optional DM sent to new members, after membership screening if the guild uses it.
+	// "{channel}" is replaced with a link to the welcome channel.
+	DMText string `json:"dm_text"`
+}
+
+const (
+	welcomeButtonStart    = "start"
+	welcomeButtonHelp     = "help"
+	welcomeButtonLanguage = "language"
+	welcomeButtonGuest    = "guest"
+
+	welcomeHelpButtonID = "welcome_help_button"
+)
+
+// HexColor is an embed color written as "#RRGGBB" in JSON
+type HexColor int
+
+func (c HexColor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("#%06X", int(c)))
+}
+
+func (c *HexColor) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("color must be a string like \"#5865F2\": %w", err)
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || v < 0 || v > 0xFFFFFF {
+		return fmt.Errorf("invalid color %q", s)
+	}
+	*c = HexColor(v)
+	return nil
+}
+
+func defaultWelcomeMessage() WelcomeMessage {
+	return WelcomeMessage{
+		Title:       "高専学生認証システム",
+		Description: "全てのチャンネルを閲覧するためには、高専生であることを認証する必要があります..\n下記のボタンからプライベートチャンネルを作成し、手順に従って認証を完了させてください.",
+		Color:       0x5865F2,
+		ButtonLabel: "Tap Here to Start Verification",
+		ButtonEmoji: "✅",
+		Buttons:     []string{welcomeButtonStart, welcomeButtonHelp, welcomeButtonLanguage},
+		HelpText: "**認証の流れ**\n" +
+			"1. 「Start Verification」ボタンを押すと、あなた専用のチャンネルが作成されます.\n" +
+			"2. そのチャンネルで `/verify` に高専のメールアドレスを入力します.\n" +
+			"3. 届いた6桁のコードを `/code` で入力すると認証が完了します.\n" +
+			"メールが届かない場合は迷惑メールフォルダを確認してください.",
+	}
+}
+
+// Returns the welcome message for a guild, with unset override fields taken from the global one
+func (c *Config) welcomeFor(guildID string) WelcomeMessage {
+	if gc, ok := c.Guilds[guildID]; ok && gc.Welcome != nil {
+		return c.Welcome.merge(gc.Welcome)
+	}
+	return c.Welcome
+}
+
+// Returns w with the fields set in o replaced
+func (w WelcomeMessage) merge(o *WelcomeMessage) WelcomeMessage {
+	if o.Title != "" {
+		w.Title = o.Title
+	}
+	if o.Description != "" {
+		w.Description = o.Description
+	}
+	if o.Color != 0 {
+		w.Color = o.Color
+	}
+	if o.ImageURL != "" {
+		w.ImageURL = o.ImageURL
+	}
+	if o.ButtonLabel != "" {
+		w.ButtonLabel = o.ButtonLabel
+	}
+	if o.ButtonEmoji != "" {
+		w.ButtonEmoji = o.ButtonEmoji
+	}
+	if len(o.Buttons) > 0 {
+		w.Buttons = o.Buttons
+	}
+	if o.HelpText != "" {
+		w.HelpText = o.HelpText
+	}
+	if o.DMText != "" {
+		w.DMText = o.DMText
+	}
+	return w
+}
+
+// Checks a button list, which Discord rejects if empty or if two buttons share a custom ID.
+// Without "start" nobody could begin verifying from the post.
+func validateWelcomeButtons(buttons []string) error {
+	if len(buttons) == 0 {
+		return fmt.Errorf("must not be empty")
+	}
+	seen := make(map[string]bool)
+	for _, b := range buttons {
+		switch b {
+		case welcomeButtonStart, welcomeButtonHelp, welcomeButtonLanguage, welcomeButtonGuest:
+		default:
+			return fmt.Errorf("unknown button %q", b)
+		}
+		if seen[b] {
+			return fmt.Errorf("button %q is listed twice", b)
+		}
+		seen[b] = true
+	}
+	if !seen[welcomeButtonStart] {
+		return fmt.Errorf("must include %q", welcomeButtonStart)
+	}
+	return nil
+}
+
+func (w WelcomeMessage) components() []discordgo.MessageComponent {
+	var buttons []discordgo.MessageComponent
+	for _, b := range w.Buttons {
+		switch b {
+		case welcomeButtonStart:
+			buttons = append(buttons, discordgo.Button{
+				Label:    w.ButtonLabel,
+				Style:    discordgo.PrimaryButton,
+				CustomID: startVerificationButtonID,
+				Emoji:    w.buttonEmoji(),
+				Disabled: verificationLocked(),
+			})
+		case welcomeButtonHelp:
+			buttons = append(buttons, discordgo.Button{
+				Label:    "Help / FAQ",
+				Style:    discordgo.SecondaryButton,
+				CustomID: welcomeHelpButtonID,
+				Emoji:    &discordgo.ComponentEmoji{Name: "❓"},
+			})
+		case welcomeButtonLanguage:
+			buttons = append(buttons, discordgo.Button{
+				Label:    "English / 日本語",
+				Style:    discordgo.SecondaryButton,
+				CustomID: languageToggleButtonID,
+				Emoji:    &discordgo.ComponentEmoji{Name: "🌐"},
+			})
+		case welcomeButtonGuest:
+			// Only shown once a guest role is configured
+			if config.Guest.RoleID != "" {
+				buttons = append(buttons, guestButton())
+			}
+		}
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}}
+}
+
+func handleWelcomeHelp(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	respondEphemeral(s, i, config.welcomeForChannel(i.GuildID, i.ChannelID).HelpText)
+}
+
+func (w WelcomeMessage) embed() *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{Title: w.Title, Description: w.Description, Color: int(w.Color)}
+	if w.ImageURL != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: w.ImageURL}
+	}
+	return embed
+}
+
+var customEmojiPattern = regexp.MustCompile(`^<(a?):(\w+):(\d+)>$`)
+
+func (w WelcomeMessage) buttonEmoji() *discordgo.ComponentEmoji {
+	return parseComponentEmoji(w.ButtonEmoji)
+}
+
+// Parses a unicode emoji or a custom one written as <:name:id>; nil if empty
+func parseComponentEmoji(emoji string) *discordgo.ComponentEmoji {
+	if emoji == "" {
+		return nil
+	}
+	if m := customEmojiPattern.FindStringSubmatch(emoji); m != nil {
+		return &discordgo.ComponentEmoji{Name: m[2], ID: m[3], Animated: m[1] == "a"}
+	}
+	return &discordgo.ComponentEmoji{Name: emoji}
+}
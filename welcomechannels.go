@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// --- Additional welcome channels ---
+// Large servers have separate landing channels (JP/EN, students/guests). Each one gets
+// its own welcome post, can preset the language of users starting there and can use its
+// own email rules for the verifications started from it.
+
+type WelcomeChannel struct {
+	ChannelID string `json:"channel_id"`
+	// langJA or langEN, used for users who haven't picked a language themselves
+	Language string `json:"language,omitempty"`
+	// Fields set here replace those of the guild's welcome message
+	Welcome *WelcomeMessage `json:"welcome,omitempty"`
+	// Replaces the guild's email rules for verifications started here
+	EmailRules *EmailRules `json:"email_rules,omitempty"`
+}
+
+func (wc *WelcomeChannel) validate() error {
+	if wc.ChannelID == "" {
+		return fmt.Errorf("channel_id is required")
+	}
+	if wc.Language != "" && wc.Language != langJA && wc.Language != langEN {
+		return fmt.Errorf("language must be %q or %q, got %q", langJA, langEN, wc.Language)
+	}
+	if wc.Welcome != nil && len(wc.Welcome.Buttons) > 0 {
+		if err := validateWelcomeButtons(wc.Welcome.Buttons); err != nil {
+			return fmt.Errorf("welcome.buttons: %w", err)
+		}
+	}
+	if wc.EmailRules != nil {
+		if err := wc.EmailRules.compile(); err != nil {
+			return fmt.Errorf("email_rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns the configured extra welcome channel, or nil
+func (c *Config) welcomeChannel(channelID string) *WelcomeChannel {
+	for _, wc := range c.WelcomeChannels {
+		if wc.ChannelID == channelID {
+			return wc
+		}
+	}
+	return nil
+}
+
+// Returns the welcome message shown in a channel: the guild's, with the channel's overrides applied
+func (c *Config) welcomeForChannel(guildID, channelID string) WelcomeMessage {
+	w := c.welcomeFor(guildID)
+	if wc := c.welcomeChannel(channelID); wc != nil && wc.Welcome != nil {
+		w = w.merge(wc.Welcome)
+	}
+	return w
+}
+
+// Returns the email rules for a user's verification: those of the welcome channel they
+// started from, falling back to the guild's
+func (c *Config) emailRulesForUser(guildID, userID string) *EmailRules {
+	if wc := c.welcomeChannel(store.welcomeChannelOf(userID)); wc != nil && wc.EmailRules != nil {
+		return wc.EmailRules
+	}
+	return c.emailRulesFor(guildID)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// --- Welcome message upkeep ---
+// In welcome channels where members can talk, the welcome message scrolls out of sight
+// and newcomers don't find the button. It can be pinned, and reposted at the bottom
+// (deleting the old copy) once enough messages were posted after it.
+
+type WelcomeUpkeep struct {
+	// Pin the welcome message; the bot deletes its own "pinned a message" notice
+	Pin bool `json:"pin"`
+	// Repost the welcome message once this many messages were posted after it; 0 never reposts
+	RepostAfter int `json:"repost_after"`
+}
+
+func (u WelcomeUpkeep) validate() error {
+	if u.RepostAfter < 0 {
+		return fmt.Errorf("repost_after must not be negative")
+	}
+	return nil
+}
+
+var welcomePosts = struct {
+	sync.Mutex
+	// The bot's current welcome message, keyed by channel ID
+	ids map[string]string
+	// Messages posted since, keyed by channel ID
+	since     map[string]int
+	reposting map[string]bool
+}{ids: make(map[string]string), since: make(map[string]int), reposting: make(map[string]bool)}
+
+// Finds the bot's welcome message among the pinned and the latest messages
+func findWelcomeMessage(s *discordgo.Session, channelID string) (*discordgo.Message, error) {
+	if config.WelcomeUpkeep.Pin {
+		if pinned, err := s.ChannelMessagesPinned(channelID); err == nil {
+			for _, msg := range pinned {
+				if msg.Author.ID == s.State.User.ID {
+					return msg, nil
+				}
+			}
+		}
+	}
+	messages, err := s.ChannelMessages(channelID, 10, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if msg.Author.ID == s.State.User.ID && msg.Type != discordgo.MessageTypeChannelPinnedMessage {
+			return msg, nil
+		}
+	}
+	return nil, nil
+}
+
+// Remembers the channel's welcome message and pins it if configured
+func trackWelcomeMessage(s *discordgo.Session, msg *discordgo.Message) {
+	welcomePosts.Lock()
+	welcomePosts.ids[msg.ChannelID] = msg.ID
+	welcomePosts.since[msg.ChannelID] = 0
+	welcomePosts.Unlock()
+	if config.WelcomeUpkeep.Pin && !msg.Pinned {
+		if err := s.ChannelMessagePin(msg.ChannelID, msg.ID); err != nil {
+			log.Printf("Failed to pin welcome message in %s: %v", msg.ChannelID, err)
+		}
+	}
+}
+
+func isWelcomeChannel(channelID string) bool {
+	for _, id := range welcomeChannelIDs() {
+		if id == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+func onWelcomeChannelMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+	upkeep := config.WelcomeUpkeep
+	if m.Author == nil || (!upkeep.Pin && upkeep.RepostAfter == 0) || !isWelcomeChannel(m.ChannelID) {
+		return
+	}
+	if m.Author.ID == s.State.User.ID {
+		if m.Type == discordgo.MessageTypeChannelPinnedMessage {
+			if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
+				debugf("Failed to delete pin notice in %s: %v", m.ChannelID, err)
+			}
+		}
+		return
+	}
+	if upkeep.RepostAfter == 0 {
+		return
+	}
+
+	welcomePosts.Lock()
+	welcomePosts.since[m.ChannelID]++
+	due := welcomePosts.since[m.ChannelID] >= upkeep.RepostAfter && !welcomePosts.reposting[m.ChannelID]
+	if due {
+		welcomePosts.reposting[m.ChannelID] = true
+	}
+	oldID := welcomePosts.ids[m.ChannelID]
+	welcomePosts.Unlock()
+	if due {
+		go repostWelcomeMessage(s, m.ChannelID, oldID)
+	}
+}
+
+// Posts a fresh copy of the welcome message at the bottom and deletes the old one
+func repostWelcomeMessage(s *discordgo.Session, channelID, oldID string) {
+	defer func() {
+		welcomePosts.Lock()
+		delete(welcomePosts.reposting, channelID)
+		welcomePosts.Unlock()
+	}()
+	if _, err := sendWelcomeMessage(s, channelID, config.welcomeForChannel(guildID, channelID)); err != nil {
+		log.Printf("Failed to repost welcome message in %s: %v", channelID, err)
+		// Wait for another round of messages instead of retrying on every one
+		welcomePosts.Lock()
+		welcomePosts.since[channelID] = 0
+		welcomePosts.Unlock()
+		return
+	}
+	if oldID == "" {
+		return
+	}
+	if err := s.ChannelMessageDelete(channelID, oldID); err != nil && !isUnknownMessage(err) {
+		log.Printf("Failed to delete old welcome message in %s: %v", channelID, err)
+	}
+}
+
+func sendWelcomeMessage(s *discordgo.Session, channelID string, welcome WelcomeMessage) (*discordgo.Message, error) {
+	msg, err := sendMessage(s, channelID, &discordgo.MessageSend{Embed: welcome.embed(), Components: welcome.components()})
+	if err != nil {
+		return nil, err
+	}
+	trackWelcomeMessage(s, msg)
+	return msg, nil
+}
+
+func isUnknownMessage(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage
+}